@@ -0,0 +1,141 @@
+// Copyright 2019 SEQSENSE, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package s3sync
+
+import (
+	"context"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// filterBatchedFilesForSync filters the files of the s3 source for the local dest
+// batch by batch. The first batch is the files directly under the source, and the
+// following ones are the top-level directories of the source.
+// Only the dest listing of the current batch is kept in memory.
+func (m *Manager) filterBatchedFilesForSync(ctx context.Context, sourcePath *s3Path, destPath string, recorder *syncRecorder) chan *fileInfo {
+	c := make(chan *fileInfo)
+
+	go func() {
+		defer close(c)
+
+		dirPrefix := sourcePath.bucketPrefix
+		if dirPrefix != "" && !strings.HasSuffix(dirPrefix, "/") {
+			dirPrefix += "/"
+		}
+		dirs, err := m.listS3Dirs(ctx, sourcePath.bucket, dirPrefix)
+		if err != nil {
+			sendErrorInfoToChannel(ctx, c, err)
+			return
+		}
+
+		root := &s3Path{bucket: sourcePath.bucket, bucketPrefix: dirPrefix, shallow: true}
+		rootFiles := m.filterFilesForSync(ctx, m.filterSourceFiles(ctx, m.listS3Files(ctx, root), ""), listLocalTopLevelFiles(ctx, m.fs(), destPath), recorder)
+		sent, ok := forwardBatch(ctx, c, rootFiles, "")
+		if !ok {
+			return
+		}
+		if len(dirs) == 0 && sent == 0 {
+			// The source may be a single object rather than a directory.
+			forwardBatch(ctx, c, m.filterFilesForSync(ctx, m.filterSourceFiles(ctx, m.listS3Files(ctx, sourcePath), ""), m.walkLocalFiles(ctx, destPath), recorder), "")
+			return
+		}
+
+		for _, dir := range dirs {
+			m.println("Syncing the batch of", dir)
+			sub := &s3Path{bucket: sourcePath.bucket, bucketPrefix: dirPrefix + dir + "/"}
+			files := m.filterFilesForSync(ctx, m.filterSourceFiles(ctx, m.listS3Files(ctx, sub), filepath.FromSlash(dir)), m.walkLocalFiles(ctx, filepath.Join(destPath, dir)), recorder)
+			if _, ok := forwardBatch(ctx, c, files, dir); !ok {
+				return
+			}
+		}
+	}()
+
+	return c
+}
+
+// forwardBatch sends the files of the batch with the names relative to the sync root,
+// and returns the number of the sent files and false if the context is done.
+func forwardBatch(ctx context.Context, c chan *fileInfo, files chan *fileInfo, dir string) (int, bool) {
+	var n int
+	for file := range files {
+		if file.err == nil {
+			file.name = filepath.Join(filepath.FromSlash(dir), file.name)
+			n++
+		}
+		if !sendInfoToChannel(ctx, c, file) {
+			// Drain the batch to stop its listing goroutines.
+			for range files {
+			}
+			return n, false
+		}
+	}
+	return n, true
+}
+
+// listS3Dirs returns the names of the directories directly under the prefix.
+func (m *Manager) listS3Dirs(ctx context.Context, bucket, prefix string) ([]string, error) {
+	var dirs []string
+	var token *string
+	for {
+		list, err := m.s3.ListObjectsV2WithContext(ctx, &s3.ListObjectsV2Input{
+			Bucket:            aws.String(bucket),
+			Prefix:            aws.String(prefix),
+			Delimiter:         aws.String("/"),
+			ContinuationToken: token,
+			MaxKeys:           m.maxKeys(),
+			RequestPayer:      m.requestPayer(),
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, commonPrefix := range list.CommonPrefixes {
+			dir := strings.TrimSuffix(aws.StringValue(commonPrefix.Prefix)[len(prefix):], "/")
+			if dir == "" || dir == "." || dir == ".." {
+				continue
+			}
+			dirs = append(dirs, dir)
+		}
+		if token = nextContinuationToken(list); token == nil {
+			return dirs, nil
+		}
+	}
+}
+
+// listLocalTopLevelFiles returns a channel which receives the files directly under basePath.
+func listLocalTopLevelFiles(ctx context.Context, fs FileSystem, basePath string) chan *fileInfo {
+	c := make(chan *fileInfo)
+
+	go func() {
+		defer close(c)
+
+		basePath = filepath.ToSlash(basePath)
+		entries, err := fs.ReadDir(basePath)
+		if os.IsNotExist(err) {
+			return
+		} else if err != nil {
+			sendErrorInfoToChannel(ctx, c, err)
+			return
+		}
+		for _, stat := range entries {
+			if !sendFileInfoToChannel(ctx, c, basePath, path.Join(basePath, stat.Name()), stat) {
+				return
+			}
+		}
+	}()
+	return c
+}
@@ -0,0 +1,124 @@
+// Copyright 2019 SEQSENSE, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package s3sync
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func setupBatchTest(t *testing.T) (*fakeS3, string) {
+	client := newFakeS3()
+	for _, key := range []string{
+		"data/root1.txt",
+		"data/root2.txt",
+		"data/a/1.txt",
+		"data/a/2.txt",
+		"data/b/sub/3.txt",
+		"data/b/sub/deep/4.txt",
+		"data/c/uptodate.txt",
+		"data.txt",
+		"other/5.txt",
+	} {
+		client.putObject("example-bucket", key, []byte(key), time.Now().Add(-time.Hour))
+	}
+
+	temp, err := ioutil.TempDir("", "s3synctest")
+	if err != nil {
+		t.Fatal("Failed to create temp dir")
+	}
+	writeFile(t, filepath.Join(temp, "c/uptodate.txt"), "data/c/uptodate.txt")
+	return client, temp
+}
+
+func TestFilterBatchedFilesForSync(t *testing.T) {
+	client, temp := setupBatchTest(t)
+	defer os.RemoveAll(temp)
+
+	for _, prefix := range []string{"data", "data/"} {
+		t.Run(prefix, func(t *testing.T) {
+			m := &Manager{s3: client}
+			sourcePath := &s3Path{bucket: "example-bucket", bucketPrefix: prefix}
+
+			var names []string
+			for file := range m.filterBatchedFilesForSync(context.Background(), sourcePath, temp, &syncRecorder{}) {
+				if file.err != nil {
+					t.Fatal("Filtering should be successful", file.err)
+				}
+				names = append(names, filepath.ToSlash(file.name))
+			}
+			sort.Strings(names)
+
+			expected := []string{
+				"a/1.txt",
+				"a/2.txt",
+				"b/sub/3.txt",
+				"b/sub/deep/4.txt",
+				"root1.txt",
+				"root2.txt",
+			}
+			if !reflect.DeepEqual(expected, names) {
+				t.Errorf("Each file should be filtered exactly once, expected: %v, actual: %v", expected, names)
+			}
+		})
+	}
+}
+
+func TestFilterBatchedFilesForSyncSingleObject(t *testing.T) {
+	client, temp := setupBatchTest(t)
+	defer os.RemoveAll(temp)
+
+	m := &Manager{s3: client}
+	sourcePath := &s3Path{bucket: "example-bucket", bucketPrefix: "data.txt"}
+
+	var names []string
+	for file := range m.filterBatchedFilesForSync(context.Background(), sourcePath, temp, &syncRecorder{}) {
+		if file.err != nil {
+			t.Fatal("Filtering should be successful", file.err)
+		}
+		names = append(names, file.name)
+	}
+	if !reflect.DeepEqual([]string{"data.txt"}, names) {
+		t.Errorf("Only the single object should be filtered, actual: %v", names)
+	}
+}
+
+func TestSyncBatchByTopLevelDir(t *testing.T) {
+	client, temp := setupBatchTest(t)
+	defer os.RemoveAll(temp)
+
+	m := &Manager{s3: client, option: Option{BatchByTopLevelDir: true}}
+	if err := m.Sync("s3://example-bucket/data", temp); err != nil {
+		t.Fatal("Sync should be successful", err)
+	}
+
+	for _, name := range []string{"root1.txt", "root2.txt", "a/1.txt", "a/2.txt", "b/sub/3.txt", "b/sub/deep/4.txt", "c/uptodate.txt"} {
+		data, err := ioutil.ReadFile(filepath.Join(temp, name))
+		if err != nil {
+			t.Fatal("Failed to read", name)
+		}
+		if string(data) != "data/"+name {
+			t.Errorf("Unexpected content of %s: %s", name, data)
+		}
+	}
+	fileNotExists(t, filepath.Join(temp, "5.txt"))
+	if n := client.count("GetObject"); n != 6 {
+		t.Errorf("Expected 6 downloads, got %d", n)
+	}
+}
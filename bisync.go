@@ -0,0 +1,311 @@
+// Copyright 2019 SEQSENSE, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package s3sync
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// biSyncDirection is the direction in which a file is transferred by BiSync.
+type biSyncDirection int
+
+const (
+	biSyncNone biSyncDirection = iota
+	biSyncUpload
+	biSyncDownload
+	biSyncConflict
+)
+
+// biSyncEntry is the state of a file after the previous BiSync, which is the same
+// on both sides.
+type biSyncEntry struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+}
+
+// BiSync syncs the local directory and the s3 prefix in both directions.
+// The file on only one side is copied to the other side, and the file on both
+// sides is copied from the side newer by more than Option.ModTimeTolerance.
+// Nothing is deleted on either side. The modification time of the uploaded file
+// is set to the last modified of the object, as the downloaded one, so that the
+// both sides are the same after the sync.
+// With Option.BiSyncStateFile, the file is copied from the side changed since
+// the previous sync, and the file changed on both sides is a conflict which is
+// reported to Option.OnConflict and is left as is.
+func (m *Manager) BiSync(local, remote string) (*SyncResult, error) {
+	if err := validateUploadOption(&m.option); err != nil {
+		return nil, err
+	}
+	if err := validateLocalNameMap(m.option.LocalNameMap); err != nil {
+		return nil, err
+	}
+	if err := validatePatterns(&m.option); err != nil {
+		return nil, err
+	}
+	if err := validateSSECustomerKey(&m.option); err != nil {
+		return nil, err
+	}
+	if stat, err := m.fs().Stat(local); err != nil {
+		return nil, err
+	} else if !stat.IsDir() {
+		return nil, errors.New("local path of BiSync must be a directory")
+	}
+	remoteURL, err := url.Parse(remote)
+	if err != nil {
+		return nil, err
+	}
+	if !isS3URL(remoteURL) {
+		return nil, errors.New("remote of BiSync must be a s3 url")
+	}
+	remotePath, err := urlToS3Path(remoteURL)
+	if err != nil {
+		return nil, err
+	}
+	if remotePath.pattern != "" {
+		return nil, fmt.Errorf("%w in BiSync", ErrGlobNotSupported)
+	}
+
+	state, err := m.loadBiSyncState()
+	if err != nil {
+		return nil, err
+	}
+	m, err = m.withIgnoreFile(local)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	localFiles, err := fileInfoChanToMap(m.filterSourceFiles(ctx, m.walkLocalFiles(ctx, local), ""))
+	if err != nil {
+		return nil, err
+	}
+	remoteFiles, err := fileInfoChanToMap(m.filterSourceFiles(ctx, m.listS3Files(ctx, remotePath), ""))
+	if err != nil {
+		return nil, err
+	}
+	// BiSync doesn't delete, so the kept files are just dropped.
+	dropKeptFiles(localFiles)
+	dropKeptFiles(remoteFiles)
+
+	recorder := &syncRecorder{}
+	directions := make(map[string]biSyncDirection)
+	var files []*fileInfo
+	for name, localFile := range localFiles {
+		direction := m.biSyncDirection(localFile, remoteFiles[name], state[filepath.ToSlash(name)])
+		switch direction {
+		case biSyncUpload:
+			files = append(files, localFile)
+		case biSyncNone:
+			recorder.addSkipped(localFile)
+		case biSyncConflict:
+			m.println("Conflict of", name, "which is changed on both sides")
+			if m.option.OnConflict != nil {
+				m.option.OnConflict(localFile.toFileInfo(), remoteFiles[name].toFileInfo())
+			}
+		}
+		directions[name] = direction
+	}
+	for name, remoteFile := range remoteFiles {
+		if _, ok := localFiles[name]; !ok {
+			files = append(files, remoteFile)
+			directions[name] = biSyncDownload
+		} else if directions[name] == biSyncDownload {
+			files = append(files, remoteFile)
+		}
+	}
+
+	// synced has the states of the files transferred in this sync.
+	synced := make(map[string]*biSyncEntry)
+	var mutex sync.Mutex
+	errs := m.transferFiles(ctx, cancel, replayFiles(files), func(file *fileInfo) error {
+		var entry *biSyncEntry
+		var err error
+		if directions[file.name] == biSyncUpload {
+			entry, err = m.biSyncUpload(ctx, file, remotePath)
+		} else {
+			err = m.download(ctx, file, remotePath, local)
+			entry = &biSyncEntry{Size: file.size, ModTime: file.lastModified}
+		}
+		if err != nil {
+			return err
+		}
+		recorder.addTransferred(file)
+		mutex.Lock()
+		defer mutex.Unlock()
+		synced[filepath.ToSlash(file.name)] = entry
+		return nil
+	})
+
+	if !m.option.DryRun {
+		if err := m.saveBiSyncState(updateBiSyncState(state, localFiles, directions, synced)); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return recorder.result(), &SyncError{Errors: errs}
+	}
+	return recorder.result(), nil
+}
+
+// dropKeptFiles removes the kept files, which are only listed for the deletion.
+func dropKeptFiles(files map[string]*fileInfo) {
+	for name, file := range files {
+		if file.kept {
+			delete(files, name)
+		}
+	}
+}
+
+// biSyncDirection returns the direction in which the file is transferred.
+// remote is nil if the file exists only locally, and state is nil if the file isn't
+// recorded by the previous sync.
+func (m *Manager) biSyncDirection(local, remote *fileInfo, state *biSyncEntry) biSyncDirection {
+	if remote == nil {
+		return biSyncUpload
+	}
+	tolerance := m.modTimeTolerance()
+	if state != nil {
+		localChanged := local.size != state.Size || absDuration(local.lastModified.Sub(state.ModTime)) > tolerance
+		remoteChanged := remote.size != state.Size || absDuration(remote.lastModified.Sub(state.ModTime)) > tolerance
+		switch {
+		case localChanged && remoteChanged:
+			if local.size == remote.size && absDuration(local.lastModified.Sub(remote.lastModified)) <= tolerance {
+				// Both are changed to the same.
+				return biSyncNone
+			}
+			return biSyncConflict
+		case localChanged:
+			return biSyncUpload
+		case remoteChanged:
+			return biSyncDownload
+		}
+		return biSyncNone
+	}
+	switch diff := local.lastModified.Sub(remote.lastModified); {
+	case diff > tolerance:
+		return biSyncUpload
+	case -diff > tolerance:
+		return biSyncDownload
+	case local.size != remote.size:
+		// Either side can't be chosen by the time.
+		return biSyncConflict
+	}
+	return biSyncNone
+}
+
+// biSyncUpload uploads the local file, and sets the modification time of the file
+// to the last modified of the uploaded object.
+func (m *Manager) biSyncUpload(ctx context.Context, file *fileInfo, remotePath *s3Path) (*biSyncEntry, error) {
+	if err := m.uploadFile(ctx, file, remotePath, nil); err != nil {
+		return nil, err
+	}
+	if m.option.DryRun {
+		return nil, nil
+	}
+	sse := m.sseCustomer()
+	head, err := m.s3.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket:               aws.String(remotePath.bucket),
+		Key:                  aws.String(m.uploadKey(file, remotePath)),
+		RequestPayer:         m.requestPayer(),
+		SSECustomerAlgorithm: sse.algorithm,
+		SSECustomerKey:       sse.key,
+		SSECustomerKeyMD5:    sse.keyMD5,
+	})
+	if err != nil {
+		return nil, err
+	}
+	modTime := aws.TimeValue(head.LastModified)
+	if err := m.fs().Chtimes(file.path, modTime, modTime); err != nil {
+		return nil, err
+	}
+	return &biSyncEntry{Size: file.size, ModTime: modTime}, nil
+}
+
+// updateBiSyncState returns the state after the sync. The files which are not
+// transferred keep the previous state, so that the conflicts and the failed files
+// are compared again by the next sync.
+func updateBiSyncState(state map[string]*biSyncEntry, localFiles map[string]*fileInfo, directions map[string]biSyncDirection, synced map[string]*biSyncEntry) map[string]*biSyncEntry {
+	updated := make(map[string]*biSyncEntry)
+	for name, direction := range directions {
+		key := filepath.ToSlash(name)
+		switch {
+		case synced[key] != nil:
+			updated[key] = synced[key]
+		case direction == biSyncNone:
+			file := localFiles[name]
+			updated[key] = &biSyncEntry{Size: file.size, ModTime: file.lastModified}
+		case state[key] != nil:
+			updated[key] = state[key]
+		}
+	}
+	return updated
+}
+
+// loadBiSyncState reads Option.BiSyncStateFile, or returns nil if it isn't
+// configured or doesn't exist yet.
+func (m *Manager) loadBiSyncState() (map[string]*biSyncEntry, error) {
+	if m.option.BiSyncStateFile == "" {
+		return nil, nil
+	}
+	data, err := ioutil.ReadFile(m.option.BiSyncStateFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var state map[string]*biSyncEntry
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// saveBiSyncState writes the state to Option.BiSyncStateFile atomically.
+func (m *Manager) saveBiSyncState(state map[string]*biSyncEntry) error {
+	if m.option.BiSyncStateFile == "" {
+		return nil
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(m.option.BiSyncStateFile), m.dirMode()); err != nil {
+		return err
+	}
+	tmp := m.option.BiSyncStateFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, m.option.BiSyncStateFile)
+}
+
+func absDuration(d time.Duration) time.Duration {
+	if d < 0 {
+		return -d
+	}
+	return d
+}
@@ -0,0 +1,168 @@
+// Copyright 2019 SEQSENSE, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package s3sync
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeFileAt(t *testing.T, filename, data string, modTime time.Time) {
+	writeFile(t, filename, data)
+	if err := os.Chtimes(filename, modTime, modTime); err != nil {
+		t.Fatal("Failed to set the modification time", err)
+	}
+}
+
+func objectHasContent(t *testing.T, client *fakeS3, key, expected string) {
+	if object, ok := client.getObject("example-bucket", key); !ok || string(object.data) != expected {
+		t.Errorf("%s should have %q", key, expected)
+	}
+}
+
+func TestBiSync(t *testing.T) {
+	temp, err := ioutil.TempDir("", "s3synctest")
+	if err != nil {
+		t.Fatal("Failed to create temp dir")
+	}
+	defer os.RemoveAll(temp)
+
+	now := time.Now().Truncate(time.Second)
+	old := now.Add(-time.Hour)
+	client := newFakeS3()
+	writeFileAt(t, filepath.Join(temp, "up.txt"), "new local", now)
+	client.putObject("example-bucket", "up.txt", []byte("old"), old)
+	writeFileAt(t, filepath.Join(temp, "down.txt"), "old", old)
+	client.putObject("example-bucket", "down.txt", []byte("new remote"), now)
+	writeFileAt(t, filepath.Join(temp, "same.txt"), "same", old)
+	client.putObject("example-bucket", "same.txt", []byte("same"), old)
+	writeFile(t, filepath.Join(temp, "dir", "local.txt"), "local")
+	client.putObject("example-bucket", "dir/remote.txt", []byte("remote"), now)
+
+	m := &Manager{s3: client}
+	result, err := m.BiSync(temp, "s3://example-bucket")
+	if err != nil {
+		t.Fatal("BiSync should be successful", err)
+	}
+	if names := fileInfoNames(result.Transferred); len(names) != 4 {
+		t.Errorf("The changed files should be transferred, got %v", names)
+	}
+	objectHasContent(t, client, "up.txt", "new local")
+	objectHasContent(t, client, "dir/local.txt", "local")
+	objectHasContent(t, client, "same.txt", "same")
+	fileHasContent(t, filepath.Join(temp, "down.txt"), "new remote")
+	fileHasContent(t, filepath.Join(temp, "dir", "remote.txt"), "remote")
+
+	// Both sides are the same after the sync.
+	result, err = m.BiSync(temp, "s3://example-bucket")
+	if err != nil {
+		t.Fatal("BiSync should be successful", err)
+	}
+	if len(result.Transferred) != 0 || len(result.Skipped) != 5 {
+		t.Errorf("Nothing should be transferred by the second sync, got %v", fileInfoNames(result.Transferred))
+	}
+}
+
+func TestBiSyncConflict(t *testing.T) {
+	temp, err := ioutil.TempDir("", "s3synctest")
+	if err != nil {
+		t.Fatal("Failed to create temp dir")
+	}
+	defer os.RemoveAll(temp)
+	local := filepath.Join(temp, "local")
+
+	old := time.Now().Truncate(time.Second).Add(-time.Hour)
+	client := newFakeS3()
+	for _, name := range []string{"both.txt", "local.txt", "remote.txt"} {
+		writeFileAt(t, filepath.Join(local, name), "synced", old)
+		client.putObject("example-bucket", name, []byte("synced"), old)
+	}
+
+	var conflicts []string
+	m := &Manager{s3: client, option: Option{
+		BiSyncStateFile: filepath.Join(temp, "state.json"),
+		OnConflict: func(local, remote FileInfo) {
+			if local.Name != remote.Name {
+				t.Errorf("Conflict of the different files %s and %s", local.Name, remote.Name)
+			}
+			conflicts = append(conflicts, local.Name)
+		},
+	}}
+	if _, err := m.BiSync(local, "s3://example-bucket"); err != nil {
+		t.Fatal("BiSync should be successful", err)
+	}
+
+	// The local change older than the remote is uploaded, since only the local
+	// side is changed since the previous sync.
+	writeFileAt(t, filepath.Join(local, "local.txt"), "changed local", old.Add(-time.Hour))
+	client.putObject("example-bucket", "remote.txt", []byte("changed remote"), old.Add(time.Minute))
+	writeFile(t, filepath.Join(local, "both.txt"), "changed local")
+	client.putObject("example-bucket", "both.txt", []byte("changed remote"), time.Now())
+
+	result, err := m.BiSync(local, "s3://example-bucket")
+	if err != nil {
+		t.Fatal("BiSync should be successful", err)
+	}
+	if names := fileInfoNames(result.Transferred); len(names) != 2 {
+		t.Errorf("The files changed on one side should be transferred, got %v", names)
+	}
+	objectHasContent(t, client, "local.txt", "changed local")
+	fileHasContent(t, filepath.Join(local, "remote.txt"), "changed remote")
+
+	if len(conflicts) != 1 || conflicts[0] != "both.txt" {
+		t.Fatalf("The file changed on both sides should be reported, got %v", conflicts)
+	}
+	fileHasContent(t, filepath.Join(local, "both.txt"), "changed local")
+	objectHasContent(t, client, "both.txt", "changed remote")
+
+	// The conflict is kept until it is resolved.
+	conflicts = nil
+	if _, err := m.BiSync(local, "s3://example-bucket"); err != nil {
+		t.Fatal("BiSync should be successful", err)
+	}
+	if len(conflicts) != 1 {
+		t.Errorf("The conflict should be reported again, got %v", conflicts)
+	}
+}
+
+func TestBiSyncDirection(t *testing.T) {
+	now := time.Now()
+	file := func(size int64, modTime time.Time) *fileInfo {
+		return &fileInfo{size: size, lastModified: modTime}
+	}
+	testCases := map[string]struct {
+		local, remote *fileInfo
+		state         *biSyncEntry
+		expected      biSyncDirection
+	}{
+		"LocalOnly":       {file(1, now), nil, nil, biSyncUpload},
+		"LocalNewer":      {file(1, now), file(1, now.Add(-time.Hour)), nil, biSyncUpload},
+		"RemoteNewer":     {file(1, now.Add(-time.Hour)), file(1, now), nil, biSyncDownload},
+		"Same":            {file(1, now), file(1, now), nil, biSyncNone},
+		"SameTimeDiffers": {file(1, now), file(2, now), nil, biSyncConflict},
+		"Unchanged":       {file(1, now), file(1, now), &biSyncEntry{1, now}, biSyncNone},
+		"LocalChanged":    {file(2, now.Add(-time.Hour)), file(1, now), &biSyncEntry{1, now}, biSyncUpload},
+		"RemoteChanged":   {file(1, now), file(2, now.Add(-time.Hour)), &biSyncEntry{1, now}, biSyncDownload},
+		"BothChanged":     {file(2, now), file(3, now), &biSyncEntry{1, now}, biSyncConflict},
+		"BothSame":        {file(2, now), file(2, now), &biSyncEntry{1, now}, biSyncNone},
+	}
+	m := &Manager{}
+	for name, testCase := range testCases {
+		if direction := m.biSyncDirection(testCase.local, testCase.remote, testCase.state); direction != testCase.expected {
+			t.Errorf("%s: expected %d, got %d", name, testCase.expected, direction)
+		}
+	}
+}
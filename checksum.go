@@ -0,0 +1,62 @@
+// Copyright 2019 SEQSENSE, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package s3sync
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"strings"
+)
+
+// hashFile returns the hex encoded sha256 hash of the file content.
+func hashFile(fs FileSystem, filename string) (string, error) {
+	return hashFileWith(fs, filename, sha256.New())
+}
+
+// md5File returns the hex encoded md5 hash of the file content.
+func md5File(fs FileSystem, filename string) (string, error) {
+	return hashFileWith(fs, filename, md5.New())
+}
+
+func hashFileWith(fs FileSystem, filename string, h hash.Hash) (string, error) {
+	f, err := fs.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// isSinglePartETag returns true if the ETag is the md5 of the object.
+// The ETag of a multipart uploaded object has the "-<number of parts>" suffix,
+// and some s3 compatible stores return the ETag which isn't the md5 even for
+// the single part objects, so the ETag has to be in the form of the hex md5.
+func isSinglePartETag(etag string) bool {
+	if len(etag) != hex.EncodedLen(md5.Size) {
+		return false
+	}
+	_, err := hex.DecodeString(etag)
+	return err == nil
+}
+
+// normalizeETag removes the quotes of the ETag.
+func normalizeETag(etag string) string {
+	return strings.Trim(etag, "\"")
+}
@@ -0,0 +1,187 @@
+// Copyright 2019 SEQSENSE, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package s3sync
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// ChecksumStore caches the checksums of the local files.
+// path is the file path qualified by the hash algorithm, e.g. "sha256:dir/file",
+// so that a store can be shared by the comparison modes using the different hashes.
+// The cached checksum must be discarded if the size or the modification time differs.
+type ChecksumStore interface {
+	Get(path string, size int64, modTime time.Time) (string, bool)
+	Put(path string, size int64, modTime time.Time, hash string)
+}
+
+type checksumEntry struct {
+	Path    string    `json:"path"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+	Hash    string    `json:"hash"`
+}
+
+func (e *checksumEntry) matches(size int64, modTime time.Time) bool {
+	return e.Size == size && e.ModTime.Equal(modTime)
+}
+
+// MemoryChecksumStore is the ChecksumStore which keeps the checksums in memory.
+// It is used by default.
+type MemoryChecksumStore struct {
+	mutex   sync.Mutex
+	entries map[string]*checksumEntry
+}
+
+// NewMemoryChecksumStore returns a new empty MemoryChecksumStore.
+func NewMemoryChecksumStore() *MemoryChecksumStore {
+	return &MemoryChecksumStore{entries: make(map[string]*checksumEntry)}
+}
+
+// Get returns the cached checksum of the file.
+func (s *MemoryChecksumStore) Get(path string, size int64, modTime time.Time) (string, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	entry, ok := s.entries[path]
+	if !ok || !entry.matches(size, modTime) {
+		return "", false
+	}
+	return entry.Hash, true
+}
+
+// Put caches the checksum of the file.
+func (s *MemoryChecksumStore) Put(path string, size int64, modTime time.Time, hash string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.entries[path] = &checksumEntry{Path: path, Size: size, ModTime: modTime, Hash: hash}
+}
+
+// FileChecksumStore is the ChecksumStore which persists the checksums to a file,
+// to reuse them across the processes.
+// The checksums are appended to the file as JSON lines, and the last line of each
+// path is used on load.
+type FileChecksumStore struct {
+	memory *MemoryChecksumStore
+	mutex  sync.Mutex
+	file   *os.File
+	// errs are the errors of Put which are not reported yet.
+	errs []error
+}
+
+// OpenFileChecksumStore loads the checksums from the file and opens it to append
+// the new ones. The file is created if it doesn't exist.
+func OpenFileChecksumStore(filename string) (*FileChecksumStore, error) {
+	memory := NewMemoryChecksumStore()
+	if f, err := os.Open(filename); err == nil {
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			entry := &checksumEntry{}
+			if err := json.Unmarshal(scanner.Bytes(), entry); err != nil {
+				// The line partially written on crash is skipped.
+				continue
+			}
+			memory.entries[entry.Path] = entry
+		}
+		err := scanner.Err()
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &FileChecksumStore{memory: memory, file: f}, nil
+}
+
+// Get returns the cached checksum of the file.
+func (s *FileChecksumStore) Get(path string, size int64, modTime time.Time) (string, bool) {
+	return s.memory.Get(path, size, modTime)
+}
+
+// Put caches the checksum of the file and appends it to the store file.
+// The checksum is kept in memory even if the write fails, and the error is logged
+// by the Manager which computed the checksum.
+func (s *FileChecksumStore) Put(path string, size int64, modTime time.Time, hash string) {
+	s.memory.Put(path, size, modTime, hash)
+
+	data, err := json.Marshal(&checksumEntry{Path: path, Size: size, ModTime: modTime, Hash: hash})
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if err != nil {
+		s.errs = append(s.errs, fmt.Errorf("failed to encode the checksum of %s: %v", path, err))
+		return
+	}
+	if _, err := s.file.Write(append(data, '\n')); err != nil {
+		s.errs = append(s.errs, fmt.Errorf("failed to write the checksum of %s: %v", path, err))
+	}
+}
+
+// takeErrors returns the errors of Put since the last call.
+func (s *FileChecksumStore) takeErrors() []error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	errs := s.errs
+	s.errs = nil
+	return errs
+}
+
+// Close closes the store file.
+func (s *FileChecksumStore) Close() error {
+	return s.file.Close()
+}
+
+// fileChecksum returns the checksum of the local file by the named hash algorithm,
+// using Option.ChecksumStore as the cache.
+func (m *Manager) fileChecksum(file *fileInfo, algorithm string) (string, error) {
+	key := algorithm + ":" + file.path
+	store := m.option.ChecksumStore
+	if store != nil {
+		if hash, ok := store.Get(key, file.size, file.lastModified); ok {
+			return hash, nil
+		}
+	}
+
+	var hash string
+	var err error
+	switch algorithm {
+	case "md5":
+		hash, err = md5File(m.fs(), file.path)
+	case "sha256":
+		hash, err = hashFile(m.fs(), file.path)
+	default:
+		panic("unknown hash algorithm " + algorithm)
+	}
+	if err != nil {
+		return "", err
+	}
+	if store != nil {
+		store.Put(key, file.size, file.lastModified, hash)
+		if s, ok := store.(interface{ takeErrors() []error }); ok {
+			// The failure to persist the checksum doesn't fail the sync.
+			for _, err := range s.takeErrors() {
+				m.println(err)
+			}
+		}
+	}
+	return hash, nil
+}
@@ -0,0 +1,172 @@
+// Copyright 2019 SEQSENSE, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package s3sync
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testChecksumStore(t *testing.T, store ChecksumStore) {
+	now := time.Now()
+	if _, ok := store.Get("sha256:a.txt", 1, now); ok {
+		t.Error("The empty store should not have the checksum")
+	}
+	store.Put("sha256:a.txt", 1, now, "0123")
+	if hash, ok := store.Get("sha256:a.txt", 1, now); !ok || hash != "0123" {
+		t.Errorf("The stored checksum should be returned, actual: %s", hash)
+	}
+	if _, ok := store.Get("sha256:a.txt", 2, now); ok {
+		t.Error("The checksum should be discarded if the size differs")
+	}
+	if _, ok := store.Get("sha256:a.txt", 1, now.Add(time.Second)); ok {
+		t.Error("The checksum should be discarded if the modification time differs")
+	}
+	if _, ok := store.Get("md5:a.txt", 1, now); ok {
+		t.Error("The checksum of the other algorithm should not be returned")
+	}
+}
+
+func TestMemoryChecksumStore(t *testing.T) {
+	testChecksumStore(t, NewMemoryChecksumStore())
+}
+
+func TestFileChecksumStore(t *testing.T) {
+	temp, err := ioutil.TempDir("", "s3synctest")
+	if err != nil {
+		t.Fatal("Failed to create temp dir")
+	}
+	defer os.RemoveAll(temp)
+	filename := filepath.Join(temp, "checksums.jsonl")
+
+	store, err := OpenFileChecksumStore(filename)
+	if err != nil {
+		t.Fatal("OpenFileChecksumStore should be successful", err)
+	}
+	testChecksumStore(t, store)
+
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 6, time.UTC)
+	store.Put("sha256:b.txt", 10, modTime, "old")
+	store.Put("sha256:b.txt", 10, modTime, "new")
+	if err := store.Close(); err != nil {
+		t.Fatal("Close should be successful", err)
+	}
+
+	// The partially written line is skipped on load.
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal("Failed to open the store file", err)
+	}
+	f.WriteString(`{"path":"sha256:c.txt","si`)
+	f.Close()
+
+	reopened, err := OpenFileChecksumStore(filename)
+	if err != nil {
+		t.Fatal("OpenFileChecksumStore should be successful", err)
+	}
+	defer reopened.Close()
+	if hash, ok := reopened.Get("sha256:b.txt", 10, modTime); !ok || hash != "new" {
+		t.Errorf("The last checksum should be loaded, actual: %s", hash)
+	}
+	if _, ok := reopened.Get("sha256:c.txt", 10, modTime); ok {
+		t.Error("The broken entry should not be loaded")
+	}
+}
+
+// countingChecksumStore counts the calls of the embedded store.
+type countingChecksumStore struct {
+	*MemoryChecksumStore
+	gets, puts int
+}
+
+func (s *countingChecksumStore) Get(path string, size int64, modTime time.Time) (string, bool) {
+	s.gets++
+	return s.MemoryChecksumStore.Get(path, size, modTime)
+}
+
+func (s *countingChecksumStore) Put(path string, size int64, modTime time.Time, hash string) {
+	s.puts++
+	s.MemoryChecksumStore.Put(path, size, modTime, hash)
+}
+
+func TestFileChecksumWithStore(t *testing.T) {
+	temp, err := ioutil.TempDir("", "s3synctest")
+	if err != nil {
+		t.Fatal("Failed to create temp dir")
+	}
+	defer os.RemoveAll(temp)
+	writeFile(t, filepath.Join(temp, "a.txt"), "a")
+	stat, err := os.Stat(filepath.Join(temp, "a.txt"))
+	if err != nil {
+		t.Fatal("Failed to stat", err)
+	}
+	file := &fileInfo{name: "a.txt", path: filepath.Join(temp, "a.txt"), size: stat.Size(), lastModified: stat.ModTime()}
+
+	store := &countingChecksumStore{MemoryChecksumStore: NewMemoryChecksumStore()}
+	m := &Manager{option: Option{ChecksumStore: store}}
+
+	for i := 0; i < 2; i++ {
+		hash, err := m.fileChecksum(file, "md5")
+		if err != nil {
+			t.Fatal("fileChecksum should be successful", err)
+		}
+		if expected, _ := md5File(osFileSystem{}, file.path); hash != expected {
+			t.Errorf("Expected md5: %s, actual: %s", expected, hash)
+		}
+	}
+	if store.gets != 2 || store.puts != 1 {
+		t.Errorf("The checksum should be computed once and cached, gets: %d, puts: %d", store.gets, store.puts)
+	}
+
+	// The cached value is used without reading the file.
+	store.Put("sha256:"+file.path, file.size, file.lastModified, "cached")
+	if hash, _ := m.fileChecksum(file, "sha256"); hash != "cached" {
+		t.Errorf("The injected store should be used, actual: %s", hash)
+	}
+}
+
+func TestFileChecksumStoreWriteError(t *testing.T) {
+	temp, err := ioutil.TempDir("", "s3synctest")
+	if err != nil {
+		t.Fatal("Failed to create temp dir")
+	}
+	defer os.RemoveAll(temp)
+	writeFile(t, filepath.Join(temp, "a.txt"), "a")
+	stat, err := os.Stat(filepath.Join(temp, "a.txt"))
+	if err != nil {
+		t.Fatal("Failed to stat", err)
+	}
+	file := &fileInfo{name: "a.txt", path: filepath.Join(temp, "a.txt"), size: stat.Size(), lastModified: stat.ModTime()}
+
+	store, err := OpenFileChecksumStore(filepath.Join(temp, "checksums.jsonl"))
+	if err != nil {
+		t.Fatal("OpenFileChecksumStore should be successful", err)
+	}
+	// The write to the closed file fails.
+	store.Close()
+
+	l := &captureLogger{}
+	m := &Manager{option: Option{ChecksumStore: store, Logger: l}}
+	if _, err := m.fileChecksum(file, "md5"); err != nil {
+		t.Fatal("The failure to persist the checksum should not fail", err)
+	}
+	if lines := l.linesWithPrefix("failed to write the checksum"); len(lines) != 1 {
+		t.Errorf("The write error should be logged to Option.Logger, got %v", l.lines)
+	}
+	if hash, ok := store.Get("md5:"+file.path, file.size, file.lastModified); !ok || hash == "" {
+		t.Error("The checksum should be kept in memory")
+	}
+}
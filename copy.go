@@ -0,0 +1,228 @@
+// Copyright 2019 SEQSENSE, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package s3sync
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// maxCopyObjectSize is the maximum object size of a single CopyObject request.
+// The larger objects are copied by parts. It is a variable to be replaced in the tests.
+var maxCopyObjectSize = maxSinglePartSize
+
+// defaultCopyPartSize is the part size of the multipart copy without Option.PartSize.
+const defaultCopyPartSize int64 = 512 * 1024 * 1024
+
+// copyObject copies the source object to the dest s3 path by the server side copy.
+// If the destination has the different client and it is denied to read the source,
+// the object is streamed through this process instead.
+// With Option.Move, the source object is deleted after the copy succeeds.
+func (m *Manager) copyObject(ctx context.Context, file *fileInfo, sourcePath, destPath *s3Path) error {
+	dest := m.destManager()
+	key := dest.uploadKey(file, destPath)
+
+	if m.option.DryRun {
+		m.println("Would copy", "s3://"+sourcePath.bucket+"/"+file.path, "to", "s3://"+destPath.bucket+"/"+key)
+		return nil
+	}
+	m.println("Copying", "s3://"+sourcePath.bucket+"/"+file.path, "to", "s3://"+destPath.bucket+"/"+key)
+
+	var err error
+	if file.size > maxCopyObjectSize {
+		input := dest.uploadInput(file, destPath.bucket, key)
+		if err = m.copySourceHeaders(ctx, input, sourcePath.bucket, file.path); err == nil {
+			err = dest.multipartCopy(ctx, input, sourcePath.bucket, file.path, file.size, m.sseCustomer())
+		}
+	} else {
+		// The headers of the source are kept, except the storage class and the ACL.
+		input := dest.uploadInput(file, destPath.bucket, key)
+		sse := m.sseCustomer()
+		copyInput := &s3.CopyObjectInput{
+			Bucket:                         input.Bucket,
+			Key:                            input.Key,
+			CopySource:                     aws.String(copySource(sourcePath.bucket, file.path)),
+			ACL:                            input.ACL,
+			StorageClass:                   input.StorageClass,
+			SSECustomerAlgorithm:           input.SSECustomerAlgorithm,
+			SSECustomerKey:                 input.SSECustomerKey,
+			SSECustomerKeyMD5:              input.SSECustomerKeyMD5,
+			CopySourceSSECustomerAlgorithm: sse.algorithm,
+			CopySourceSSECustomerKey:       sse.key,
+			CopySourceSSECustomerKeyMD5:    sse.keyMD5,
+		}
+		if m.option.TaggingDirective != "" {
+			copyInput.TaggingDirective = aws.String(m.option.TaggingDirective)
+			if m.option.TaggingDirective == s3.TaggingDirectiveReplace {
+				copyInput.Tagging = input.Tagging
+			}
+		}
+		_, err = dest.s3.CopyObjectWithContext(ctx, copyInput)
+	}
+	if m.destS3 != nil && isAccessDenied(err) {
+		err = m.streamObject(ctx, file, sourcePath, destPath, key)
+	}
+	if err != nil {
+		return err
+	}
+	if !m.option.Move {
+		return nil
+	}
+
+	// The source is deleted only after the copy is completed.
+	_, err = m.s3.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(sourcePath.bucket),
+		Key:    aws.String(file.path),
+	})
+	return err
+}
+
+// streamObject downloads the object by the source client and uploads it by the
+// destination client.
+func (m *Manager) streamObject(ctx context.Context, file *fileInfo, sourcePath, destPath *s3Path, key string) error {
+	sse := m.sseCustomer()
+	output, err := m.s3.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket:               aws.String(sourcePath.bucket),
+		Key:                  aws.String(file.path),
+		RequestPayer:         m.requestPayer(),
+		SSECustomerAlgorithm: sse.algorithm,
+		SSECustomerKey:       sse.key,
+		SSECustomerKeyMD5:    sse.keyMD5,
+	})
+	if err != nil {
+		return err
+	}
+	defer output.Body.Close()
+
+	dest := m.destManager()
+	input := dest.uploadInput(file, destPath.bucket, key)
+	input.Body = dest.throttleReader(ctx, output.Body)
+	_, err = dest.newUploader(file.size).UploadWithContext(ctx, input)
+	return err
+}
+
+// copySourceHeaders sets the headers of the source object to the upload input,
+// which CopyObject keeps but the multipart copy doesn't.
+func (m *Manager) copySourceHeaders(ctx context.Context, input *s3manager.UploadInput, sourceBucket, sourceKey string) error {
+	sse := m.sseCustomer()
+	head, err := m.s3.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket:               aws.String(sourceBucket),
+		Key:                  aws.String(sourceKey),
+		RequestPayer:         m.requestPayer(),
+		SSECustomerAlgorithm: sse.algorithm,
+		SSECustomerKey:       sse.key,
+		SSECustomerKeyMD5:    sse.keyMD5,
+	})
+	if err != nil {
+		return err
+	}
+	input.CacheControl = head.CacheControl
+	input.ContentDisposition = head.ContentDisposition
+	input.ContentEncoding = head.ContentEncoding
+	input.ContentLanguage = head.ContentLanguage
+	input.ContentType = head.ContentType
+	input.Metadata = head.Metadata
+	input.WebsiteRedirectLocation = head.WebsiteRedirectLocation
+	return nil
+}
+
+// multipartCopy copies the large source object of the size by UploadPartCopy to the
+// object of the upload input. The headers of the input are set since the multipart
+// copy doesn't keep the ones of the source object. sourceSSE is the SSE-C headers
+// to read the source object.
+func (m *Manager) multipartCopy(ctx context.Context, input *s3manager.UploadInput, sourceBucket, sourceKey string, size int64, sourceSSE sseCustomer) error {
+	created, err := m.s3.CreateMultipartUploadWithContext(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:                  input.Bucket,
+		Key:                     input.Key,
+		ACL:                     input.ACL,
+		CacheControl:            input.CacheControl,
+		ContentDisposition:      input.ContentDisposition,
+		ContentEncoding:         input.ContentEncoding,
+		ContentLanguage:         input.ContentLanguage,
+		ContentType:             input.ContentType,
+		Expires:                 input.Expires,
+		Metadata:                input.Metadata,
+		StorageClass:            input.StorageClass,
+		Tagging:                 input.Tagging,
+		WebsiteRedirectLocation: input.WebsiteRedirectLocation,
+		SSECustomerAlgorithm:    input.SSECustomerAlgorithm,
+		SSECustomerKey:          input.SSECustomerKey,
+		SSECustomerKeyMD5:       input.SSECustomerKeyMD5,
+	})
+	if err != nil {
+		return err
+	}
+
+	partSize := m.copyPartSize(size)
+	var parts []*s3.CompletedPart
+	for number, offset := int64(1), int64(0); offset < size; number, offset = number+1, offset+partSize {
+		end := offset + partSize
+		if end > size {
+			end = size
+		}
+		output, err := m.s3.UploadPartCopyWithContext(ctx, &s3.UploadPartCopyInput{
+			Bucket:                         input.Bucket,
+			Key:                            input.Key,
+			UploadId:                       created.UploadId,
+			PartNumber:                     aws.Int64(number),
+			CopySource:                     aws.String(copySource(sourceBucket, sourceKey)),
+			CopySourceRange:                aws.String(fmt.Sprintf("bytes=%d-%d", offset, end-1)),
+			SSECustomerAlgorithm:           input.SSECustomerAlgorithm,
+			SSECustomerKey:                 input.SSECustomerKey,
+			SSECustomerKeyMD5:              input.SSECustomerKeyMD5,
+			CopySourceSSECustomerAlgorithm: sourceSSE.algorithm,
+			CopySourceSSECustomerKey:       sourceSSE.key,
+			CopySourceSSECustomerKeyMD5:    sourceSSE.keyMD5,
+		})
+		if err != nil {
+			m.s3.AbortMultipartUploadWithContext(ctx, &s3.AbortMultipartUploadInput{
+				Bucket:   input.Bucket,
+				Key:      input.Key,
+				UploadId: created.UploadId,
+			})
+			return err
+		}
+		parts = append(parts, &s3.CompletedPart{
+			ETag:       output.CopyPartResult.ETag,
+			PartNumber: aws.Int64(number),
+		})
+	}
+
+	_, err = m.s3.CompleteMultipartUploadWithContext(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          input.Bucket,
+		Key:             input.Key,
+		UploadId:        created.UploadId,
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+	})
+	return err
+}
+
+// copyPartSize returns the part size of the multipart copy within the part number limit.
+func (m *Manager) copyPartSize(size int64) int64 {
+	partSize := defaultCopyPartSize
+	if m.option.PartSize > 0 {
+		partSize = m.option.PartSize
+	}
+	maxParts := int64(s3manager.MaxUploadParts)
+	if m.option.MaxUploadParts > 0 {
+		maxParts = int64(m.option.MaxUploadParts)
+	}
+	if size/partSize >= maxParts {
+		partSize = size/maxParts + 1
+	}
+	return partSize
+}
@@ -0,0 +1,271 @@
+// Copyright 2019 SEQSENSE, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package s3sync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// copyErrorS3 fails CopyObject.
+type copyErrorS3 struct {
+	*fakeS3
+}
+
+func (c *copyErrorS3) CopyObjectWithContext(ctx aws.Context, input *s3.CopyObjectInput, opts ...request.Option) (*s3.CopyObjectOutput, error) {
+	c.called("CopyObject")
+	return nil, errors.New("copy failed")
+}
+
+func TestCopyObject(t *testing.T) {
+	file := &fileInfo{name: "dir/a.txt", path: "src/dir/a.txt", size: 1}
+	sourcePath := &s3Path{bucket: "source-bucket", bucketPrefix: "src"}
+	destPath := &s3Path{bucket: "dest-bucket", bucketPrefix: "dst"}
+
+	testCases := map[string]struct {
+		move      bool
+		copyFails bool
+		copied    bool
+		deleted   bool
+	}{
+		"Copy":           {false, false, true, false},
+		"Move":           {true, false, true, true},
+		"MoveCopyFailed": {true, true, false, false},
+	}
+	for name, tt := range testCases {
+		t.Run(name, func(t *testing.T) {
+			fake := newFakeS3()
+			fake.putObject("source-bucket", "src/dir/a.txt", []byte("a"), time.Now())
+			fake.createBucket("dest-bucket")
+
+			m := &Manager{s3: fake, option: Option{Move: tt.move}}
+			if tt.copyFails {
+				m.s3 = &copyErrorS3{fakeS3: fake}
+			}
+			err := m.copyObject(context.Background(), file, sourcePath, destPath)
+			if tt.copyFails != (err != nil) {
+				t.Fatal("Unexpected error", err)
+			}
+
+			if _, ok := fake.getObject("dest-bucket", "dst/dir/a.txt"); ok != tt.copied {
+				t.Errorf("The object copied: %v, expected: %v", ok, tt.copied)
+			}
+			if _, ok := fake.getObject("source-bucket", "src/dir/a.txt"); ok == tt.deleted {
+				t.Errorf("The source deleted: %v, expected: %v", !ok, tt.deleted)
+			}
+			if tt.copyFails && fake.count("DeleteObject") != 0 {
+				t.Error("The source must not be deleted if the copy failed")
+			}
+		})
+	}
+}
+
+// deniedCopyS3 denies CopyObject like the client of the other account.
+type deniedCopyS3 struct {
+	*fakeS3
+}
+
+func (d *deniedCopyS3) CopyObjectWithContext(ctx aws.Context, input *s3.CopyObjectInput, opts ...request.Option) (*s3.CopyObjectOutput, error) {
+	d.called("CopyObject")
+	return nil, awserr.New("AccessDenied", "Access Denied", nil)
+}
+
+func TestCopyObjectWithClients(t *testing.T) {
+	file := &fileInfo{name: "a.txt", path: "a.txt", size: 4}
+	sourcePath := &s3Path{bucket: "source-bucket"}
+	destPath := &s3Path{bucket: "dest-bucket", bucketPrefix: "copied"}
+
+	t.Run("ServerSide", func(t *testing.T) {
+		// The destination client can read the source.
+		client := newFakeS3()
+		client.putObject("source-bucket", "a.txt", []byte("data"), time.Now())
+		client.createBucket("dest-bucket")
+
+		m := NewWithClients(client, client)
+		if err := m.copyObject(context.Background(), file, sourcePath, destPath); err != nil {
+			t.Fatal("copyObject should be successful", err)
+		}
+		if client.count("CopyObject") != 1 || client.count("GetObject") != 0 {
+			t.Error("The object should be copied on the server side")
+		}
+	})
+
+	for _, move := range []bool{false, true} {
+		t.Run(fmt.Sprintf("StreamMove%v", move), func(t *testing.T) {
+			source := newFakeS3()
+			source.putObject("source-bucket", "a.txt", []byte("data"), time.Now())
+			dest := newFakeS3()
+			dest.createBucket("dest-bucket")
+
+			var opts []OptionFunc
+			if move {
+				opts = append(opts, WithMove())
+			}
+			m := NewWithClients(source, &deniedCopyS3{fakeS3: dest}, opts...)
+			if err := m.copyObject(context.Background(), file, sourcePath, destPath); err != nil {
+				t.Fatal("copyObject should be successful", err)
+			}
+
+			object, ok := dest.getObject("dest-bucket", "copied/a.txt")
+			if !ok || string(object.data) != "data" {
+				t.Fatal("The object should be streamed to the destination client")
+			}
+			if source.count("GetObject") != 1 || dest.count("PutObject") != 1 {
+				t.Error("The object should be downloaded by the source client and uploaded by the dest client")
+			}
+			if _, ok := source.getObject("source-bucket", "a.txt"); ok == move {
+				t.Errorf("The source deleted: %v, expected: %v", !ok, move)
+			}
+		})
+	}
+}
+
+func TestSyncS3ToS3(t *testing.T) {
+	client := newFakeS3()
+	for _, key := range []string{"src/a.txt", "src/dir/b.txt", "src/uptodate.txt", "other/c.txt"} {
+		client.putObject("source-bucket", key, []byte(key), time.Now().Add(-time.Hour))
+	}
+	client.putObject("dest-bucket", "dst/uptodate.txt", []byte("src/uptodate.txt"), time.Now())
+
+	m := &Manager{s3: client}
+	for i := 0; i < 2; i++ {
+		result, err := m.SyncWithResult("s3://source-bucket/src", "s3://dest-bucket/dst")
+		if err != nil {
+			t.Fatal("Sync should be successful", err)
+		}
+		if i == 0 && (len(result.Transferred) != 2 || len(result.Skipped) != 1) {
+			t.Errorf("Unexpected result: %+v", result)
+		}
+	}
+
+	for _, name := range []string{"a.txt", "dir/b.txt", "uptodate.txt"} {
+		if object, ok := client.getObject("dest-bucket", "dst/"+name); !ok || string(object.data) != "src/"+name {
+			t.Errorf("dst/%s should be copied", name)
+		}
+	}
+	if _, ok := client.getObject("dest-bucket", "dst/c.txt"); ok {
+		t.Error("The object out of the source should not be copied")
+	}
+	if n := client.count("CopyObject"); n != 2 {
+		t.Errorf("Only the changed objects should be copied once, got %d copies", n)
+	}
+	if n := client.count("GetObject"); n != 0 {
+		t.Errorf("The objects should not be downloaded, got %d", n)
+	}
+
+	if err := m.Sync("s3://source-bucket/src", "s3://missing-bucket"); err == nil {
+		t.Error("Sync to the missing bucket should fail")
+	}
+}
+
+func TestSyncS3ToS3MultipartCopy(t *testing.T) {
+	defer func(size int64) { maxCopyObjectSize = size }(maxCopyObjectSize)
+	maxCopyObjectSize = 10
+
+	client := &copySourceSSES3{fakeS3: newFakeS3()}
+	client.putObject("source-bucket", "small.txt", []byte("small"), time.Now())
+	large := client.putObject("source-bucket", "large.txt", []byte("large object over the limit"), time.Now())
+	large.contentType = "text/csv"
+	large.cacheControl = "no-cache"
+	large.metadata = map[string]*string{"Owner": aws.String("alice")}
+	client.createBucket("dest-bucket")
+
+	m := &Manager{s3: client, option: Option{SSECustomerKey: testSSECustomerKey}}
+	if err := m.Sync("s3://source-bucket", "s3://dest-bucket"); err != nil {
+		t.Fatal("Sync should be successful", err)
+	}
+	for key, data := range map[string]string{"small.txt": "small", "large.txt": "large object over the limit"} {
+		if object, ok := client.getObject("dest-bucket", key); !ok || string(object.data) != data {
+			t.Errorf("%s should be copied", key)
+		}
+	}
+	if client.count("CopyObject") != 1 || client.count("UploadPartCopy") != 1 {
+		t.Error("The large object should be copied by parts")
+	}
+	// The headers of the source are kept as CopyObject does.
+	object, _ := client.getObject("dest-bucket", "large.txt")
+	if object.contentType != "text/csv" || object.cacheControl != "no-cache" ||
+		!reflect.DeepEqual(map[string]*string{"Owner": aws.String("alice")}, object.metadata) {
+		t.Errorf("The headers of the source should be kept, got %q %q %v", object.contentType, object.cacheControl, object.metadata)
+	}
+	if client.copySourceKey != testSSECustomerKey {
+		t.Errorf("The parts should be read by the key of the source, got %q", client.copySourceKey)
+	}
+
+	// The source key is given separately from the headers of the dest.
+	m = &Manager{s3: client}
+	file := &fileInfo{name: "copied.txt", path: "large.txt", size: 27}
+	sse := (&Manager{option: Option{SSECustomerKey: testSSECustomerKey}}).sseCustomer()
+	if err := m.multipartCopy(context.Background(), m.uploadInput(file, "dest-bucket", "copied.txt"), "source-bucket", "large.txt", file.size, sse); err != nil {
+		t.Fatal("multipartCopy should be successful", err)
+	}
+	if client.copySourceKey != testSSECustomerKey {
+		t.Errorf("The parts should be read by the key of the source, got %q", client.copySourceKey)
+	}
+
+	// The parts are split by the part size.
+	m.option.PartSize = 10
+	err := m.multipartCopy(context.Background(), m.uploadInput(file, "dest-bucket", "copied.txt"), "source-bucket", "large.txt", file.size, m.sseCustomer())
+	if err != nil {
+		t.Fatal("multipartCopy should be successful", err)
+	}
+	if object, ok := client.getObject("dest-bucket", "copied.txt"); !ok || string(object.data) != "large object over the limit" {
+		t.Error("The object should be copied by parts")
+	}
+	if n := client.count("UploadPartCopy"); n != 5 {
+		t.Errorf("Expected 3 parts, got %d", n-2)
+	}
+}
+
+// copySourceSSES3 records the SSE-C key of the source of UploadPartCopy.
+type copySourceSSES3 struct {
+	*fakeS3
+	copySourceKey string
+}
+
+func (c *copySourceSSES3) UploadPartCopyWithContext(ctx aws.Context, input *s3.UploadPartCopyInput, opts ...request.Option) (*s3.UploadPartCopyOutput, error) {
+	c.mu.Lock()
+	c.copySourceKey = aws.StringValue(input.CopySourceSSECustomerKey)
+	c.mu.Unlock()
+	return c.fakeS3.UploadPartCopyWithContext(ctx, input, opts...)
+}
+
+func TestCopyPartSize(t *testing.T) {
+	const gib = 1024 * 1024 * 1024
+	testCases := map[string]struct {
+		size     int64
+		option   Option
+		expected int64
+	}{
+		"Default":        {6 * gib, Option{}, defaultCopyPartSize},
+		"PartSize":       {6 * gib, Option{PartSize: gib}, gib},
+		"MaxUploadParts": {6 * gib, Option{PartSize: gib, MaxUploadParts: 3}, 2*gib + 1},
+	}
+	for name, tt := range testCases {
+		t.Run(name, func(t *testing.T) {
+			m := &Manager{option: tt.option}
+			if partSize := m.copyPartSize(tt.size); partSize != tt.expected {
+				t.Errorf("Expected %d, got %d", tt.expected, partSize)
+			}
+		})
+	}
+}
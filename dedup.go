@@ -0,0 +1,62 @@
+// Copyright 2019 SEQSENSE, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package s3sync
+
+import (
+	"sync"
+)
+
+// dedupTracker tracks the content hashes of the files transferred in a sync,
+// so that the files with the same content are transferred only once and
+// the others are created by the server side copy.
+type dedupTracker struct {
+	mu      sync.Mutex
+	entries map[string]*dedupEntry
+}
+
+type dedupEntry struct {
+	key  string
+	done chan struct{}
+	err  error
+}
+
+func newDedupTracker() *dedupTracker {
+	return &dedupTracker{
+		entries: make(map[string]*dedupEntry),
+	}
+}
+
+// transfer calls upload if the hash is seen for the first time, otherwise waits
+// for the first transfer of the same content and calls copy with its key.
+// If the first transfer failed, upload is called as a fallback.
+func (d *dedupTracker) transfer(hash, key string, upload func() error, copy func(sourceKey string) error) error {
+	d.mu.Lock()
+	entry, ok := d.entries[hash]
+	if !ok {
+		entry = &dedupEntry{key: key, done: make(chan struct{})}
+		d.entries[hash] = entry
+	}
+	d.mu.Unlock()
+
+	if !ok {
+		entry.err = upload()
+		close(entry.done)
+		return entry.err
+	}
+
+	<-entry.done
+	if entry.err != nil {
+		return upload()
+	}
+	return copy(entry.key)
+}
@@ -0,0 +1,106 @@
+// Copyright 2019 SEQSENSE, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package s3sync
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestDedupTracker(t *testing.T) {
+	temp, err := ioutil.TempDir("", "s3synctest")
+	if err != nil {
+		t.Fatal("Failed to create temp dir")
+	}
+	defer os.RemoveAll(temp)
+
+	files := map[string]string{
+		"a.txt":     "same",
+		"b.txt":     "same",
+		"dir/c.txt": "same",
+		"d.txt":     "different",
+	}
+	for name, data := range files {
+		writeFile(t, filepath.Join(temp, name), data)
+	}
+
+	d := newDedupTracker()
+	var uploads, copies int32
+	wg := sync.WaitGroup{}
+	for name := range files {
+		wg.Add(1)
+		go func(name string) {
+			defer wg.Done()
+			hash, err := hashFile(osFileSystem{}, filepath.Join(temp, name))
+			if err != nil {
+				t.Error("hashFile should be successful", err)
+				return
+			}
+			err = d.transfer(hash, name,
+				func() error {
+					atomic.AddInt32(&uploads, 1)
+					return nil
+				},
+				func(sourceKey string) error {
+					if files[sourceKey] != files[name] {
+						t.Errorf("%s is copied from %s which has different content", name, sourceKey)
+					}
+					atomic.AddInt32(&copies, 1)
+					return nil
+				},
+			)
+			if err != nil {
+				t.Error("transfer should be successful", err)
+			}
+		}(name)
+	}
+	wg.Wait()
+
+	if uploads != 2 {
+		t.Errorf("Expected 2 uploads, got %d", uploads)
+	}
+	if copies != 2 {
+		t.Errorf("Expected 2 copies, got %d", copies)
+	}
+}
+
+func TestDedupTrackerFallback(t *testing.T) {
+	d := newDedupTracker()
+	uploads := 0
+	upload := func() error {
+		uploads++
+		if uploads == 1 {
+			return errors.New("upload failed")
+		}
+		return nil
+	}
+	copy := func(string) error {
+		t.Fatal("Copy from the failed upload should not be called")
+		return nil
+	}
+
+	if err := d.transfer("hash", "a", upload, copy); err == nil {
+		t.Fatal("The first upload should fail")
+	}
+	if err := d.transfer("hash", "b", upload, copy); err != nil {
+		t.Fatal("The fallback upload should be successful", err)
+	}
+	if uploads != 2 {
+		t.Fatal("The duplicate should be uploaded if the first upload failed")
+	}
+}
@@ -0,0 +1,293 @@
+// Copyright 2019 SEQSENSE, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package s3sync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// maxDeleteObjects is the maximum number of the keys of a DeleteObjects request.
+const maxDeleteObjects = 1000
+
+// DeleteOrphans deletes the local files under dest which don't exist in the s3 source,
+// and returns the paths of the removed files. Neither the local files dropped by the filters
+// of Option nor the ones whose objects are dropped by them are deleted.
+// If pruneEmptyDirs or Option.PruneEmptyDirs is true, the directories which became
+// empty by the deletion are also removed and included in the result. The empty
+// directories which didn't have the orphans are kept. dest itself is never removed.
+// The deletion is checked by Option.MaxDeletePercent and Option.DeleteConfirmation first.
+// With Option.DryRun, the orphans are returned without being removed.
+func (m *Manager) DeleteOrphans(source, dest string, pruneEmptyDirs bool) ([]string, error) {
+	if err := validateLocalNameMap(m.option.LocalNameMap); err != nil {
+		return nil, err
+	}
+	if err := validatePatterns(&m.option); err != nil {
+		return nil, err
+	}
+	sourceURL, err := url.Parse(source)
+	if err != nil {
+		return nil, err
+	}
+	if !isS3URL(sourceURL) {
+		return nil, errors.New("source of DeleteOrphans must be a s3 url")
+	}
+	destURL, err := url.Parse(dest)
+	if err != nil {
+		return nil, err
+	}
+	if isS3URL(destURL) {
+		return nil, errors.New("dest of DeleteOrphans must be a local path")
+	}
+	if m, err = m.withIgnoreFile(dest); err != nil {
+		return nil, err
+	}
+
+	sourcePath, err := urlToS3Path(sourceURL)
+	if err != nil {
+		return nil, err
+	}
+
+	// Cancelling the context stops the listings on error.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sourceFiles, err := fileInfoChanToMap(m.filterSourceFiles(ctx, m.listS3Files(ctx, sourcePath), ""))
+	if err != nil {
+		return nil, err
+	}
+	destFiles, err := fileInfoChanToMap(m.walkLocalFiles(ctx, dest))
+	if err != nil {
+		return nil, err
+	}
+
+	var orphanFiles []*fileInfo
+	for name, file := range destFiles {
+		if _, ok := sourceFiles[name]; !ok {
+			orphanFiles = append(orphanFiles, file)
+		}
+	}
+	orphanFiles = m.filterNames(orphanFiles)
+	sort.Slice(orphanFiles, func(i, j int) bool {
+		return orphanFiles[i].path < orphanFiles[j].path
+	})
+	if err := m.confirmDeletion(orphanFiles, len(destFiles)); err != nil {
+		return nil, err
+	}
+	orphans := make([]string, len(orphanFiles))
+	for i, file := range orphanFiles {
+		orphans[i] = file.path
+	}
+
+	var removed []string
+	if m.option.DryRun {
+		for _, orphan := range orphans {
+			m.println("Would delete", orphan)
+		}
+		return orphans, nil
+	}
+	for _, orphan := range orphans {
+		if err := m.fs().Remove(orphan); err != nil {
+			return removed, err
+		}
+		if m.option.PreserveMetadata {
+			if err := m.fs().Remove(orphan + metadataSuffix); err != nil && !os.IsNotExist(err) {
+				return removed, err
+			}
+		}
+		removed = append(removed, orphan)
+	}
+
+	if pruneEmptyDirs || m.option.PruneEmptyDirs {
+		for _, orphan := range orphans {
+			dirs, err := removeEmptyParents(m.fs(), dest, orphan)
+			removed = append(removed, dirs...)
+			if err != nil {
+				return removed, err
+			}
+		}
+	}
+	return removed, nil
+}
+
+// deleteExtraLocalFiles deletes the local files under destPath which are not listed
+// in the source by the sync, for Option.Delete.
+func (m *Manager) deleteExtraLocalFiles(ctx context.Context, destPath string, recorder *syncRecorder) error {
+	if stat, err := m.fs().Stat(destPath); os.IsNotExist(err) || (err == nil && !stat.IsDir()) {
+		// Nothing to delete in the single file destination.
+		return nil
+	}
+	destFiles, err := collectFiles(m.walkLocalFiles(ctx, destPath))
+	if err != nil {
+		return err
+	}
+	extraFiles := m.filterNames(recorder.unlisted(destFiles))
+	if err := m.confirmDeletion(extraFiles, len(destFiles)); err != nil {
+		return err
+	}
+
+	root := filepath.Clean(destPath)
+	for _, file := range extraFiles {
+		filename := filepath.Clean(file.path)
+		if filename == root || !isSameOrUnder(filename, root) {
+			return fmt.Errorf("refused to delete %s outside of %s", filename, root)
+		}
+		if m.option.DryRun {
+			m.println("Would delete", filename)
+			recorder.addDeleted(file)
+			continue
+		}
+		m.println("Deleting", filename)
+		if err := m.fs().Remove(filename); err != nil {
+			return err
+		}
+		if m.option.PreserveMetadata {
+			if err := m.fs().Remove(filename + metadataSuffix); err != nil && !os.IsNotExist(err) {
+				return err
+			}
+		}
+		recorder.addDeleted(file)
+		if m.option.PruneEmptyDirs {
+			if _, err := removeEmptyParents(m.fs(), root, filename); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// deleteExtraObjects deletes the objects under destPath which are not listed
+// in the source by the sync, for Option.Delete.
+// The objects are deleted by DeleteObjects up to 1000 keys per request.
+// The errors of the keys in all the batches are returned as SyncError of FileError.
+func (m *Manager) deleteExtraObjects(ctx context.Context, destPath *s3Path, recorder *syncRecorder) error {
+	destFiles, err := collectFiles(m.listS3Files(ctx, destPath))
+	if err != nil {
+		return err
+	}
+	extraFiles := m.filterNames(recorder.unlisted(destFiles))
+	if err := m.confirmDeletion(extraFiles, len(destFiles)); err != nil {
+		return err
+	}
+
+	for _, file := range extraFiles {
+		if _, ok := relativeKey(destPath.bucketPrefix, file.path); !ok {
+			return fmt.Errorf("refused to delete s3://%s/%s outside of the destination", destPath.bucket, file.path)
+		}
+	}
+	if m.option.DryRun {
+		for _, file := range extraFiles {
+			m.println("Would delete", "s3://"+destPath.bucket+"/"+file.path)
+			recorder.addDeleted(file)
+		}
+		return nil
+	}
+	var errs []error
+	for start := 0; start < len(extraFiles); start += maxDeleteObjects {
+		end := start + maxDeleteObjects
+		if end > len(extraFiles) {
+			end = len(extraFiles)
+		}
+		batch := extraFiles[start:end]
+		objects := make([]*s3.ObjectIdentifier, len(batch))
+		for i, file := range batch {
+			m.println("Deleting", "s3://"+destPath.bucket+"/"+file.path)
+			objects[i] = &s3.ObjectIdentifier{Key: aws.String(file.path)}
+		}
+		output, err := m.s3.DeleteObjectsWithContext(ctx, &s3.DeleteObjectsInput{
+			Bucket: aws.String(destPath.bucket),
+			Delete: &s3.Delete{Objects: objects, Quiet: aws.Bool(true)},
+		})
+		if err != nil {
+			return err
+		}
+		failed := make(map[string]error)
+		for _, e := range output.Errors {
+			failed[aws.StringValue(e.Key)] = awserr.New(aws.StringValue(e.Code), aws.StringValue(e.Message), nil)
+		}
+		for _, file := range batch {
+			if err, ok := failed[file.path]; ok {
+				errs = append(errs, &FileError{Name: file.name, Err: err})
+				continue
+			}
+			recorder.addDeleted(file)
+		}
+	}
+	if len(errs) > 0 {
+		return &SyncError{Errors: errs}
+	}
+	return nil
+}
+
+// confirmDeletion checks the files to be deleted from the destination of the given
+// number of files by Option.MaxDeletePercent and Option.DeleteConfirmation.
+// Nothing must be deleted if it returns an error.
+func (m *Manager) confirmDeletion(toDelete []*fileInfo, total int) error {
+	if len(toDelete) == 0 {
+		return nil
+	}
+	if max := m.option.MaxDeletePercent; max > 0 && float64(len(toDelete)) > float64(total)*max/100 {
+		return &TooManyDeletionsError{Deleting: len(toDelete), Total: total, MaxPercent: max}
+	}
+	if m.option.DeleteConfirmation != nil {
+		files := make([]FileInfo, len(toDelete))
+		for i, file := range toDelete {
+			files[i] = file.toFileInfo()
+		}
+		if err := m.option.DeleteConfirmation(files); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeEmptyParents removes the empty parent directories of the given path
+// up to (but not including) root, and returns the removed directories.
+func removeEmptyParents(fs FileSystem, root, path string) ([]string, error) {
+	root = filepath.Clean(root)
+	var removed []string
+	for dir := filepath.Dir(path); dir != root && dir != "." && dir != filepath.Dir(dir); dir = filepath.Dir(dir) {
+		empty, err := isEmptyDir(fs, dir)
+		if os.IsNotExist(err) {
+			// Already removed via another orphan in the same directory.
+			continue
+		} else if err != nil {
+			return removed, err
+		}
+		if !empty {
+			break
+		}
+		if err := fs.Remove(dir); err != nil {
+			return removed, err
+		}
+		removed = append(removed, dir)
+	}
+	return removed, nil
+}
+
+func isEmptyDir(fs FileSystem, dir string) (bool, error) {
+	infos, err := fs.ReadDir(dir)
+	if err != nil {
+		return false, err
+	}
+	return len(infos) == 0, nil
+}
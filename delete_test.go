@@ -0,0 +1,436 @@
+// Copyright 2019 SEQSENSE, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package s3sync
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func setupOrphanTest(t *testing.T) (*Manager, string) {
+	client := newFakeS3()
+	client.putObject("example-bucket", "a.txt", []byte("a"), time.Now())
+	client.putObject("example-bucket", "dir/b.txt", []byte("b"), time.Now())
+
+	temp, err := ioutil.TempDir("", "s3synctest")
+	if err != nil {
+		t.Fatal("Failed to create temp dir")
+	}
+	for _, name := range []string{"a.txt", "dir/b.txt", "orphan.txt", "dir/orphan.txt", "empty/nested/orphan.txt"} {
+		writeFile(t, filepath.Join(temp, name), "data")
+	}
+	return &Manager{s3: client}, temp
+}
+
+func TestDeleteOrphans(t *testing.T) {
+	m, temp := setupOrphanTest(t)
+	defer os.RemoveAll(temp)
+
+	removed, err := m.DeleteOrphans("s3://example-bucket", temp, false)
+	if err != nil {
+		t.Fatal("DeleteOrphans should be successful", err)
+	}
+	if len(removed) != 3 {
+		t.Fatal("3 orphans should be removed", removed)
+	}
+
+	fileExists(t, filepath.Join(temp, "a.txt"))
+	fileExists(t, filepath.Join(temp, "dir/b.txt"))
+	fileNotExists(t, filepath.Join(temp, "orphan.txt"))
+	fileNotExists(t, filepath.Join(temp, "dir/orphan.txt"))
+	fileNotExists(t, filepath.Join(temp, "empty/nested/orphan.txt"))
+	// The empty directory is kept without pruning.
+	fileExists(t, filepath.Join(temp, "empty/nested"))
+}
+
+func TestDeleteOrphansPruneEmptyDirs(t *testing.T) {
+	m, temp := setupOrphanTest(t)
+	defer os.RemoveAll(temp)
+
+	removed, err := m.DeleteOrphans("s3://example-bucket", temp, true)
+	if err != nil {
+		t.Fatal("DeleteOrphans should be successful", err)
+	}
+	if len(removed) != 5 {
+		t.Fatal("3 orphans and 2 directories should be removed", removed)
+	}
+
+	fileExists(t, filepath.Join(temp, "dir/b.txt"))
+	fileNotExists(t, filepath.Join(temp, "empty"))
+	fileExists(t, temp)
+}
+
+func TestDeleteOrphansPruneEmptyDirsOption(t *testing.T) {
+	m, temp := setupOrphanTest(t)
+	defer os.RemoveAll(temp)
+	m.option.PruneEmptyDirs = true
+
+	// Empty directories which existed before the deletion are kept.
+	if err := os.MkdirAll(filepath.Join(temp, "dir/empty/nested"), 0755); err != nil {
+		t.Fatal("Failed to create dir", err)
+	}
+
+	removed, err := m.DeleteOrphans("s3://example-bucket", temp, false)
+	if err != nil {
+		t.Fatal("DeleteOrphans should be successful", err)
+	}
+	if len(removed) != 5 {
+		t.Fatal("3 orphans and 2 directories should be removed", removed)
+	}
+
+	fileExists(t, filepath.Join(temp, "dir/b.txt"))
+	fileExists(t, filepath.Join(temp, "dir/empty/nested"))
+	fileNotExists(t, filepath.Join(temp, "empty"))
+	fileExists(t, temp)
+}
+
+func TestDeleteOrphansInvalidURL(t *testing.T) {
+	m := &Manager{s3: newFakeS3()}
+	if _, err := m.DeleteOrphans("foo", "bar", false); err == nil {
+		t.Fatal("source must be a s3 url")
+	}
+	if _, err := m.DeleteOrphans("s3://foo", "s3://bar", false); err == nil {
+		t.Fatal("dest must be a local path")
+	}
+}
+
+func writeFile(t *testing.T, filename, data string) {
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		t.Fatal("Failed to create dir", err)
+	}
+	if err := ioutil.WriteFile(filename, []byte(data), 0644); err != nil {
+		t.Fatal("Failed to write", filename)
+	}
+}
+
+func fileExists(t *testing.T, filename string) {
+	if _, err := os.Stat(filename); err != nil {
+		t.Fatal(filename, "should exist")
+	}
+}
+
+func fileNotExists(t *testing.T, filename string) {
+	if _, err := os.Stat(filename); !os.IsNotExist(err) {
+		t.Fatal(filename, "should not exist")
+	}
+}
+
+func TestDeleteOrphansConfirmation(t *testing.T) {
+	t.Run("Veto", func(t *testing.T) {
+		m, temp := setupOrphanTest(t)
+		defer os.RemoveAll(temp)
+
+		vetoErr := errors.New("vetoed")
+		var confirmed []string
+		m.option.DeleteConfirmation = func(toDelete []FileInfo) error {
+			for _, file := range toDelete {
+				confirmed = append(confirmed, filepath.ToSlash(file.Name))
+			}
+			return vetoErr
+		}
+
+		removed, err := m.DeleteOrphans("s3://example-bucket", temp, true)
+		if err != vetoErr {
+			t.Fatal("The error of the confirmation should be returned", err)
+		}
+		if len(removed) != 0 {
+			t.Error("Nothing should be removed", removed)
+		}
+		expected := []string{"dir/orphan.txt", "empty/nested/orphan.txt", "orphan.txt"}
+		if !reflect.DeepEqual(expected, confirmed) {
+			t.Errorf("Expected confirmation of %v, actual: %v", expected, confirmed)
+		}
+		fileExists(t, filepath.Join(temp, "orphan.txt"))
+	})
+
+	t.Run("Accept", func(t *testing.T) {
+		m, temp := setupOrphanTest(t)
+		defer os.RemoveAll(temp)
+		m.option.DeleteConfirmation = func([]FileInfo) error { return nil }
+
+		if removed, err := m.DeleteOrphans("s3://example-bucket", temp, false); err != nil || len(removed) != 3 {
+			t.Fatal("The orphans should be removed", removed, err)
+		}
+	})
+}
+
+func TestDeleteOrphansMaxDeletePercent(t *testing.T) {
+	// 3 of 5 files are orphans.
+	testCases := map[string]struct {
+		percent float64
+		allowed bool
+	}{
+		"Disabled": {0, true},
+		"Below":    {50, false},
+		"Exact":    {60, true},
+		"Above":    {80, true},
+	}
+	for name, tt := range testCases {
+		t.Run(name, func(t *testing.T) {
+			m, temp := setupOrphanTest(t)
+			defer os.RemoveAll(temp)
+			m.option.MaxDeletePercent = tt.percent
+			m.option.DeleteConfirmation = func([]FileInfo) error {
+				if !tt.allowed {
+					t.Error("The confirmation should not be called if the guard refuses")
+				}
+				return nil
+			}
+
+			removed, err := m.DeleteOrphans("s3://example-bucket", temp, false)
+			if tt.allowed {
+				if err != nil || len(removed) != 3 {
+					t.Fatal("The orphans should be removed", removed, err)
+				}
+				return
+			}
+			var tooMany *TooManyDeletionsError
+			if !errors.As(err, &tooMany) {
+				t.Fatal("TooManyDeletionsError should be returned", err)
+			}
+			if tooMany.Deleting != 3 || tooMany.Total != 5 {
+				t.Errorf("Unexpected error: %v", tooMany)
+			}
+			fileExists(t, filepath.Join(temp, "orphan.txt"))
+		})
+	}
+}
+
+func TestSyncDelete(t *testing.T) {
+	for _, deleteExtra := range []bool{false, true} {
+		t.Run(fmt.Sprintf("Delete=%v", deleteExtra), func(t *testing.T) {
+			m, temp := setupOrphanTest(t)
+			defer os.RemoveAll(temp)
+			m.option.Delete = deleteExtra
+
+			result, err := m.SyncWithResult("s3://example-bucket", temp)
+			if err != nil {
+				t.Fatal("Sync should be successful", err)
+			}
+
+			fileExists(t, filepath.Join(temp, "a.txt"))
+			fileExists(t, filepath.Join(temp, "dir/b.txt"))
+			if !deleteExtra {
+				fileExists(t, filepath.Join(temp, "orphan.txt"))
+				if len(result.Deleted) != 0 {
+					t.Fatal("Nothing should be deleted", result.Deleted)
+				}
+				return
+			}
+			fileNotExists(t, filepath.Join(temp, "orphan.txt"))
+			fileNotExists(t, filepath.Join(temp, "dir/orphan.txt"))
+			fileNotExists(t, filepath.Join(temp, "empty/nested/orphan.txt"))
+			var deleted []string
+			for _, file := range result.Deleted {
+				deleted = append(deleted, filepath.ToSlash(file.Name))
+			}
+			expected := []string{"dir/orphan.txt", "empty/nested/orphan.txt", "orphan.txt"}
+			if !reflect.DeepEqual(expected, deleted) {
+				t.Errorf("Expected deleted %v, got %v", expected, deleted)
+			}
+		})
+	}
+}
+
+func TestSyncDeleteListingError(t *testing.T) {
+	m, temp := setupOrphanTest(t)
+	defer os.RemoveAll(temp)
+	m.option.Delete = true
+
+	if err := m.Sync("s3://missing-bucket", temp); err == nil {
+		t.Fatal("Sync should fail")
+	}
+	fileExists(t, filepath.Join(temp, "orphan.txt"))
+}
+
+func TestSyncDeletePartialListing(t *testing.T) {
+	newClient := func() (*listErrorS3, *fakeS3) {
+		fake := newFakeS3()
+		fake.pageSize = 2
+		for _, key := range []string{"src/1", "src/2", "src/3", "dst/1", "dst/2", "dst/3", "dst/orphan"} {
+			fake.putObject("example-bucket", key, []byte("data"), time.Now())
+		}
+		// The second page of the listing fails.
+		return &listErrorS3{stallingS3: &stallingS3{fakeS3: fake}, failPage: 2}, fake
+	}
+
+	t.Run("S3ToLocal", func(t *testing.T) {
+		m, temp := setupOrphanTest(t)
+		defer os.RemoveAll(temp)
+		client, _ := newClient()
+		m.s3 = client
+		m.option.Delete = true
+
+		if err := m.Sync("s3://example-bucket/src", temp); err == nil {
+			t.Fatal("Sync should fail")
+		}
+		fileExists(t, filepath.Join(temp, "orphan.txt"))
+		fileExists(t, filepath.Join(temp, "dir/orphan.txt"))
+	})
+
+	t.Run("S3ToS3", func(t *testing.T) {
+		client, fake := newClient()
+		m := &Manager{s3: client, option: Option{Delete: true}}
+		if err := m.Sync("s3://example-bucket/src", "s3://example-bucket/dst"); err == nil {
+			t.Fatal("Sync should fail")
+		}
+		if fake.count("DeleteObjects") != 0 {
+			t.Error("Nothing should be deleted")
+		}
+	})
+
+	t.Run("LocalToS3", func(t *testing.T) {
+		temp, err := ioutil.TempDir("", "s3synctest")
+		if err != nil {
+			t.Fatal("Failed to create temp dir")
+		}
+		defer os.RemoveAll(temp)
+		writeFile(t, filepath.Join(temp, "1"), "data")
+
+		client, fake := newClient()
+		m := &Manager{s3: client, option: Option{Delete: true}}
+		if err := m.Sync(temp, "s3://example-bucket/dst"); err == nil {
+			t.Fatal("Sync should fail")
+		}
+		if fake.count("DeleteObjects") != 0 {
+			t.Error("Nothing should be deleted")
+		}
+	})
+}
+
+func TestSyncDeleteS3(t *testing.T) {
+	temp, err := ioutil.TempDir("", "s3synctest")
+	if err != nil {
+		t.Fatal("Failed to create temp dir")
+	}
+	defer os.RemoveAll(temp)
+	writeFile(t, filepath.Join(temp, "a.txt"), "a")
+
+	client := newFakeS3()
+	client.putObject("example-bucket", "dest/stale.txt", []byte("stale"), time.Now())
+	client.putObject("example-bucket", "other/keep.txt", []byte("keep"), time.Now())
+
+	m := &Manager{s3: client, option: Option{Delete: true}}
+	if err := m.Sync(temp, "s3://example-bucket/dest"); err != nil {
+		t.Fatal("Sync should be successful", err)
+	}
+	if _, ok := client.getObject("example-bucket", "dest/a.txt"); !ok {
+		t.Error("a.txt should be uploaded")
+	}
+	if _, ok := client.getObject("example-bucket", "dest/stale.txt"); ok {
+		t.Error("The stale object should be deleted")
+	}
+	if _, ok := client.getObject("example-bucket", "other/keep.txt"); !ok {
+		t.Error("The object outside of the destination should be kept")
+	}
+	if n := client.count("DeleteObjects"); n != 1 {
+		t.Errorf("Expected 1 DeleteObjects, got %d", n)
+	}
+}
+
+// deleteErrorS3 fails to delete the keys by the per-key errors of DeleteObjects.
+type deleteErrorS3 struct {
+	*fakeS3
+	failKeys map[string]bool
+}
+
+func (d *deleteErrorS3) DeleteObjectsWithContext(ctx aws.Context, input *s3.DeleteObjectsInput, opts ...request.Option) (*s3.DeleteObjectsOutput, error) {
+	var objects []*s3.ObjectIdentifier
+	var errs []*s3.Error
+	for _, object := range input.Delete.Objects {
+		if d.failKeys[aws.StringValue(object.Key)] {
+			errs = append(errs, &s3.Error{Key: object.Key, Code: aws.String("AccessDenied"), Message: aws.String("Access Denied")})
+			continue
+		}
+		objects = append(objects, object)
+	}
+	filtered := *input
+	filtered.Delete = &s3.Delete{Objects: objects, Quiet: input.Delete.Quiet}
+	output, err := d.fakeS3.DeleteObjectsWithContext(ctx, &filtered, opts...)
+	if err != nil {
+		return nil, err
+	}
+	output.Errors = errs
+	return output, nil
+}
+
+func TestSyncDeleteS3Batches(t *testing.T) {
+	temp, err := ioutil.TempDir("", "s3synctest")
+	if err != nil {
+		t.Fatal("Failed to create temp dir")
+	}
+	defer os.RemoveAll(temp)
+	writeFile(t, filepath.Join(temp, "a.txt"), "a")
+
+	fake := newFakeS3()
+	for i := 0; i < 2500; i++ {
+		fake.putObject("example-bucket", fmt.Sprintf("dest/%04d", i), []byte("stale"), time.Now())
+	}
+	// The failures are in the first and the last batches.
+	client := &deleteErrorS3{fakeS3: fake, failKeys: map[string]bool{"dest/0010": true, "dest/2400": true}}
+
+	m := &Manager{s3: client, option: Option{Delete: true}}
+	result, err := m.SyncWithResult(temp, "s3://example-bucket/dest")
+	var syncErr *SyncError
+	if !errors.As(err, &syncErr) || len(syncErr.Errors) != 2 {
+		t.Fatalf("The errors of the keys should be aggregated, got %v", err)
+	}
+	var failed []string
+	for _, err := range syncErr.Errors {
+		var fileErr *FileError
+		var aerr awserr.Error
+		if !errors.As(err, &fileErr) || !errors.As(err, &aerr) || aerr.Code() != "AccessDenied" {
+			t.Errorf("Unexpected error %v", err)
+			continue
+		}
+		failed = append(failed, fileErr.Name)
+	}
+	if !reflect.DeepEqual([]string{"0010", "2400"}, failed) {
+		t.Errorf("Expected the failed keys, got %v", failed)
+	}
+
+	if n := client.count("DeleteObjects"); n != 3 {
+		t.Errorf("The keys should be deleted by 3 batches, got %d", n)
+	}
+	if n := len(result.Deleted); n != 2498 {
+		t.Errorf("The other keys should be deleted, got %d", n)
+	}
+	if _, ok := client.getObject("example-bucket", "dest/0010"); !ok {
+		t.Error("The failed key should be kept")
+	}
+	if _, ok := client.getObject("example-bucket", "dest/2499"); ok {
+		t.Error("The key of the last batch should be deleted")
+	}
+}
+
+func TestSyncDeleteUnsupported(t *testing.T) {
+	m := &Manager{s3: newFakeS3(), option: Option{Delete: true}}
+	if err := m.Sync("s3://example-bucket/*.txt", "bar"); err == nil {
+		t.Error("Delete should not be supported with the glob pattern")
+	}
+	m.option.BatchByTopLevelDir = true
+	if err := m.Sync("s3://example-bucket", "bar"); err == nil {
+		t.Error("Delete should not be supported with BatchByTopLevelDir")
+	}
+}
@@ -0,0 +1,59 @@
+// Copyright 2019 SEQSENSE, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package s3sync
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// freeDiskSpace returns the bytes available to the user on the filesystem of the path.
+// It is a variable to be replaced in the tests.
+var freeDiskSpace = statFreeDiskSpace
+
+// checkDiskSpace checks that the filesystem of destPath has enough space for the planned files.
+func checkDiskSpace(destPath string, planned []*fileInfo) error {
+	var required uint64
+	for _, file := range planned {
+		required += uint64(file.size)
+	}
+
+	available, err := freeDiskSpace(existingParent(destPath))
+	if err != nil {
+		return err
+	}
+	if required > available {
+		return &InsufficientDiskSpaceError{
+			Path:      destPath,
+			Required:  required,
+			Available: available,
+		}
+	}
+	return nil
+}
+
+// existingParent returns the nearest existing directory of the path,
+// since the destination may not be created yet.
+func existingParent(path string) string {
+	path = filepath.Clean(path)
+	for {
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return path
+		}
+		path = parent
+	}
+}
@@ -0,0 +1,79 @@
+// Copyright 2019 SEQSENSE, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package s3sync
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCheckDiskSpace(t *testing.T) {
+	client := newFakeS3()
+	client.putObject("example-bucket", "a", make([]byte, 100), time.Now())
+	client.putObject("example-bucket", "b", make([]byte, 200), time.Now())
+
+	temp, err := ioutil.TempDir("", "s3synctest")
+	if err != nil {
+		t.Fatal("Failed to create temp dir")
+	}
+	defer os.RemoveAll(temp)
+
+	defer func(f func(string) (uint64, error)) {
+		freeDiskSpace = f
+	}(freeDiskSpace)
+
+	var queried string
+	available := uint64(299)
+	freeDiskSpace = func(path string) (uint64, error) {
+		queried = path
+		return available, nil
+	}
+
+	dest := filepath.Join(temp, "not/created/yet")
+	m := &Manager{s3: client, option: Option{CheckDiskSpace: true}}
+	err = m.Sync("s3://example-bucket", dest)
+	var insufficient *InsufficientDiskSpaceError
+	if !errors.As(err, &insufficient) {
+		t.Fatal("InsufficientDiskSpaceError should be returned", err)
+	}
+	if insufficient.Required != 300 || insufficient.Available != 299 {
+		t.Errorf("Unexpected error %v", insufficient)
+	}
+	if queried != temp {
+		t.Errorf("The nearest existing directory should be queried, got %s", queried)
+	}
+	if client.count("GetObject") != 0 {
+		t.Error("Nothing should be downloaded")
+	}
+
+	available = 300
+	if err := m.Sync("s3://example-bucket", dest); err != nil {
+		t.Fatal("Sync should be successful", err)
+	}
+	fileHasSize(t, filepath.Join(dest, "a"), 100)
+	fileHasSize(t, filepath.Join(dest, "b"), 200)
+}
+
+func TestStatFreeDiskSpace(t *testing.T) {
+	available, err := statFreeDiskSpace(os.TempDir())
+	if err != nil {
+		t.Skip("Free disk space is not available", err)
+	}
+	if available == 0 {
+		t.Error("Temp dir should have free space")
+	}
+}
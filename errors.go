@@ -0,0 +1,231 @@
+// Copyright 2019 SEQSENSE, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package s3sync
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// ErrKMSAccessDenied is matched by errors.Is for the download errors caused by the
+// missing permission of the KMS key which encrypts the object (SSE-KMS),
+// rather than the permission of the object itself.
+var ErrKMSAccessDenied = errors.New("access to the KMS key of the object is denied")
+
+// ErrLocalToLocal is returned by Sync if both the source and the destination are
+// local paths.
+var ErrLocalToLocal = errors.New("local to local sync is not supported")
+
+// ErrNotS3URL is matched by errors.Is for the url which must be a s3 url.
+var ErrNotS3URL = errors.New("not a s3 url")
+
+// ErrMissingBucket is returned for the s3 url without the bucket name.
+var ErrMissingBucket = errors.New("s3 url is missing bucket name")
+
+// ErrGlobNotSupported is matched by errors.Is for the glob pattern in the url
+// which doesn't support it, e.g. the destination.
+var ErrGlobNotSupported = errors.New("glob pattern is not supported")
+
+// ErrIncompatibleOptions is matched by errors.Is for the combination of the options
+// which is not supported.
+var ErrIncompatibleOptions = errors.New("incompatible options")
+
+type kmsAccessError struct {
+	err error
+}
+
+func (e *kmsAccessError) Error() string {
+	return ErrKMSAccessDenied.Error() + ": " + e.err.Error()
+}
+
+func (e *kmsAccessError) Unwrap() error {
+	return e.err
+}
+
+func (e *kmsAccessError) Is(target error) bool {
+	return target == ErrKMSAccessDenied
+}
+
+// classifyKMSError wraps the error of GetObject if it is caused by KMS.
+func classifyKMSError(err error) error {
+	aerr, ok := err.(awserr.Error)
+	if !ok {
+		return err
+	}
+	if strings.HasPrefix(aerr.Code(), "KMS.") {
+		return &kmsAccessError{err: err}
+	}
+	if aerr.Code() == "AccessDenied" {
+		message := strings.ToLower(aerr.Message())
+		if strings.Contains(message, "kms") || strings.Contains(message, "customer master key") {
+			return &kmsAccessError{err: err}
+		}
+	}
+	return err
+}
+
+// FileError is the error of the transfer of a file.
+type FileError struct {
+	// Name is the path of the file relative to the sync root.
+	Name string
+	Err  error
+}
+
+func (e *FileError) Error() string {
+	return e.Name + ": " + e.Err.Error()
+}
+
+func (e *FileError) Unwrap() error {
+	return e.Err
+}
+
+// SyncError is returned when some of the files failed in a sync.
+// The errors of the transfers are FileError, and the others, e.g. of the listing,
+// are as is. errors.Is and errors.As match any of the errors.
+type SyncError struct {
+	Errors []error
+}
+
+func (e *SyncError) Error() string {
+	msgs := make([]string, len(e.Errors))
+	for i, err := range e.Errors {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+func (e *SyncError) Is(target error) bool {
+	for _, err := range e.Errors {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *SyncError) As(target interface{}) bool {
+	for _, err := range e.Errors {
+		if errors.As(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// DirectoryConflictError is returned when a directory exists at the path
+// which a downloaded file should be written to.
+type DirectoryConflictError struct {
+	Path string
+}
+
+func (e *DirectoryConflictError) Error() string {
+	return fmt.Sprintf("can't download to %s: the path is a directory", e.Path)
+}
+
+// ConcurrentWriteError is returned with Option.ExclusiveCreate when the temporary
+// file of a download already exists, since another process may be writing it.
+type ConcurrentWriteError struct {
+	Path string
+}
+
+func (e *ConcurrentWriteError) Error() string {
+	return fmt.Sprintf("can't download to %s: the file is being written by another process", e.Path)
+}
+
+// InsufficientDiskSpaceError is returned when the destination filesystem doesn't have
+// enough space for the planned downloads.
+type InsufficientDiskSpaceError struct {
+	Path      string
+	Required  uint64
+	Available uint64
+}
+
+func (e *InsufficientDiskSpaceError) Error() string {
+	return fmt.Sprintf("insufficient disk space for %s: %d bytes required, %d bytes available",
+		e.Path, e.Required, e.Available)
+}
+
+// TooManyDeletionsError is returned when the deletion exceeds Option.MaxDeletePercent
+// of the destination files. Nothing is deleted in that case.
+type TooManyDeletionsError struct {
+	Deleting   int
+	Total      int
+	MaxPercent float64
+}
+
+func (e *TooManyDeletionsError) Error() string {
+	return fmt.Sprintf("refused to delete %d of %d files: more than %g%% of the destination",
+		e.Deleting, e.Total, e.MaxPercent)
+}
+
+// VerifyError is returned when the destination doesn't match the transferred files
+// on the verification of Option.PostVerify.
+type VerifyError struct {
+	// Missing is the names of the files which don't exist in the destination.
+	Missing []string
+	// SizeMismatch is the names of the files which have the different size from the source.
+	SizeMismatch []string
+	// ContentTypeDrift is the names of the files whose Content-Type differs from
+	// the one the upload sets, checked with Option.VerifyContentType.
+	ContentTypeDrift []string
+}
+
+func (e *VerifyError) Error() string {
+	var msgs []string
+	if len(e.Missing) > 0 {
+		msgs = append(msgs, "missing: "+strings.Join(e.Missing, ", "))
+	}
+	if len(e.SizeMismatch) > 0 {
+		msgs = append(msgs, "size mismatch: "+strings.Join(e.SizeMismatch, ", "))
+	}
+	if len(e.ContentTypeDrift) > 0 {
+		msgs = append(msgs, "content type drift: "+strings.Join(e.ContentTypeDrift, ", "))
+	}
+	return "post verification failed: " + strings.Join(msgs, "; ")
+}
+
+// orNil returns nil if there is no discrepancy.
+func (e *VerifyError) orNil() error {
+	if len(e.Missing) == 0 && len(e.SizeMismatch) == 0 && len(e.ContentTypeDrift) == 0 {
+		return nil
+	}
+	return e
+}
+
+// isAccessDenied returns true if the error means the request is not permitted.
+func isAccessDenied(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	return ok && aerr.Code() == "AccessDenied"
+}
+
+// isPreconditionFailed returns true if the condition of the request, e.g. IfUnmodifiedSince,
+// is not met.
+func isPreconditionFailed(err error) bool {
+	aerr, ok := err.(awserr.Error)
+	return ok && aerr.Code() == "PreconditionFailed"
+}
+
+// isNotFound returns true if the error means the object doesn't exist.
+func isNotFound(err error) bool {
+	if aerr, ok := err.(awserr.Error); ok {
+		switch aerr.Code() {
+		case "NotFound", s3.ErrCodeNoSuchKey:
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,178 @@
+// Copyright 2019 SEQSENSE, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package s3sync
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestClassifyKMSError(t *testing.T) {
+	testCases := map[string]struct {
+		err error
+		kms bool
+	}{
+		"KMSAccessDenied": {
+			awserr.New("AccessDenied", "The ciphertext refers to a customer master key that does not exist, does not exist in this region, or you are not allowed to access.", nil),
+			true,
+		},
+		"KMSDecrypt": {
+			awserr.NewRequestFailure(awserr.New("AccessDenied", "User is not authorized to perform: kms:Decrypt", nil), 403, "req"),
+			true,
+		},
+		"KMSException": {
+			awserr.New("KMS.DisabledException", "The key is disabled", nil),
+			true,
+		},
+		"ObjectAccessDenied": {
+			awserr.New("AccessDenied", "Access Denied", nil),
+			false,
+		},
+		"NoSuchKey": {
+			awserr.New(s3.ErrCodeNoSuchKey, "The specified key does not exist.", nil),
+			false,
+		},
+		"NotAWSError": {
+			errors.New("kms"),
+			false,
+		},
+	}
+	for name, testCase := range testCases {
+		t.Run(name, func(t *testing.T) {
+			err := classifyKMSError(testCase.err)
+			if errors.Is(err, ErrKMSAccessDenied) != testCase.kms {
+				t.Errorf("Expected errors.Is(ErrKMSAccessDenied) to be %v for %v", testCase.kms, err)
+			}
+			var aerr awserr.Error
+			if _, ok := testCase.err.(awserr.Error); ok && !errors.As(err, &aerr) {
+				t.Error("The original error should be kept")
+			}
+		})
+	}
+}
+
+// kmsDeniedS3 denies GetObject by the KMS permission.
+type kmsDeniedS3 struct {
+	*fakeS3
+}
+
+func (k *kmsDeniedS3) GetObjectWithContext(aws.Context, *s3.GetObjectInput, ...request.Option) (*s3.GetObjectOutput, error) {
+	return nil, awserr.NewRequestFailure(
+		awserr.New("AccessDenied", "User is not authorized to perform: kms:Decrypt", nil), 403, "req")
+}
+
+func TestDownloadKMSAccessDenied(t *testing.T) {
+	client := &kmsDeniedS3{fakeS3: newFakeS3()}
+	client.putObject("example-bucket", "encrypted", []byte("data"), time.Now())
+
+	temp, err := ioutil.TempDir("", "s3synctest")
+	if err != nil {
+		t.Fatal("Failed to create temp dir")
+	}
+	defer os.RemoveAll(temp)
+
+	m := &Manager{s3: client}
+	file := &fileInfo{name: "encrypted", path: "encrypted", size: 4}
+	err = m.download(context.Background(), file, &s3Path{bucket: "example-bucket"}, temp)
+	if !errors.Is(err, ErrKMSAccessDenied) {
+		t.Fatal("ErrKMSAccessDenied should be returned", err)
+	}
+}
+
+func TestSyncError(t *testing.T) {
+	client := &kmsDeniedS3{fakeS3: newFakeS3()}
+	client.putObject("example-bucket", "a", []byte("data"), time.Now())
+	client.putObject("example-bucket", "dir/b", []byte("data"), time.Now())
+
+	temp, err := ioutil.TempDir("", "s3synctest")
+	if err != nil {
+		t.Fatal("Failed to create temp dir")
+	}
+	defer os.RemoveAll(temp)
+
+	m := &Manager{s3: client}
+	err = m.Sync("s3://example-bucket", temp)
+
+	var syncErr *SyncError
+	if !errors.As(err, &syncErr) {
+		t.Fatalf("SyncError should be returned, got %T %v", err, err)
+	}
+	names := make(map[string]bool)
+	for _, e := range syncErr.Errors {
+		fileErr, ok := e.(*FileError)
+		if !ok {
+			t.Fatalf("FileError should be returned, got %T %v", e, e)
+		}
+		names[filepath.ToSlash(fileErr.Name)] = true
+	}
+	if !reflect.DeepEqual(map[string]bool{"a": true, "dir/b": true}, names) {
+		t.Errorf("The errors of a and dir/b should be returned, got %v", names)
+	}
+
+	if !errors.Is(err, ErrKMSAccessDenied) {
+		t.Error("The errors of the files should match by errors.Is")
+	}
+	var fileErr *FileError
+	if !errors.As(err, &fileErr) {
+		t.Error("The errors of the files should match by errors.As")
+	}
+	for _, name := range []string{"a", filepath.Join("dir", "b")} {
+		if !strings.Contains(err.Error(), name+": "+ErrKMSAccessDenied.Error()) {
+			t.Errorf("The message should contain the error of %s, got %q", name, err.Error())
+		}
+	}
+}
+
+func TestSentinelErrors(t *testing.T) {
+	m := &Manager{s3: newFakeS3()}
+	testCases := map[string]struct {
+		err      error
+		expected error
+	}{
+		"LocalToLocal":    {m.Sync("foo", "bar"), ErrLocalToLocal},
+		"MissingBucket":   {m.Sync("s3:///prefix", "foo"), ErrMissingBucket},
+		"GlobDestination": {m.Sync("foo", "s3://example-bucket/*.txt"), ErrGlobNotSupported},
+		"DeleteGlob": {
+			(&Manager{s3: newFakeS3(), option: Option{Delete: true}}).Sync("s3://example-bucket/*.txt", "foo"),
+			ErrIncompatibleOptions,
+		},
+		"ForceSkipExisting": {
+			(&Manager{s3: newFakeS3(), option: Option{Force: true, SkipExisting: true}}).Sync("s3://example-bucket", "foo"),
+			ErrIncompatibleOptions,
+		},
+	}
+	for name, testCase := range testCases {
+		if !errors.Is(testCase.err, testCase.expected) {
+			t.Errorf("%s: expected %v, got %v", name, testCase.expected, testCase.err)
+		}
+	}
+
+	if _, _, err := ParseS3URL("https://example.com/foo"); !errors.Is(err, ErrNotS3URL) {
+		t.Errorf("Expected %v, got %v", ErrNotS3URL, err)
+	}
+	if _, _, err := ParseS3URL("s3:///foo"); !errors.Is(err, ErrMissingBucket) {
+		t.Errorf("Expected %v, got %v", ErrMissingBucket, err)
+	}
+}
@@ -0,0 +1,209 @@
+// Copyright 2019 SEQSENSE, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package s3sync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"sync"
+)
+
+// SyncFanOut syncs the local source to the multiple s3 destinations in one pass.
+// The source is listed once, and each file is opened once and uploaded to
+// all the destinations which need it concurrently.
+// The returned map has the result of each destination, which is nil on success.
+// The error is returned if the sync can't be started.
+// Option.Delete, Option.Dedup, Option.UpdateHeadersInPlace and Option.CreateFolderMarkers
+// are not supported, and ErrIncompatibleOptions is returned if any of them is set.
+func (m *Manager) SyncFanOut(source string, dests []string) (map[string]error, error) {
+	if name := fanOutUnsupportedOption(&m.option); name != "" {
+		return nil, fmt.Errorf("%w: the %s option is not supported by SyncFanOut", ErrIncompatibleOptions, name)
+	}
+	if err := validateUploadOption(&m.option); err != nil {
+		return nil, err
+	}
+	if err := validateLocalNameMap(m.option.LocalNameMap); err != nil {
+		return nil, err
+	}
+	if err := validatePatterns(&m.option); err != nil {
+		return nil, err
+	}
+	sourceURL, err := url.Parse(source)
+	if err != nil {
+		return nil, err
+	}
+	if isS3URL(sourceURL) {
+		return nil, errors.New("source of SyncFanOut must be a local path")
+	}
+	if m, err = m.withIgnoreFile(source); err != nil {
+		return nil, err
+	}
+
+	destPaths := make([]*s3Path, len(dests))
+	for i, dest := range dests {
+		destURL, err := url.Parse(dest)
+		if err != nil {
+			return nil, err
+		}
+		if !isS3URL(destURL) {
+			return nil, errors.New("dests of SyncFanOut must be s3 urls")
+		}
+		if destPaths[i], err = urlToS3Path(destURL); err != nil {
+			return nil, err
+		}
+		if destPaths[i].pattern != "" {
+			return nil, fmt.Errorf("%w in the destination", ErrGlobNotSupported)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	counter := &transferCounter{}
+	if m.option.ProgressInterval > 0 {
+		defer logProgress(counter, m.option.ProgressInterval, m.printf)()
+	}
+
+	var sourceFiles []*fileInfo
+	for file := range m.walkLocalFiles(ctx, source) {
+		if file.err != nil {
+			return nil, file.err
+		}
+		if file, ok := m.applyObjectFilter(file, ""); ok {
+			sourceFiles = append(sourceFiles, m.mapUploadName(file))
+		}
+	}
+
+	// targets has the indices of the destinations which need each file.
+	results := make([]*fanOutResult, len(dests))
+	recorders := make([]*syncRecorder, len(dests))
+	targets := make(map[string][]int)
+	for i, destPath := range destPaths {
+		results[i] = &fanOutResult{}
+		recorders[i] = &syncRecorder{}
+		sourceChan := make(chan *fileInfo, len(sourceFiles))
+		for _, file := range sourceFiles {
+			sourceChan <- file
+		}
+		close(sourceChan)
+		for file := range m.filterFilesForSync(ctx, sourceChan, m.listS3Files(ctx, destPath), recorders[i]) {
+			if file.err != nil {
+				results[i].add(file.err)
+				continue
+			}
+			targets[file.name] = append(targets[file.name], i)
+		}
+	}
+
+	wg := &sync.WaitGroup{}
+	sem := make(chan struct{}, m.parallelism())
+	for _, file := range sourceFiles {
+		indices := targets[file.name]
+		if len(indices) == 0 {
+			continue
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(file *fileInfo, indices []int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			f, err := m.fs().Open(file.path)
+			if err != nil {
+				for _, i := range indices {
+					results[i].add(&FileError{Name: file.name, Err: err})
+				}
+				return
+			}
+			defer f.Close()
+
+			uploadWg := &sync.WaitGroup{}
+			for _, i := range indices {
+				uploadWg.Add(1)
+				go func(i int) {
+					defer uploadWg.Done()
+					// Each upload reads the shared file independently.
+					body := io.NewSectionReader(f, 0, file.size)
+					if err := m.upload(ctx, file, body, destPaths[i]); err != nil {
+						results[i].add(&FileError{Name: file.name, Err: err})
+						return
+					}
+					counter.add(file.size)
+					recorders[i].addTransferred(file)
+				}(i)
+			}
+			uploadWg.Wait()
+		}(file, indices)
+	}
+	wg.Wait()
+
+	if m.option.PostVerify && !m.option.DryRun {
+		for i, destPath := range destPaths {
+			if results[i].err() != nil {
+				continue
+			}
+			if err := m.verifyS3Files(ctx, recorders[i], destPath); err != nil {
+				results[i].add(err)
+			}
+		}
+	}
+
+	errs := make(map[string]error, len(dests))
+	for i, dest := range dests {
+		errs[dest] = results[i].err()
+	}
+	return errs, nil
+}
+
+// fanOutUnsupportedOption returns the name of the option set which SyncFanOut
+// doesn't support, or empty if there is none.
+func fanOutUnsupportedOption(option *Option) string {
+	switch {
+	case option.Delete:
+		return "Delete"
+	case option.Dedup:
+		return "Dedup"
+	case option.UpdateHeadersInPlace:
+		return "UpdateHeadersInPlace"
+	case option.CreateFolderMarkers:
+		return "CreateFolderMarkers"
+	}
+	return ""
+}
+
+// fanOutResult accumulates the errors of a destination.
+type fanOutResult struct {
+	mutex sync.Mutex
+	errs  []error
+}
+
+func (r *fanOutResult) add(err error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.errs = append(r.errs, err)
+}
+
+// err returns the single error as is to keep its type, or the SyncError of the errors.
+func (r *fanOutResult) err() error {
+	switch len(r.errs) {
+	case 0:
+		return nil
+	case 1:
+		return r.errs[0]
+	}
+	return &SyncError{Errors: r.errs}
+}
@@ -0,0 +1,176 @@
+// Copyright 2019 SEQSENSE, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package s3sync
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSyncFanOut(t *testing.T) {
+	temp, err := ioutil.TempDir("", "s3synctest")
+	if err != nil {
+		t.Fatal("Failed to create temp dir")
+	}
+	defer os.RemoveAll(temp)
+
+	files := map[string]string{
+		"a.txt":         "a",
+		"dir/b.txt":     "bb",
+		"dir/sub/c.txt": "ccc",
+	}
+	for name, data := range files {
+		writeFile(t, filepath.Join(temp, name), data)
+	}
+
+	client := newFakeS3()
+	client.createBucket("bucket1")
+	// bucket2 already has the up-to-date a.txt
+	client.putObject("bucket2", "prefix/a.txt", []byte("a"), time.Now().Add(time.Hour))
+
+	m := &Manager{s3: client}
+	results, err := m.SyncFanOut(temp, []string{"s3://bucket1", "s3://bucket2/prefix", "s3://missing-bucket"})
+	if err != nil {
+		t.Fatal("SyncFanOut should be successful", err)
+	}
+
+	if results["s3://bucket1"] != nil || results["s3://bucket2/prefix"] != nil {
+		t.Fatal("Sync to the existing buckets should be successful", results)
+	}
+	if results["s3://missing-bucket"] == nil {
+		t.Error("Sync to the missing bucket should fail")
+	}
+
+	for name, data := range files {
+		for _, key := range []string{"bucket1/" + name, "bucket2/prefix/" + name} {
+			bucket, key := splitBucketKey(key)
+			object, ok := client.getObject(bucket, key)
+			if !ok || string(object.data) != data {
+				t.Errorf("%s/%s should be uploaded", bucket, key)
+			}
+		}
+	}
+	if n := client.count("PutObject"); n != 5 {
+		t.Errorf("Expected 5 uploads, got %d", n)
+	}
+}
+
+func TestSyncFanOutIgnoreFile(t *testing.T) {
+	temp, err := ioutil.TempDir("", "s3synctest")
+	if err != nil {
+		t.Fatal("Failed to create temp dir")
+	}
+	defer os.RemoveAll(temp)
+	writeFile(t, filepath.Join(temp, ".s3syncignore"), "*.o\n")
+	writeFile(t, filepath.Join(temp, "a.txt"), "a")
+	writeFile(t, filepath.Join(temp, "dir", "b.o"), "b")
+
+	client := newFakeS3()
+	client.createBucket("bucket1")
+	client.createBucket("bucket2")
+	m := &Manager{s3: client, option: Option{UseIgnoreFile: true}}
+	results, err := m.SyncFanOut(temp, []string{"s3://bucket1", "s3://bucket2"})
+	if err != nil {
+		t.Fatal("SyncFanOut should be successful", err)
+	}
+	for _, bucket := range []string{"bucket1", "bucket2"} {
+		if err := results["s3://"+bucket]; err != nil {
+			t.Fatalf("Sync to %s should be successful: %v", bucket, err)
+		}
+		if _, ok := client.getObject(bucket, "a.txt"); !ok {
+			t.Errorf("a.txt should be uploaded to %s", bucket)
+		}
+		for _, key := range []string{".s3syncignore", "dir/b.o"} {
+			if _, ok := client.getObject(bucket, key); ok {
+				t.Errorf("The ignored %s should not be uploaded to %s", key, bucket)
+			}
+		}
+	}
+}
+
+func TestSyncFanOutInvalidURL(t *testing.T) {
+	m := &Manager{s3: newFakeS3()}
+	if _, err := m.SyncFanOut("s3://foo", []string{"s3://bar"}); err == nil {
+		t.Error("Source must be a local path")
+	}
+	if _, err := m.SyncFanOut("foo", []string{"s3://bar", "baz"}); err == nil {
+		t.Error("Dests must be s3 urls")
+	}
+}
+
+func TestSyncFanOutUnsupportedOption(t *testing.T) {
+	testCases := map[string]Option{
+		"Delete":               {Delete: true},
+		"Dedup":                {Dedup: true},
+		"UpdateHeadersInPlace": {UpdateHeadersInPlace: true},
+		"CreateFolderMarkers":  {CreateFolderMarkers: true},
+	}
+	for name, option := range testCases {
+		t.Run(name, func(t *testing.T) {
+			m := &Manager{s3: newFakeS3(), option: option}
+			if _, err := m.SyncFanOut("foo", []string{"s3://bar"}); !errors.Is(err, ErrIncompatibleOptions) {
+				t.Errorf("Expected ErrIncompatibleOptions, got %v", err)
+			}
+		})
+	}
+}
+
+func TestExplicitKeyMap(t *testing.T) {
+	temp, err := ioutil.TempDir("", "s3synctest")
+	if err != nil {
+		t.Fatal("Failed to create temp dir")
+	}
+	defer os.RemoveAll(temp)
+
+	writeFile(t, filepath.Join(temp, "index.template"), "index")
+	writeFile(t, filepath.Join(temp, "dir/page.template"), "page")
+	writeFile(t, filepath.Join(temp, "style.css"), "style")
+
+	client := newFakeS3()
+	client.createBucket("example-bucket")
+	m := &Manager{s3: client, option: Option{
+		ExplicitKeyMap: map[string]string{
+			"index.template":    "index.html",
+			"dir/page.template": "pages/page.html",
+		},
+	}}
+
+	for i := 0; i < 2; i++ {
+		results, err := m.SyncFanOut(temp, []string{"s3://example-bucket/site"})
+		if err != nil || results["s3://example-bucket/site"] != nil {
+			t.Fatal("Sync should be successful", err, results)
+		}
+	}
+
+	for key, data := range map[string]string{
+		"site/index.html":      "index",
+		"site/pages/page.html": "page",
+		"site/style.css":       "style",
+	} {
+		if object, ok := client.getObject("example-bucket", key); !ok || string(object.data) != data {
+			t.Errorf("%s should be uploaded", key)
+		}
+	}
+	for _, key := range []string{"site/index.template", "site/dir/page.template"} {
+		if _, ok := client.getObject("example-bucket", key); ok {
+			t.Errorf("%s should not be uploaded", key)
+		}
+	}
+	if n := client.count("PutObject"); n != 3 {
+		t.Errorf("The mapped files should not be uploaded again, got %d uploads", n)
+	}
+}
@@ -0,0 +1,188 @@
+// Copyright 2019 SEQSENSE, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package s3sync
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// defaultIgnoreFileName is the default of Option.IgnoreFileName.
+const defaultIgnoreFileName = ".s3syncignore"
+
+// isFiltered returns true if the file of the slash separated name relative to the
+// sync root is excluded by Option.Exclude, or not included by Option.Include.
+// Exclude takes precedence over Include.
+func (m *Manager) isFiltered(name string) bool {
+	if m.option.PreserveMetadata && strings.HasSuffix(name, metadataSuffix) {
+		// The sidecar files are not synced as the files.
+		return true
+	}
+	for _, pattern := range m.option.Exclude {
+		if matchPattern(pattern, name) {
+			return true
+		}
+	}
+	if len(m.option.Include) == 0 {
+		return false
+	}
+	for _, pattern := range m.option.Include {
+		if matchPattern(pattern, name) {
+			return false
+		}
+	}
+	return true
+}
+
+// inModifiedWindow returns true if the modification time is in the window of
+// Option.ModifiedAfter and Option.ModifiedBefore.
+func (m *Manager) inModifiedWindow(modTime time.Time) bool {
+	if !m.option.ModifiedAfter.IsZero() && modTime.Before(m.option.ModifiedAfter) {
+		return false
+	}
+	if !m.option.ModifiedBefore.IsZero() && !modTime.Before(m.option.ModifiedBefore) {
+		return false
+	}
+	return true
+}
+
+// matchPattern returns true if the slash separated name matches the glob pattern
+// in the manner of gitignore:
+//   - The pattern without a slash matches any segment of the name ("*.tmp", ".git").
+//   - The other patterns match the segments from the root ("dir/*.txt").
+//   - "**" matches zero or more segments (".git/**", "**/cache").
+//
+// The name under a directory which matches the pattern also matches.
+func matchPattern(pattern, name string) bool {
+	segments := strings.Split(name, "/")
+	pattern = strings.TrimSuffix(pattern, "/")
+	if !strings.Contains(pattern, "/") {
+		for _, segment := range segments {
+			if matched, _ := path.Match(pattern, segment); matched {
+				return true
+			}
+		}
+		return false
+	}
+	return matchSegments(strings.Split(strings.TrimPrefix(pattern, "/"), "/"), segments)
+}
+
+// matchSegments returns true if the leading segments of the name match the pattern.
+func matchSegments(patterns, segments []string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	if patterns[0] == "**" {
+		for i := 0; i <= len(segments); i++ {
+			if matchSegments(patterns[1:], segments[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(segments) == 0 {
+		return false
+	}
+	if matched, _ := path.Match(patterns[0], segments[0]); !matched {
+		return false
+	}
+	return matchSegments(patterns[1:], segments[1:])
+}
+
+// validatePatterns validates the syntax of Option.Include and Option.Exclude.
+func validatePatterns(option *Option) error {
+	for _, pattern := range append(append([]string{}, option.Include...), option.Exclude...) {
+		for _, segment := range strings.Split(pattern, "/") {
+			if _, err := path.Match(segment, ""); err != nil {
+				return fmt.Errorf("invalid filter pattern %q: %v", pattern, err)
+			}
+		}
+	}
+	return nil
+}
+
+// filterNames returns the files whose names are not filtered by isFiltered,
+// and which Option.Filter keeps.
+func (m *Manager) filterNames(files []*fileInfo) []*fileInfo {
+	if m.option.Filter == nil && len(m.option.Include) == 0 && len(m.option.Exclude) == 0 &&
+		!m.option.PreserveMetadata && m.option.ModifiedAfter.IsZero() && m.option.ModifiedBefore.IsZero() {
+		return files
+	}
+	var filtered []*fileInfo
+	for _, file := range files {
+		if !m.isFiltered(filepath.ToSlash(file.name)) && m.inModifiedWindow(file.lastModified) &&
+			(m.option.Filter == nil || m.option.Filter(file.toFileInfo())) {
+			filtered = append(filtered, file)
+		}
+	}
+	return filtered
+}
+
+// withIgnoreFile returns the Manager which excludes the patterns of the ignore file
+// at the root of the local path by Option.UseIgnoreFile, or m itself if there is
+// no ignore file.
+func (m *Manager) withIgnoreFile(localPath string) (*Manager, error) {
+	if !m.option.UseIgnoreFile {
+		return m, nil
+	}
+	if stat, err := m.fs().Stat(localPath); err != nil || !stat.IsDir() {
+		// The single file and the new destination have no ignore file.
+		return m, nil
+	}
+	name := m.option.IgnoreFileName
+	if name == "" {
+		name = defaultIgnoreFileName
+	}
+	patterns, err := readIgnoreFile(m.fs(), filepath.Join(localPath, name))
+	if os.IsNotExist(err) {
+		return m, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	option := m.option
+	option.Exclude = append(append([]string{"/" + name}, option.Exclude...), patterns...)
+	if err := validatePatterns(&option); err != nil {
+		return nil, fmt.Errorf("%s: %v", name, err)
+	}
+	return m.withOption(option), nil
+}
+
+// readIgnoreFile returns the patterns of the ignore file, skipping the blank lines
+// and the comment lines starting with "#".
+func readIgnoreFile(fs FileSystem, filename string) ([]string, error) {
+	f, err := fs.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var patterns []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		patterns = append(patterns, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return patterns, nil
+}
@@ -0,0 +1,363 @@
+// Copyright 2019 SEQSENSE, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package s3sync
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestMatchPattern(t *testing.T) {
+	testCases := []struct {
+		pattern, name string
+		expected      bool
+	}{
+		{"*.tmp", "a.tmp", true},
+		{"*.tmp", "dir/a.tmp", true},
+		{"*.tmp", "a.tmp.txt", false},
+		{".git", ".git/config", true},
+		{".git/**", ".git/objects/ab/cd", true},
+		{".git/**", "sub/.git/config", false},
+		{"**/.git/**", "sub/.git/config", true},
+		{"dir/*.txt", "dir/a.txt", true},
+		{"dir/*.txt", "other/dir/a.txt", false},
+		{"/dir", "dir/sub/a.txt", true},
+		{"dir/", "dir/a.txt", true},
+		{"**/cache", "a/b/cache/c", true},
+		{"a/**/b.txt", "a/b.txt", true},
+		{"a/**/b.txt", "a/x/y/b.txt", true},
+	}
+	for _, tt := range testCases {
+		if matched := matchPattern(tt.pattern, tt.name); matched != tt.expected {
+			t.Errorf("matchPattern(%q, %q) should be %v", tt.pattern, tt.name, tt.expected)
+		}
+	}
+}
+
+func TestIsFiltered(t *testing.T) {
+	m := &Manager{option: Option{Include: []string{"*.jpg"}, Exclude: []string{"tmp"}}}
+	testCases := map[string]bool{
+		"a.jpg":     false,
+		"dir/b.jpg": false,
+		"a.png":     true,
+		"tmp/c.jpg": true,
+	}
+	for name, expected := range testCases {
+		if filtered := m.isFiltered(name); filtered != expected {
+			t.Errorf("isFiltered(%q) should be %v", name, expected)
+		}
+	}
+}
+
+func TestSyncIncludeExclude(t *testing.T) {
+	temp, err := ioutil.TempDir("", "s3synctest")
+	if err != nil {
+		t.Fatal("Failed to create temp dir")
+	}
+	defer os.RemoveAll(temp)
+	writeFile(t, filepath.Join(temp, "local.tmp"), "local")
+
+	client := newFakeS3()
+	for _, key := range []string{"a.jpg", "b.png", "c.tmp", ".git/d.jpg", "dir/e.jpg"} {
+		client.putObject("example-bucket", key, []byte("data"), time.Now())
+	}
+
+	m := &Manager{s3: client, option: Option{
+		Include: []string{"*.jpg", "*.tmp"},
+		Exclude: []string{"*.tmp", ".git/**"},
+		Delete:  true,
+	}}
+	result, err := m.SyncWithResult("s3://example-bucket", temp)
+	if err != nil {
+		t.Fatal("Sync should be successful", err)
+	}
+	if names := fileInfoNames(result.Transferred); !reflect.DeepEqual([]string{"a.jpg", "dir/e.jpg"}, names) {
+		t.Errorf("Unexpected transferred files %v", names)
+	}
+	// The excluded file is not deleted.
+	fileExists(t, filepath.Join(temp, "local.tmp"))
+}
+
+func TestSyncFilter(t *testing.T) {
+	temp, err := ioutil.TempDir("", "s3synctest")
+	if err != nil {
+		t.Fatal("Failed to create temp dir")
+	}
+	defer os.RemoveAll(temp)
+	writeFile(t, filepath.Join(temp, "local.jpg"), "local")
+	writeFile(t, filepath.Join(temp, "orphan.txt"), "orphan")
+
+	client := newFakeS3()
+	for _, key := range []string{"a.txt", "b.jpg", "dir/c.txt", "dir/d.jpg"} {
+		client.putObject("example-bucket", key, []byte("data"), time.Now())
+	}
+	client.putObject("example-bucket", "e.tmp.txt", []byte("data"), time.Now())
+
+	var names []string
+	m := &Manager{s3: client, option: Option{
+		Exclude: []string{"*.tmp.txt"},
+		Filter: func(info FileInfo) bool {
+			names = append(names, info.Name)
+			return filepath.Ext(info.Name) == ".txt" && info.Size < 10
+		},
+		Delete: true,
+	}}
+	result, err := m.SyncWithResult("s3://example-bucket", temp)
+	if err != nil {
+		t.Fatal("Sync should be successful", err)
+	}
+	if names := fileInfoNames(result.Transferred); !reflect.DeepEqual([]string{"a.txt", "dir/c.txt"}, names) {
+		t.Errorf("Only the .txt files should be transferred, got %v", names)
+	}
+	for _, name := range names {
+		if name == "e.tmp.txt" {
+			t.Error("The excluded file should not be passed to the filter")
+		}
+	}
+	// The destination file dropped by the filter is not deleted.
+	fileExists(t, filepath.Join(temp, "local.jpg"))
+	fileNotExists(t, filepath.Join(temp, "orphan.txt"))
+}
+
+func TestFilterKeepsDest(t *testing.T) {
+	small := func(info FileInfo) bool { return info.Size < 10 }
+	testCases := map[string]struct {
+		option       Option
+		deleteOrphan bool
+	}{
+		"Filter":        {option: Option{Filter: small, Delete: true}},
+		"ObjectFilter":  {option: Option{ObjectFilter: func(info FileInfo) (FileInfo, bool) { return info, small(info) }, Delete: true}},
+		"DeleteOrphans": {option: Option{Filter: small}, deleteOrphan: true},
+	}
+	for name, tt := range testCases {
+		t.Run(name, func(t *testing.T) {
+			temp, err := ioutil.TempDir("", "s3synctest")
+			if err != nil {
+				t.Fatal("Failed to create temp dir")
+			}
+			defer os.RemoveAll(temp)
+			// The local file is kept by the filter, but its object is dropped.
+			writeFile(t, filepath.Join(temp, "large.txt"), "small")
+			writeFile(t, filepath.Join(temp, "orphan.txt"), "orphan")
+
+			client := newFakeS3()
+			client.putObject("example-bucket", "large.txt", []byte("large content"), time.Now())
+
+			m := &Manager{s3: client, option: tt.option}
+			if tt.deleteOrphan {
+				_, err = m.DeleteOrphans("s3://example-bucket", temp, false)
+			} else {
+				err = m.Sync("s3://example-bucket", temp)
+			}
+			if err != nil {
+				t.Fatal("Sync should be successful", err)
+			}
+			fileExists(t, filepath.Join(temp, "large.txt"))
+			fileNotExists(t, filepath.Join(temp, "orphan.txt"))
+		})
+	}
+}
+
+func TestSyncModifiedWindow(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+	after, before := now.Add(-24*time.Hour), now.Add(-time.Hour)
+
+	testCases := map[string]struct {
+		option   Option
+		expected []string
+	}{
+		"NoBound":     {Option{}, []string{"new.txt", "old.txt", "recent.txt"}},
+		"After":       {Option{ModifiedAfter: after}, []string{"new.txt", "recent.txt"}},
+		"Before":      {Option{ModifiedBefore: before}, []string{"old.txt", "recent.txt"}},
+		"AfterBefore": {Option{ModifiedAfter: after, ModifiedBefore: before}, []string{"recent.txt"}},
+		"Exact":       {Option{ModifiedAfter: now, ModifiedBefore: now.Add(time.Second)}, []string{"new.txt"}},
+	}
+	for name, tt := range testCases {
+		t.Run(name, func(t *testing.T) {
+			temp, err := ioutil.TempDir("", "s3synctest")
+			if err != nil {
+				t.Fatal("Failed to create temp dir")
+			}
+			defer os.RemoveAll(temp)
+			// The destination file out of the window is not deleted.
+			writeFile(t, filepath.Join(temp, "old.txt"), "local")
+			if err := os.Chtimes(filepath.Join(temp, "old.txt"), after.Add(-time.Hour), after.Add(-time.Hour)); err != nil {
+				t.Fatal(err)
+			}
+
+			client := newFakeS3()
+			client.putObject("example-bucket", "old.txt", []byte("old"), now.Add(-48*time.Hour))
+			client.putObject("example-bucket", "recent.txt", []byte("recent"), now.Add(-2*time.Hour))
+			client.putObject("example-bucket", "new.txt", []byte("new"), now)
+
+			tt.option.Delete = true
+			m := &Manager{s3: client, option: tt.option}
+			result, err := m.SyncWithResult("s3://example-bucket", temp)
+			if err != nil {
+				t.Fatal("Sync should be successful", err)
+			}
+			if names := fileInfoNames(result.Transferred); !reflect.DeepEqual(tt.expected, names) {
+				t.Errorf("Expected transferred files %v, got %v", tt.expected, names)
+			}
+			fileExists(t, filepath.Join(temp, "old.txt"))
+		})
+	}
+}
+
+func TestModifiedWindowKeepsDest(t *testing.T) {
+	now := time.Now().Truncate(time.Second)
+	after := now.Add(-24 * time.Hour)
+
+	t.Run("Upload", func(t *testing.T) {
+		temp, err := ioutil.TempDir("", "s3synctest")
+		if err != nil {
+			t.Fatal("Failed to create temp dir")
+		}
+		defer os.RemoveAll(temp)
+		writeFile(t, filepath.Join(temp, "old.txt"), "old")
+		if err := os.Chtimes(filepath.Join(temp, "old.txt"), after.Add(-time.Hour), after.Add(-time.Hour)); err != nil {
+			t.Fatal(err)
+		}
+		writeFile(t, filepath.Join(temp, "new.txt"), "new")
+
+		// The object uploaded by the previous sync is newer than the local file.
+		client := newFakeS3()
+		client.putObject("example-bucket", "old.txt", []byte("old"), now)
+		client.putObject("example-bucket", "extra.txt", []byte("extra"), now)
+
+		m := &Manager{s3: client, option: Option{Delete: true, ModifiedAfter: after}}
+		result, err := m.SyncWithResult(temp, "s3://example-bucket")
+		if err != nil {
+			t.Fatal("Sync should be successful", err)
+		}
+		if names := fileInfoNames(result.Deleted); !reflect.DeepEqual([]string{"extra.txt"}, names) {
+			t.Errorf("Expected deleted files %v, got %v", []string{"extra.txt"}, names)
+		}
+		if _, ok := client.getObject("example-bucket", "old.txt"); !ok {
+			t.Error("The object of the file out of the window should be kept")
+		}
+	})
+	t.Run("DeleteOrphans", func(t *testing.T) {
+		temp, err := ioutil.TempDir("", "s3synctest")
+		if err != nil {
+			t.Fatal("Failed to create temp dir")
+		}
+		defer os.RemoveAll(temp)
+		// The file downloaded by the previous sync is newer than the object.
+		writeFile(t, filepath.Join(temp, "old.txt"), "old")
+		writeFile(t, filepath.Join(temp, "orphan.txt"), "orphan")
+
+		client := newFakeS3()
+		client.putObject("example-bucket", "old.txt", []byte("old"), after.Add(-time.Hour))
+
+		m := &Manager{s3: client, option: Option{ModifiedAfter: after}}
+		removed, err := m.DeleteOrphans("s3://example-bucket", temp, false)
+		if err != nil {
+			t.Fatal("DeleteOrphans should be successful", err)
+		}
+		if expected := []string{filepath.Join(temp, "orphan.txt")}; !reflect.DeepEqual(expected, removed) {
+			t.Errorf("Expected removed files %v, got %v", expected, removed)
+		}
+		fileExists(t, filepath.Join(temp, "old.txt"))
+	})
+}
+
+func TestSyncInvalidPattern(t *testing.T) {
+	m := &Manager{s3: newFakeS3(), option: Option{Exclude: []string{"dir/[a"}}}
+	if err := m.Sync("s3://example-bucket", "dest"); err == nil {
+		t.Error("The invalid pattern should be rejected")
+	}
+}
+
+func TestReadIgnoreFile(t *testing.T) {
+	temp, err := ioutil.TempDir("", "s3synctest")
+	if err != nil {
+		t.Fatal("Failed to create temp dir")
+	}
+	defer os.RemoveAll(temp)
+
+	filename := filepath.Join(temp, ".s3syncignore")
+	writeFile(t, filename, "# build outputs\n*.o\n\n  build/  \n#*.txt\nlogs/**\r\n")
+	patterns, err := readIgnoreFile(osFileSystem{}, filename)
+	if err != nil {
+		t.Fatal("readIgnoreFile should be successful", err)
+	}
+	if expected := []string{"*.o", "build/", "logs/**"}; !reflect.DeepEqual(expected, patterns) {
+		t.Errorf("Expected patterns %v, got %v", expected, patterns)
+	}
+}
+
+func TestSyncIgnoreFile(t *testing.T) {
+	temp, err := ioutil.TempDir("", "s3synctest")
+	if err != nil {
+		t.Fatal("Failed to create temp dir")
+	}
+	defer os.RemoveAll(temp)
+
+	t.Run("Upload", func(t *testing.T) {
+		source := filepath.Join(temp, "upload")
+		writeFile(t, filepath.Join(source, ".s3syncignore"), "# objects\n*.o\nbuild/\n")
+		for _, name := range []string{"a.c", "a.o", "build/b.c", "src/c.c", "src/c.o"} {
+			writeFile(t, filepath.Join(source, name), "data")
+		}
+
+		client := newFakeS3()
+		client.createBucket("example-bucket")
+		m := &Manager{s3: client, option: Option{UseIgnoreFile: true}}
+		result, err := m.SyncWithResult(source, "s3://example-bucket")
+		if err != nil {
+			t.Fatal("Sync should be successful", err)
+		}
+		names := fileInfoNames(result.Transferred)
+		sort.Strings(names)
+		if expected := []string{"a.c", "src/c.c"}; !reflect.DeepEqual(expected, names) {
+			t.Errorf("Expected transferred files %v, got %v", expected, names)
+		}
+	})
+
+	t.Run("Download", func(t *testing.T) {
+		dest := filepath.Join(temp, "download")
+		writeFile(t, filepath.Join(dest, ".syncignore"), "*.log\n")
+		writeFile(t, filepath.Join(dest, "local.log"), "local")
+
+		client := newFakeS3()
+		for _, key := range []string{"a.txt", "b.log", "dir/c.log"} {
+			client.putObject("example-bucket", key, []byte("data"), time.Now())
+		}
+		m := &Manager{s3: client, option: Option{UseIgnoreFile: true, IgnoreFileName: ".syncignore", Delete: true}}
+		result, err := m.SyncWithResult("s3://example-bucket", dest)
+		if err != nil {
+			t.Fatal("Sync should be successful", err)
+		}
+		if names := fileInfoNames(result.Transferred); !reflect.DeepEqual([]string{"a.txt"}, names) {
+			t.Errorf("Unexpected transferred files %v", names)
+		}
+		// Neither the ignored file nor the ignore file is deleted.
+		fileExists(t, filepath.Join(dest, "local.log"))
+		fileExists(t, filepath.Join(dest, ".syncignore"))
+	})
+
+	t.Run("InvalidPattern", func(t *testing.T) {
+		source := filepath.Join(temp, "invalid")
+		writeFile(t, filepath.Join(source, ".s3syncignore"), "dir/[a\n")
+		m := &Manager{s3: newFakeS3(), option: Option{UseIgnoreFile: true}}
+		if err := m.Sync(source, "s3://example-bucket"); err == nil {
+			t.Error("The invalid pattern should be rejected")
+		}
+	})
+}
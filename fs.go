@@ -0,0 +1,117 @@
+// Copyright 2019 SEQSENSE, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package s3sync
+
+import (
+	"io"
+	"os"
+	"time"
+)
+
+// FileSystem is the local side of the sync, which is the OS filesystem by default.
+// Option.FileSystem replaces it, e.g. by an in-memory filesystem for the tests
+// or a custom storage. The paths are separated by the slash or the os path separator.
+type FileSystem interface {
+	// Open opens the file to read.
+	Open(name string) (File, error)
+	// OpenFile opens the file by the flags of os.OpenFile, e.g. to create the file.
+	OpenFile(name string, flag int, perm os.FileMode) (File, error)
+	// Stat returns the info of the file, following the symbolic link.
+	Stat(name string) (os.FileInfo, error)
+	// ReadDir returns the infos of the entries of the directory sorted by the names.
+	// The infos of the symbolic links are of the links themselves.
+	ReadDir(name string) ([]os.FileInfo, error)
+	// MkdirAll creates the directory and its missing parents. It does nothing
+	// if the directory already exists.
+	MkdirAll(path string, perm os.FileMode) error
+	// Rename moves the file, replacing the existing newpath.
+	Rename(oldpath, newpath string) error
+	// Remove removes the file or the empty directory.
+	Remove(name string) error
+	// RemoveAll removes the path and its children. It returns nil if the path
+	// doesn't exist.
+	RemoveAll(path string) error
+	// Chtimes changes the access and the modification times of the file.
+	Chtimes(name string, atime, mtime time.Time) error
+}
+
+// File is the file opened by FileSystem.
+type File interface {
+	io.Reader
+	io.ReaderAt
+	io.Seeker
+	io.WriterAt
+	io.Closer
+	// Stat returns the info of the file.
+	Stat() (os.FileInfo, error)
+	// Truncate changes the size of the file, e.g. to discard the partial download.
+	Truncate(size int64) error
+	// Chmod changes the mode of the file.
+	Chmod(mode os.FileMode) error
+}
+
+// osFileSystem is the FileSystem of the os package.
+type osFileSystem struct{}
+
+func (osFileSystem) Open(name string) (File, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		// Not to return the nil *os.File as the non-nil File.
+		return nil, err
+	}
+	return f, nil
+}
+
+func (osFileSystem) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	f, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (osFileSystem) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(name)
+}
+
+func (osFileSystem) ReadDir(name string) ([]os.FileInfo, error) {
+	return readDir(name)
+}
+
+func (osFileSystem) MkdirAll(path string, perm os.FileMode) error {
+	return os.MkdirAll(path, perm)
+}
+
+func (osFileSystem) Rename(oldpath, newpath string) error {
+	return os.Rename(oldpath, newpath)
+}
+
+func (osFileSystem) Remove(name string) error {
+	return os.Remove(name)
+}
+
+func (osFileSystem) RemoveAll(path string) error {
+	return os.RemoveAll(path)
+}
+
+func (osFileSystem) Chtimes(name string, atime, mtime time.Time) error {
+	return os.Chtimes(name, atime, mtime)
+}
+
+// fs returns Option.FileSystem, or the OS filesystem if it isn't set.
+func (m *Manager) fs() FileSystem {
+	if m.option.FileSystem != nil {
+		return m.option.FileSystem
+	}
+	return osFileSystem{}
+}
@@ -0,0 +1,343 @@
+// Copyright 2019 SEQSENSE, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package s3sync
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memFileSystem is the in-memory FileSystem for the tests.
+type memFileSystem struct {
+	mu    sync.Mutex
+	files map[string]*memFile
+}
+
+type memFile struct {
+	data    []byte
+	dir     bool
+	mode    os.FileMode
+	modTime time.Time
+}
+
+func newMemFileSystem() *memFileSystem {
+	return &memFileSystem{files: map[string]*memFile{
+		string(filepath.Separator): {dir: true, mode: os.ModeDir | 0755},
+	}}
+}
+
+func memPath(name string) string {
+	return filepath.Clean(filepath.FromSlash(name))
+}
+
+func (fs *memFileSystem) Open(name string) (File, error) {
+	return fs.OpenFile(name, os.O_RDONLY, 0)
+}
+
+func (fs *memFileSystem) OpenFile(name string, flag int, perm os.FileMode) (File, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	name = memPath(name)
+	f, ok := fs.files[name]
+	switch {
+	case ok && flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL:
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrExist}
+	case ok && f.dir && flag&(os.O_WRONLY|os.O_RDWR) != 0:
+		return nil, &os.PathError{Op: "open", Path: name, Err: errors.New("is a directory")}
+	case !ok && flag&os.O_CREATE == 0:
+		return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+	case !ok:
+		if parent, ok := fs.files[filepath.Dir(name)]; !ok || !parent.dir {
+			return nil, &os.PathError{Op: "open", Path: name, Err: os.ErrNotExist}
+		}
+		f = &memFile{mode: perm, modTime: time.Now()}
+		fs.files[name] = f
+	}
+	if flag&os.O_TRUNC != 0 {
+		f.data = nil
+	}
+	return &memHandle{fs: fs, name: name, file: f}, nil
+}
+
+func (fs *memFileSystem) Stat(name string) (os.FileInfo, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	name = memPath(name)
+	f, ok := fs.files[name]
+	if !ok {
+		return nil, &os.PathError{Op: "stat", Path: name, Err: os.ErrNotExist}
+	}
+	return f.info(name), nil
+}
+
+func (fs *memFileSystem) ReadDir(name string) ([]os.FileInfo, error) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	name = memPath(name)
+	if f, ok := fs.files[name]; !ok || !f.dir {
+		return nil, &os.PathError{Op: "readdir", Path: name, Err: os.ErrNotExist}
+	}
+	var infos []os.FileInfo
+	for p, f := range fs.files {
+		if p != name && filepath.Dir(p) == name {
+			infos = append(infos, f.info(p))
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+	return infos, nil
+}
+
+func (fs *memFileSystem) MkdirAll(path string, perm os.FileMode) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	for p := memPath(path); ; p = filepath.Dir(p) {
+		if f, ok := fs.files[p]; ok {
+			if !f.dir {
+				return &os.PathError{Op: "mkdir", Path: p, Err: errors.New("not a directory")}
+			}
+			return nil
+		}
+		fs.files[p] = &memFile{dir: true, mode: os.ModeDir | perm, modTime: time.Now()}
+	}
+}
+
+func (fs *memFileSystem) Rename(oldpath, newpath string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	oldpath, newpath = memPath(oldpath), memPath(newpath)
+	f, ok := fs.files[oldpath]
+	if !ok || f.dir {
+		return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: os.ErrNotExist}
+	}
+	delete(fs.files, oldpath)
+	fs.files[newpath] = f
+	return nil
+}
+
+func (fs *memFileSystem) Remove(name string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	name = memPath(name)
+	if _, ok := fs.files[name]; !ok {
+		return &os.PathError{Op: "remove", Path: name, Err: os.ErrNotExist}
+	}
+	for p := range fs.files {
+		if p != name && filepath.Dir(p) == name {
+			return &os.PathError{Op: "remove", Path: name, Err: errors.New("directory not empty")}
+		}
+	}
+	delete(fs.files, name)
+	return nil
+}
+
+func (fs *memFileSystem) RemoveAll(path string) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	path = memPath(path)
+	for p := range fs.files {
+		if p == path || strings.HasPrefix(p, path+string(filepath.Separator)) {
+			delete(fs.files, p)
+		}
+	}
+	return nil
+}
+
+func (fs *memFileSystem) Chtimes(name string, atime, mtime time.Time) error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	name = memPath(name)
+	f, ok := fs.files[name]
+	if !ok {
+		return &os.PathError{Op: "chtimes", Path: name, Err: os.ErrNotExist}
+	}
+	f.modTime = mtime
+	return nil
+}
+
+func (fs *memFileSystem) writeFile(name, content string, modTime time.Time) {
+	if err := fs.MkdirAll(filepath.Dir(memPath(name)), 0755); err != nil {
+		panic(err)
+	}
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	fs.files[memPath(name)] = &memFile{data: []byte(content), mode: 0644, modTime: modTime}
+}
+
+func (fs *memFileSystem) content(name string) (string, bool) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	f, ok := fs.files[memPath(name)]
+	if !ok || f.dir {
+		return "", false
+	}
+	return string(f.data), true
+}
+
+func (f *memFile) info(name string) os.FileInfo {
+	return &memFileInfo{name: filepath.Base(name), size: int64(len(f.data)), mode: f.mode, modTime: f.modTime}
+}
+
+type memFileInfo struct {
+	name    string
+	size    int64
+	mode    os.FileMode
+	modTime time.Time
+}
+
+func (i *memFileInfo) Name() string       { return i.name }
+func (i *memFileInfo) Size() int64        { return i.size }
+func (i *memFileInfo) Mode() os.FileMode  { return i.mode }
+func (i *memFileInfo) ModTime() time.Time { return i.modTime }
+func (i *memFileInfo) IsDir() bool        { return i.mode.IsDir() }
+func (i *memFileInfo) Sys() interface{}   { return nil }
+
+// memHandle is the File opened by memFileSystem.
+type memHandle struct {
+	fs     *memFileSystem
+	name   string
+	file   *memFile
+	offset int64
+}
+
+func (h *memHandle) Read(p []byte) (int, error) {
+	n, err := h.ReadAt(p, h.offset)
+	h.offset += int64(n)
+	return n, err
+}
+
+func (h *memHandle) ReadAt(p []byte, off int64) (int, error) {
+	h.fs.mu.Lock()
+	defer h.fs.mu.Unlock()
+	if off >= int64(len(h.file.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, h.file.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (h *memHandle) Seek(offset int64, whence int) (int64, error) {
+	h.fs.mu.Lock()
+	defer h.fs.mu.Unlock()
+	switch whence {
+	case io.SeekCurrent:
+		offset += h.offset
+	case io.SeekEnd:
+		offset += int64(len(h.file.data))
+	}
+	if offset < 0 {
+		return 0, errors.New("negative offset")
+	}
+	h.offset = offset
+	return offset, nil
+}
+
+func (h *memHandle) WriteAt(p []byte, off int64) (int, error) {
+	h.fs.mu.Lock()
+	defer h.fs.mu.Unlock()
+	if end := off + int64(len(p)); end > int64(len(h.file.data)) {
+		h.file.data = append(h.file.data, make([]byte, end-int64(len(h.file.data)))...)
+	}
+	copy(h.file.data[off:], p)
+	h.file.modTime = time.Now()
+	return len(p), nil
+}
+
+func (h *memHandle) Close() error { return nil }
+
+func (h *memHandle) Stat() (os.FileInfo, error) {
+	h.fs.mu.Lock()
+	defer h.fs.mu.Unlock()
+	return h.file.info(h.name), nil
+}
+
+func (h *memHandle) Truncate(size int64) error {
+	h.fs.mu.Lock()
+	defer h.fs.mu.Unlock()
+	if size < int64(len(h.file.data)) {
+		h.file.data = h.file.data[:size]
+	} else {
+		h.file.data = append(h.file.data, make([]byte, size-int64(len(h.file.data)))...)
+	}
+	return nil
+}
+
+func (h *memHandle) Chmod(mode os.FileMode) error {
+	h.fs.mu.Lock()
+	defer h.fs.mu.Unlock()
+	h.file.mode = mode
+	return nil
+}
+
+func TestSyncFileSystem(t *testing.T) {
+	dest := filepath.Join(os.TempDir(), "s3synctest-memfs")
+	fs := newMemFileSystem()
+	fs.writeFile(filepath.Join(dest, "orphan.txt"), "orphan", time.Now())
+
+	client := newFakeS3()
+	modTime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	client.putObject("example-bucket", "a.txt", []byte("aaa"), modTime)
+	client.putObject("example-bucket", "dir/b.txt", bytes.Repeat([]byte("b"), 100), modTime)
+
+	m := &Manager{s3: client, option: Option{FileSystem: fs, Delete: true}}
+	result, err := m.SyncWithResult("s3://example-bucket", dest)
+	if err != nil {
+		t.Fatal("Sync should be successful", err)
+	}
+	if names := fileInfoNames(result.Transferred); !reflect.DeepEqual([]string{"a.txt", "dir/b.txt"}, names) {
+		t.Errorf("All the objects should be downloaded, got %v", names)
+	}
+	if content, ok := fs.content(filepath.Join(dest, "a.txt")); !ok || content != "aaa" {
+		t.Errorf("a.txt should be downloaded to the filesystem, got %q", content)
+	}
+	if content, ok := fs.content(filepath.Join(dest, "dir", "b.txt")); !ok || len(content) != 100 {
+		t.Errorf("dir/b.txt should be downloaded to the filesystem, got %d bytes", len(content))
+	}
+	if _, ok := fs.content(filepath.Join(dest, "orphan.txt")); ok {
+		t.Error("The extra file should be deleted from the filesystem")
+	}
+	if stat, err := fs.Stat(filepath.Join(dest, "a.txt")); err != nil || !stat.ModTime().Equal(modTime) {
+		t.Error("The modification time of the object should be kept", err)
+	}
+	if _, err := os.Stat(dest); !os.IsNotExist(err) {
+		t.Error("The OS filesystem should not be touched", err)
+	}
+
+	// The second sync compares the files on the filesystem.
+	result, err = m.SyncWithResult("s3://example-bucket", dest)
+	if err != nil {
+		t.Fatal("Sync should be successful", err)
+	}
+	if len(result.Transferred) != 0 {
+		t.Errorf("The synced files should not be transferred again, got %v", fileInfoNames(result.Transferred))
+	}
+
+	// The files are uploaded from the filesystem.
+	if err := m.Sync(dest, "s3://example-bucket/copy"); err != nil {
+		t.Fatal("Sync should be successful", err)
+	}
+	if object, ok := client.getObject("example-bucket", "copy/dir/b.txt"); !ok || len(object.data) != 100 {
+		t.Error("dir/b.txt should be uploaded from the filesystem")
+	}
+}
@@ -12,8 +12,6 @@
 // limitations under the License.
 package s3sync
 
-import "log"
-
 // LoggerIF is the logger interface which this library requires.
 type LoggerIF interface {
 	// Log inserts a log entry. Arguments are handled in the manner
@@ -24,18 +22,50 @@ type LoggerIF interface {
 	Logf(format string, v ...interface{})
 }
 
-// Logger is the logger instance.
-var logger LoggerIF
+// Logger is the logger instance, which discards the logs by default.
+var logger LoggerIF = NopLogger{}
 
-// SetLogger sets the logger.
+// SetLogger sets the package logger used by the Managers without Option.Logger.
+// The nil logger restores the default which discards the logs.
 func SetLogger(l LoggerIF) {
+	if l == nil {
+		l = NopLogger{}
+	}
 	logger = l
 }
 
+// NopLogger is the logger which discards all the log entries.
+// It can be set to Option.Logger to silence a Manager.
+type NopLogger struct{}
+
+// Log discards the log entry.
+func (NopLogger) Log(v ...interface{}) {}
+
+// Logf discards the log entry.
+func (NopLogger) Logf(format string, v ...interface{}) {}
+
 func println(v ...interface{}) {
-	if logger == nil {
-		log.Println(v...)
+	logger.Log(v...)
+}
+
+func printf(format string, v ...interface{}) {
+	logger.Logf(format, v...)
+}
+
+// println logs to Option.Logger, or to the package logger if it is nil.
+func (m *Manager) println(v ...interface{}) {
+	if m.option.Logger != nil {
+		m.option.Logger.Log(v...)
 		return
 	}
-	logger.Log(v...)
+	println(v...)
+}
+
+// printf logs to Option.Logger, or to the package logger if it is nil.
+func (m *Manager) printf(format string, v ...interface{}) {
+	if m.option.Logger != nil {
+		m.option.Logger.Logf(format, v...)
+		return
+	}
+	printf(format, v...)
 }
@@ -0,0 +1,87 @@
+// Copyright 2019 SEQSENSE, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package s3sync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// SyncMapping maps a s3 prefix to a directory of the local tree.
+type SyncMapping struct {
+	// S3 is the s3 url of the prefix.
+	S3 string
+	// LocalDir is the directory relative to the local root.
+	LocalDir string
+	// Upload syncs the local directory to the s3 prefix instead of downloading.
+	Upload bool
+}
+
+// SyncMappings syncs each of the mappings between the s3 prefix and the directory
+// under localRoot, and returns the merged result. The names in the result are
+// relative to localRoot. The local directories must not overlap each other not to
+// collide the files of the different prefixes.
+// The remaining mappings are synced even if one of them fails.
+func (m *Manager) SyncMappings(localRoot string, mappings []SyncMapping) (*SyncResult, error) {
+	if err := validateSyncMappings(mappings); err != nil {
+		return nil, err
+	}
+
+	recorder := &syncRecorder{}
+	var errMsgs []string
+	for _, mapping := range mappings {
+		local := filepath.Join(localRoot, mapping.LocalDir)
+		source, dest := mapping.S3, local
+		if mapping.Upload {
+			source, dest = local, mapping.S3
+		}
+
+		mappingRecorder := &syncRecorder{}
+		if err := m.sync(context.Background(), source, dest, mappingRecorder); err != nil {
+			errMsgs = append(errMsgs, fmt.Sprintf("%s: %v", mapping.S3, err))
+		}
+		recorder.merge(mappingRecorder, filepath.Clean(mapping.LocalDir))
+	}
+
+	if len(errMsgs) > 0 {
+		return recorder.result(), errors.New(strings.Join(errMsgs, "\n"))
+	}
+	return recorder.result(), nil
+}
+
+// validateSyncMappings validates that the local directories of the mappings
+// are under the root and don't overlap each other.
+func validateSyncMappings(mappings []SyncMapping) error {
+	dirs := make([]string, len(mappings))
+	for i, mapping := range mappings {
+		dir := filepath.Clean(mapping.LocalDir)
+		if filepath.IsAbs(dir) || dir == ".." || strings.HasPrefix(dir, ".."+string(filepath.Separator)) {
+			return fmt.Errorf("LocalDir %s must be relative to the local root", mapping.LocalDir)
+		}
+		for _, other := range dirs[:i] {
+			if isSameOrUnder(dir, other) || isSameOrUnder(other, dir) {
+				return fmt.Errorf("LocalDir %s overlaps %s", mapping.LocalDir, other)
+			}
+		}
+		dirs[i] = dir
+	}
+	return nil
+}
+
+// isSameOrUnder returns true if the cleaned path is dir itself or under dir.
+func isSameOrUnder(path, dir string) bool {
+	return dir == "." || path == dir || strings.HasPrefix(path, dir+string(filepath.Separator))
+}
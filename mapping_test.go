@@ -0,0 +1,127 @@
+// Copyright 2019 SEQSENSE, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package s3sync
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSyncMappings(t *testing.T) {
+	temp, err := ioutil.TempDir("", "s3synctest")
+	if err != nil {
+		t.Fatal("Failed to create temp dir")
+	}
+	defer os.RemoveAll(temp)
+
+	client := newFakeS3()
+	// Both prefixes have the same names.
+	client.putObject("bucket1", "logs/a.txt", []byte("bucket1 a"), time.Now())
+	client.putObject("bucket1", "logs/dir/b.txt", []byte("bucket1 b"), time.Now())
+	client.putObject("bucket2", "archive/a.txt", []byte("bucket2 a"), time.Now())
+	client.putObject("bucket2", "archive/c.txt", []byte("bucket2 c"), time.Now().Add(-time.Hour))
+	writeFile(t, filepath.Join(temp, "merged/two/c.txt"), "bucket2 c")
+
+	m := &Manager{s3: client}
+	result, err := m.SyncMappings(temp, []SyncMapping{
+		{S3: "s3://bucket1/logs", LocalDir: "merged/one"},
+		{S3: "s3://bucket2/archive", LocalDir: "merged/two"},
+	})
+	if err != nil {
+		t.Fatal("SyncMappings should be successful", err)
+	}
+
+	for name, data := range map[string]string{
+		"merged/one/a.txt":     "bucket1 a",
+		"merged/one/dir/b.txt": "bucket1 b",
+		"merged/two/a.txt":     "bucket2 a",
+		"merged/two/c.txt":     "bucket2 c",
+	} {
+		actual, err := ioutil.ReadFile(filepath.Join(temp, name))
+		if err != nil || string(actual) != data {
+			t.Errorf("%s should have %q, actual: %q", name, data, actual)
+		}
+	}
+
+	var transferred, skipped []string
+	for _, file := range result.Transferred {
+		transferred = append(transferred, filepath.ToSlash(file.Name))
+	}
+	for _, file := range result.Skipped {
+		skipped = append(skipped, filepath.ToSlash(file.Name))
+	}
+	if expected := []string{"merged/one/a.txt", "merged/one/dir/b.txt", "merged/two/a.txt"}; !reflect.DeepEqual(expected, transferred) {
+		t.Errorf("Expected transferred: %v, actual: %v", expected, transferred)
+	}
+	if expected := []string{"merged/two/c.txt"}; !reflect.DeepEqual(expected, skipped) {
+		t.Errorf("Expected skipped: %v, actual: %v", expected, skipped)
+	}
+}
+
+func TestSyncMappingsPartialFailure(t *testing.T) {
+	temp, err := ioutil.TempDir("", "s3synctest")
+	if err != nil {
+		t.Fatal("Failed to create temp dir")
+	}
+	defer os.RemoveAll(temp)
+
+	client := newFakeS3()
+	client.putObject("bucket1", "a.txt", []byte("a"), time.Now())
+
+	m := &Manager{s3: client}
+	result, err := m.SyncMappings(temp, []SyncMapping{
+		{S3: "s3://missing-bucket", LocalDir: "missing"},
+		{S3: "s3://bucket1", LocalDir: "one"},
+	})
+	if err == nil {
+		t.Fatal("The failure of the missing bucket should be returned")
+	}
+	if len(result.Transferred) != 1 {
+		t.Error("The other mapping should be synced", result.Transferred)
+	}
+	fileExists(t, filepath.Join(temp, "one/a.txt"))
+}
+
+func TestValidateSyncMappings(t *testing.T) {
+	testCases := map[string]struct {
+		dirs  []string
+		valid bool
+	}{
+		"Siblings": {[]string{"a", "b", "ab"}, true},
+		"Same":     {[]string{"a", "a/"}, false},
+		"Nested":   {[]string{"a", "a/b"}, false},
+		"Parent":   {[]string{"a/b", "a"}, false},
+		"Root":     {[]string{".", "a"}, false},
+		"Outside":  {[]string{"../a"}, false},
+		"Absolute": {[]string{filepath.Join(os.TempDir(), "a")}, false},
+	}
+	for name, tt := range testCases {
+		t.Run(name, func(t *testing.T) {
+			var mappings []SyncMapping
+			for _, dir := range tt.dirs {
+				mappings = append(mappings, SyncMapping{S3: "s3://bucket/" + dir, LocalDir: filepath.FromSlash(dir)})
+			}
+			err := validateSyncMappings(mappings)
+			if tt.valid && err != nil {
+				t.Error("The mappings should be valid", err)
+			}
+			if !tt.valid && err == nil {
+				t.Error("The mappings should be invalid")
+			}
+		})
+	}
+}
@@ -0,0 +1,150 @@
+// Copyright 2019 SEQSENSE, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package s3sync
+
+import (
+	"context"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// listFolderMarkers returns the slash separated names of the folder markers,
+// the zero-byte objects with the trailing slash, under the s3 path.
+// The listing of the files drops the markers, so they are listed separately.
+func (m *Manager) listFolderMarkers(ctx context.Context, p *s3Path) (map[string]struct{}, error) {
+	markers := make(map[string]struct{})
+	var token *string
+	for {
+		var list *s3.ListObjectsV2Output
+		err := m.retry(ctx, func() error {
+			var err error
+			list, err = m.s3.ListObjectsV2WithContext(ctx, &s3.ListObjectsV2Input{
+				Bucket:            aws.String(p.bucket),
+				Prefix:            aws.String(p.listPrefix()),
+				ContinuationToken: token,
+				MaxKeys:           m.maxKeys(),
+				RequestPayer:      m.requestPayer(),
+			})
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, object := range list.Contents {
+			key := aws.StringValue(object.Key)
+			if !strings.HasSuffix(key, "/") || aws.Int64Value(object.Size) != 0 || !p.match(key) {
+				continue
+			}
+			dir := strings.TrimSuffix(key, "/")
+			if dir == strings.TrimSuffix(p.bucketPrefix, "/") {
+				// The marker of the prefix itself.
+				continue
+			}
+			if name, ok := relativeKey(p.bucketPrefix, dir); ok {
+				markers[name] = struct{}{}
+			}
+		}
+		if token = nextContinuationToken(list); token == nil {
+			return markers, nil
+		}
+	}
+}
+
+// uploadFolderMarkers creates the folder marker of each empty directory under the
+// local path, which doesn't exist in the dest s3 path yet.
+func (m *Manager) uploadFolderMarkers(ctx context.Context, localPath string, destPath *s3Path) error {
+	dirs, err := listEmptyDirs(m.fs(), localPath, localPath, nil)
+	if err != nil || len(dirs) == 0 {
+		return err
+	}
+
+	markers, err := m.listFolderMarkers(ctx, destPath)
+	if err != nil {
+		return err
+	}
+	for _, dir := range dirs {
+		dir = m.toS3Name(filepath.ToSlash(dir))
+		if _, ok := markers[dir]; ok {
+			continue
+		}
+		key := path.Join(destPath.bucketPrefix, dir) + "/"
+		if m.option.DryRun {
+			m.println("Would create the folder marker", "s3://"+destPath.bucket+"/"+key)
+			continue
+		}
+		m.println("Creating the folder marker", "s3://"+destPath.bucket+"/"+key)
+		sse := m.sseCustomer()
+		_, err := m.s3.PutObjectWithContext(ctx, &s3.PutObjectInput{
+			Bucket:               aws.String(destPath.bucket),
+			Key:                  aws.String(key),
+			Body:                 strings.NewReader(""),
+			RequestPayer:         m.requestPayer(),
+			SSECustomerAlgorithm: sse.algorithm,
+			SSECustomerKey:       sse.key,
+			SSECustomerKeyMD5:    sse.keyMD5,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// listEmptyDirs appends the paths relative to root of the empty directories under dir
+// to dirs, in the lexical order. The symbolic links to the directories are not followed.
+func listEmptyDirs(fs FileSystem, root, dir string, dirs []string) ([]string, error) {
+	entries, err := fs.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 && dir != root {
+		rel, err := filepath.Rel(root, dir)
+		if err != nil {
+			return nil, err
+		}
+		return append(dirs, rel), nil
+	}
+	for _, entry := range entries {
+		if !entry.IsDir() {
+			continue
+		}
+		if dirs, err = listEmptyDirs(fs, root, filepath.Join(dir, entry.Name()), dirs); err != nil {
+			return nil, err
+		}
+	}
+	return dirs, nil
+}
+
+// downloadFolderMarkers creates the local directory of each folder marker under
+// the source s3 path.
+func (m *Manager) downloadFolderMarkers(ctx context.Context, sourcePath *s3Path, destPath string) error {
+	markers, err := m.listFolderMarkers(ctx, sourcePath)
+	if err != nil {
+		return err
+	}
+	for name := range markers {
+		dir := filepath.Join(destPath, filepath.FromSlash(m.toLocalName(name)))
+		if m.option.DryRun {
+			m.println("Would create the directory", dir)
+			continue
+		}
+		if err := m.fs().MkdirAll(dir, m.dirMode()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
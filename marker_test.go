@@ -0,0 +1,100 @@
+// Copyright 2019 SEQSENSE, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package s3sync
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCreateFolderMarkers(t *testing.T) {
+	temp, err := ioutil.TempDir("", "s3synctest")
+	if err != nil {
+		t.Fatal("Failed to create temp dir")
+	}
+	defer os.RemoveAll(temp)
+
+	src := filepath.Join(temp, "src")
+	writeFile(t, filepath.Join(src, "dir", "a.txt"), "a")
+	for _, dir := range []string{"empty", filepath.Join("dir", "empty")} {
+		if err := os.MkdirAll(filepath.Join(src, dir), 0755); err != nil {
+			t.Fatal("Failed to create dir", err)
+		}
+	}
+
+	client := newFakeS3()
+	client.createBucket("example-bucket")
+	// The marker of the prefix itself is not a directory under it.
+	client.putObject("example-bucket", "prefix/", nil, time.Now())
+	m := &Manager{s3: client, option: Option{CreateFolderMarkers: true}}
+	for i := 0; i < 2; i++ {
+		if err := m.Sync(src, "s3://example-bucket/prefix"); err != nil {
+			t.Fatal("Sync should be successful", err)
+		}
+	}
+	for _, key := range []string{"prefix/empty/", "prefix/dir/empty/"} {
+		if object, ok := client.getObject("example-bucket", key); !ok || len(object.data) != 0 {
+			t.Errorf("The folder marker %s should be created", key)
+		}
+	}
+	if _, ok := client.getObject("example-bucket", "prefix/dir/"); ok {
+		t.Error("The marker of the non-empty directory should not be created")
+	}
+	if n := client.count("PutObject"); n != 3 {
+		t.Errorf("The markers should be created once, got %d PutObject", n)
+	}
+
+	dest := filepath.Join(temp, "dest")
+	if err := m.Sync("s3://example-bucket/prefix", dest); err != nil {
+		t.Fatal("Sync should be successful", err)
+	}
+	fileHasContent(t, filepath.Join(dest, "dir", "a.txt"), "a")
+	for _, dir := range []string{"empty", filepath.Join("dir", "empty")} {
+		if stat, err := os.Stat(filepath.Join(dest, dir)); err != nil || !stat.IsDir() {
+			t.Errorf("The empty directory %s should be created", dir)
+		}
+	}
+	fileNotExists(t, filepath.Join(dest, "prefix"))
+
+	// The markers are ignored without the option.
+	dest = filepath.Join(temp, "dest2")
+	if err := (&Manager{s3: client}).Sync("s3://example-bucket/prefix", dest); err != nil {
+		t.Fatal("Sync should be successful", err)
+	}
+	fileNotExists(t, filepath.Join(dest, "empty"))
+}
+
+func TestCreateFolderMarkersFileSystem(t *testing.T) {
+	src := filepath.Join(os.TempDir(), "s3synctest-memfs")
+	fs := newMemFileSystem()
+	fs.writeFile(filepath.Join(src, "dir", "a.txt"), "a", time.Now())
+	if err := fs.MkdirAll(filepath.Join(src, "dir", "empty"), 0755); err != nil {
+		t.Fatal("Failed to create dir", err)
+	}
+
+	client := newFakeS3()
+	client.createBucket("example-bucket")
+	m := &Manager{s3: client, option: Option{FileSystem: fs, CreateFolderMarkers: true}}
+	if err := m.Sync(src, "s3://example-bucket"); err != nil {
+		t.Fatal("Sync should be successful", err)
+	}
+	if object, ok := client.getObject("example-bucket", "dir/empty/"); !ok || len(object.data) != 0 {
+		t.Error("The folder marker of the empty directory on the filesystem should be created")
+	}
+	if _, err := os.Stat(src); !os.IsNotExist(err) {
+		t.Error("The OS filesystem should not be touched", err)
+	}
+}
@@ -0,0 +1,125 @@
+// Copyright 2019 SEQSENSE, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package s3sync
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// metadataSuffix is the suffix of the sidecar file of Option.PreserveMetadata.
+const metadataSuffix = ".s3meta"
+
+// objectMetadata is the content of the sidecar file, which keeps the headers of
+// the downloaded object.
+type objectMetadata struct {
+	Metadata    map[string]string `json:"metadata,omitempty"`
+	ContentType string            `json:"contentType,omitempty"`
+	ETag        string            `json:"etag,omitempty"`
+}
+
+// getObjectRecorder records the first GetObject response of the download, as
+// s3manager.Downloader doesn't return the headers of the object.
+type getObjectRecorder struct {
+	s3iface.S3API
+	mu     sync.Mutex
+	output *s3.GetObjectOutput
+}
+
+func (r *getObjectRecorder) GetObjectWithContext(ctx aws.Context, input *s3.GetObjectInput, opts ...request.Option) (*s3.GetObjectOutput, error) {
+	output, err := r.S3API.GetObjectWithContext(ctx, input, opts...)
+	if err == nil {
+		r.mu.Lock()
+		if r.output == nil {
+			r.output = output
+		}
+		r.mu.Unlock()
+	}
+	return output, err
+}
+
+// writeMetadata writes the headers of the GetObject response to the sidecar file
+// of the local file.
+func (m *Manager) writeMetadata(filename string, output *s3.GetObjectOutput) error {
+	data, err := json.Marshal(&objectMetadata{
+		Metadata:    aws.StringValueMap(output.Metadata),
+		ContentType: aws.StringValue(output.ContentType),
+		ETag:        aws.StringValue(output.ETag),
+	})
+	if err != nil {
+		return err
+	}
+	f, err := m.fs().OpenFile(filename+metadataSuffix, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteAt(data, 0)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// readMetadata reads the sidecar file of the local file, or returns nil if it
+// doesn't exist.
+func (m *Manager) readMetadata(filename string) (*objectMetadata, error) {
+	f, err := m.fs().Open(filename + metadataSuffix)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	var meta objectMetadata
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return nil, err
+	}
+	return &meta, nil
+}
+
+// restoreMetadata sets the metadata and the content type of the sidecar file to
+// the upload input by Option.PreserveMetadata. Option.Metadata and Option.ContentType
+// take precedence over the sidecar file.
+func (m *Manager) restoreMetadata(file *fileInfo, input *s3manager.UploadInput) error {
+	if !m.option.PreserveMetadata {
+		return nil
+	}
+	meta, err := m.readMetadata(file.path)
+	if err != nil || meta == nil {
+		return err
+	}
+	if len(meta.Metadata) > 0 {
+		metadata := aws.StringMap(meta.Metadata)
+		for k, v := range input.Metadata {
+			metadata[k] = v
+		}
+		input.Metadata = metadata
+	}
+	if meta.ContentType != "" && m.option.ContentType == "" {
+		input.ContentType = aws.String(meta.ContentType)
+	}
+	return nil
+}
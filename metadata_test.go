@@ -0,0 +1,206 @@
+// Copyright 2019 SEQSENSE, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package s3sync
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+func TestPreserveMetadata(t *testing.T) {
+	temp, err := ioutil.TempDir("", "s3synctest")
+	if err != nil {
+		t.Fatal("Failed to create temp dir")
+	}
+	defer os.RemoveAll(temp)
+	writeFile(t, filepath.Join(temp, "orphan.txt"), "orphan")
+	writeFile(t, filepath.Join(temp, "orphan.txt"+metadataSuffix), "{}")
+
+	client := newFakeS3()
+	object := client.putObject("example-bucket", "dir/file.bin", []byte("data"), time.Now())
+	object.metadata = aws.StringMap(map[string]string{"Owner": "alice"})
+	object.contentType = "application/x-custom"
+
+	m := &Manager{s3: client, option: Option{PreserveMetadata: true, Delete: true}}
+	if err := m.Sync("s3://example-bucket", temp); err != nil {
+		t.Fatal("Sync should be successful", err)
+	}
+	fileHasContent(t, filepath.Join(temp, "dir", "file.bin"), "data")
+	data, err := ioutil.ReadFile(filepath.Join(temp, "dir", "file.bin"+metadataSuffix))
+	if err != nil {
+		t.Fatal("The sidecar file should be written", err)
+	}
+	var meta objectMetadata
+	if err := json.Unmarshal(data, &meta); err != nil {
+		t.Fatal("The sidecar file should be JSON", err)
+	}
+	expected := objectMetadata{
+		Metadata:    map[string]string{"Owner": "alice"},
+		ContentType: "application/x-custom",
+		ETag:        object.etag,
+	}
+	if !reflect.DeepEqual(expected, meta) {
+		t.Errorf("Expected metadata %+v, got %+v", expected, meta)
+	}
+	// The sidecar file is deleted with the extra file.
+	fileNotExists(t, filepath.Join(temp, "orphan.txt"))
+	fileNotExists(t, filepath.Join(temp, "orphan.txt"+metadataSuffix))
+
+	// The sidecar file is neither deleted nor uploaded, and restores the headers.
+	result, err := m.SyncWithResult(temp, "s3://example-bucket/copy")
+	if err != nil {
+		t.Fatal("Sync should be successful", err)
+	}
+	if names := fileInfoNames(result.Transferred); !reflect.DeepEqual([]string{"dir/file.bin"}, names) {
+		t.Errorf("Only the file should be uploaded, got %v", names)
+	}
+	copied, ok := client.getObject("example-bucket", "copy/dir/file.bin")
+	if !ok {
+		t.Fatal("The file should be uploaded")
+	}
+	if metadata := aws.StringValueMap(copied.metadata); !reflect.DeepEqual(map[string]string{"Owner": "alice"}, metadata) {
+		t.Errorf("The metadata should be restored, got %v", metadata)
+	}
+	if copied.contentType != "application/x-custom" {
+		t.Errorf("The content type should be restored, got %s", copied.contentType)
+	}
+	if err := m.Sync("s3://example-bucket", temp); err != nil {
+		t.Fatal("Sync should be successful", err)
+	}
+	fileExists(t, filepath.Join(temp, "dir", "file.bin"+metadataSuffix))
+}
+
+func TestPreserveMetadataDeleteOrphans(t *testing.T) {
+	temp, err := ioutil.TempDir("", "s3synctest")
+	if err != nil {
+		t.Fatal("Failed to create temp dir")
+	}
+	defer os.RemoveAll(temp)
+	writeFile(t, filepath.Join(temp, "file.txt"), "data")
+	writeFile(t, filepath.Join(temp, "file.txt"+metadataSuffix), "{}")
+	writeFile(t, filepath.Join(temp, "orphan.txt"), "orphan")
+	writeFile(t, filepath.Join(temp, "orphan.txt"+metadataSuffix), "{}")
+
+	client := newFakeS3()
+	client.putObject("example-bucket", "file.txt", []byte("data"), time.Now())
+	m := &Manager{s3: client, option: Option{PreserveMetadata: true}}
+	removed, err := m.DeleteOrphans("s3://example-bucket", temp, false)
+	if err != nil {
+		t.Fatal("DeleteOrphans should be successful", err)
+	}
+	if expected := []string{filepath.Join(temp, "orphan.txt")}; !reflect.DeepEqual(expected, removed) {
+		t.Errorf("Expected removed files %v, got %v", expected, removed)
+	}
+	// The sidecar file is deleted with the orphan.
+	fileNotExists(t, filepath.Join(temp, "orphan.txt"+metadataSuffix))
+	fileExists(t, filepath.Join(temp, "file.txt"+metadataSuffix))
+}
+
+func TestPreserveMetadataOption(t *testing.T) {
+	temp, err := ioutil.TempDir("", "s3synctest")
+	if err != nil {
+		t.Fatal("Failed to create temp dir")
+	}
+	defer os.RemoveAll(temp)
+	writeFile(t, filepath.Join(temp, "file.txt"), "data")
+	writeFile(t, filepath.Join(temp, "file.txt"+metadataSuffix),
+		`{"metadata":{"Owner":"alice","Team":"a"},"contentType":"application/x-custom"}`)
+
+	client := newFakeS3()
+	client.createBucket("example-bucket")
+	m := &Manager{s3: client, option: Option{
+		PreserveMetadata: true,
+		Metadata:         map[string]string{"Team": "b"},
+		ContentType:      "text/x-explicit",
+	}}
+	if err := m.Sync(temp, "s3://example-bucket"); err != nil {
+		t.Fatal("Sync should be successful", err)
+	}
+	object, ok := client.getObject("example-bucket", "file.txt")
+	if !ok {
+		t.Fatal("The file should be uploaded")
+	}
+	// The options take precedence over the sidecar file.
+	expected := map[string]string{"Owner": "alice", "Team": "b"}
+	if metadata := aws.StringValueMap(object.metadata); !reflect.DeepEqual(expected, metadata) {
+		t.Errorf("Expected metadata %v, got %v", expected, metadata)
+	}
+	if object.contentType != "text/x-explicit" {
+		t.Errorf("Option.ContentType should be used, got %s", object.contentType)
+	}
+}
+
+func TestPreserveMetadataUpdateHeadersInPlace(t *testing.T) {
+	temp, err := ioutil.TempDir("", "s3synctest")
+	if err != nil {
+		t.Fatal("Failed to create temp dir")
+	}
+	defer os.RemoveAll(temp)
+	writeFile(t, filepath.Join(temp, "file.txt"), "data")
+	writeFile(t, filepath.Join(temp, "file.txt"+metadataSuffix),
+		`{"metadata":{"Owner":"alice"},"contentType":"application/x-custom"}`)
+
+	client := newFakeS3()
+	client.putObject("example-bucket", "file.txt", []byte("data"), time.Now().Add(-time.Hour))
+
+	m := &Manager{s3: client, option: Option{PreserveMetadata: true, UpdateHeadersInPlace: true}}
+	if err := m.Sync(temp, "s3://example-bucket"); err != nil {
+		t.Fatal("Sync should be successful", err)
+	}
+	if client.count("PutObject") != 0 || client.count("CopyObject") != 1 {
+		t.Fatal("The headers should be updated in place")
+	}
+	object, _ := client.getObject("example-bucket", "file.txt")
+	if metadata := aws.StringValueMap(object.metadata); !reflect.DeepEqual(map[string]string{"Owner": "alice"}, metadata) {
+		t.Errorf("The metadata should be restored, got %v", metadata)
+	}
+	if object.contentType != "application/x-custom" {
+		t.Errorf("The content type should be restored, got %s", object.contentType)
+	}
+}
+
+func TestPreserveMetadataDedup(t *testing.T) {
+	temp, err := ioutil.TempDir("", "s3synctest")
+	if err != nil {
+		t.Fatal("Failed to create temp dir")
+	}
+	defer os.RemoveAll(temp)
+	owners := map[string]string{"a.txt": "alice", "b.txt": "bob"}
+	for name, owner := range owners {
+		writeFile(t, filepath.Join(temp, name), "same")
+		writeFile(t, filepath.Join(temp, name+metadataSuffix), `{"metadata":{"Owner":"`+owner+`"}}`)
+	}
+
+	client := newFakeS3()
+	client.createBucket("example-bucket")
+	m := &Manager{s3: client, option: Option{PreserveMetadata: true, Dedup: true}}
+	if err := m.Sync(temp, "s3://example-bucket"); err != nil {
+		t.Fatal("Sync should be successful", err)
+	}
+	if client.count("PutObject") != 1 || client.count("CopyObject") != 1 {
+		t.Fatal("The duplicate should be copied")
+	}
+	for name, owner := range owners {
+		object, _ := client.getObject("example-bucket", name)
+		if metadata := aws.StringValueMap(object.metadata); !reflect.DeepEqual(map[string]string{"Owner": owner}, metadata) {
+			t.Errorf("%s: the metadata of the own sidecar should be restored, got %v", name, metadata)
+		}
+	}
+}
@@ -0,0 +1,509 @@
+// Copyright 2019 SEQSENSE, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package s3sync
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client/metadata"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+type fakeObject struct {
+	data         []byte
+	lastModified time.Time
+	etag         string
+	metadata     map[string]*string
+	contentType  string
+	cacheControl string
+	storageClass string
+	acl          string
+	contentMD5   string
+	tagging      string
+}
+
+// fakeS3 is an in-memory s3 client for the unit tests.
+// The methods which are not overridden panic via the embedded nil interface.
+type fakeS3 struct {
+	s3iface.S3API
+
+	mu      sync.Mutex
+	buckets map[string]map[string]*fakeObject
+	uploads map[string]map[int64][]byte
+	// created has the inputs of the multipart uploads, whose headers are set on the completion.
+	created map[string]*s3.CreateMultipartUploadInput
+	calls   map[string]int
+
+	// pageSize is the default number of the keys in a listing page.
+	pageSize int
+}
+
+func newFakeS3() *fakeS3 {
+	return &fakeS3{
+		buckets: make(map[string]map[string]*fakeObject),
+		uploads: make(map[string]map[int64][]byte),
+		created: make(map[string]*s3.CreateMultipartUploadInput),
+		calls:   make(map[string]int),
+	}
+}
+
+// count returns the number of the calls of the given api.
+func (f *fakeS3) count(api string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.calls[api]
+}
+
+func (f *fakeS3) called(api string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls[api]++
+}
+
+func (f *fakeS3) createBucket(bucket string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.buckets[bucket] == nil {
+		f.buckets[bucket] = make(map[string]*fakeObject)
+	}
+}
+
+// splitBucketKey splits "bucket/key" into the bucket and the key.
+func splitBucketKey(s string) (string, string) {
+	parts := strings.SplitN(s, "/", 2)
+	return parts[0], parts[1]
+}
+
+// putObject stores the object and returns it to allow the tests set the other attributes.
+func (f *fakeS3) putObject(bucket, key string, data []byte, lastModified time.Time) *fakeObject {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.buckets[bucket] == nil {
+		f.buckets[bucket] = make(map[string]*fakeObject)
+	}
+	object := &fakeObject{
+		data:         data,
+		lastModified: lastModified,
+		etag:         fmt.Sprintf("\"%x\"", md5.Sum(data)),
+	}
+	f.buckets[bucket][key] = object
+	return object
+}
+
+func (f *fakeS3) getObject(bucket, key string) (*fakeObject, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	object, ok := f.buckets[bucket][key]
+	return object, ok
+}
+
+func (f *fakeS3) ListObjectsV2(input *s3.ListObjectsV2Input) (*s3.ListObjectsV2Output, error) {
+	return f.ListObjectsV2WithContext(aws.BackgroundContext(), input)
+}
+
+func (f *fakeS3) ListObjectsV2WithContext(ctx aws.Context, input *s3.ListObjectsV2Input, opts ...request.Option) (*s3.ListObjectsV2Output, error) {
+	f.called("ListObjectsV2")
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	objects, ok := f.buckets[aws.StringValue(input.Bucket)]
+	if !ok {
+		return nil, awserr.New(s3.ErrCodeNoSuchBucket, "The specified bucket does not exist", nil)
+	}
+	prefix := aws.StringValue(input.Prefix)
+	var keys []string
+	for key := range objects {
+		if strings.HasPrefix(key, prefix) && key > aws.StringValue(input.ContinuationToken) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	maxKeys := int(aws.Int64Value(input.MaxKeys))
+	if maxKeys <= 0 || maxKeys > 1000 {
+		maxKeys = 1000
+		if f.pageSize > 0 {
+			maxKeys = f.pageSize
+		}
+	}
+	output := &s3.ListObjectsV2Output{}
+	delimiter := aws.StringValue(input.Delimiter)
+	var n int
+	var last string
+	for _, key := range keys {
+		if delimiter != "" {
+			if i := strings.Index(key[len(prefix):], delimiter); i >= 0 {
+				// The keys under the common prefix are rolled up into an entry.
+				commonPrefix := key[:len(prefix)+i+len(delimiter)]
+				if commonPrefix+"\xff" == last {
+					continue
+				}
+				if n == maxKeys {
+					output.NextContinuationToken = aws.String(last)
+					break
+				}
+				output.CommonPrefixes = append(output.CommonPrefixes, &s3.CommonPrefix{Prefix: aws.String(commonPrefix)})
+				n, last = n+1, commonPrefix+"\xff"
+				continue
+			}
+		}
+		if n == maxKeys {
+			output.NextContinuationToken = aws.String(last)
+			break
+		}
+		object := objects[key]
+		storageClass := object.storageClass
+		if storageClass == "" {
+			storageClass = s3.ObjectStorageClassStandard
+		}
+		output.Contents = append(output.Contents, &s3.Object{
+			Key:          aws.String(key),
+			Size:         aws.Int64(int64(len(object.data))),
+			LastModified: aws.Time(object.lastModified),
+			ETag:         aws.String(object.etag),
+			StorageClass: aws.String(storageClass),
+		})
+		n, last = n+1, key
+	}
+	return output, nil
+}
+
+func (f *fakeS3) GetObjectWithContext(ctx aws.Context, input *s3.GetObjectInput, opts ...request.Option) (*s3.GetObjectOutput, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	f.called("GetObject")
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	object, ok := f.buckets[aws.StringValue(input.Bucket)][aws.StringValue(input.Key)]
+	if !ok {
+		return nil, awserr.New(s3.ErrCodeNoSuchKey, "The specified key does not exist.", nil)
+	}
+	if input.IfMatch != nil && normalizeETag(aws.StringValue(input.IfMatch)) != normalizeETag(object.etag) {
+		return nil, awserr.New("PreconditionFailed", "At least one of the pre-conditions you specified did not hold", nil)
+	}
+	if input.IfUnmodifiedSince != nil && object.lastModified.After(*input.IfUnmodifiedSince) {
+		return nil, awserr.New("PreconditionFailed", "At least one of the pre-conditions you specified did not hold", nil)
+	}
+
+	size := int64(len(object.data))
+	start, end := int64(0), size-1
+	if input.Range != nil {
+		fmt.Sscanf(aws.StringValue(input.Range), "bytes=%d-%d", &start, &end)
+		if end >= size {
+			end = size - 1
+		}
+	}
+	var data []byte
+	if start <= end {
+		data = object.data[start : end+1]
+	}
+	return &s3.GetObjectOutput{
+		Body:          ioutil.NopCloser(bytes.NewReader(data)),
+		ContentLength: aws.Int64(int64(len(data))),
+		ContentRange:  aws.String(fmt.Sprintf("bytes %d-%d/%d", start, end, size)),
+		LastModified:  aws.Time(object.lastModified),
+		ETag:          aws.String(object.etag),
+		Metadata:      object.metadata,
+		ContentType:   stringOrNil(object.contentType),
+	}, nil
+}
+
+func (f *fakeS3) HeadObject(input *s3.HeadObjectInput) (*s3.HeadObjectOutput, error) {
+	return f.HeadObjectWithContext(aws.BackgroundContext(), input)
+}
+
+func (f *fakeS3) HeadObjectWithContext(ctx aws.Context, input *s3.HeadObjectInput, opts ...request.Option) (*s3.HeadObjectOutput, error) {
+	f.called("HeadObject")
+	object, ok := f.getObject(aws.StringValue(input.Bucket), aws.StringValue(input.Key))
+	if !ok {
+		return nil, awserr.New("NotFound", "Not Found", nil)
+	}
+	return &s3.HeadObjectOutput{
+		ContentLength: aws.Int64(int64(len(object.data))),
+		LastModified:  aws.Time(object.lastModified),
+		ETag:          aws.String(object.etag),
+		Metadata:      object.metadata,
+		ContentType:   stringOrNil(object.contentType),
+		CacheControl:  stringOrNil(object.cacheControl),
+	}, nil
+}
+
+// fakeRequest returns a request which calls send instead of the http request.
+func fakeRequest(name string, params, data interface{}, send func() error) *request.Request {
+	req := request.New(aws.Config{}, metadata.ClientInfo{}, request.Handlers{}, nil,
+		&request.Operation{Name: name, HTTPPath: "/"}, params, data)
+	req.Handlers.Send.PushBack(func(r *request.Request) {
+		r.Error = send()
+	})
+	return req
+}
+
+func (f *fakeS3) PutObjectRequest(input *s3.PutObjectInput) (*request.Request, *s3.PutObjectOutput) {
+	output := &s3.PutObjectOutput{}
+	return fakeRequest("PutObject", input, output, func() error {
+		_, err := f.PutObjectWithContext(aws.BackgroundContext(), input)
+		return err
+	}), output
+}
+
+func (f *fakeS3) PutObjectWithContext(ctx aws.Context, input *s3.PutObjectInput, opts ...request.Option) (*s3.PutObjectOutput, error) {
+	f.called("PutObject")
+	var data []byte
+	if input.Body != nil {
+		var err error
+		if data, err = ioutil.ReadAll(input.Body); err != nil {
+			return nil, err
+		}
+	}
+	if err := checkContentMD5(input.ContentMD5, data); err != nil {
+		return nil, err
+	}
+	object := f.putObject(aws.StringValue(input.Bucket), aws.StringValue(input.Key), data, time.Now())
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	object.contentMD5 = aws.StringValue(input.ContentMD5)
+	object.metadata = input.Metadata
+	object.contentType = aws.StringValue(input.ContentType)
+	object.cacheControl = aws.StringValue(input.CacheControl)
+	object.storageClass = aws.StringValue(input.StorageClass)
+	object.acl = aws.StringValue(input.ACL)
+	object.tagging = aws.StringValue(input.Tagging)
+	return &s3.PutObjectOutput{}, nil
+}
+
+// checkContentMD5 returns BadDigest if the Content-MD5 is given and differs from the data.
+func checkContentMD5(contentMD5 *string, data []byte) error {
+	if contentMD5 == nil {
+		return nil
+	}
+	sum := md5.Sum(data)
+	if base64.StdEncoding.EncodeToString(sum[:]) != *contentMD5 {
+		return awserr.New("BadDigest", "The Content-MD5 you specified did not match what we received.", nil)
+	}
+	return nil
+}
+
+func (f *fakeS3) GetObjectRequest(input *s3.GetObjectInput) (*request.Request, *s3.GetObjectOutput) {
+	output := &s3.GetObjectOutput{}
+	return fakeRequest("GetObject", input, output, func() error {
+		return errors.New("GetObjectRequest is only used for presign in the tests")
+	}), output
+}
+
+func (f *fakeS3) CreateMultipartUploadWithContext(ctx aws.Context, input *s3.CreateMultipartUploadInput, opts ...request.Option) (*s3.CreateMultipartUploadOutput, error) {
+	f.called("CreateMultipartUpload")
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	uploadID := fmt.Sprintf("upload-%d", len(f.uploads)+1)
+	f.uploads[uploadID] = make(map[int64][]byte)
+	f.created[uploadID] = input
+	return &s3.CreateMultipartUploadOutput{UploadId: aws.String(uploadID)}, nil
+}
+
+func (f *fakeS3) UploadPartWithContext(ctx aws.Context, input *s3.UploadPartInput, opts ...request.Option) (*s3.UploadPartOutput, error) {
+	f.called("UploadPart")
+	data, err := ioutil.ReadAll(input.Body)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkContentMD5(input.ContentMD5, data); err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	parts, ok := f.uploads[aws.StringValue(input.UploadId)]
+	if !ok {
+		return nil, awserr.New(s3.ErrCodeNoSuchUpload, "The specified upload does not exist.", nil)
+	}
+	parts[aws.Int64Value(input.PartNumber)] = data
+	return &s3.UploadPartOutput{ETag: aws.String(fmt.Sprintf("\"etag-%d\"", aws.Int64Value(input.PartNumber)))}, nil
+}
+
+func (f *fakeS3) UploadPartCopyWithContext(ctx aws.Context, input *s3.UploadPartCopyInput, opts ...request.Option) (*s3.UploadPartCopyOutput, error) {
+	f.called("UploadPartCopy")
+	source, err := url.PathUnescape(aws.StringValue(input.CopySource))
+	if err != nil {
+		return nil, err
+	}
+	bucket, key := splitBucketKey(source)
+	object, ok := f.getObject(bucket, key)
+	if !ok {
+		return nil, awserr.New(s3.ErrCodeNoSuchKey, "The specified key does not exist.", nil)
+	}
+	var start, end int
+	if _, err := fmt.Sscanf(aws.StringValue(input.CopySourceRange), "bytes=%d-%d", &start, &end); err != nil {
+		return nil, awserr.New("InvalidArgument", "Invalid copy source range", nil)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	parts, ok := f.uploads[aws.StringValue(input.UploadId)]
+	if !ok {
+		return nil, awserr.New(s3.ErrCodeNoSuchUpload, "The specified upload does not exist.", nil)
+	}
+	parts[aws.Int64Value(input.PartNumber)] = object.data[start : end+1]
+	return &s3.UploadPartCopyOutput{
+		CopyPartResult: &s3.CopyPartResult{ETag: aws.String(fmt.Sprintf("\"etag-%d\"", aws.Int64Value(input.PartNumber)))},
+	}, nil
+}
+
+func (f *fakeS3) CompleteMultipartUploadWithContext(ctx aws.Context, input *s3.CompleteMultipartUploadInput, opts ...request.Option) (*s3.CompleteMultipartUploadOutput, error) {
+	f.called("CompleteMultipartUpload")
+	f.mu.Lock()
+	parts, ok := f.uploads[aws.StringValue(input.UploadId)]
+	created := f.created[aws.StringValue(input.UploadId)]
+	delete(f.uploads, aws.StringValue(input.UploadId))
+	delete(f.created, aws.StringValue(input.UploadId))
+	f.mu.Unlock()
+	if !ok {
+		return nil, awserr.New(s3.ErrCodeNoSuchUpload, "The specified upload does not exist.", nil)
+	}
+	var data []byte
+	for _, part := range input.MultipartUpload.Parts {
+		data = append(data, parts[aws.Int64Value(part.PartNumber)]...)
+	}
+	object := f.putObject(aws.StringValue(input.Bucket), aws.StringValue(input.Key), data, time.Now())
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	object.etag = fmt.Sprintf("\"%x-%d\"", md5.Sum(data), len(input.MultipartUpload.Parts))
+	object.metadata = created.Metadata
+	object.contentType = aws.StringValue(created.ContentType)
+	object.cacheControl = aws.StringValue(created.CacheControl)
+	object.storageClass = aws.StringValue(created.StorageClass)
+	object.acl = aws.StringValue(created.ACL)
+	object.tagging = aws.StringValue(created.Tagging)
+	return &s3.CompleteMultipartUploadOutput{}, nil
+}
+
+func (f *fakeS3) ListPartsWithContext(ctx aws.Context, input *s3.ListPartsInput, opts ...request.Option) (*s3.ListPartsOutput, error) {
+	f.called("ListParts")
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	parts, ok := f.uploads[aws.StringValue(input.UploadId)]
+	if !ok {
+		return nil, awserr.New(s3.ErrCodeNoSuchUpload, "The specified upload does not exist.", nil)
+	}
+	output := &s3.ListPartsOutput{}
+	for number, data := range parts {
+		output.Parts = append(output.Parts, &s3.Part{
+			ETag:       aws.String(fmt.Sprintf("\"etag-%d\"", number)),
+			PartNumber: aws.Int64(number),
+			Size:       aws.Int64(int64(len(data))),
+		})
+	}
+	sort.Slice(output.Parts, func(i, j int) bool {
+		return *output.Parts[i].PartNumber < *output.Parts[j].PartNumber
+	})
+	return output, nil
+}
+
+func (f *fakeS3) AbortMultipartUploadWithContext(ctx aws.Context, input *s3.AbortMultipartUploadInput, opts ...request.Option) (*s3.AbortMultipartUploadOutput, error) {
+	f.called("AbortMultipartUpload")
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.uploads, aws.StringValue(input.UploadId))
+	return &s3.AbortMultipartUploadOutput{}, nil
+}
+
+func (f *fakeS3) DeleteObjectWithContext(ctx aws.Context, input *s3.DeleteObjectInput, opts ...request.Option) (*s3.DeleteObjectOutput, error) {
+	f.called("DeleteObject")
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	objects, ok := f.buckets[aws.StringValue(input.Bucket)]
+	if !ok {
+		return nil, awserr.New(s3.ErrCodeNoSuchBucket, "The specified bucket does not exist", nil)
+	}
+	delete(objects, aws.StringValue(input.Key))
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+func (f *fakeS3) DeleteObjectsWithContext(ctx aws.Context, input *s3.DeleteObjectsInput, opts ...request.Option) (*s3.DeleteObjectsOutput, error) {
+	f.called("DeleteObjects")
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	objects, ok := f.buckets[aws.StringValue(input.Bucket)]
+	if !ok {
+		return nil, awserr.New(s3.ErrCodeNoSuchBucket, "The specified bucket does not exist", nil)
+	}
+	if len(input.Delete.Objects) > 1000 {
+		return nil, awserr.New("MalformedXML", "The request has more than 1000 keys", nil)
+	}
+	for _, object := range input.Delete.Objects {
+		delete(objects, aws.StringValue(object.Key))
+	}
+	return &s3.DeleteObjectsOutput{}, nil
+}
+
+func stringOrNil(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return aws.String(s)
+}
+
+func (f *fakeS3) CopyObjectWithContext(ctx aws.Context, input *s3.CopyObjectInput, opts ...request.Option) (*s3.CopyObjectOutput, error) {
+	f.called("CopyObject")
+	source, err := url.PathUnescape(aws.StringValue(input.CopySource))
+	if err != nil {
+		return nil, err
+	}
+	parts := strings.SplitN(source, "/", 2)
+	if len(parts) != 2 {
+		return nil, awserr.New("InvalidArgument", "Invalid copy source", nil)
+	}
+	object, ok := f.getObject(parts[0], parts[1])
+	if !ok {
+		return nil, awserr.New(s3.ErrCodeNoSuchKey, "The specified key does not exist.", nil)
+	}
+	if int64(len(object.data)) > maxCopyObjectSize {
+		return nil, awserr.New("InvalidRequest", "The specified copy source is larger than the maximum allowable size", nil)
+	}
+
+	copied := f.putObject(aws.StringValue(input.Bucket), aws.StringValue(input.Key), object.data, time.Now())
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	copied.etag = object.etag
+	copied.storageClass = aws.StringValue(input.StorageClass)
+	copied.acl = aws.StringValue(input.ACL)
+	if aws.StringValue(input.MetadataDirective) == s3.MetadataDirectiveReplace {
+		copied.metadata = input.Metadata
+		copied.contentType = aws.StringValue(input.ContentType)
+		copied.cacheControl = aws.StringValue(input.CacheControl)
+	} else {
+		copied.metadata = object.metadata
+		copied.contentType = object.contentType
+		copied.cacheControl = object.cacheControl
+	}
+	if aws.StringValue(input.TaggingDirective) == s3.TaggingDirectiveReplace {
+		copied.tagging = aws.StringValue(input.Tagging)
+	} else {
+		copied.tagging = object.tagging
+	}
+	return &s3.CopyObjectOutput{}, nil
+}
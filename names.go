@@ -0,0 +1,79 @@
+// Copyright 2019 SEQSENSE, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package s3sync
+
+import (
+	"fmt"
+	"strings"
+)
+
+// WindowsNameMap is the LocalNameMap which replaces the characters reserved in the
+// Windows file names with their full-width forms.
+var WindowsNameMap = map[rune]rune{
+	'<':  '＜',
+	'>':  '＞',
+	':':  '：',
+	'"':  '＂',
+	'\\': '＼',
+	'|':  '｜',
+	'?':  '？',
+	'*':  '＊',
+}
+
+// toLocalName applies Option.LocalNameMap to the slash separated name of the s3 key.
+func (m *Manager) toLocalName(name string) string {
+	if len(m.option.LocalNameMap) == 0 {
+		return name
+	}
+	return strings.Map(func(r rune) rune {
+		if replacement, ok := m.option.LocalNameMap[r]; ok {
+			return replacement
+		}
+		return r
+	}, name)
+}
+
+// toS3Name restores the s3 key from the slash separated local name.
+func (m *Manager) toS3Name(name string) string {
+	if len(m.option.LocalNameMap) == 0 {
+		return name
+	}
+	reverse := make(map[rune]rune, len(m.option.LocalNameMap))
+	for original, replacement := range m.option.LocalNameMap {
+		reverse[replacement] = original
+	}
+	return strings.Map(func(r rune) rune {
+		if original, ok := reverse[r]; ok {
+			return original
+		}
+		return r
+	}, name)
+}
+
+// validateLocalNameMap validates that the replacement of LocalNameMap is reversible.
+func validateLocalNameMap(nameMap map[rune]rune) error {
+	replaced := make(map[rune]rune, len(nameMap))
+	for original, replacement := range nameMap {
+		if original == '/' || replacement == '/' {
+			return fmt.Errorf("LocalNameMap can't replace %q with %q: the separator can't be replaced", original, replacement)
+		}
+		if _, ok := nameMap[replacement]; ok {
+			return fmt.Errorf("LocalNameMap can't replace %q with %q: the replacement is also replaced", original, replacement)
+		}
+		if other, ok := replaced[replacement]; ok {
+			return fmt.Errorf("LocalNameMap can't replace both %q and %q with %q", other, original, replacement)
+		}
+		replaced[replacement] = original
+	}
+	return nil
+}
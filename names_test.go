@@ -0,0 +1,84 @@
+// Copyright 2019 SEQSENSE, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package s3sync
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLocalNameMapRoundTrip(t *testing.T) {
+	temp, err := ioutil.TempDir("", "s3synctest")
+	if err != nil {
+		t.Fatal("Failed to create temp dir")
+	}
+	defer os.RemoveAll(temp)
+
+	client := newFakeS3()
+	client.putObject("source-bucket", "dir/a:b.txt", []byte("a"), time.Now())
+	client.putObject("source-bucket", "what?.txt", []byte("b"), time.Now())
+	client.createBucket("dest-bucket")
+
+	m := &Manager{s3: client, option: Option{LocalNameMap: WindowsNameMap}}
+	if err := m.Sync("s3://source-bucket", temp); err != nil {
+		t.Fatal("Sync should be successful", err)
+	}
+	fileExists(t, filepath.Join(temp, "dir", "a：b.txt"))
+	fileExists(t, filepath.Join(temp, "what？.txt"))
+
+	// The second sync finds the mapped files up-to-date.
+	if err := m.Sync("s3://source-bucket", temp); err != nil {
+		t.Fatal("Sync should be successful", err)
+	}
+	if n := client.count("GetObject"); n != 2 {
+		t.Errorf("Expected 2 downloads, got %d", n)
+	}
+
+	results, err := m.SyncFanOut(temp, []string{"s3://dest-bucket"})
+	if err != nil || results["s3://dest-bucket"] != nil {
+		t.Fatal("SyncFanOut should be successful", err, results)
+	}
+	for _, key := range []string{"dir/a:b.txt", "what?.txt"} {
+		if _, ok := client.getObject("dest-bucket", key); !ok {
+			t.Errorf("%s should be restored on upload", key)
+		}
+	}
+}
+
+func TestValidateLocalNameMap(t *testing.T) {
+	testCases := map[string]struct {
+		nameMap map[rune]rune
+		valid   bool
+	}{
+		"Nil":                   {nil, true},
+		"Windows":               {WindowsNameMap, true},
+		"Separator":             {map[rune]rune{'/': '_'}, false},
+		"ToSeparator":           {map[rune]rune{':': '/'}, false},
+		"ChainedReplacement":    {map[rune]rune{':': '_', '_': '-'}, false},
+		"DuplicatedReplacement": {map[rune]rune{':': '_', '?': '_'}, false},
+	}
+	for name, tt := range testCases {
+		t.Run(name, func(t *testing.T) {
+			err := validateLocalNameMap(tt.nameMap)
+			if tt.valid && err != nil {
+				t.Error("The map should be valid", err)
+			}
+			if !tt.valid && err == nil {
+				t.Error("The map should be invalid")
+			}
+		})
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright 2019 SEQSENSE, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build windows
+// +build windows
+
+package s3sync
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLocalNameMapWindows(t *testing.T) {
+	keys := map[string]string{
+		"a:b.txt":       "a：b.txt",
+		"dir/c|d.txt":   filepath.Join("dir", "c｜d.txt"),
+		"e<f>.txt":      "e＜f＞.txt",
+		"g\"h\".txt":    "g＂h＂.txt",
+		"i*.txt":        "i＊.txt",
+		"j\\k.txt":      "j＼k.txt",
+		"what%3F.txt":   "what%3F.txt",
+		"reserved?.txt": "reserved？.txt",
+	}
+
+	client := newFakeS3()
+	for key := range keys {
+		client.putObject("example-bucket", key, []byte(key), time.Now())
+	}
+
+	t.Run("WithoutMap", func(t *testing.T) {
+		temp, err := ioutil.TempDir("", "s3synctest")
+		if err != nil {
+			t.Fatal("Failed to create temp dir")
+		}
+		defer os.RemoveAll(temp)
+
+		m := &Manager{s3: client}
+		if err := m.Sync("s3://example-bucket", temp); err == nil {
+			t.Error("Sync of the reserved characters should fail on Windows")
+		}
+	})
+	t.Run("WithMap", func(t *testing.T) {
+		temp, err := ioutil.TempDir("", "s3synctest")
+		if err != nil {
+			t.Fatal("Failed to create temp dir")
+		}
+		defer os.RemoveAll(temp)
+
+		m := &Manager{s3: client, option: Option{LocalNameMap: WindowsNameMap}}
+		if err := m.Sync("s3://example-bucket", temp); err != nil {
+			t.Fatal("Sync should be successful", err)
+		}
+		for key, name := range keys {
+			data, err := ioutil.ReadFile(filepath.Join(temp, name))
+			if err != nil {
+				t.Errorf("%s should be downloaded to %s", key, name)
+				continue
+			}
+			if string(data) != key {
+				t.Errorf("Unexpected content of %s: %s", name, data)
+			}
+		}
+	})
+}
@@ -0,0 +1,800 @@
+// Copyright 2019 SEQSENSE, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package s3sync
+
+import (
+	"os"
+	"time"
+)
+
+// Option is the option of s3sync behavior.
+type Option struct {
+	// PruneEmptyDirs removes the local directories which became empty
+	// after deletions. The destination directory itself is never removed.
+	PruneEmptyDirs bool
+	// StallTimeout aborts a download which makes no progress for the duration.
+	// The stalled download is retried up to 3 times. Zero disables the detection.
+	StallTimeout time.Duration
+	// Dedup uploads the same file content only once in a local to s3 sync.
+	// The other files with the same content are created by the server side copy
+	// from the first uploaded object.
+	Dedup bool
+	// MetadataCompareKey is the user metadata key compared between the source and
+	// the destination to detect the changes instead of the size and the modification time.
+	// The size and the modification time are compared if either of them doesn't have the
+	// metadata. It requires a HEAD request for each listed object.
+	MetadataCompareKey string
+	// PartSize is the part size of the multipart uploads.
+	// Zero uses the s3manager default (5 MiB).
+	PartSize int64
+	// MaxUploadParts is the maximum number of parts of a multipart upload.
+	// Zero uses the s3manager default (10000).
+	MaxUploadParts int
+	// SinglePartThreshold forces single part uploads for the files smaller than
+	// the threshold. The files larger than both the threshold and PartSize are
+	// uploaded by multipart. It can't exceed 5 GiB, the limit of PutObject.
+	SinglePartThreshold int64
+	// StorageClassFunc returns the storage class of each uploaded object.
+	// Empty string leaves the storage class to the bucket default.
+	StorageClassFunc func(file FileInfo) string
+	// UpdateHeadersInPlace updates only the headers (Content-Type, Cache-Control,
+	// user metadata and so on) of the existing object in a local to s3 sync,
+	// if the body is unchanged, by copying the object onto itself.
+	// The body is compared by the md5 checksum, so the multipart uploaded objects
+	// are uploaded again.
+	UpdateHeadersInPlace bool
+	// ProgressInterval is the interval of the progress log which has the cumulative
+	// number of the transferred files and bytes, and the current throughput.
+	// Zero disables the progress log.
+	ProgressInterval time.Duration
+	// ExplicitKeyMap maps the slash separated relative path of a local file to
+	// the object key relative to the destination prefix in a local to s3 sync.
+	// The files not in the map are uploaded to the default keys.
+	ExplicitKeyMap map[string]string
+	// RemoveConflictingDirs removes the local directory which exists at the path of
+	// a downloaded file. Otherwise, DirectoryConflictError is returned for the file.
+	RemoveConflictingDirs bool
+	// CheckDiskSpace checks that the destination filesystem has enough free space
+	// for the total size of the planned downloads before starting them.
+	// The downloads start after the listings are finished.
+	CheckDiskSpace bool
+	// MaxConnsPerHost limits the number of the simultaneous connections to the s3
+	// endpoint by configuring the http transport of the client.
+	// Zero means no limit. It is applied when the client is created from a session.
+	MaxConnsPerHost int
+	// PostVerify re-lists the destination after the transfers, and returns VerifyError
+	// if the transferred files are missing or have the wrong size.
+	PostVerify bool
+	// ResumeStateDir is the directory to record the state of the multipart uploads.
+	// If it is set, the interrupted multipart uploads are resumed by the next sync
+	// from the parts which are already uploaded.
+	ResumeStateDir string
+	// BatchByTopLevelDir processes the s3 to local sync per top-level directory of
+	// the source, so that the listing of only one directory is kept in memory at a time.
+	// It is ignored if the source has a glob pattern.
+	BatchByTopLevelDir bool
+	// LocalNameMap replaces the characters of the s3 keys in the local file names,
+	// e.g. WindowsNameMap for the characters which can't be used on Windows.
+	// The reverse replacement is applied to the local file names on upload,
+	// so that the keys are restored by the round-trip.
+	LocalNameMap map[rune]rune
+	// ChecksumStore caches the checksums of the local files computed for the comparisons.
+	// New and NewWithOption use a MemoryChecksumStore if it is nil.
+	ChecksumStore ChecksumStore
+	// DeleteConfirmation is called with the files to be deleted from the destination
+	// before any of them are deleted. Returning an error aborts the deletion.
+	DeleteConfirmation func(toDelete []FileInfo) error
+	// MaxDeletePercent refuses the deletion of more than the percentage of the
+	// destination files with TooManyDeletionsError. Zero allows any deletion.
+	MaxDeletePercent float64
+	// HeadCompare compares the size, the modification time and the ETag returned by
+	// HeadObject instead of the listing, for the s3 compatible stores whose listing
+	// metadata are inaccurate. It costs a request per object.
+	HeadCompare bool
+	// ListConcurrency is the maximum number of the concurrent requests to get the
+	// object metadata or to list the prefixes during the listing. The default is 16.
+	ListConcurrency int
+	// VerifyContentType also compares the Content-Type of the s3 objects on PostVerify,
+	// and reports the objects whose type differs from the one of the upload, including
+	// the up-to-date ones. It costs a request per object.
+	VerifyContentType bool
+	// CompareETag compares the local files with the md5 ETag of the s3 objects on upload,
+	// instead of the modification time. The objects uploaded by multipart are always
+	// uploaded again since their ETag isn't the md5.
+	CompareETag bool
+	// Move deletes the source objects after they are copied in the s3 to s3 sync.
+	Move bool
+	// ExecutionStrategy selects whether the transfers start while listing (Stream)
+	// or after the whole listing and comparison complete (TwoPhase).
+	// CheckDiskSpace always uses TwoPhase since it needs the total size.
+	ExecutionStrategy ExecutionStrategy
+	// QuarantineFile is the file to record the consecutive download failures of the
+	// objects. The objects failed QuarantineThreshold times in a row are skipped
+	// without the error until QuarantineRetryInterval passes since the last failure.
+	QuarantineFile string
+	// QuarantineThreshold is the number of the consecutive failures to quarantine
+	// an object. The default is 3.
+	QuarantineThreshold int
+	// QuarantineRetryInterval is the interval to retry the quarantined objects.
+	// Zero retries them on every sync.
+	QuarantineRetryInterval time.Duration
+	// ParallelListing speeds up the listing of the large s3 prefixes by discovering
+	// the top-level common prefixes first and listing each of them concurrently
+	// up to ListConcurrency.
+	ParallelListing bool
+	// ObjectFilter is applied to every listed source object. Returning false drops
+	// the object, and the Name and the ModTime of the returned FileInfo are used
+	// for the comparison and the transfer instead of the listed ones.
+	// The Size is ignored since it is the actual size of the content.
+	// The destination of the dropped object is not deleted by Delete and DeleteOrphans.
+	ObjectFilter func(FileInfo) (FileInfo, bool)
+	// ExclusiveCreate creates the temporary file of each download exclusively.
+	// The download fails with ConcurrentWriteError if another process is writing
+	// the same file. The temporary file left by a crashed process has to be
+	// removed manually.
+	ExclusiveCreate bool
+	// Reporter receives the result at the end of each sync.
+	Reporter Reporter
+	// Parallelism is the number of the files transferred concurrently.
+	// The default is twice the number of the CPUs.
+	Parallelism int
+	// Delete deletes the destination files which don't exist in the source after
+	// a successful sync, including the ones dropped by ObjectFilter.
+	// The deletion is checked by MaxDeletePercent and DeleteConfirmation first.
+	// It is not supported with the glob pattern nor BatchByTopLevelDir.
+	Delete bool
+	// DryRun logs and records the planned transfers and deletions without
+	// changing the destination, nor the source with Move. PostVerify is skipped.
+	DryRun bool
+	// Logger receives the log entries of the Manager instead of the package logger
+	// set by SetLogger. NopLogger discards them.
+	Logger LoggerIF
+	// ContentType is the Content-Type of all the uploaded objects.
+	// The type is guessed from the file extension if it is empty.
+	ContentType string
+	// NoMimeTypeGuess disables the guess of the Content-Type from the file extension,
+	// leaving the type of the uploaded objects to the s3 default.
+	NoMimeTypeGuess bool
+	// Include is the glob patterns of the relative names of the files to be synced.
+	// All the files are synced if it is empty. A pattern without a slash matches
+	// any segment of the name, and "**" matches zero or more segments.
+	// The files under the matched directories also match.
+	Include []string
+	// Exclude is the glob patterns of the files not to be synced, in the same
+	// syntax as Include. It takes precedence over Include.
+	// The excluded files are never deleted by Delete.
+	Exclude []string
+	// ModTimeTolerance is the difference of the modification times which is
+	// ignored in the comparison, since s3 truncates the time to seconds.
+	// The default is 1 second, and a negative value compares the times exactly.
+	ModTimeTolerance time.Duration
+	// ContentComparison selects how the existing destination files are compared
+	// with the source. The default is SizeTime.
+	ContentComparison ContentComparison
+	// StorageClass is the storage class of the uploaded and copied objects.
+	// StorageClassFunc takes precedence if it returns non-empty class.
+	// Empty string leaves the storage class to the bucket default.
+	StorageClass string
+	// ACL is the canned ACL of the uploaded and copied objects, e.g. "public-read".
+	// Empty string leaves the ACL to the bucket default.
+	ACL string
+	// MaxRetries is the number of the retries of the listings, the downloads and
+	// the uploads failed by the transient errors, e.g. the throttling and the
+	// server errors. The other errors are returned immediately. Zero disables the retry.
+	MaxRetries int
+	// RetryBaseDelay is the delay before the first retry, which is doubled on each
+	// retry and jittered. The default is 100 milliseconds.
+	RetryBaseDelay time.Duration
+	// MaxBytesPerSecond limits the total throughput of the downloads and the uploads
+	// of all the workers. Zero disables the limit.
+	MaxBytesPerSecond int64
+	// OnFileStart is called when the transfer of each file starts.
+	OnFileStart func(file FileInfo)
+	// OnFileDone is called when the transfer of each file started by OnFileStart
+	// finishes, with the number of the transferred bytes and the error of the transfer.
+	// The calls of OnFileStart and OnFileDone are serialized, so the callbacks don't
+	// need to be safe for concurrent use, but must not block the transfers for long.
+	OnFileDone func(file FileInfo, bytesTransferred int64, err error)
+	// ListBufferSize is the number of the listed s3 objects buffered ahead of the
+	// comparison and the transfers. The larger buffer lets the listing run further
+	// ahead at the cost of the memory for the buffered entries. The default is 1000.
+	ListBufferSize int
+	// SkipExisting skips the source files which exist in the destination,
+	// even if they differ, so that only the new files are transferred.
+	SkipExisting bool
+	// VerifyUpload sends the Content-MD5 of the uploaded files, so that s3 rejects
+	// the body corrupted in transit by BadDigest. The files up to 5 GiB are uploaded
+	// by a single PutObject in this mode unless uploaded by Option.ResumeStateDir.
+	// Each part of the multipart uploads is verified by the Content-MD5 of the part.
+	VerifyUpload bool
+	// UseIgnoreFile reads the patterns of the files not to be synced from the file
+	// named IgnoreFileName at the root of the local source or destination, and adds
+	// them to Exclude. Each line is a pattern, and the blank lines and the lines
+	// starting with "#" are ignored. The ignore file itself is not synced.
+	UseIgnoreFile bool
+	// IgnoreFileName is the name of the ignore file. The default is ".s3syncignore".
+	IgnoreFileName string
+	// FileMode is the permission of the downloaded files. Zero leaves the default
+	// 0666 permission masked by the umask.
+	FileMode os.FileMode
+	// DirMode is the permission of the directories created by the downloads,
+	// masked by the umask. The default is 0755.
+	DirMode os.FileMode
+	// ForcePathStyle accesses the buckets by the path-style url
+	// (http://endpoint/bucket/key), which the s3 compatible stores like MinIO and Ceph
+	// often require with the custom endpoint of the session. It is applied when
+	// the client is created from a session.
+	ForcePathStyle bool
+	// Tags are the tags of the uploaded objects, e.g. for the cost allocation.
+	// Empty map leaves the objects untagged.
+	Tags map[string]string
+	// TaggingDirective is the tagging directive of the s3 to s3 copies, "COPY" to
+	// keep the tags of the source object or "REPLACE" to set Option.Tags.
+	// Empty string leaves it to the s3 default, which is "COPY".
+	TaggingDirective string
+	// CacheControl is the Cache-Control of all the uploaded objects,
+	// e.g. "max-age=31536000" for the static site hosting.
+	CacheControl string
+	// Metadata is the user metadata (x-amz-meta-*) of all the uploaded objects.
+	Metadata map[string]string
+	// MaxFileSize is the maximum size in bytes of the synced files.
+	// The larger files are skipped, and their destinations are neither updated
+	// nor deleted by Option.Delete. Zero means unlimited.
+	MaxFileSize int64
+	// VersionID is the version of the object downloaded from the versioned bucket.
+	// It is only supported for the download of a single object, and the latest
+	// version is downloaded if it is empty.
+	VersionID string
+	// RequestPayer is set to the listings and the downloads, e.g. "requester" to
+	// accept the charges of the requester pays buckets. Empty string leaves it unset.
+	RequestPayer string
+	// Resume keeps the temporary file of the failed download, and continues it by the
+	// ranged GET on the next attempt if the object of the same ETag is downloaded.
+	// The ETag is recorded next to the temporary file. The parts of the download
+	// are not downloaded concurrently with Resume, regardless of DownloadConcurrency.
+	// It is ignored with Option.ExclusiveCreate, which treats the temporary file as
+	// the one of another process.
+	Resume bool
+	// MaxKeys is the maximum number of the keys in a page of the s3 listings,
+	// which only changes the number of the list requests, up to the s3 limit of 1000.
+	// Zero uses the s3 default (1000).
+	MaxKeys int64
+	// SSECustomerKey is the raw 32 bytes AES256 key of the server side encryption
+	// by the customer provided key (SSE-C). The objects are uploaded, downloaded and
+	// copied with the key. The ETags of the encrypted objects are not the md5 of the
+	// content, so the checksum comparisons see them as changed.
+	SSECustomerKey string
+	// WalkConcurrency is the maximum number of the goroutines walking the local
+	// directories concurrently, which speeds up the listing of the directory trees
+	// on the network filesystems. Zero or one walks them sequentially.
+	WalkConcurrency int
+	// Force transfers all the source files regardless of the destination, e.g. to
+	// recover the corrupted destination. It can't be used with Option.SkipExisting.
+	Force bool
+	// FollowSymlinks lists the symbolic links in the local directories as the files
+	// or the directories which they point to. The links to their own ancestors and
+	// the broken links are skipped. Without it, the symbolic links are skipped,
+	// except the one given as the local path of the sync.
+	FollowSymlinks bool
+	// FailFast aborts the sync at the first failed file, rather than continuing
+	// the transfers of the other files. The sync is always aborted by the listing
+	// errors, before deleting any file by Option.Delete.
+	FailFast bool
+	// DisableMultipart uploads every file by a single PutObject, so that the ETag
+	// of the object is the md5 of the content. The files larger than 5 GiB,
+	// the limit of PutObject, fail to upload.
+	DisableMultipart bool
+	// UploadConcurrency is the number of the parts of a multipart upload which
+	// are uploaded concurrently. Zero uses the s3manager default (5).
+	UploadConcurrency int
+	// DownloadPartSize is the size of the ranged GETs by which each object is
+	// downloaded. Zero uses the s3manager default (5 MiB).
+	DownloadPartSize int64
+	// DownloadConcurrency is the number of the parts of an object which are
+	// downloaded concurrently. Zero uses the s3manager default (5).
+	// Each of the Parallelism files is downloaded by its own downloader, so up to
+	// Parallelism * DownloadConcurrency requests are in flight at once.
+	DownloadConcurrency int
+	// BiSyncStateFile is the file to record the state of the files after each
+	// BiSync, to detect the side which is changed since the previous sync.
+	// Without it, BiSync copies the newer side.
+	BiSyncStateFile string
+	// OnConflict is called by BiSync for each file changed on both sides.
+	// The conflicting file is not transferred.
+	OnConflict func(local, remote FileInfo)
+	// CreateFolderMarkers keeps the empty directories by the folder markers, the
+	// zero-byte objects with the trailing slash. The marker of each empty local
+	// directory is created by the upload, and the directory of each marker is
+	// created by the download.
+	CreateFolderMarkers bool
+	// AutoRegion finds the region of each bucket by GetBucketLocation, and accesses
+	// the bucket by the client of its region, rather than failing by the redirect
+	// if the region of the session differs. The region is looked up once per bucket
+	// of a Manager. It is ignored by the Manager of NewWithClient and NewWithClients.
+	AutoRegion bool
+	// Filter decides whether to sync each file after Include and Exclude.
+	// Returning false drops the file. Both the source and the destination files
+	// dropped by it are neither transferred nor deleted.
+	Filter func(FileInfo) bool
+	// FileSystem replaces the local filesystem of the sync, e.g. by an in-memory one.
+	// The state files of the options, like QuarantineFile, and the disk space
+	// check of CheckDiskSpace are still on the OS filesystem.
+	FileSystem FileSystem
+	// PreserveMetadata writes the user metadata, the content type and the ETag of
+	// each downloaded object to the sidecar JSON file, the file name + ".s3meta".
+	// The upload restores the metadata and the content type from the sidecar file.
+	// The sidecar files are not synced as the files themselves, and are deleted
+	// with their files by Delete and DeleteOrphans.
+	PreserveMetadata bool
+	// ModifiedAfter skips the source files modified before the time, regardless
+	// of the comparison with the destination. The destinations of the skipped files
+	// are not deleted by Delete and DeleteOrphans. The zero time means no bound.
+	ModifiedAfter time.Time
+	// ModifiedBefore skips the source files modified at or after the time.
+	// The zero time means no bound.
+	ModifiedBefore time.Time
+}
+
+// ContentComparison is the method to compare the source and the destination files.
+type ContentComparison int
+
+const (
+	// SizeTime syncs the source whose size differs or which is newer than the destination.
+	// It is the default.
+	SizeTime ContentComparison = iota
+	// ChecksumMD5 compares the md5 of the local file with the ETag of the s3 object,
+	// regardless of the modification times. The objects uploaded by multipart have
+	// the composite ETag which isn't the md5, so they are compared by the size only.
+	ChecksumMD5
+)
+
+// ExecutionStrategy is the strategy to start the transfers of a sync.
+type ExecutionStrategy int
+
+const (
+	// Stream starts each transfer as soon as the file is found to need the sync.
+	// It is the default.
+	Stream ExecutionStrategy = iota
+	// TwoPhase lists and compares all the files first, then starts the transfers.
+	// Nothing is transferred if the listing fails.
+	TwoPhase
+)
+
+// OptionFunc is the functional option of s3sync behavior.
+// It is an alternative to construct the Option struct.
+type OptionFunc func(*Option)
+
+// WithPruneEmptyDirs sets Option.PruneEmptyDirs.
+func WithPruneEmptyDirs() OptionFunc {
+	return func(o *Option) { o.PruneEmptyDirs = true }
+}
+
+// WithStallTimeout sets Option.StallTimeout.
+func WithStallTimeout(d time.Duration) OptionFunc {
+	return func(o *Option) { o.StallTimeout = d }
+}
+
+// WithDedup sets Option.Dedup.
+func WithDedup() OptionFunc {
+	return func(o *Option) { o.Dedup = true }
+}
+
+// WithMetadataCompareKey sets Option.MetadataCompareKey.
+func WithMetadataCompareKey(key string) OptionFunc {
+	return func(o *Option) { o.MetadataCompareKey = key }
+}
+
+// WithPartSize sets Option.PartSize.
+func WithPartSize(n int64) OptionFunc {
+	return func(o *Option) { o.PartSize = n }
+}
+
+// WithMaxUploadParts sets Option.MaxUploadParts.
+func WithMaxUploadParts(n int) OptionFunc {
+	return func(o *Option) { o.MaxUploadParts = n }
+}
+
+// WithSinglePartThreshold sets Option.SinglePartThreshold.
+func WithSinglePartThreshold(n int64) OptionFunc {
+	return func(o *Option) { o.SinglePartThreshold = n }
+}
+
+// WithStorageClassFunc sets Option.StorageClassFunc.
+func WithStorageClassFunc(f func(file FileInfo) string) OptionFunc {
+	return func(o *Option) { o.StorageClassFunc = f }
+}
+
+// WithUpdateHeadersInPlace sets Option.UpdateHeadersInPlace.
+func WithUpdateHeadersInPlace() OptionFunc {
+	return func(o *Option) { o.UpdateHeadersInPlace = true }
+}
+
+// WithProgressInterval sets Option.ProgressInterval.
+func WithProgressInterval(d time.Duration) OptionFunc {
+	return func(o *Option) { o.ProgressInterval = d }
+}
+
+// WithExplicitKeyMap sets Option.ExplicitKeyMap.
+func WithExplicitKeyMap(m map[string]string) OptionFunc {
+	return func(o *Option) { o.ExplicitKeyMap = m }
+}
+
+// WithRemoveConflictingDirs sets Option.RemoveConflictingDirs.
+func WithRemoveConflictingDirs() OptionFunc {
+	return func(o *Option) { o.RemoveConflictingDirs = true }
+}
+
+// WithCheckDiskSpace sets Option.CheckDiskSpace.
+func WithCheckDiskSpace() OptionFunc {
+	return func(o *Option) { o.CheckDiskSpace = true }
+}
+
+// WithMaxConnsPerHost sets Option.MaxConnsPerHost.
+func WithMaxConnsPerHost(n int) OptionFunc {
+	return func(o *Option) { o.MaxConnsPerHost = n }
+}
+
+// WithPostVerify sets Option.PostVerify.
+func WithPostVerify() OptionFunc {
+	return func(o *Option) { o.PostVerify = true }
+}
+
+// WithResumeStateDir sets Option.ResumeStateDir.
+func WithResumeStateDir(dir string) OptionFunc {
+	return func(o *Option) { o.ResumeStateDir = dir }
+}
+
+// WithBatchByTopLevelDir sets Option.BatchByTopLevelDir.
+func WithBatchByTopLevelDir() OptionFunc {
+	return func(o *Option) { o.BatchByTopLevelDir = true }
+}
+
+// WithLocalNameMap sets Option.LocalNameMap.
+func WithLocalNameMap(nameMap map[rune]rune) OptionFunc {
+	return func(o *Option) { o.LocalNameMap = nameMap }
+}
+
+// WithChecksumStore sets Option.ChecksumStore.
+func WithChecksumStore(store ChecksumStore) OptionFunc {
+	return func(o *Option) { o.ChecksumStore = store }
+}
+
+// WithDeleteConfirmation sets Option.DeleteConfirmation.
+func WithDeleteConfirmation(f func(toDelete []FileInfo) error) OptionFunc {
+	return func(o *Option) { o.DeleteConfirmation = f }
+}
+
+// WithMaxDeletePercent sets Option.MaxDeletePercent.
+func WithMaxDeletePercent(percent float64) OptionFunc {
+	return func(o *Option) { o.MaxDeletePercent = percent }
+}
+
+// WithHeadCompare sets Option.HeadCompare.
+func WithHeadCompare() OptionFunc {
+	return func(o *Option) { o.HeadCompare = true }
+}
+
+// WithListConcurrency sets Option.ListConcurrency.
+func WithListConcurrency(n int) OptionFunc {
+	return func(o *Option) { o.ListConcurrency = n }
+}
+
+// WithVerifyContentType sets Option.VerifyContentType.
+func WithVerifyContentType() OptionFunc {
+	return func(o *Option) { o.VerifyContentType = true }
+}
+
+// WithCompareETag sets Option.CompareETag.
+func WithCompareETag() OptionFunc {
+	return func(o *Option) { o.CompareETag = true }
+}
+
+// WithMove sets Option.Move.
+func WithMove() OptionFunc {
+	return func(o *Option) { o.Move = true }
+}
+
+// WithExecutionStrategy sets Option.ExecutionStrategy.
+func WithExecutionStrategy(strategy ExecutionStrategy) OptionFunc {
+	return func(o *Option) { o.ExecutionStrategy = strategy }
+}
+
+// WithQuarantine sets Option.QuarantineFile, Option.QuarantineThreshold and
+// Option.QuarantineRetryInterval.
+func WithQuarantine(filename string, threshold int, retryInterval time.Duration) OptionFunc {
+	return func(o *Option) {
+		o.QuarantineFile = filename
+		o.QuarantineThreshold = threshold
+		o.QuarantineRetryInterval = retryInterval
+	}
+}
+
+// WithParallelListing sets Option.ParallelListing.
+func WithParallelListing() OptionFunc {
+	return func(o *Option) { o.ParallelListing = true }
+}
+
+// WithObjectFilter sets Option.ObjectFilter.
+func WithObjectFilter(f func(FileInfo) (FileInfo, bool)) OptionFunc {
+	return func(o *Option) { o.ObjectFilter = f }
+}
+
+// WithExclusiveCreate sets Option.ExclusiveCreate.
+func WithExclusiveCreate() OptionFunc {
+	return func(o *Option) { o.ExclusiveCreate = true }
+}
+
+// WithReporter sets Option.Reporter.
+func WithReporter(r Reporter) OptionFunc {
+	return func(o *Option) { o.Reporter = r }
+}
+
+// WithParallelism sets Option.Parallelism.
+func WithParallelism(n int) OptionFunc {
+	return func(o *Option) { o.Parallelism = n }
+}
+
+// WithDelete sets Option.Delete.
+func WithDelete() OptionFunc {
+	return func(o *Option) { o.Delete = true }
+}
+
+// WithDryRun sets Option.DryRun.
+func WithDryRun() OptionFunc {
+	return func(o *Option) { o.DryRun = true }
+}
+
+// WithLogger sets Option.Logger.
+func WithLogger(l LoggerIF) OptionFunc {
+	return func(o *Option) { o.Logger = l }
+}
+
+// WithContentType sets Option.ContentType.
+func WithContentType(contentType string) OptionFunc {
+	return func(o *Option) { o.ContentType = contentType }
+}
+
+// WithNoMimeTypeGuess sets Option.NoMimeTypeGuess.
+func WithNoMimeTypeGuess() OptionFunc {
+	return func(o *Option) { o.NoMimeTypeGuess = true }
+}
+
+// WithInclude appends the patterns to Option.Include.
+func WithInclude(patterns ...string) OptionFunc {
+	return func(o *Option) { o.Include = append(o.Include, patterns...) }
+}
+
+// WithExclude appends the patterns to Option.Exclude.
+func WithExclude(patterns ...string) OptionFunc {
+	return func(o *Option) { o.Exclude = append(o.Exclude, patterns...) }
+}
+
+// WithModTimeTolerance sets Option.ModTimeTolerance.
+func WithModTimeTolerance(d time.Duration) OptionFunc {
+	return func(o *Option) { o.ModTimeTolerance = d }
+}
+
+// WithContentComparison sets Option.ContentComparison.
+func WithContentComparison(comparison ContentComparison) OptionFunc {
+	return func(o *Option) { o.ContentComparison = comparison }
+}
+
+// WithStorageClass sets Option.StorageClass.
+func WithStorageClass(class string) OptionFunc {
+	return func(o *Option) { o.StorageClass = class }
+}
+
+// WithACL sets Option.ACL.
+func WithACL(acl string) OptionFunc {
+	return func(o *Option) { o.ACL = acl }
+}
+
+// WithMaxRetries sets Option.MaxRetries.
+func WithMaxRetries(n int) OptionFunc {
+	return func(o *Option) { o.MaxRetries = n }
+}
+
+// WithRetryBaseDelay sets Option.RetryBaseDelay.
+func WithRetryBaseDelay(d time.Duration) OptionFunc {
+	return func(o *Option) { o.RetryBaseDelay = d }
+}
+
+// WithMaxBytesPerSecond sets Option.MaxBytesPerSecond.
+func WithMaxBytesPerSecond(n int64) OptionFunc {
+	return func(o *Option) { o.MaxBytesPerSecond = n }
+}
+
+// WithOnFileStart sets Option.OnFileStart.
+func WithOnFileStart(f func(file FileInfo)) OptionFunc {
+	return func(o *Option) { o.OnFileStart = f }
+}
+
+// WithOnFileDone sets Option.OnFileDone.
+func WithOnFileDone(f func(file FileInfo, bytesTransferred int64, err error)) OptionFunc {
+	return func(o *Option) { o.OnFileDone = f }
+}
+
+// WithListBufferSize sets Option.ListBufferSize.
+func WithListBufferSize(n int) OptionFunc {
+	return func(o *Option) { o.ListBufferSize = n }
+}
+
+// WithSkipExisting sets Option.SkipExisting.
+func WithSkipExisting() OptionFunc {
+	return func(o *Option) { o.SkipExisting = true }
+}
+
+// WithVerifyUpload sets Option.VerifyUpload.
+func WithVerifyUpload() OptionFunc {
+	return func(o *Option) { o.VerifyUpload = true }
+}
+
+// WithIgnoreFile sets Option.UseIgnoreFile, and Option.IgnoreFileName if name is not empty.
+func WithIgnoreFile(name string) OptionFunc {
+	return func(o *Option) {
+		o.UseIgnoreFile = true
+		if name != "" {
+			o.IgnoreFileName = name
+		}
+	}
+}
+
+// WithFileMode sets Option.FileMode.
+func WithFileMode(mode os.FileMode) OptionFunc {
+	return func(o *Option) { o.FileMode = mode }
+}
+
+// WithDirMode sets Option.DirMode.
+func WithDirMode(mode os.FileMode) OptionFunc {
+	return func(o *Option) { o.DirMode = mode }
+}
+
+// WithForcePathStyle sets Option.ForcePathStyle.
+func WithForcePathStyle() OptionFunc {
+	return func(o *Option) { o.ForcePathStyle = true }
+}
+
+// WithTags sets Option.Tags.
+func WithTags(tags map[string]string) OptionFunc {
+	return func(o *Option) { o.Tags = tags }
+}
+
+// WithTaggingDirective sets Option.TaggingDirective.
+func WithTaggingDirective(directive string) OptionFunc {
+	return func(o *Option) { o.TaggingDirective = directive }
+}
+
+// WithCacheControl sets Option.CacheControl.
+func WithCacheControl(cacheControl string) OptionFunc {
+	return func(o *Option) { o.CacheControl = cacheControl }
+}
+
+// WithMetadata sets Option.Metadata.
+func WithMetadata(metadata map[string]string) OptionFunc {
+	return func(o *Option) { o.Metadata = metadata }
+}
+
+// WithMaxFileSize sets Option.MaxFileSize.
+func WithMaxFileSize(size int64) OptionFunc {
+	return func(o *Option) { o.MaxFileSize = size }
+}
+
+// WithVersionID sets Option.VersionID.
+func WithVersionID(versionID string) OptionFunc {
+	return func(o *Option) { o.VersionID = versionID }
+}
+
+// WithRequestPayer sets Option.RequestPayer.
+func WithRequestPayer(payer string) OptionFunc {
+	return func(o *Option) { o.RequestPayer = payer }
+}
+
+// WithResume sets Option.Resume.
+func WithResume() OptionFunc {
+	return func(o *Option) { o.Resume = true }
+}
+
+// WithMaxKeys sets Option.MaxKeys.
+func WithMaxKeys(maxKeys int64) OptionFunc {
+	return func(o *Option) { o.MaxKeys = maxKeys }
+}
+
+// WithSSECustomerKey sets Option.SSECustomerKey.
+func WithSSECustomerKey(key string) OptionFunc {
+	return func(o *Option) { o.SSECustomerKey = key }
+}
+
+// WithWalkConcurrency sets Option.WalkConcurrency.
+func WithWalkConcurrency(n int) OptionFunc {
+	return func(o *Option) { o.WalkConcurrency = n }
+}
+
+// WithForce sets Option.Force.
+func WithForce() OptionFunc {
+	return func(o *Option) { o.Force = true }
+}
+
+// WithFollowSymlinks sets Option.FollowSymlinks.
+func WithFollowSymlinks() OptionFunc {
+	return func(o *Option) { o.FollowSymlinks = true }
+}
+
+// WithFailFast sets Option.FailFast.
+func WithFailFast() OptionFunc {
+	return func(o *Option) { o.FailFast = true }
+}
+
+// WithDisableMultipart sets Option.DisableMultipart.
+func WithDisableMultipart() OptionFunc {
+	return func(o *Option) { o.DisableMultipart = true }
+}
+
+// WithUploadConcurrency sets Option.UploadConcurrency.
+func WithUploadConcurrency(n int) OptionFunc {
+	return func(o *Option) { o.UploadConcurrency = n }
+}
+
+// WithDownloadPartSize sets Option.DownloadPartSize.
+func WithDownloadPartSize(n int64) OptionFunc {
+	return func(o *Option) { o.DownloadPartSize = n }
+}
+
+// WithDownloadConcurrency sets Option.DownloadConcurrency.
+func WithDownloadConcurrency(n int) OptionFunc {
+	return func(o *Option) { o.DownloadConcurrency = n }
+}
+
+// WithBiSyncStateFile sets Option.BiSyncStateFile.
+func WithBiSyncStateFile(filename string) OptionFunc {
+	return func(o *Option) { o.BiSyncStateFile = filename }
+}
+
+// WithOnConflict sets Option.OnConflict.
+func WithOnConflict(f func(local, remote FileInfo)) OptionFunc {
+	return func(o *Option) { o.OnConflict = f }
+}
+
+// WithCreateFolderMarkers sets Option.CreateFolderMarkers.
+func WithCreateFolderMarkers() OptionFunc {
+	return func(o *Option) { o.CreateFolderMarkers = true }
+}
+
+// WithAutoRegion sets Option.AutoRegion.
+func WithAutoRegion() OptionFunc {
+	return func(o *Option) { o.AutoRegion = true }
+}
+
+// WithFilter sets Option.Filter.
+func WithFilter(f func(FileInfo) bool) OptionFunc {
+	return func(o *Option) { o.Filter = f }
+}
+
+// WithFileSystem sets Option.FileSystem.
+func WithFileSystem(fs FileSystem) OptionFunc {
+	return func(o *Option) { o.FileSystem = fs }
+}
+
+// WithPreserveMetadata enables Option.PreserveMetadata.
+func WithPreserveMetadata() OptionFunc {
+	return func(o *Option) { o.PreserveMetadata = true }
+}
+
+// WithModifiedAfter sets Option.ModifiedAfter.
+func WithModifiedAfter(t time.Time) OptionFunc {
+	return func(o *Option) { o.ModifiedAfter = t }
+}
+
+// WithModifiedBefore sets Option.ModifiedBefore.
+func WithModifiedBefore(t time.Time) OptionFunc {
+	return func(o *Option) { o.ModifiedBefore = t }
+}
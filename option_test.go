@@ -0,0 +1,239 @@
+// Copyright 2019 SEQSENSE, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package s3sync
+
+import (
+	"io/ioutil"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+)
+
+func TestOptionFunc(t *testing.T) {
+	keyMap := map[string]string{"a.txt": "b.txt"}
+	store := NewMemoryChecksumStore()
+	expected := Option{
+		PruneEmptyDirs:          true,
+		StallTimeout:            time.Minute,
+		Dedup:                   true,
+		MetadataCompareKey:      "sha256",
+		PartSize:                10,
+		MaxUploadParts:          20,
+		SinglePartThreshold:     30,
+		UpdateHeadersInPlace:    true,
+		ProgressInterval:        time.Second,
+		ExplicitKeyMap:          keyMap,
+		RemoveConflictingDirs:   true,
+		CheckDiskSpace:          true,
+		MaxConnsPerHost:         4,
+		PostVerify:              true,
+		ResumeStateDir:          "/tmp/state",
+		BatchByTopLevelDir:      true,
+		LocalNameMap:            WindowsNameMap,
+		ChecksumStore:           store,
+		MaxDeletePercent:        10,
+		HeadCompare:             true,
+		ListConcurrency:         8,
+		VerifyContentType:       true,
+		CompareETag:             true,
+		Move:                    true,
+		ExecutionStrategy:       TwoPhase,
+		QuarantineFile:          "/tmp/quarantine.json",
+		QuarantineThreshold:     5,
+		QuarantineRetryInterval: time.Hour,
+		ParallelListing:         true,
+		ExclusiveCreate:         true,
+		Reporter:                NewJSONReporter(ioutil.Discard),
+		Parallelism:             8,
+		Delete:                  true,
+		DryRun:                  true,
+		Logger:                  NopLogger{},
+		ContentType:             "text/plain",
+		NoMimeTypeGuess:         true,
+		Include:                 []string{"*.jpg"},
+		Exclude:                 []string{"*.tmp", ".git/**"},
+		ModTimeTolerance:        2 * time.Second,
+		ContentComparison:       ChecksumMD5,
+		StorageClass:            "STANDARD_IA",
+		ACL:                     "public-read",
+		MaxRetries:              3,
+		RetryBaseDelay:          time.Millisecond,
+		MaxBytesPerSecond:       1024,
+		ListBufferSize:          10,
+		SkipExisting:            true,
+		VerifyUpload:            true,
+		UseIgnoreFile:           true,
+		IgnoreFileName:          ".syncignore",
+		FileMode:                0600,
+		DirMode:                 0700,
+		ForcePathStyle:          true,
+		Tags:                    map[string]string{"team": "robot"},
+		TaggingDirective:        "REPLACE",
+		CacheControl:            "max-age=60",
+		Metadata:                map[string]string{"owner": "me"},
+		MaxFileSize:             2048,
+		VersionID:               "v1",
+		RequestPayer:            "requester",
+		Resume:                  true,
+		MaxKeys:                 100,
+		SSECustomerKey:          "key",
+		WalkConcurrency:         4,
+		Force:                   true,
+		FollowSymlinks:          true,
+		FailFast:                true,
+		DisableMultipart:        true,
+		UploadConcurrency:       3,
+		DownloadPartSize:        1024,
+		DownloadConcurrency:     2,
+		BiSyncStateFile:         "state.json",
+		CreateFolderMarkers:     true,
+		AutoRegion:              true,
+		FileSystem:              osFileSystem{},
+		PreserveMetadata:        true,
+		ModifiedAfter:           time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC),
+		ModifiedBefore:          time.Date(2020, 2, 1, 0, 0, 0, 0, time.UTC),
+	}
+
+	sess := session.Must(session.NewSession(&aws.Config{Region: aws.String("us-east-1")}))
+	m := New(sess,
+		WithPruneEmptyDirs(),
+		WithStallTimeout(time.Minute),
+		WithDedup(),
+		WithMetadataCompareKey("sha256"),
+		WithPartSize(10),
+		WithMaxUploadParts(20),
+		WithSinglePartThreshold(30),
+		WithStorageClassFunc(func(FileInfo) string { return "STANDARD_IA" }),
+		WithUpdateHeadersInPlace(),
+		WithProgressInterval(time.Second),
+		WithExplicitKeyMap(keyMap),
+		WithRemoveConflictingDirs(),
+		WithCheckDiskSpace(),
+		WithMaxConnsPerHost(4),
+		WithPostVerify(),
+		WithResumeStateDir("/tmp/state"),
+		WithBatchByTopLevelDir(),
+		WithLocalNameMap(WindowsNameMap),
+		WithChecksumStore(store),
+		WithDeleteConfirmation(func([]FileInfo) error { return nil }),
+		WithMaxDeletePercent(10),
+		WithHeadCompare(),
+		WithListConcurrency(8),
+		WithVerifyContentType(),
+		WithCompareETag(),
+		WithMove(),
+		WithExecutionStrategy(TwoPhase),
+		WithQuarantine("/tmp/quarantine.json", 5, time.Hour),
+		WithParallelListing(),
+		WithObjectFilter(func(info FileInfo) (FileInfo, bool) { return info, true }),
+		WithExclusiveCreate(),
+		WithReporter(NewJSONReporter(ioutil.Discard)),
+		WithParallelism(8),
+		WithDelete(),
+		WithDryRun(),
+		WithLogger(NopLogger{}),
+		WithContentType("text/plain"),
+		WithNoMimeTypeGuess(),
+		WithInclude("*.jpg"),
+		WithExclude("*.tmp"),
+		WithExclude(".git/**"),
+		WithModTimeTolerance(2*time.Second),
+		WithContentComparison(ChecksumMD5),
+		WithStorageClass("STANDARD_IA"),
+		WithACL("public-read"),
+		WithMaxRetries(3),
+		WithRetryBaseDelay(time.Millisecond),
+		WithMaxBytesPerSecond(1024),
+		WithListBufferSize(10),
+		WithSkipExisting(),
+		WithVerifyUpload(),
+		WithIgnoreFile(".syncignore"),
+		WithFileMode(0600),
+		WithDirMode(0700),
+		WithForcePathStyle(),
+		WithTags(map[string]string{"team": "robot"}),
+		WithTaggingDirective("REPLACE"),
+		WithCacheControl("max-age=60"),
+		WithMetadata(map[string]string{"owner": "me"}),
+		WithMaxFileSize(2048),
+		WithVersionID("v1"),
+		WithRequestPayer("requester"),
+		WithResume(),
+		WithMaxKeys(100),
+		WithSSECustomerKey("key"),
+		WithWalkConcurrency(4),
+		WithForce(),
+		WithFollowSymlinks(),
+		WithFailFast(),
+		WithDisableMultipart(),
+		WithUploadConcurrency(3),
+		WithDownloadPartSize(1024),
+		WithDownloadConcurrency(2),
+		WithBiSyncStateFile("state.json"),
+		WithCreateFolderMarkers(),
+		WithAutoRegion(),
+		WithOnFileStart(func(FileInfo) {}),
+		WithOnFileDone(func(FileInfo, int64, error) {}),
+		WithOnConflict(func(FileInfo, FileInfo) {}),
+		WithFilter(func(FileInfo) bool { return true }),
+		WithFileSystem(osFileSystem{}),
+		WithPreserveMetadata(),
+		WithModifiedAfter(time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)),
+		WithModifiedBefore(time.Date(2020, 2, 1, 0, 0, 0, 0, time.UTC)),
+	)
+
+	if m.option.StorageClassFunc == nil || m.option.StorageClassFunc(FileInfo{}) != "STANDARD_IA" {
+		t.Error("StorageClassFunc should be set")
+	}
+	if m.option.DeleteConfirmation == nil {
+		t.Error("DeleteConfirmation should be set")
+	}
+	if m.option.ObjectFilter == nil {
+		t.Error("ObjectFilter should be set")
+	}
+	if m.option.OnFileStart == nil || m.option.OnFileDone == nil {
+		t.Error("OnFileStart and OnFileDone should be set")
+	}
+	if m.option.OnConflict == nil {
+		t.Error("OnConflict should be set")
+	}
+	if m.option.Filter == nil {
+		t.Error("Filter should be set")
+	}
+	// Functions are not comparable by DeepEqual.
+	m.option.StorageClassFunc = nil
+	m.option.DeleteConfirmation = nil
+	m.option.ObjectFilter = nil
+	m.option.OnFileStart = nil
+	m.option.OnFileDone = nil
+	m.option.OnConflict = nil
+	m.option.Filter = nil
+	if !reflect.DeepEqual(expected, m.option) {
+		t.Errorf("Expected option: %+v, actual: %+v", expected, m.option)
+	}
+}
+
+func TestOptionFuncDefault(t *testing.T) {
+	sess := session.Must(session.NewSession(&aws.Config{Region: aws.String("us-east-1")}))
+	m := New(sess)
+	if _, ok := m.option.ChecksumStore.(*MemoryChecksumStore); !ok {
+		t.Error("MemoryChecksumStore should be used by default")
+	}
+	m.option.ChecksumStore = nil
+	if !reflect.DeepEqual(Option{}, m.option) {
+		t.Errorf("New without options should use the zero Option, actual: %+v", m.option)
+	}
+}
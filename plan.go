@@ -0,0 +1,108 @@
+// Copyright 2019 SEQSENSE, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package s3sync
+
+import (
+	"context"
+	"net/url"
+)
+
+// Action is the operation of a Change.
+type Action int
+
+const (
+	// ActionUpload uploads the local file to s3.
+	ActionUpload Action = iota
+	// ActionDownload downloads the object to the local file.
+	ActionDownload
+	// ActionCopy copies the object to the s3 destination.
+	ActionCopy
+	// ActionDelete deletes the file from the destination by Option.Delete.
+	ActionDelete
+	// ActionSkip leaves the up-to-date file in the destination.
+	ActionSkip
+)
+
+func (a Action) String() string {
+	switch a {
+	case ActionUpload:
+		return "Upload"
+	case ActionDownload:
+		return "Download"
+	case ActionCopy:
+		return "Copy"
+	case ActionDelete:
+		return "Delete"
+	case ActionSkip:
+		return "Skip"
+	}
+	return "Unknown"
+}
+
+// Change is a change of the destination computed by Plan.
+type Change struct {
+	Action Action `json:"action"`
+	// Name is the path of the file relative to the sync root,
+	// separated by the os path separator.
+	Name string `json:"name"`
+	// Size is the size of the file in bytes.
+	Size int64 `json:"size"`
+}
+
+// Plan returns the changes which Sync would make from source to dest, without
+// transferring or deleting anything. The transfers come first, then the deletions
+// and the skipped files, each sorted by the name.
+// The sync runs in the manner of Option.DryRun, without the logs, Option.DeleteConfirmation
+// and the callbacks of the files.
+func (m *Manager) Plan(source, dest string) ([]Change, error) {
+	sourceURL, err := url.Parse(source)
+	if err != nil {
+		return nil, err
+	}
+	destURL, err := url.Parse(dest)
+	if err != nil {
+		return nil, err
+	}
+	transfer := ActionUpload
+	switch {
+	case isS3URL(sourceURL) && isS3URL(destURL):
+		transfer = ActionCopy
+	case isS3URL(sourceURL):
+		transfer = ActionDownload
+	}
+
+	option := m.option
+	option.DryRun = true
+	option.Logger = NopLogger{}
+	option.DeleteConfirmation = nil
+	option.OnFileStart = nil
+	option.OnFileDone = nil
+	dryRun := m.withOption(option)
+
+	recorder := &syncRecorder{}
+	if err := dryRun.sync(context.Background(), source, dest, recorder); err != nil {
+		return nil, err
+	}
+	result := recorder.result()
+
+	var changes []Change
+	add := func(action Action, files []FileInfo) {
+		for _, file := range files {
+			changes = append(changes, Change{Action: action, Name: file.Name, Size: file.Size})
+		}
+	}
+	add(transfer, result.Transferred)
+	add(ActionDelete, result.Deleted)
+	add(ActionSkip, result.Skipped)
+	return changes, nil
+}
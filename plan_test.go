@@ -0,0 +1,103 @@
+// Copyright 2019 SEQSENSE, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package s3sync
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPlan(t *testing.T) {
+	temp, err := ioutil.TempDir("", "s3synctest")
+	if err != nil {
+		t.Fatal("Failed to create temp dir")
+	}
+	defer os.RemoveAll(temp)
+
+	writeFile(t, filepath.Join(temp, "new.txt"), "new")
+	writeFile(t, filepath.Join(temp, "same.txt"), "same")
+	past := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(filepath.Join(temp, "same.txt"), past, past); err != nil {
+		t.Fatal(err)
+	}
+
+	client := newFakeS3()
+	client.putObject("example-bucket", "same.txt", []byte("same"), time.Now())
+	client.putObject("example-bucket", "extra.txt", []byte("extra"), time.Now())
+
+	var confirmed bool
+	m := &Manager{s3: client, option: Option{
+		Delete: true,
+		DeleteConfirmation: func([]FileInfo) error {
+			confirmed = true
+			return nil
+		},
+	}}
+
+	testCases := map[string]struct {
+		source, dest string
+		expected     []Change
+	}{
+		"Upload": {
+			temp, "s3://example-bucket",
+			[]Change{
+				{ActionUpload, "new.txt", 3},
+				{ActionDelete, "extra.txt", 5},
+				{ActionSkip, "same.txt", 4},
+			},
+		},
+		"Download": {
+			"s3://example-bucket", temp,
+			[]Change{
+				{ActionDownload, "extra.txt", 5},
+				// The object is newer than the local file.
+				{ActionDownload, "same.txt", 4},
+				{ActionDelete, "new.txt", 3},
+			},
+		},
+		"Copy": {
+			"s3://example-bucket", "s3://example-bucket/copy",
+			[]Change{
+				{ActionCopy, "extra.txt", 5},
+				{ActionCopy, "same.txt", 4},
+			},
+		},
+	}
+	for name, testCase := range testCases {
+		t.Run(name, func(t *testing.T) {
+			changes, err := m.Plan(testCase.source, testCase.dest)
+			if err != nil {
+				t.Fatal("Plan should be successful", err)
+			}
+			if !reflect.DeepEqual(testCase.expected, changes) {
+				t.Errorf("Expected changes %v, got %v", testCase.expected, changes)
+			}
+		})
+	}
+
+	// Nothing is changed by the plan.
+	for _, api := range []string{"PutObject", "CopyObject", "DeleteObjects", "GetObject"} {
+		if n := client.count(api); n != 0 {
+			t.Errorf("%s should not be called, called %d times", api, n)
+		}
+	}
+	fileExists(t, filepath.Join(temp, "new.txt"))
+	fileNotExists(t, filepath.Join(temp, "extra.txt"))
+	if confirmed {
+		t.Error("DeleteConfirmation should not be called by the plan")
+	}
+}
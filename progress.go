@@ -0,0 +1,128 @@
+// Copyright 2019 SEQSENSE, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package s3sync
+
+import (
+	"context"
+	"io"
+	"sync/atomic"
+	"time"
+)
+
+// progressWriterAt counts the bytes written to the underlying writer.
+type progressWriterAt struct {
+	w io.WriterAt
+	n int64
+}
+
+func (p *progressWriterAt) WriteAt(b []byte, off int64) (int, error) {
+	n, err := p.w.WriteAt(b, off)
+	atomic.AddInt64(&p.n, int64(n))
+	return n, err
+}
+
+// transferCounter counts the transferred files and bytes of a sync.
+type transferCounter struct {
+	files int64
+	bytes int64
+}
+
+func (t *transferCounter) add(bytes int64) {
+	atomic.AddInt64(&t.files, 1)
+	atomic.AddInt64(&t.bytes, bytes)
+}
+
+func (t *transferCounter) load() (files, bytes int64) {
+	return atomic.LoadInt64(&t.files), atomic.LoadInt64(&t.bytes)
+}
+
+// logProgress logs the cumulative progress and the current throughput every interval
+// by printf until the returned function is called.
+func logProgress(counter *transferCounter, interval time.Duration, printf func(string, ...interface{})) func() {
+	done := make(chan struct{})
+	finished := make(chan struct{})
+
+	go func() {
+		defer close(finished)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		_, lastBytes := counter.load()
+		last := time.Now()
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-ticker.C:
+				files, bytes := counter.load()
+				rate := float64(bytes-lastBytes) / now.Sub(last).Seconds() / (1024 * 1024)
+				printf("Progress: %d files, %d bytes transferred (%.2f MB/s)", files, bytes, rate)
+				lastBytes, last = bytes, now
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-finished
+	}
+}
+
+// minStallCheckInterval is the minimum interval of the progress checks of watchStall.
+const minStallCheckInterval = time.Millisecond
+
+// watchStall cancels the context when the counter doesn't change for the timeout.
+// The returned function stops watching and reports whether the stall was detected.
+func watchStall(cancel context.CancelFunc, counter *int64, timeout time.Duration) func() bool {
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	var stalled int32
+
+	go func() {
+		defer close(finished)
+
+		interval := timeout / 4
+		if interval < minStallCheckInterval {
+			interval = minStallCheckInterval
+		}
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		last := atomic.LoadInt64(counter)
+		lastChanged := time.Now()
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-ticker.C:
+				if n := atomic.LoadInt64(counter); n != last {
+					last = n
+					lastChanged = now
+					continue
+				}
+				if now.Sub(lastChanged) >= timeout {
+					atomic.StoreInt32(&stalled, 1)
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+
+	return func() bool {
+		close(done)
+		<-finished
+		return atomic.LoadInt32(&stalled) == 1
+	}
+}
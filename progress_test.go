@@ -0,0 +1,262 @@
+// Copyright 2019 SEQSENSE, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package s3sync
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// stallingS3 stops sending the object body mid-stream for the first
+// given number of GetObject calls.
+type stallingS3 struct {
+	*fakeS3
+	stalls int32
+}
+
+func (s *stallingS3) GetObjectWithContext(ctx aws.Context, input *s3.GetObjectInput, opts ...request.Option) (*s3.GetObjectOutput, error) {
+	output, err := s.fakeS3.GetObjectWithContext(ctx, input, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if atomic.AddInt32(&s.stalls, -1) >= 0 {
+		output.Body = ioutil.NopCloser(io.MultiReader(
+			io.LimitReader(output.Body, 1),
+			&blockingReader{ctx: ctx},
+		))
+	}
+	return output, nil
+}
+
+// blockingReader blocks until the context is cancelled.
+type blockingReader struct {
+	ctx aws.Context
+}
+
+func (b *blockingReader) Read([]byte) (int, error) {
+	<-b.ctx.Done()
+	return 0, b.ctx.Err()
+}
+
+func TestStallTimeout(t *testing.T) {
+	data := strings.Repeat("data", 100)
+
+	t.Run("Retried", func(t *testing.T) {
+		client := &stallingS3{fakeS3: newFakeS3(), stalls: 2}
+		client.putObject("example-bucket", "stall.txt", []byte(data), time.Now())
+
+		temp, err := ioutil.TempDir("", "s3synctest")
+		if err != nil {
+			t.Fatal("Failed to create temp dir")
+		}
+		defer os.RemoveAll(temp)
+
+		m := &Manager{s3: client, option: Option{StallTimeout: 100 * time.Millisecond}}
+		if err := m.Sync("s3://example-bucket", temp); err != nil {
+			t.Fatal("Sync should be successful after the retries", err)
+		}
+		fileHasSize(t, filepath.Join(temp, "stall.txt"), len(data))
+	})
+
+	t.Run("Aborted", func(t *testing.T) {
+		client := &stallingS3{fakeS3: newFakeS3(), stalls: maxStallRetries + 1}
+		client.putObject("example-bucket", "stall.txt", []byte(data), time.Now())
+
+		temp, err := ioutil.TempDir("", "s3synctest")
+		if err != nil {
+			t.Fatal("Failed to create temp dir")
+		}
+		defer os.RemoveAll(temp)
+
+		m := &Manager{s3: client, option: Option{StallTimeout: 100 * time.Millisecond}}
+		err = m.Sync("s3://example-bucket", temp)
+		if err == nil || !strings.Contains(err.Error(), ErrTransferStalled.Error()) {
+			t.Fatal("Sync should fail with the stall error", err)
+		}
+	})
+
+	t.Run("TinyTimeout", func(t *testing.T) {
+		var n int64
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		stop := watchStall(cancel, &n, time.Nanosecond)
+		<-ctx.Done()
+		if !stop() {
+			t.Error("The stall should be detected")
+		}
+	})
+}
+
+// slowS3 delays each GetObject.
+type slowS3 struct {
+	*fakeS3
+	delay time.Duration
+}
+
+func (s *slowS3) GetObjectWithContext(ctx aws.Context, input *s3.GetObjectInput, opts ...request.Option) (*s3.GetObjectOutput, error) {
+	time.Sleep(s.delay)
+	return s.fakeS3.GetObjectWithContext(ctx, input, opts...)
+}
+
+type captureLogger struct {
+	mu    sync.Mutex
+	lines []string
+}
+
+func (c *captureLogger) Log(v ...interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lines = append(c.lines, fmt.Sprint(v...))
+}
+
+func (c *captureLogger) Logf(format string, v ...interface{}) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lines = append(c.lines, fmt.Sprintf(format, v...))
+}
+
+func (c *captureLogger) linesWithPrefix(prefix string) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var lines []string
+	for _, line := range c.lines {
+		if strings.HasPrefix(line, prefix) {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
+
+func TestProgressInterval(t *testing.T) {
+	client := &slowS3{fakeS3: newFakeS3(), delay: 200 * time.Millisecond}
+	for _, key := range []string{"a", "b", "c"} {
+		client.putObject("example-bucket", key, []byte("data"), time.Now())
+	}
+
+	temp, err := ioutil.TempDir("", "s3synctest")
+	if err != nil {
+		t.Fatal("Failed to create temp dir")
+	}
+	defer os.RemoveAll(temp)
+
+	l := &captureLogger{}
+	m := &Manager{s3: client, option: Option{ProgressInterval: 50 * time.Millisecond, Logger: l}}
+	start := time.Now()
+	if err := m.Sync("s3://example-bucket", temp); err != nil {
+		t.Fatal("Sync should be successful", err)
+	}
+	elapsed := time.Since(start)
+
+	// Wait to confirm that the progress log is stopped after the sync.
+	n := len(l.linesWithPrefix("Progress:"))
+	time.Sleep(150 * time.Millisecond)
+	lines := l.linesWithPrefix("Progress:")
+	if len(lines) != n {
+		t.Error("Progress log should be stopped after the sync")
+	}
+
+	if len(lines) == 0 {
+		t.Fatal("Progress should be logged")
+	}
+	if max := int(elapsed/(50*time.Millisecond)) + 1; len(lines) > max {
+		t.Errorf("Progress log should be throttled, got %d lines in %v", len(lines), elapsed)
+	}
+	for _, line := range lines {
+		if !strings.Contains(line, "files") || !strings.Contains(line, "MB/s") {
+			t.Errorf("Unexpected progress log %q", line)
+		}
+	}
+}
+
+func TestFileCallbacks(t *testing.T) {
+	client := newFakeS3()
+	files := map[string]int{"a": 1, "b/c": 2, "b/d": 3}
+	for key, size := range files {
+		client.putObject("example-bucket", key, make([]byte, size), time.Now())
+	}
+
+	temp, err := ioutil.TempDir("", "s3synctest")
+	if err != nil {
+		t.Fatal("Failed to create temp dir")
+	}
+	defer os.RemoveAll(temp)
+
+	// The counters are not guarded since the callbacks are serialized.
+	started := make(map[string]int64)
+	done := make(map[string]int64)
+	var errs []error
+	m := &Manager{s3: client, option: Option{
+		OnFileStart: func(file FileInfo) {
+			started[filepath.ToSlash(file.Name)] = file.Size
+		},
+		OnFileDone: func(file FileInfo, n int64, err error) {
+			done[filepath.ToSlash(file.Name)] = n
+			if err != nil {
+				errs = append(errs, err)
+			}
+		},
+	}}
+
+	t.Run("Success", func(t *testing.T) {
+		if err := m.Sync("s3://example-bucket", filepath.Join(temp, "success")); err != nil {
+			t.Fatal("Sync should be successful", err)
+		}
+		if len(started) != len(files) || len(done) != len(files) {
+			t.Fatalf("The callbacks should be called for %d files, started %d, done %d", len(files), len(started), len(done))
+		}
+		for key, size := range files {
+			if started[key] != int64(size) {
+				t.Errorf("OnFileStart of %s should receive the size %d, got %d", key, size, started[key])
+			}
+			if done[key] != int64(size) {
+				t.Errorf("OnFileDone of %s should receive %d transferred bytes, got %d", key, size, done[key])
+			}
+		}
+		if len(errs) != 0 {
+			t.Errorf("OnFileDone should receive no error, got %v", errs)
+		}
+	})
+
+	t.Run("Error", func(t *testing.T) {
+		started = make(map[string]int64)
+		done = make(map[string]int64)
+		m.s3 = &kmsDeniedS3{fakeS3: client}
+		if err := m.Sync("s3://example-bucket", filepath.Join(temp, "error")); err == nil {
+			t.Fatal("Sync should fail")
+		}
+		if len(started) != len(files) || len(done) != len(files) {
+			t.Fatalf("The callbacks should be called for %d files, started %d, done %d", len(files), len(started), len(done))
+		}
+		for key, n := range done {
+			if n != 0 {
+				t.Errorf("No bytes of %s should be transferred, got %d", key, n)
+			}
+		}
+		if len(errs) != len(files) {
+			t.Errorf("OnFileDone should receive %d errors, got %v", len(files), errs)
+		}
+	})
+}
@@ -0,0 +1,128 @@
+// Copyright 2019 SEQSENSE, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package s3sync
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// defaultQuarantineThreshold is the default of Option.QuarantineThreshold.
+const defaultQuarantineThreshold = 3
+
+type quarantineEntry struct {
+	Failures    int       `json:"failures"`
+	LastFailure time.Time `json:"lastFailure"`
+}
+
+// quarantine records the consecutive failures of the objects to Option.QuarantineFile,
+// and skips the objects failed more than the threshold until the retry interval passes.
+// The methods of nil quarantine do nothing.
+type quarantine struct {
+	mutex         sync.Mutex
+	filename      string
+	threshold     int
+	retryInterval time.Duration
+	entries       map[string]*quarantineEntry
+}
+
+// openQuarantine loads the quarantine file, or returns nil if it isn't configured.
+func (m *Manager) openQuarantine() (*quarantine, error) {
+	if m.option.QuarantineFile == "" {
+		return nil, nil
+	}
+	q := &quarantine{
+		filename:      m.option.QuarantineFile,
+		threshold:     m.option.QuarantineThreshold,
+		retryInterval: m.option.QuarantineRetryInterval,
+		entries:       make(map[string]*quarantineEntry),
+	}
+	if q.threshold <= 0 {
+		q.threshold = defaultQuarantineThreshold
+	}
+
+	data, err := ioutil.ReadFile(q.filename)
+	if os.IsNotExist(err) {
+		return q, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &q.entries); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// isQuarantined returns true if the object should be skipped in this sync.
+func (q *quarantine) isQuarantined(key string) bool {
+	if q == nil {
+		return false
+	}
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	entry, ok := q.entries[key]
+	if !ok || entry.Failures < q.threshold {
+		return false
+	}
+	// The quarantined object is retried periodically.
+	return time.Since(entry.LastFailure) < q.retryInterval
+}
+
+func (q *quarantine) recordFailure(key string) {
+	if q == nil {
+		return
+	}
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	entry, ok := q.entries[key]
+	if !ok {
+		entry = &quarantineEntry{}
+		q.entries[key] = entry
+	}
+	entry.Failures++
+	entry.LastFailure = time.Now()
+}
+
+func (q *quarantine) recordSuccess(key string) {
+	if q == nil {
+		return
+	}
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	delete(q.entries, key)
+}
+
+// save writes the entries to the quarantine file atomically.
+func (q *quarantine) save() error {
+	if q == nil {
+		return nil
+	}
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	data, err := json.Marshal(q.entries)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(q.filename), 0755); err != nil {
+		return err
+	}
+	tmp := q.filename + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, q.filename)
+}
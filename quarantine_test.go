@@ -0,0 +1,108 @@
+// Copyright 2019 SEQSENSE, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package s3sync
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// failingKeyS3 fails GetObject of the key while failing is set.
+type failingKeyS3 struct {
+	*fakeS3
+	key     string
+	failing int32
+}
+
+func (f *failingKeyS3) GetObjectWithContext(ctx aws.Context, input *s3.GetObjectInput, opts ...request.Option) (*s3.GetObjectOutput, error) {
+	if aws.StringValue(input.Key) == f.key {
+		f.called("GetBadObject")
+		if atomic.LoadInt32(&f.failing) == 1 {
+			return nil, errors.New("permanently broken")
+		}
+	}
+	return f.fakeS3.GetObjectWithContext(ctx, input, opts...)
+}
+
+func TestQuarantine(t *testing.T) {
+	temp, err := ioutil.TempDir("", "s3synctest")
+	if err != nil {
+		t.Fatal("Failed to create temp dir")
+	}
+	defer os.RemoveAll(temp)
+	dest := filepath.Join(temp, "dest")
+
+	fake := newFakeS3()
+	fake.putObject("example-bucket", "good.txt", []byte("good"), time.Now())
+	fake.putObject("example-bucket", "bad.txt", []byte("bad"), time.Now())
+	client := &failingKeyS3{fakeS3: fake, key: "bad.txt", failing: 1}
+
+	retryInterval := 200 * time.Millisecond
+	sync := func() error {
+		// Each sync runs by a new Manager like the scheduled processes.
+		m := &Manager{s3: client, option: Option{
+			QuarantineFile:          filepath.Join(temp, "quarantine.json"),
+			QuarantineThreshold:     2,
+			QuarantineRetryInterval: retryInterval,
+		}}
+		return m.Sync("s3://example-bucket", dest)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := sync(); err == nil {
+			t.Fatal("Sync should fail until the object is quarantined")
+		}
+	}
+	fileExists(t, filepath.Join(dest, "good.txt"))
+
+	// The quarantined object is skipped without the error.
+	if err := sync(); err != nil {
+		t.Fatal("The quarantined object should not fail the sync", err)
+	}
+	if n := fake.count("GetBadObject"); n != 2 {
+		t.Errorf("The quarantined object should not be downloaded, got %d", n)
+	}
+
+	// The object is retried after the interval, and quarantined again on failure.
+	time.Sleep(retryInterval)
+	if err := sync(); err == nil {
+		t.Fatal("The retried object should fail")
+	}
+	if err := sync(); err != nil {
+		t.Fatal("The object should be quarantined again", err)
+	}
+	if n := fake.count("GetBadObject"); n != 3 {
+		t.Errorf("The quarantined object should be retried once, got %d", n)
+	}
+
+	// The recovered object is removed from the quarantine.
+	atomic.StoreInt32(&client.failing, 0)
+	time.Sleep(retryInterval)
+	if err := sync(); err != nil {
+		t.Fatal("The recovered object should be downloaded", err)
+	}
+	fileExists(t, filepath.Join(dest, "bad.txt"))
+	data, err := ioutil.ReadFile(filepath.Join(temp, "quarantine.json"))
+	if err != nil || string(data) != "{}" {
+		t.Errorf("The quarantine should be empty, actual: %s", data)
+	}
+}
@@ -0,0 +1,71 @@
+// Copyright 2019 SEQSENSE, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package s3sync
+
+import (
+	"context"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// withBucketRegions returns the Manager whose clients access the source and the
+// dest buckets in their regions by Option.AutoRegion, or m itself if it is not
+// enabled. The empty bucket name is of the local path.
+func (m *Manager) withBucketRegions(ctx context.Context, sourceBucket, destBucket string) (*Manager, error) {
+	if !m.option.AutoRegion || m.regionClient == nil {
+		return m, nil
+	}
+	source, dest := m.s3, m.destS3
+	if sourceBucket != "" {
+		var err error
+		if source, err = m.bucketClient(ctx, sourceBucket); err != nil {
+			return nil, err
+		}
+	}
+	if destBucket != "" {
+		client, err := m.bucketClient(ctx, destBucket)
+		if err != nil {
+			return nil, err
+		}
+		if client != source {
+			dest = client
+		}
+	}
+	return &Manager{s3: source, destS3: dest, option: m.option, limiter: m.rateLimiter()}, nil
+}
+
+// bucketClient returns the client of the region of the bucket, which is cached
+// in the Manager.
+func (m *Manager) bucketClient(ctx context.Context, bucket string) (s3iface.S3API, error) {
+	m.bucketMutex.Lock()
+	defer m.bucketMutex.Unlock()
+	if client, ok := m.bucketClients[bucket]; ok {
+		return client, nil
+	}
+	output, err := m.s3.GetBucketLocationWithContext(ctx, &s3.GetBucketLocationInput{
+		Bucket: aws.String(bucket),
+	})
+	if err != nil {
+		return nil, err
+	}
+	// The location of us-east-1 is empty.
+	region := s3.NormalizeBucketLocation(aws.StringValue(output.LocationConstraint))
+	client := m.regionClient(region)
+	if m.bucketClients == nil {
+		m.bucketClients = make(map[string]s3iface.S3API)
+	}
+	m.bucketClients[bucket] = client
+	return client, nil
+}
@@ -0,0 +1,142 @@
+// Copyright 2019 SEQSENSE, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package s3sync
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// locationS3 returns the location of the buckets by GetBucketLocation.
+type locationS3 struct {
+	*fakeS3
+	locations map[string]string
+}
+
+func (l *locationS3) GetBucketLocationWithContext(ctx aws.Context, input *s3.GetBucketLocationInput, opts ...request.Option) (*s3.GetBucketLocationOutput, error) {
+	l.called("GetBucketLocation")
+	return &s3.GetBucketLocationOutput{
+		LocationConstraint: aws.String(l.locations[aws.StringValue(input.Bucket)]),
+	}, nil
+}
+
+func TestAutoRegion(t *testing.T) {
+	temp, err := ioutil.TempDir("", "s3synctest")
+	if err != nil {
+		t.Fatal("Failed to create temp dir")
+	}
+	defer os.RemoveAll(temp)
+
+	// The objects are only accessible by the client of the bucket region.
+	regional := newFakeS3()
+	regional.putObject("example-bucket", "a.txt", []byte("data"), time.Now())
+	regional.createBucket("dest-bucket")
+	client := &locationS3{fakeS3: newFakeS3(), locations: map[string]string{
+		"example-bucket": "eu-west-1",
+		"dest-bucket":    "EU",
+	}}
+
+	var regions []string
+	m := &Manager{s3: client, option: Option{AutoRegion: true}}
+	m.regionClient = func(region string) s3iface.S3API {
+		regions = append(regions, region)
+		return regional
+	}
+	for i := 0; i < 2; i++ {
+		if err := m.Sync("s3://example-bucket", temp); err != nil {
+			t.Fatal("Sync should be successful", err)
+		}
+	}
+	fileHasContent(t, filepath.Join(temp, "a.txt"), "data")
+	if err := m.Sync("s3://example-bucket", "s3://dest-bucket"); err != nil {
+		t.Fatal("Sync should be successful", err)
+	}
+	if _, ok := regional.getObject("dest-bucket", "a.txt"); !ok {
+		t.Error("The object should be copied by the client of the region")
+	}
+
+	if n := client.count("GetBucketLocation"); n != 2 {
+		t.Errorf("The location should be looked up once per bucket, got %d", n)
+	}
+	if !reflect.DeepEqual([]string{"eu-west-1", "eu-west-1"}, regions) {
+		t.Errorf("The clients of the bucket regions should be created, got %v", regions)
+	}
+
+	// The region is not looked up without the option.
+	m = &Manager{s3: client, regionClient: m.regionClient}
+	if err := m.Sync("s3://example-bucket", temp); err == nil {
+		t.Error("Sync should access the bucket by the default client")
+	}
+	if n := client.count("GetBucketLocation"); n != 2 {
+		t.Errorf("The location should not be looked up, got %d", n)
+	}
+}
+
+func TestAutoRegionDerivedManager(t *testing.T) {
+	temp, err := ioutil.TempDir("", "s3synctest")
+	if err != nil {
+		t.Fatal("Failed to create temp dir")
+	}
+	defer os.RemoveAll(temp)
+	writeFile(t, filepath.Join(temp, ".s3syncignore"), "*.o\n")
+	writeFile(t, filepath.Join(temp, "ignored.o"), "ignored")
+
+	// The objects are only accessible by the client of the bucket region.
+	regional := newFakeS3()
+	regional.putObject("example-bucket", "a.txt", []byte("data"), time.Now())
+	client := &locationS3{fakeS3: newFakeS3(), locations: map[string]string{
+		"example-bucket": "eu-west-1",
+	}}
+	m := &Manager{s3: client, option: Option{AutoRegion: true, UseIgnoreFile: true}}
+	m.regionClient = func(region string) s3iface.S3API { return regional }
+
+	changes, err := m.Plan("s3://example-bucket", temp)
+	if err != nil {
+		t.Fatal("Plan should be successful", err)
+	}
+	if expected := []Change{{ActionDownload, "a.txt", 4}}; !reflect.DeepEqual(expected, changes) {
+		t.Errorf("Expected changes %v, got %v", expected, changes)
+	}
+	if err := m.Sync("s3://example-bucket", temp); err != nil {
+		t.Fatal("Sync with the ignore file should be successful", err)
+	}
+	fileHasContent(t, filepath.Join(temp, "a.txt"), "data")
+}
+
+func TestAutoRegionClient(t *testing.T) {
+	sess := session.Must(session.NewSession(&aws.Config{Region: aws.String("us-east-1")}))
+	m := NewWithOption(sess, &Option{AutoRegion: true, ForcePathStyle: true})
+	if m.regionClient("us-east-1") != m.s3 {
+		t.Error("The client of the session region should be used as is")
+	}
+	client, ok := m.regionClient("eu-west-1").(*s3.S3)
+	if !ok {
+		t.Fatal("The client of the region should be created")
+	}
+	if region := aws.StringValue(client.Config.Region); region != "eu-west-1" {
+		t.Errorf("The region of the client should be adjusted, got %s", region)
+	}
+	if !aws.BoolValue(client.Config.S3ForcePathStyle) {
+		t.Error("The client of the region should keep the other configs")
+	}
+}
@@ -0,0 +1,54 @@
+// Copyright 2019 SEQSENSE, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package s3sync
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+)
+
+// Reporter receives the result of a sync.
+type Reporter interface {
+	// Report is called at the end of each sync with the result and the error
+	// of the sync, which is nil on success.
+	Report(result *SyncResult, err error) error
+}
+
+// JSONReporter writes the results as JSON lines to the writer.
+type JSONReporter struct {
+	mutex sync.Mutex
+	w     io.Writer
+}
+
+// NewJSONReporter returns a new JSONReporter writing to w.
+func NewJSONReporter(w io.Writer) *JSONReporter {
+	return &JSONReporter{w: w}
+}
+
+// jsonReport is the line written by JSONReporter.
+type jsonReport struct {
+	*SyncResult
+	Error string `json:"error,omitempty"`
+}
+
+// Report writes the result with the error message.
+func (r *JSONReporter) Report(result *SyncResult, err error) error {
+	report := jsonReport{SyncResult: result}
+	if err != nil {
+		report.Error = err.Error()
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return json.NewEncoder(r.w).Encode(report)
+}
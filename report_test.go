@@ -0,0 +1,75 @@
+// Copyright 2019 SEQSENSE, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package s3sync
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// errorWriter fails all the writes.
+type errorWriter struct{}
+
+func (errorWriter) Write([]byte) (int, error) {
+	return 0, errors.New("write failed")
+}
+
+func TestJSONReporter(t *testing.T) {
+	temp, err := ioutil.TempDir("", "s3synctest")
+	if err != nil {
+		t.Fatal("Failed to create temp dir")
+	}
+	defer os.RemoveAll(temp)
+
+	client := newFakeS3()
+	client.putObject("example-bucket", "a.txt", []byte("a"), time.Now())
+
+	buf := &bytes.Buffer{}
+	m := &Manager{s3: client, option: Option{Reporter: NewJSONReporter(buf)}}
+	if err := m.Sync("s3://example-bucket", temp); err != nil {
+		t.Fatal("Sync should be successful", err)
+	}
+	if err := m.Sync("s3://missing-bucket", temp); err == nil {
+		t.Fatal("Sync from the missing bucket should fail")
+	}
+
+	decoder := json.NewDecoder(buf)
+	var reports []jsonReport
+	for decoder.More() {
+		report := jsonReport{SyncResult: &SyncResult{}}
+		if err := decoder.Decode(&report); err != nil {
+			t.Fatal("The report should be JSON", err)
+		}
+		reports = append(reports, report)
+	}
+	if len(reports) != 2 {
+		t.Fatalf("Each sync should be reported, got %d reports", len(reports))
+	}
+	if reports[0].Error != "" || len(reports[0].Transferred) != 1 || reports[0].Transferred[0].Name != "a.txt" || reports[0].Transferred[0].Size != 1 {
+		t.Errorf("Unexpected report of the successful sync: %+v", reports[0])
+	}
+	if reports[1].Error == "" {
+		t.Errorf("The error should be reported: %+v", reports[1])
+	}
+
+	m.option.Reporter = NewJSONReporter(errorWriter{})
+	if err := m.Sync("s3://example-bucket", filepath.Join(temp, "dest")); err == nil {
+		t.Error("The report error should be returned")
+	}
+}
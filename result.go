@@ -0,0 +1,145 @@
+// Copyright 2019 SEQSENSE, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package s3sync
+
+import (
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// SyncResult is the files processed by a sync.
+type SyncResult struct {
+	// Transferred is the files transferred to the destination.
+	Transferred []FileInfo `json:"transferred"`
+	// Deleted is the files deleted from the destination by Option.Delete.
+	Deleted []FileInfo `json:"deleted"`
+	// Skipped is the files which are up-to-date in the destination.
+	Skipped []FileInfo `json:"skipped"`
+}
+
+// SyncStats is the numbers of the files processed by a sync.
+type SyncStats struct {
+	FilesTransferred int   `json:"filesTransferred"`
+	BytesTransferred int64 `json:"bytesTransferred"`
+	FilesDeleted     int   `json:"filesDeleted"`
+	FilesSkipped     int   `json:"filesSkipped"`
+}
+
+// Stats returns the statistics of the result.
+func (r *SyncResult) Stats() *SyncStats {
+	stats := &SyncStats{
+		FilesTransferred: len(r.Transferred),
+		FilesDeleted:     len(r.Deleted),
+		FilesSkipped:     len(r.Skipped),
+	}
+	for _, file := range r.Transferred {
+		stats.BytesTransferred += file.Size
+	}
+	return stats
+}
+
+// syncRecorder records the processed files during a sync.
+type syncRecorder struct {
+	mutex       sync.Mutex
+	transferred []*fileInfo
+	deleted     []*fileInfo
+	skipped     []*fileInfo
+	// listed is the names of the source files, recorded for Option.Delete.
+	listed map[string]struct{}
+}
+
+func (r *syncRecorder) addTransferred(file *fileInfo) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.transferred = append(r.transferred, file)
+}
+
+func (r *syncRecorder) addSkipped(file *fileInfo) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.skipped = append(r.skipped, file)
+}
+
+func (r *syncRecorder) addDeleted(file *fileInfo) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.deleted = append(r.deleted, file)
+}
+
+func (r *syncRecorder) addListed(name string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.listed == nil {
+		r.listed = make(map[string]struct{})
+	}
+	r.listed[name] = struct{}{}
+}
+
+// unlisted returns the destination files whose names are not listed in the source.
+func (r *syncRecorder) unlisted(destFiles []*fileInfo) []*fileInfo {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	var files []*fileInfo
+	for _, file := range destFiles {
+		if _, ok := r.listed[file.name]; !ok {
+			files = append(files, file)
+		}
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].path < files[j].path
+	})
+	return files
+}
+
+// merge records the files of the other recorder with the names under dir.
+func (r *syncRecorder) merge(other *syncRecorder, dir string) {
+	prefixed := func(files []*fileInfo) []*fileInfo {
+		result := make([]*fileInfo, len(files))
+		for i, file := range files {
+			copied := *file
+			copied.name = filepath.Join(dir, file.name)
+			result[i] = &copied
+		}
+		return result
+	}
+	other.mutex.Lock()
+	defer other.mutex.Unlock()
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.transferred = append(r.transferred, prefixed(other.transferred)...)
+	r.deleted = append(r.deleted, prefixed(other.deleted)...)
+	r.skipped = append(r.skipped, prefixed(other.skipped)...)
+}
+
+// result returns the recorded files sorted by the name.
+func (r *syncRecorder) result() *SyncResult {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return &SyncResult{
+		Transferred: toSortedFileInfos(r.transferred),
+		Deleted:     toSortedFileInfos(r.deleted),
+		Skipped:     toSortedFileInfos(r.skipped),
+	}
+}
+
+func toSortedFileInfos(files []*fileInfo) []FileInfo {
+	infos := make([]FileInfo, len(files))
+	for i, file := range files {
+		infos[i] = file.toFileInfo()
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Name < infos[j].Name
+	})
+	return infos
+}
@@ -0,0 +1,130 @@
+// Copyright 2019 SEQSENSE, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package s3sync
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSyncWithResult(t *testing.T) {
+	temp, err := ioutil.TempDir("", "s3synctest")
+	if err != nil {
+		t.Fatal("Failed to create temp dir")
+	}
+	defer os.RemoveAll(temp)
+
+	client := newFakeS3()
+	client.putObject("example-bucket", "new.txt", []byte("new"), time.Now())
+	client.putObject("example-bucket", "dir/changed.txt", []byte("changed"), time.Now())
+	client.putObject("example-bucket", "dir/uptodate.txt", []byte("uptodate"), time.Now().Add(-time.Hour))
+
+	writeFile(t, filepath.Join(temp, "dir/changed.txt"), "old")
+	writeFile(t, filepath.Join(temp, "dir/uptodate.txt"), "uptodate")
+	writeFile(t, filepath.Join(temp, "localonly.txt"), "local")
+
+	m := &Manager{s3: client}
+	result, err := m.SyncWithResult("s3://example-bucket", temp)
+	if err != nil {
+		t.Fatal("Sync should be successful", err)
+	}
+
+	names := func(files []FileInfo) []string {
+		names := []string{}
+		for _, file := range files {
+			names = append(names, filepath.ToSlash(file.Name))
+		}
+		return names
+	}
+	if expected := []string{"dir/changed.txt", "new.txt"}; !reflect.DeepEqual(expected, names(result.Transferred)) {
+		t.Errorf("Expected transferred: %v, actual: %v", expected, names(result.Transferred))
+	}
+	if expected := []string{"dir/uptodate.txt"}; !reflect.DeepEqual(expected, names(result.Skipped)) {
+		t.Errorf("Expected skipped: %v, actual: %v", expected, names(result.Skipped))
+	}
+	if len(result.Deleted) != 0 {
+		t.Errorf("Nothing should be deleted, actual: %v", names(result.Deleted))
+	}
+	if result.Transferred[0].Size != int64(len("changed")) {
+		t.Errorf("Transferred file should have the source size, actual: %d", result.Transferred[0].Size)
+	}
+}
+
+func TestSyncWithResultError(t *testing.T) {
+	m := &Manager{s3: newFakeS3()}
+	result, err := m.SyncWithResult("s3://missing-bucket", "dest")
+	if err == nil {
+		t.Fatal("Sync from the missing bucket should fail")
+	}
+	if result == nil || len(result.Transferred) != 0 {
+		t.Error("The empty result should be returned on failure", result)
+	}
+}
+
+func TestSyncWithStats(t *testing.T) {
+	temp, err := ioutil.TempDir("", "s3synctest")
+	if err != nil {
+		t.Fatal("Failed to create temp dir")
+	}
+	defer os.RemoveAll(temp)
+
+	client := newFakeS3()
+	client.putObject("example-bucket", "a.txt", []byte("a"), time.Now())
+	client.putObject("example-bucket", "dir/b.txt", []byte("bb"), time.Now())
+	client.putObject("example-bucket", "uptodate.txt", []byte("uptodate"), time.Now().Add(-time.Hour))
+
+	writeFile(t, filepath.Join(temp, "uptodate.txt"), "uptodate")
+	writeFile(t, filepath.Join(temp, "stale.txt"), "stale")
+
+	m := &Manager{s3: client, option: Option{Delete: true}}
+	stats, err := m.SyncWithStats("s3://example-bucket", temp)
+	if err != nil {
+		t.Fatal("Sync should be successful", err)
+	}
+	expected := &SyncStats{FilesTransferred: 2, BytesTransferred: 3, FilesDeleted: 1, FilesSkipped: 1}
+	if !reflect.DeepEqual(expected, stats) {
+		t.Errorf("Expected stats %+v, got %+v", expected, stats)
+	}
+}
+
+func TestSyncResultJSON(t *testing.T) {
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	result := &SyncResult{
+		Transferred: []FileInfo{{Name: "a.txt", Size: 1, ModTime: modTime}},
+		Deleted:     []FileInfo{},
+		Skipped:     []FileInfo{{Name: "b.txt", Size: 2, ModTime: modTime}},
+	}
+
+	data, err := json.Marshal(result)
+	if err != nil {
+		t.Fatal("Failed to marshal", err)
+	}
+	expected := `{"transferred":[{"name":"a.txt","size":1,"modTime":"2020-01-02T03:04:05Z"}],` +
+		`"deleted":[],"skipped":[{"name":"b.txt","size":2,"modTime":"2020-01-02T03:04:05Z"}]}`
+	if string(data) != expected {
+		t.Errorf("Expected: %s, actual: %s", expected, data)
+	}
+
+	var decoded SyncResult
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		t.Fatal("Failed to unmarshal", err)
+	}
+	if !reflect.DeepEqual(result, &decoded) {
+		t.Errorf("The result should be round-tripped, expected: %+v, actual: %+v", result, decoded)
+	}
+}
@@ -0,0 +1,348 @@
+// Copyright 2019 SEQSENSE, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package s3sync
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/awsutil"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// multipartState is the state of a resumable multipart upload recorded in
+// Option.ResumeStateDir.
+type multipartState struct {
+	Bucket   string              `json:"bucket"`
+	Key      string              `json:"key"`
+	UploadID string              `json:"uploadId"`
+	Size     int64               `json:"size"`
+	ModTime  time.Time           `json:"modTime"`
+	PartSize int64               `json:"partSize"`
+	Parts    []*s3.CompletedPart `json:"parts"`
+}
+
+// multipartPartSize returns the part size of the file, which is the same as the one
+// s3manager uses.
+func (m *Manager) multipartPartSize(size int64) int64 {
+	partSize := m.option.PartSize
+	if partSize == 0 {
+		partSize = s3manager.DefaultUploadPartSize
+	}
+	maxParts := int64(m.option.MaxUploadParts)
+	if maxParts == 0 {
+		maxParts = s3manager.MaxUploadParts
+	}
+	if size/partSize >= maxParts {
+		partSize = size/maxParts + 1
+	}
+	return partSize
+}
+
+// isResumable returns true if the file is uploaded by the resumable part loop.
+func (m *Manager) isResumable(file *fileInfo) bool {
+	return m.option.ResumeStateDir != "" && !m.option.DisableMultipart &&
+		file.size >= m.option.SinglePartThreshold &&
+		file.size >= m.multipartPartSize(file.size)
+}
+
+// uploadResumable uploads the file by the multipart upload, recording the completed
+// parts to the state file. If the state of the previous upload of the same file is
+// found, the upload continues from the parts which are already uploaded.
+// The state is kept on error, so that the next sync can resume the upload.
+func (m *Manager) uploadResumable(ctx context.Context, file *fileInfo, body io.ReadSeeker, input *s3manager.UploadInput) error {
+	stateFile := m.stateFilename(*input.Bucket, *input.Key)
+	partSize := m.multipartPartSize(file.size)
+
+	state, err := m.resumeMultipartState(ctx, stateFile, file, input, partSize)
+	if err != nil {
+		return err
+	}
+	if state == nil {
+		createInput := &s3.CreateMultipartUploadInput{}
+		awsutil.Copy(createInput, input)
+		output, err := m.s3.CreateMultipartUploadWithContext(ctx, createInput)
+		if err != nil {
+			return err
+		}
+		state = &multipartState{
+			Bucket:   *input.Bucket,
+			Key:      *input.Key,
+			UploadID: aws.StringValue(output.UploadId),
+			Size:     file.size,
+			ModTime:  file.lastModified,
+			PartSize: partSize,
+		}
+		if err := writeMultipartState(stateFile, state); err != nil {
+			return err
+		}
+	}
+
+	completed := make(map[int64]bool)
+	for _, part := range state.Parts {
+		completed[aws.Int64Value(part.PartNumber)] = true
+	}
+
+	buf := make([]byte, partSize)
+	for number, offset := int64(1), int64(0); offset < file.size; number, offset = number+1, offset+partSize {
+		if completed[number] {
+			continue
+		}
+		if _, err := body.Seek(offset, io.SeekStart); err != nil {
+			return err
+		}
+		n, err := io.ReadFull(body, buf)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		partInput := &s3.UploadPartInput{
+			Bucket:               input.Bucket,
+			Key:                  input.Key,
+			UploadId:             aws.String(state.UploadID),
+			PartNumber:           aws.Int64(number),
+			Body:                 bytes.NewReader(buf[:n]),
+			SSECustomerAlgorithm: input.SSECustomerAlgorithm,
+			SSECustomerKey:       input.SSECustomerKey,
+			SSECustomerKeyMD5:    input.SSECustomerKeyMD5,
+		}
+		if m.option.VerifyUpload {
+			sum := md5.Sum(buf[:n])
+			partInput.ContentMD5 = aws.String(base64.StdEncoding.EncodeToString(sum[:]))
+		}
+		output, err := m.s3.UploadPartWithContext(ctx, partInput)
+		if err != nil {
+			return err
+		}
+		state.Parts = append(state.Parts, &s3.CompletedPart{
+			ETag:       output.ETag,
+			PartNumber: aws.Int64(number),
+		})
+		if err := writeMultipartState(stateFile, state); err != nil {
+			return err
+		}
+	}
+
+	sort.Slice(state.Parts, func(i, j int) bool {
+		return *state.Parts[i].PartNumber < *state.Parts[j].PartNumber
+	})
+	_, err = m.s3.CompleteMultipartUploadWithContext(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          input.Bucket,
+		Key:             input.Key,
+		UploadId:        aws.String(state.UploadID),
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: state.Parts},
+	})
+	if err != nil {
+		return err
+	}
+	return os.Remove(stateFile)
+}
+
+// resumeMultipartState loads the state of the previous upload of the file, and updates
+// the completed parts by ListParts. It returns nil if there is no upload to resume.
+func (m *Manager) resumeMultipartState(ctx context.Context, stateFile string, file *fileInfo, input *s3manager.UploadInput, partSize int64) (*multipartState, error) {
+	data, err := ioutil.ReadFile(stateFile)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	state := &multipartState{}
+	if err := json.Unmarshal(data, state); err != nil {
+		// The broken state is discarded.
+		return nil, nil
+	}
+	if state.Bucket != *input.Bucket || state.Key != *input.Key ||
+		state.Size != file.size || !state.ModTime.Equal(file.lastModified) || state.PartSize != partSize {
+		// The file has been changed since the previous upload.
+		m.abortMultipartUpload(ctx, state)
+		return nil, nil
+	}
+
+	// The parts are listed from s3 since the recorded ones may be lost
+	// or the upload may be finished between the upload and the recording.
+	state.Parts = nil
+	var marker *int64
+	for {
+		output, err := m.s3.ListPartsWithContext(ctx, &s3.ListPartsInput{
+			Bucket:           input.Bucket,
+			Key:              input.Key,
+			UploadId:         aws.String(state.UploadID),
+			PartNumberMarker: marker,
+		})
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchUpload {
+			// The upload has been completed or aborted.
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		}
+		for _, part := range output.Parts {
+			number := aws.Int64Value(part.PartNumber)
+			if aws.Int64Value(part.Size) != expectedPartSize(number, file.size, partSize) {
+				continue
+			}
+			state.Parts = append(state.Parts, &s3.CompletedPart{
+				ETag:       part.ETag,
+				PartNumber: part.PartNumber,
+			})
+		}
+		if !aws.BoolValue(output.IsTruncated) {
+			break
+		}
+		marker = output.NextPartNumberMarker
+	}
+	m.println("Resuming the upload of", file.name, "from", len(state.Parts), "uploaded parts")
+	return state, nil
+}
+
+func (m *Manager) abortMultipartUpload(ctx context.Context, state *multipartState) {
+	// The upload left by the failed abort is cleaned up by the lifecycle rule of the bucket.
+	m.s3.AbortMultipartUploadWithContext(ctx, &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(state.Bucket),
+		Key:      aws.String(state.Key),
+		UploadId: aws.String(state.UploadID),
+	})
+}
+
+// expectedPartSize returns the size of the part of the given number.
+func expectedPartSize(number, size, partSize int64) int64 {
+	if remaining := size - (number-1)*partSize; remaining < partSize {
+		return remaining
+	}
+	return partSize
+}
+
+// stateFilename returns the state file of the upload to the object.
+func (m *Manager) stateFilename(bucket, key string) string {
+	sum := sha256.Sum256([]byte(bucket + "/" + key))
+	return filepath.Join(m.option.ResumeStateDir, hex.EncodeToString(sum[:])+".json")
+}
+
+// writeMultipartState writes the state atomically not to leave the broken state on crash.
+func writeMultipartState(filename string, state *multipartState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return err
+	}
+	tmp := filename + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
+
+// resumeETagSuffix is the suffix of the file next to the temporary file of a download,
+// which records the ETag of the object the partial file is written from.
+const resumeETagSuffix = ".etag"
+
+// resumablePartial returns the info of the partial temporary file of the download
+// to be continued, or nil if the download starts over. The partial file is continued
+// only if it is written from the object of the same ETag. Otherwise the temporary
+// file is truncated, and the ETag of the object is recorded for the next attempt.
+func (m *Manager) resumablePartial(writer File, filename string, file *fileInfo) (os.FileInfo, error) {
+	stat, err := writer.Stat()
+	if err != nil {
+		return nil, err
+	}
+	recorded, err := m.readResumeETag(filename)
+	if err != nil {
+		return nil, err
+	}
+	if file.etag != "" && recorded == file.etag && stat.Size() > 0 && stat.Size() < file.size {
+		return stat, nil
+	}
+	if err := writer.Truncate(0); err != nil {
+		return nil, err
+	}
+	return nil, m.writeResumeETag(filename, file.etag)
+}
+
+// readResumeETag returns the ETag recorded for the temporary file, or empty if
+// it isn't recorded.
+func (m *Manager) readResumeETag(filename string) (string, error) {
+	f, err := m.fs().Open(filename + resumeETagSuffix)
+	if os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	data, err := ioutil.ReadAll(f)
+	if err != nil {
+		return "", err
+	}
+	return string(bytes.TrimSpace(data)), nil
+}
+
+// writeResumeETag records the ETag of the object written to the temporary file.
+func (m *Manager) writeResumeETag(filename, etag string) error {
+	f, err := m.fs().OpenFile(filename+resumeETagSuffix, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0666)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteAt([]byte(etag), 0)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// downloadRange downloads the rest of the object after the partial file by the ranged GET,
+// and returns the size of the whole downloaded file.
+// The download fails with PreconditionFailed if the object is no longer the one of
+// the ETag, which the partial file is written from.
+func (m *Manager) downloadRange(ctx context.Context, client s3iface.S3API, w io.WriterAt, input *s3.GetObjectInput, partial os.FileInfo, etag string) (int64, error) {
+	offset := partial.Size()
+	ranged := *input
+	ranged.Range = aws.String(fmt.Sprintf("bytes=%d-", offset))
+	ranged.IfMatch = aws.String(`"` + etag + `"`)
+	output, err := client.GetObjectWithContext(ctx, &ranged)
+	if err != nil {
+		return 0, err
+	}
+	defer output.Body.Close()
+
+	n, err := io.Copy(&offsetWriter{w: w, offset: offset}, output.Body)
+	return offset + n, err
+}
+
+// offsetWriter writes to the WriterAt sequentially from the offset.
+type offsetWriter struct {
+	w      io.WriterAt
+	offset int64
+}
+
+func (o *offsetWriter) Write(b []byte) (int, error) {
+	n, err := o.w.WriteAt(b, o.offset)
+	o.offset += int64(n)
+	return n, err
+}
@@ -0,0 +1,289 @@
+// Copyright 2019 SEQSENSE, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package s3sync
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// interruptingS3 fails UploadPart of the given part number to simulate an interruption,
+// and records the uploaded part numbers.
+type interruptingS3 struct {
+	*fakeS3
+	failPart int64
+
+	mutex sync.Mutex
+	parts []int64
+}
+
+func (i *interruptingS3) UploadPartWithContext(ctx aws.Context, input *s3.UploadPartInput, opts ...request.Option) (*s3.UploadPartOutput, error) {
+	number := aws.Int64Value(input.PartNumber)
+	if number == i.failPart {
+		return nil, errors.New("interrupted")
+	}
+	i.mutex.Lock()
+	i.parts = append(i.parts, number)
+	i.mutex.Unlock()
+	return i.fakeS3.UploadPartWithContext(ctx, input, opts...)
+}
+
+func setupResumeTest(t *testing.T) (string, string, []byte) {
+	temp, err := ioutil.TempDir("", "s3synctest")
+	if err != nil {
+		t.Fatal("Failed to create temp dir")
+	}
+	stateDir, err := ioutil.TempDir("", "s3syncstate")
+	if err != nil {
+		t.Fatal("Failed to create temp dir")
+	}
+	// 3 parts of 5 MiB, 5 MiB and 1 MiB.
+	data := bytes.Repeat([]byte("0123456789abcdef"), 11*1024*1024/16)
+	writeFile(t, filepath.Join(temp, "large.bin"), string(data))
+	return temp, stateDir, data
+}
+
+func stateFiles(t *testing.T, dir string) []os.FileInfo {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal("Failed to read the state dir", err)
+	}
+	return files
+}
+
+func TestResumableUpload(t *testing.T) {
+	temp, stateDir, data := setupResumeTest(t)
+	defer os.RemoveAll(temp)
+	defer os.RemoveAll(stateDir)
+
+	client := newFakeS3()
+	client.createBucket("example-bucket")
+	option := Option{ResumeStateDir: stateDir, PartSize: s3manager.MinUploadPartSize}
+
+	// The first process is interrupted at the 3rd part.
+	interrupted := &interruptingS3{fakeS3: client, failPart: 3}
+	m := &Manager{s3: interrupted, option: option}
+	results, err := m.SyncFanOut(temp, []string{"s3://example-bucket"})
+	if err != nil {
+		t.Fatal("SyncFanOut should be started", err)
+	}
+	if results["s3://example-bucket"] == nil {
+		t.Fatal("The interrupted upload should fail")
+	}
+	if n := len(stateFiles(t, stateDir)); n != 1 {
+		t.Fatalf("The state of the interrupted upload should be recorded, got %d files", n)
+	}
+
+	// The restarted process uploads only the remaining part.
+	resumed := &interruptingS3{fakeS3: client}
+	m = &Manager{s3: resumed, option: option}
+	results, err = m.SyncFanOut(temp, []string{"s3://example-bucket"})
+	if err != nil {
+		t.Fatal("SyncFanOut should be started", err)
+	}
+	if results["s3://example-bucket"] != nil {
+		t.Fatal("The resumed upload should be successful", results)
+	}
+
+	if len(resumed.parts) != 1 || resumed.parts[0] != 3 {
+		t.Errorf("Only the 3rd part should be uploaded on resume, uploaded: %v", resumed.parts)
+	}
+	if n := client.count("CreateMultipartUpload"); n != 1 {
+		t.Errorf("The multipart upload should be created once, got %d", n)
+	}
+	object, ok := client.getObject("example-bucket", "large.bin")
+	if !ok || !bytes.Equal(object.data, data) {
+		t.Error("The resumed object should have the whole content")
+	}
+	if n := len(stateFiles(t, stateDir)); n != 0 {
+		t.Errorf("The state should be removed after the completion, got %d files", n)
+	}
+}
+
+func TestResumableUploadChangedFile(t *testing.T) {
+	temp, stateDir, _ := setupResumeTest(t)
+	defer os.RemoveAll(temp)
+	defer os.RemoveAll(stateDir)
+
+	client := newFakeS3()
+	client.createBucket("example-bucket")
+	option := Option{ResumeStateDir: stateDir, PartSize: s3manager.MinUploadPartSize}
+
+	m := &Manager{s3: &interruptingS3{fakeS3: client, failPart: 2}, option: option}
+	if _, err := m.SyncFanOut(temp, []string{"s3://example-bucket"}); err != nil {
+		t.Fatal("SyncFanOut should be started", err)
+	}
+
+	// The file is modified before the restart.
+	filename := filepath.Join(temp, "large.bin")
+	if err := os.Chtimes(filename, time.Now(), time.Now().Add(time.Hour)); err != nil {
+		t.Fatal("Failed to change the modification time", err)
+	}
+
+	resumed := &interruptingS3{fakeS3: client}
+	m = &Manager{s3: resumed, option: option}
+	results, err := m.SyncFanOut(temp, []string{"s3://example-bucket"})
+	if err != nil {
+		t.Fatal("SyncFanOut should be started", err)
+	}
+	if results["s3://example-bucket"] != nil {
+		t.Fatal("The upload should be successful", results)
+	}
+	if len(resumed.parts) != 3 {
+		t.Errorf("All the parts should be uploaded again, uploaded: %v", resumed.parts)
+	}
+	if n := client.count("AbortMultipartUpload"); n != 1 {
+		t.Errorf("The stale upload should be aborted, got %d", n)
+	}
+}
+
+func TestResumableUploadLostUpload(t *testing.T) {
+	temp, stateDir, data := setupResumeTest(t)
+	defer os.RemoveAll(temp)
+	defer os.RemoveAll(stateDir)
+
+	client := newFakeS3()
+	client.createBucket("example-bucket")
+	option := Option{ResumeStateDir: stateDir, PartSize: s3manager.MinUploadPartSize}
+
+	m := &Manager{s3: &interruptingS3{fakeS3: client, failPart: 2}, option: option}
+	if _, err := m.SyncFanOut(temp, []string{"s3://example-bucket"}); err != nil {
+		t.Fatal("SyncFanOut should be started", err)
+	}
+
+	// The upload is aborted outside, e.g. by the lifecycle rule.
+	client.mu.Lock()
+	client.uploads = make(map[string]map[int64][]byte)
+	client.mu.Unlock()
+
+	m = &Manager{s3: client, option: option}
+	results, err := m.SyncFanOut(temp, []string{"s3://example-bucket"})
+	if err != nil {
+		t.Fatal("SyncFanOut should be started", err)
+	}
+	if results["s3://example-bucket"] != nil {
+		t.Fatal("The upload should be restarted from the beginning", results)
+	}
+	object, ok := client.getObject("example-bucket", "large.bin")
+	if !ok || !bytes.Equal(object.data, data) {
+		t.Error("The object should have the whole content")
+	}
+}
+
+func TestResumableDownload(t *testing.T) {
+	temp, err := ioutil.TempDir("", "s3synctest")
+	if err != nil {
+		t.Fatal("Failed to create temp dir")
+	}
+	defer os.RemoveAll(temp)
+	target := filepath.Join(temp, "a.txt")
+
+	t.Run("Partial", func(t *testing.T) {
+		client := newFakeS3()
+		object := client.putObject("example-bucket", "a.txt", []byte("0123456789"), time.Now().Add(-time.Hour))
+		writeFile(t, target+tempFileSuffix, "abcd")
+		writeFile(t, target+tempFileSuffix+resumeETagSuffix, normalizeETag(object.etag))
+
+		m := &Manager{s3: client, option: Option{Resume: true}}
+		if err := m.Sync("s3://example-bucket", temp); err != nil {
+			t.Fatal("Sync should be successful", err)
+		}
+		// Only the rest of the object is downloaded after the partial file.
+		fileHasContent(t, target, "abcd456789")
+		fileNotExists(t, target+tempFileSuffix)
+		fileNotExists(t, target+tempFileSuffix+resumeETagSuffix)
+		if n := client.count("GetObject"); n != 1 {
+			t.Errorf("Expected a ranged GetObject, got %d", n)
+		}
+	})
+
+	t.Run("Modified", func(t *testing.T) {
+		client := newFakeS3()
+		client.putObject("example-bucket", "a.txt", []byte("0123456789"), time.Now())
+		// The partial file is written from the object replaced after that.
+		writeFile(t, target+tempFileSuffix, "abcd")
+		writeFile(t, target+tempFileSuffix+resumeETagSuffix, "old-etag")
+
+		m := &Manager{s3: client, option: Option{Resume: true}}
+		if err := m.Sync("s3://example-bucket", temp); err != nil {
+			t.Fatal("Sync should be successful", err)
+		}
+		// The partial file of the older object is discarded.
+		fileHasContent(t, target, "0123456789")
+	})
+
+	t.Run("Interrupted", func(t *testing.T) {
+		os.Remove(target)
+		client := newFakeS3()
+		client.putObject("example-bucket", "a.txt", []byte("0123456789"), time.Now().Add(-time.Hour))
+
+		m := &Manager{s3: &shortGetS3{fakeS3: client}, option: Option{Resume: true}}
+		if err := m.Sync("s3://example-bucket", temp); err == nil {
+			t.Fatal("The short download should fail")
+		}
+		fileHasContent(t, target+tempFileSuffix, "01234")
+
+		m = &Manager{s3: client, option: Option{Resume: true}}
+		if err := m.Sync("s3://example-bucket", temp); err != nil {
+			t.Fatal("Sync should be successful", err)
+		}
+		fileHasContent(t, target, "0123456789")
+	})
+
+	t.Run("FailedParts", func(t *testing.T) {
+		os.Remove(target)
+		client := newFakeS3()
+		client.putObject("example-bucket", "a.txt", []byte("0123456789ABCDEF"), time.Now().Add(-time.Hour))
+
+		// The middle part fails while the later parts may succeed.
+		option := Option{Resume: true, DownloadPartSize: 4, DownloadConcurrency: 4}
+		failing := &failingRangeS3{fakeS3: client, fail: map[string]bool{"bytes=4-7": true, "bytes=12-15": true}}
+		m := &Manager{s3: failing, option: option}
+		if err := m.Sync("s3://example-bucket", temp); err == nil {
+			t.Fatal("The download should fail")
+		}
+		fileHasContent(t, target+tempFileSuffix, "0123")
+
+		m = &Manager{s3: client, option: option}
+		if err := m.Sync("s3://example-bucket", temp); err != nil {
+			t.Fatal("Sync should be successful", err)
+		}
+		fileHasContent(t, target, "0123456789ABCDEF")
+	})
+}
+
+// failingRangeS3 fails GetObject of the given ranges after a delay, so that the
+// later parts are downloaded before the failure if they are concurrent.
+type failingRangeS3 struct {
+	*fakeS3
+	fail map[string]bool
+}
+
+func (f *failingRangeS3) GetObjectWithContext(ctx aws.Context, input *s3.GetObjectInput, opts ...request.Option) (*s3.GetObjectOutput, error) {
+	if f.fail[aws.StringValue(input.Range)] {
+		time.Sleep(50 * time.Millisecond)
+		return nil, errors.New("part failed")
+	}
+	return f.fakeS3.GetObjectWithContext(ctx, input, opts...)
+}
@@ -0,0 +1,117 @@
+// Copyright 2019 SEQSENSE, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package s3sync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Retier changes the storage class of the objects under the s3 prefix to the given class
+// by copying each object onto itself, and returns the keys of the copied objects.
+// The metadata of the objects are kept as is. The objects already in the class are skipped.
+// The objects in the archive storage classes have to be restored before retiering.
+func (m *Manager) Retier(prefix, class string) ([]string, error) {
+	prefixURL, err := url.Parse(prefix)
+	if err != nil {
+		return nil, err
+	}
+	if !isS3URL(prefixURL) {
+		return nil, errors.New("prefix of Retier must be a s3 url")
+	}
+	prefixPath, err := urlToS3Path(prefixURL)
+	if err != nil {
+		return nil, err
+	}
+	if class == "" {
+		return nil, errors.New("storage class of Retier must not be empty")
+	}
+
+	ctx := context.Background()
+
+	var copied []string
+	var errMsgs []string
+	var token *string
+	sse := m.sseCustomer()
+	for {
+		list, err := m.s3.ListObjectsV2WithContext(ctx, &s3.ListObjectsV2Input{
+			Bucket:            &prefixPath.bucket,
+			Prefix:            aws.String(prefixPath.listPrefix()),
+			ContinuationToken: token,
+			MaxKeys:           m.maxKeys(),
+		})
+		if err != nil {
+			return copied, err
+		}
+
+		for _, object := range list.Contents {
+			if !prefixPath.match(*object.Key) {
+				continue
+			}
+			if _, ok := relativeKey(prefixPath.bucketPrefix, *object.Key); !ok {
+				continue
+			}
+			if storageClassOf(object) == class {
+				continue
+			}
+			if aws.Int64Value(object.Size) > maxSinglePartSize {
+				errMsgs = append(errMsgs, fmt.Sprintf("can't retier %s: the object is larger than the copy limit", *object.Key))
+				continue
+			}
+
+			m.println("Retiering", *object.Key, "from", storageClassOf(object), "to", class)
+			_, err := m.s3.CopyObjectWithContext(ctx, &s3.CopyObjectInput{
+				Bucket:                         &prefixPath.bucket,
+				Key:                            object.Key,
+				CopySource:                     aws.String(copySource(prefixPath.bucket, *object.Key)),
+				MetadataDirective:              aws.String(s3.MetadataDirectiveCopy),
+				StorageClass:                   aws.String(class),
+				SSECustomerAlgorithm:           sse.algorithm,
+				SSECustomerKey:                 sse.key,
+				SSECustomerKeyMD5:              sse.keyMD5,
+				CopySourceSSECustomerAlgorithm: sse.algorithm,
+				CopySourceSSECustomerKey:       sse.key,
+				CopySourceSSECustomerKeyMD5:    sse.keyMD5,
+			})
+			if err != nil {
+				errMsgs = append(errMsgs, err.Error())
+				continue
+			}
+			copied = append(copied, *object.Key)
+		}
+
+		if token = nextContinuationToken(list); token == nil {
+			break
+		}
+	}
+
+	if len(errMsgs) > 0 {
+		return copied, errors.New(strings.Join(errMsgs, "\n"))
+	}
+	return copied, nil
+}
+
+// storageClassOf returns the storage class of the listed object.
+// The listing may omit the class of the standard objects.
+func storageClassOf(object *s3.Object) string {
+	if class := aws.StringValue(object.StorageClass); class != "" {
+		return class
+	}
+	return s3.ObjectStorageClassStandard
+}
@@ -0,0 +1,69 @@
+// Copyright 2019 SEQSENSE, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package s3sync
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestRetier(t *testing.T) {
+	client := newFakeS3()
+	client.putObject("example-bucket", "data/standard.txt", []byte("a"), time.Now())
+	client.putObject("example-bucket", "data/dir/standard.txt", []byte("b"), time.Now())
+	client.putObject("example-bucket", "data/ia.txt", []byte("c"), time.Now()).storageClass = s3.StorageClassStandardIa
+	glacier := client.putObject("example-bucket", "data/glacier.txt", []byte("d"), time.Now())
+	glacier.storageClass = s3.StorageClassGlacier
+	glacier.metadata = map[string]*string{"Owner": aws.String("me")}
+	client.putObject("example-bucket", "other/standard.txt", []byte("e"), time.Now())
+
+	m := &Manager{s3: client}
+	copied, err := m.Retier("s3://example-bucket/data", s3.StorageClassStandardIa)
+	if err != nil {
+		t.Fatal("Retier should be successful", err)
+	}
+
+	expected := []string{"data/dir/standard.txt", "data/glacier.txt", "data/standard.txt"}
+	if !reflect.DeepEqual(expected, copied) {
+		t.Errorf("Expected copied: %v, actual: %v", expected, copied)
+	}
+	if n := client.count("CopyObject"); n != 3 {
+		t.Errorf("Only the mis-tiered objects should be copied, got %d copies", n)
+	}
+	for _, key := range expected {
+		object, _ := client.getObject("example-bucket", key)
+		if object.storageClass != s3.StorageClassStandardIa {
+			t.Errorf("%s should be in %s, actual: %s", key, s3.StorageClassStandardIa, object.storageClass)
+		}
+	}
+	if object, _ := client.getObject("example-bucket", "data/glacier.txt"); aws.StringValue(object.metadata["Owner"]) != "me" {
+		t.Error("The metadata should be kept")
+	}
+	if object, _ := client.getObject("example-bucket", "other/standard.txt"); object.storageClass != "" {
+		t.Error("The object outside of the prefix should not be copied")
+	}
+}
+
+func TestRetierInvalidArgs(t *testing.T) {
+	m := &Manager{s3: newFakeS3()}
+	if _, err := m.Retier("foo", s3.StorageClassStandardIa); err == nil {
+		t.Error("prefix must be a s3 url")
+	}
+	if _, err := m.Retier("s3://foo", ""); err == nil {
+		t.Error("storage class must not be empty")
+	}
+}
@@ -0,0 +1,83 @@
+// Copyright 2019 SEQSENSE, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package s3sync
+
+import (
+	"context"
+	"math/rand"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+// defaultRetryBaseDelay is the default of Option.RetryBaseDelay.
+const defaultRetryBaseDelay = 100 * time.Millisecond
+
+// maxRetryDelay is the upper limit of the delay between the retries.
+const maxRetryDelay = 20 * time.Second
+
+// retry calls f until it succeeds, returns a non-retryable error, or fails
+// Option.MaxRetries times after the first attempt. The retries are delayed
+// by the jittered exponential backoff.
+func (m *Manager) retry(ctx context.Context, f func() error) error {
+	base := m.option.RetryBaseDelay
+	if base <= 0 {
+		base = defaultRetryBaseDelay
+	}
+	for retry := 0; ; retry++ {
+		err := f()
+		if err == nil || retry >= m.option.MaxRetries || !isRetryable(err) {
+			return err
+		}
+
+		delay := base << uint(retry)
+		if delay > maxRetryDelay || delay <= 0 {
+			delay = maxRetryDelay
+		}
+		// Full jitter spreads the retries of the concurrent workers.
+		delay = time.Duration(rand.Int63n(int64(delay)) + 1)
+		m.println("Retrying after", delay, "by", err)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}
+
+// isRetryable returns true if the error is a transient failure of s3,
+// i.e. the throttling, the timeout or the server error.
+func isRetryable(err error) bool {
+	for err != nil {
+		if reqErr, ok := err.(awserr.RequestFailure); ok {
+			switch reqErr.StatusCode() {
+			case 500, 502, 503, 504:
+				return true
+			}
+		}
+		aerr, ok := err.(awserr.Error)
+		if !ok {
+			return false
+		}
+		switch aerr.Code() {
+		case "SlowDown", "RequestTimeout", "Throttling", "ThrottlingException",
+			"InternalError", "ServiceUnavailable":
+			return true
+		}
+		err = aerr.OrigErr()
+	}
+	return false
+}
@@ -0,0 +1,142 @@
+// Copyright 2019 SEQSENSE, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package s3sync
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// flakyS3 fails the first failures calls of each api by err.
+type flakyS3 struct {
+	*fakeS3
+	failures int
+	err      error
+
+	mu     sync.Mutex
+	failed map[string]int
+}
+
+func (f *flakyS3) fail(api string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.failed == nil {
+		f.failed = make(map[string]int)
+	}
+	if f.failed[api] >= f.failures {
+		return nil
+	}
+	f.failed[api]++
+	return f.err
+}
+
+func (f *flakyS3) ListObjectsV2WithContext(ctx aws.Context, input *s3.ListObjectsV2Input, opts ...request.Option) (*s3.ListObjectsV2Output, error) {
+	if err := f.fail("ListObjectsV2"); err != nil {
+		return nil, err
+	}
+	return f.fakeS3.ListObjectsV2WithContext(ctx, input, opts...)
+}
+
+func (f *flakyS3) GetObjectWithContext(ctx aws.Context, input *s3.GetObjectInput, opts ...request.Option) (*s3.GetObjectOutput, error) {
+	if err := f.fail("GetObject"); err != nil {
+		return nil, err
+	}
+	return f.fakeS3.GetObjectWithContext(ctx, input, opts...)
+}
+
+func (f *flakyS3) PutObjectWithContext(ctx aws.Context, input *s3.PutObjectInput, opts ...request.Option) (*s3.PutObjectOutput, error) {
+	if err := f.fail("PutObject"); err != nil {
+		return nil, err
+	}
+	return f.fakeS3.PutObjectWithContext(ctx, input, opts...)
+}
+
+var errSlowDown = awserr.NewRequestFailure(awserr.New("SlowDown", "Please reduce your request rate.", nil), 503, "request-id")
+
+func TestRetry(t *testing.T) {
+	temp, err := ioutil.TempDir("", "s3synctest")
+	if err != nil {
+		t.Fatal("Failed to create temp dir")
+	}
+	defer os.RemoveAll(temp)
+	writeFile(t, filepath.Join(temp, "upload/b.txt"), "bb")
+
+	testCases := map[string]struct {
+		maxRetries int
+		err        error
+		ok         bool
+	}{
+		"Retried":      {2, errSlowDown, true},
+		"TooMany":      {1, errSlowDown, false},
+		"Disabled":     {0, errSlowDown, false},
+		"NotRetryable": {2, awserr.New("AccessDenied", "Access Denied", nil), false},
+		"Unknown":      {2, errors.New("unknown"), false},
+	}
+	for name, testCase := range testCases {
+		t.Run(name, func(t *testing.T) {
+			fake := newFakeS3()
+			fake.putObject("example-bucket", "a.txt", []byte("a"), time.Now())
+			client := &flakyS3{fakeS3: fake, failures: 2, err: testCase.err}
+			m := &Manager{s3: client, option: Option{MaxRetries: testCase.maxRetries, RetryBaseDelay: time.Millisecond}}
+
+			downloadErr := m.Sync("s3://example-bucket", filepath.Join(temp, name))
+			uploadErr := m.Sync(filepath.Join(temp, "upload"), "s3://example-bucket/"+name)
+			if testCase.ok {
+				if downloadErr != nil || uploadErr != nil {
+					t.Fatal("Sync should be successful after the retries", downloadErr, uploadErr)
+				}
+				fileHasSize(t, filepath.Join(temp, name, "a.txt"), 1)
+				if _, ok := fake.getObject("example-bucket", name+"/b.txt"); !ok {
+					t.Error("b.txt should be uploaded")
+				}
+				return
+			}
+			if downloadErr == nil {
+				t.Error("Sync should fail")
+			}
+		})
+	}
+}
+
+func TestRetryContextDone(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	m := &Manager{option: Option{MaxRetries: 10, RetryBaseDelay: time.Hour}}
+
+	var calls int
+	done := make(chan error)
+	go func() {
+		done <- m.retry(ctx, func() error {
+			calls++
+			return errSlowDown
+		})
+	}()
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	if err := <-done; err != errSlowDown {
+		t.Errorf("The last error should be returned, got %v", err)
+	}
+	if calls != 1 {
+		t.Errorf("The retry should be stopped by the context, got %d calls", calls)
+	}
+}
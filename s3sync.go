@@ -13,10 +13,15 @@
 package s3sync
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"net/http"
 	"net/url"
 	"os"
+	"path"
 	"path/filepath"
+	"runtime"
 	"strings"
 	"sync"
 	"time"
@@ -30,16 +35,49 @@ import (
 
 // Manager manages the sync operation.
 type Manager struct {
-	s3 s3iface.S3API
-}
+	s3     s3iface.S3API
+	option Option
+	// destS3 is the client of the s3 destination if it differs from the source.
+	destS3 s3iface.S3API
+
+	// limiter is shared by the transfers for Option.MaxBytesPerSecond.
+	limiter     *rateLimiter
+	limiterOnce sync.Once
 
-// Option is the option of s3sync behavior.
-type Option struct {
+	// regionClient returns the client of the region for Option.AutoRegion.
+	// It is nil if the client is given by NewWithClient or NewWithClients.
+	regionClient func(region string) s3iface.S3API
+	// bucketClients caches the clients of the bucket regions.
+	bucketClients map[string]s3iface.S3API
+	bucketMutex   sync.Mutex
 }
 
+// ErrTransferStalled is returned when a download made no progress for Option.StallTimeout.
+var ErrTransferStalled = errors.New("transfer stalled")
+
+// maxStallRetries is the number of retries of a stalled transfer.
+const maxStallRetries = 3
+
 type s3Path struct {
 	bucket       string
 	bucketPrefix string
+	// pattern is the glob pattern which the keys have to match.
+	// Empty pattern matches all the keys under bucketPrefix.
+	// Note that "?" in the url must be escaped as "%3F".
+	pattern string
+	// shallow lists only the keys directly under bucketPrefix.
+	shallow bool
+}
+
+// FileInfo is the information of a file to be synced.
+type FileInfo struct {
+	// Name is the path of the file relative to the sync root,
+	// separated by the os path separator.
+	Name string `json:"name"`
+	// Size is the size of the file in bytes.
+	Size int64 `json:"size"`
+	// ModTime is the modification time of the file.
+	ModTime time.Time `json:"modTime"`
 }
 
 type fileInfo struct {
@@ -48,33 +86,322 @@ type fileInfo struct {
 	path         string
 	size         int64
 	lastModified time.Time
+	metadata     map[string]*string
+	// etag is the unquoted ETag of the s3 object, which is empty for the local files.
+	etag string
+	// versionID is the version of the s3 object to be downloaded, or empty for the latest.
+	versionID string
+	// kept is true for the source file dropped by Option.ModifiedAfter, Option.ModifiedBefore,
+	// Option.Filter or Option.ObjectFilter, which is only listed to keep its dest
+	// from Option.Delete and DeleteOrphans.
+	kept bool
+}
+
+func (f *fileInfo) toFileInfo() FileInfo {
+	return FileInfo{
+		Name:    f.name,
+		Size:    f.size,
+		ModTime: f.lastModified,
+	}
+}
+
+// ParseS3URL validates the s3 url and splits it into the bucket and the prefix
+// in the same way as Sync. The prefix is returned as written, including the glob pattern.
+func ParseS3URL(s string) (bucket, prefix string, err error) {
+	u, err := url.Parse(s)
+	if err != nil {
+		return "", "", err
+	}
+	if !isS3URL(u) {
+		return "", "", fmt.Errorf("%w: %s", ErrNotS3URL, s)
+	}
+	if _, err := urlToS3Path(u); err != nil {
+		return "", "", err
+	}
+	return u.Host, strings.TrimPrefix(u.Path, "/"), nil
 }
 
 func urlToS3Path(url *url.URL) (*s3Path, error) {
 	if url.Host == "" {
-		return nil, errors.New("s3 url is missing bucket name")
+		return nil, ErrMissingBucket
+	}
+
+	prefix := strings.TrimPrefix(url.Path, "/")
+	if !hasGlobMeta(prefix) {
+		return &s3Path{
+			bucket:       url.Host,
+			bucketPrefix: prefix,
+		}, nil
 	}
 
+	pattern := strings.TrimSuffix(prefix, "/")
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+	// The names of the matched files are relative to the directory
+	// which contains the first glob segment.
+	segments := strings.Split(pattern, "/")
+	var base []string
+	for _, segment := range segments {
+		if hasGlobMeta(segment) {
+			break
+		}
+		base = append(base, segment)
+	}
 	return &s3Path{
 		bucket:       url.Host,
-		bucketPrefix: strings.TrimPrefix(url.Path, "/"),
+		bucketPrefix: strings.Join(base, "/"),
+		pattern:      pattern,
 	}, nil
 }
 
-// New returns a new Manager.
-func New(sess *session.Session) *Manager {
-	return NewWithOption(sess, &Option{})
+// relativeKey returns the slash separated name of the key relative to the prefix.
+// The prefix is treated as a directory regardless of the trailing slash:
+//   - The key under the directory returns the path under it ("a/b" for "a/b/c" is "c").
+//   - The key which equals to the prefix returns its base name ("a/b" for "a/b" is "b").
+//   - The other keys, like "a/bc" for "a/b", are not under the prefix.
+//
+// It returns false if the key is not under the prefix, is a directory itself,
+// or has a "." or ".." segment which could escape the destination.
+func relativeKey(prefix, key string) (string, bool) {
+	var name string
+	switch dir := strings.TrimSuffix(prefix, "/"); {
+	case dir == "":
+		name = key
+	case key == dir && !strings.HasSuffix(prefix, "/"):
+		name = path.Base(key)
+	case strings.HasPrefix(key, dir+"/"):
+		name = key[len(dir)+1:]
+	default:
+		return "", false
+	}
+	if name == "" || strings.HasSuffix(name, "/") {
+		return "", false
+	}
+	for _, segment := range strings.Split(name, "/") {
+		if segment == "" || segment == "." || segment == ".." {
+			return "", false
+		}
+	}
+	return name, true
+}
+
+func hasGlobMeta(s string) bool {
+	return strings.ContainsAny(s, "*?[")
+}
+
+// listPrefix returns the prefix used for listing the objects.
+// For a glob pattern, it is the fixed leading part of the pattern.
+func (p *s3Path) listPrefix() string {
+	if p.pattern == "" {
+		return p.bucketPrefix
+	}
+	return p.pattern[:strings.IndexAny(p.pattern, "*?[")]
+}
+
+// match returns true if the given key matches the pattern.
+// A key under a directory which matches the pattern also matches.
+func (p *s3Path) match(key string) bool {
+	if p.pattern == "" {
+		return true
+	}
+	n := strings.Count(p.pattern, "/") + 1
+	segments := strings.SplitN(key, "/", n+1)
+	if len(segments) < n {
+		return false
+	}
+	matched, _ := path.Match(p.pattern, strings.Join(segments[:n], "/"))
+	return matched
+}
+
+// delimiter returns the delimiter of the listing.
+func (p *s3Path) delimiter() *string {
+	if p.shallow {
+		return aws.String("/")
+	}
+	return nil
+}
+
+// New returns a new Manager configured by the functional options.
+func New(sess *session.Session, opts ...OptionFunc) *Manager {
+	option := &Option{}
+	for _, opt := range opts {
+		opt(option)
+	}
+	return NewWithOption(sess, option)
 }
 
 // NewWithOption returns a new Manager with the given option.
 func NewWithOption(sess *session.Session, option *Option) *Manager {
+	var configs []*aws.Config
+	if option.MaxConnsPerHost > 0 {
+		configs = append(configs, &aws.Config{
+			HTTPClient: httpClientWithMaxConns(sess.Config.HTTPClient, option.MaxConnsPerHost),
+		})
+	}
+	if option.ForcePathStyle {
+		configs = append(configs, &aws.Config{S3ForcePathStyle: aws.Bool(true)})
+	}
+	m := newWithClient(s3.New(sess, configs...), *option)
+	m.regionClient = func(region string) s3iface.S3API {
+		if region == aws.StringValue(sess.Config.Region) {
+			return m.s3
+		}
+		return s3.New(sess, append(configs[:len(configs):len(configs)], &aws.Config{Region: aws.String(region)})...)
+	}
+	return m
+}
+
+// NewWithClient returns a new Manager which accesses s3 by the given client,
+// e.g. the client with a custom endpoint or retryer, or a fake for the tests.
+// Option.MaxConnsPerHost and Option.ForcePathStyle are ignored since the client
+// is already configured.
+func NewWithClient(api s3iface.S3API, opts ...OptionFunc) *Manager {
+	var option Option
+	for _, opt := range opts {
+		opt(&option)
+	}
+	return newWithClient(api, option)
+}
+
+func newWithClient(api s3iface.S3API, option Option) *Manager {
+	m := &Manager{
+		s3:     api,
+		option: option,
+	}
+	m.setDefaults()
+	return m
+}
+
+// NewWithClients returns a new Manager which accesses the s3 source and the s3
+// destination by the different clients, e.g. of the different accounts.
+// The objects are copied by the destination client on the server side if permitted,
+// otherwise streamed from the source client to the destination client.
+func NewWithClients(source, dest s3iface.S3API, opts ...OptionFunc) *Manager {
+	m := &Manager{
+		s3:     source,
+		destS3: dest,
+	}
+	for _, opt := range opts {
+		opt(&m.option)
+	}
+	m.setDefaults()
+	return m
+}
+
+func (m *Manager) setDefaults() {
+	if m.option.ChecksumStore == nil {
+		m.option.ChecksumStore = NewMemoryChecksumStore()
+	}
+}
+
+// destManager returns the Manager which accesses the s3 destination.
+func (m *Manager) destManager() *Manager {
+	if m.destS3 == nil {
+		return m
+	}
+	return &Manager{s3: m.destS3, option: m.option, limiter: m.rateLimiter()}
+}
+
+// withOption returns the Manager of the same clients and the rate limiter with the option.
+// The bucket regions looked up by m so far are inherited by the returned Manager.
+func (m *Manager) withOption(option Option) *Manager {
+	m.bucketMutex.Lock()
+	defer m.bucketMutex.Unlock()
+	bucketClients := make(map[string]s3iface.S3API, len(m.bucketClients))
+	for bucket, client := range m.bucketClients {
+		bucketClients[bucket] = client
+	}
 	return &Manager{
-		s3: s3.New(sess),
+		s3:            m.s3,
+		destS3:        m.destS3,
+		option:        option,
+		limiter:       m.rateLimiter(),
+		regionClient:  m.regionClient,
+		bucketClients: bucketClients,
 	}
 }
 
+// httpClientWithMaxConns returns a copy of the client whose transport limits
+// the connections per host.
+func httpClientWithMaxConns(base *http.Client, n int) *http.Client {
+	client := &http.Client{}
+	if base != nil {
+		*client = *base
+	}
+	transport, ok := client.Transport.(*http.Transport)
+	if !ok || transport == nil {
+		transport = http.DefaultTransport.(*http.Transport)
+	}
+	transport = transport.Clone()
+	transport.MaxConnsPerHost = n
+	client.Transport = transport
+	return client
+}
+
 // Sync syncs the files between s3 and local disks.
+// A single local file is uploaded to the destination key, or under the destination
+// prefix if it ends with a slash. A single object is downloaded to the destination
+// file, or into the destination directory if it ends with a separator or exists.
 func (m *Manager) Sync(source, dest string) error {
+	return m.SyncWithContext(context.Background(), source, dest)
+}
+
+// SyncWithContext syncs the files like Sync. The sync stops starting the new
+// transfers and aborts the transfers in progress when the context is done,
+// and returns ctx.Err().
+func (m *Manager) SyncWithContext(ctx context.Context, source, dest string) error {
+	_, err := m.syncWithResult(ctx, source, dest)
+	return err
+}
+
+// SyncWithResult syncs the files like Sync, and returns the files which are
+// transferred, deleted and skipped as up-to-date by the sync.
+// The result has the files processed before the failure if the sync fails.
+// The result is reported to Option.Reporter if set.
+func (m *Manager) SyncWithResult(source, dest string) (*SyncResult, error) {
+	return m.syncWithResult(context.Background(), source, dest)
+}
+
+// SyncWithStats syncs the files like Sync, and returns the statistics of the sync.
+// The statistics count the files processed before the failure if the sync fails.
+func (m *Manager) SyncWithStats(source, dest string) (*SyncStats, error) {
+	result, err := m.SyncWithResult(source, dest)
+	return result.Stats(), err
+}
+
+func (m *Manager) syncWithResult(ctx context.Context, source, dest string) (*SyncResult, error) {
+	recorder := &syncRecorder{}
+	err := m.sync(ctx, source, dest, recorder)
+	result := recorder.result()
+	if m.option.Reporter != nil {
+		if reportErr := m.option.Reporter.Report(result, err); err == nil {
+			err = reportErr
+		}
+	}
+	return result, err
+}
+
+func (m *Manager) sync(ctx context.Context, source, dest string, recorder *syncRecorder) error {
+	if err := validateUploadOption(&m.option); err != nil {
+		return err
+	}
+	if err := validateLocalNameMap(m.option.LocalNameMap); err != nil {
+		return err
+	}
+	if err := validatePatterns(&m.option); err != nil {
+		return err
+	}
+	if err := validateSSECustomerKey(&m.option); err != nil {
+		return err
+	}
+	if m.option.Delete && m.option.BatchByTopLevelDir {
+		return fmt.Errorf("%w: the Delete option is not supported with BatchByTopLevelDir", ErrIncompatibleOptions)
+	}
+	if m.option.Force && m.option.SkipExisting {
+		return fmt.Errorf("%w: the Force option is not supported with SkipExisting", ErrIncompatibleOptions)
+	}
+
 	sourceURL, err := url.Parse(source)
 	if err != nil {
 		return err
@@ -90,150 +417,790 @@ func (m *Manager) Sync(source, dest string) error {
 		if err != nil {
 			return err
 		}
+		if m.option.Delete && sourceS3Path.pattern != "" {
+			return fmt.Errorf("%w: the Delete option is not supported with the glob pattern", ErrIncompatibleOptions)
+		}
 		if isS3URL(destURL) {
+			if m.option.VersionID != "" {
+				return errVersionIDNotSingle
+			}
 			destS3Path, err := urlToS3Path(destURL)
 			if err != nil {
 				return err
 			}
-			return m.syncS3ToS3(sourceS3Path, destS3Path)
+			if destS3Path.pattern != "" {
+				return fmt.Errorf("%w in the destination", ErrGlobNotSupported)
+			}
+			regional, err := m.withBucketRegions(ctx, sourceS3Path.bucket, destS3Path.bucket)
+			if err != nil {
+				return err
+			}
+			return regional.syncS3ToS3(ctx, sourceS3Path, destS3Path, recorder)
+		}
+		regional, err := m.withBucketRegions(ctx, sourceS3Path.bucket, "")
+		if err != nil {
+			return err
 		}
-		return m.syncS3ToLocal(sourceS3Path, dest)
+		local, err := regional.withIgnoreFile(dest)
+		if err != nil {
+			return err
+		}
+		return local.syncS3ToLocal(ctx, sourceS3Path, dest, recorder)
 	}
 
 	if isS3URL(destURL) {
+		if m.option.VersionID != "" {
+			return errVersionIDNotSingle
+		}
 		destS3Path, err := urlToS3Path(destURL)
 		if err != nil {
 			return err
 		}
-		return m.syncLocalToS3(source, destS3Path)
+		if destS3Path.pattern != "" {
+			return fmt.Errorf("%w in the destination", ErrGlobNotSupported)
+		}
+		regional, err := m.withBucketRegions(ctx, "", destS3Path.bucket)
+		if err != nil {
+			return err
+		}
+		local, err := regional.withIgnoreFile(source)
+		if err != nil {
+			return err
+		}
+		return local.syncLocalToS3(ctx, source, destS3Path, recorder)
 	}
 
-	return errors.New("local to local sync is not supported")
+	return ErrLocalToLocal
 }
 
 func isS3URL(url *url.URL) bool {
 	return url.Scheme == "s3"
 }
 
-func (m *Manager) syncS3ToS3(sourcePath, destPath *s3Path) error {
-	return errors.New("S3 to S3 sync feature is not implemented")
+// syncS3ToS3 syncs the given s3 path to the given s3 path by the server side copy.
+func (m *Manager) syncS3ToS3(parent context.Context, sourcePath, destPath *s3Path, recorder *syncRecorder) error {
+	// The context is cancelled when the sync is aborted by a listing error
+	// or the parent context, to stop the listings and the copies in progress.
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+
+	counter := &transferCounter{}
+	if m.option.ProgressInterval > 0 {
+		defer logProgress(counter, m.option.ProgressInterval, m.printf)()
+	}
+
+	dest := m.destManager()
+	files := m.filterFilesForSync(ctx, m.filterSourceFiles(ctx, m.listS3Files(ctx, sourcePath), ""), dest.listS3Files(ctx, destPath), recorder)
+	if m.option.ExecutionStrategy == TwoPhase {
+		planned, err := collectFiles(files)
+		if err != nil {
+			return err
+		}
+		files = replayFiles(planned)
+	}
+
+	errs := m.transferFiles(ctx, cancel, files, func(source *fileInfo) error {
+		if err := m.copyObject(ctx, source, sourcePath, destPath); err != nil {
+			return err
+		}
+		counter.add(source.size)
+		recorder.addTransferred(source)
+		return nil
+	})
+
+	if err := parent.Err(); err != nil {
+		return err
+	}
+	if len(errs) > 0 {
+		return &SyncError{Errors: errs}
+	}
+	if m.option.Delete {
+		if err := dest.deleteExtraObjects(ctx, destPath, recorder); err != nil {
+			return err
+		}
+	}
+	if m.option.PostVerify && !m.option.DryRun {
+		return dest.verifyS3Files(ctx, recorder, destPath)
+	}
+	return nil
 }
 
-func (m *Manager) syncLocalToS3(sourcePath string, destPath *s3Path) error {
-	return errors.New("Local to S3 sync feature is not implemented")
+// syncLocalToS3 syncs the given local path to the given s3 path.
+func (m *Manager) syncLocalToS3(parent context.Context, sourcePath string, destPath *s3Path, recorder *syncRecorder) error {
+	// The context is cancelled when the sync is aborted by a listing error
+	// or the parent context, to stop the listings and the uploads in progress.
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+
+	counter := &transferCounter{}
+	if m.option.ProgressInterval > 0 {
+		defer logProgress(counter, m.option.ProgressInterval, m.printf)()
+	}
+
+	dest := m.destManager()
+	localFiles := m.walkLocalFiles(ctx, sourcePath)
+	single := m.isSingleFile(sourcePath)
+	if single {
+		var name string
+		destPath, name = m.singleFileUploadPath(sourcePath, destPath)
+		localFiles = renameSingleFile(ctx, localFiles, name, nil)
+	}
+	sourceFiles := m.mapUploadNames(ctx, m.filterSourceFiles(ctx, localFiles, ""))
+	files := m.filterFilesForSync(ctx, sourceFiles, dest.listS3Files(ctx, destPath), recorder)
+	if m.option.ExecutionStrategy == TwoPhase {
+		planned, err := collectFiles(files)
+		if err != nil {
+			return err
+		}
+		files = replayFiles(planned)
+	}
+
+	var dedup *dedupTracker
+	if m.option.Dedup {
+		dedup = newDedupTracker()
+	}
+
+	errs := m.transferFiles(ctx, cancel, files, func(source *fileInfo) error {
+		if err := dest.uploadFile(ctx, source, destPath, dedup); err != nil {
+			return err
+		}
+		counter.add(source.size)
+		recorder.addTransferred(source)
+		return nil
+	})
+
+	if err := parent.Err(); err != nil {
+		return err
+	}
+	if len(errs) > 0 {
+		return &SyncError{Errors: errs}
+	}
+	if m.option.CreateFolderMarkers && !single {
+		if err := dest.uploadFolderMarkers(ctx, sourcePath, destPath); err != nil {
+			return err
+		}
+	}
+	if m.option.Delete && !single {
+		// Nothing is deleted by the single file source.
+		if err := dest.deleteExtraObjects(ctx, destPath, recorder); err != nil {
+			return err
+		}
+	}
+	if m.option.PostVerify && !m.option.DryRun {
+		return dest.verifyS3Files(ctx, recorder, destPath)
+	}
+	return nil
 }
 
 // syncS3ToLocal syncs the given s3 path to the given local path.
-func (m *Manager) syncS3ToLocal(sourcePath *s3Path, destPath string) error {
-	wg := &sync.WaitGroup{}
+func (m *Manager) syncS3ToLocal(parent context.Context, sourcePath *s3Path, destPath string, recorder *syncRecorder) error {
+	// The context is cancelled when the sync is aborted by a listing error
+	// or the parent context, to stop the listings and the downloads in progress.
+	ctx, cancel := context.WithCancel(parent)
+	defer cancel()
+
+	counter := &transferCounter{}
+	if m.option.ProgressInterval > 0 {
+		defer logProgress(counter, m.option.ProgressInterval, m.printf)()
+	}
+
+	q, err := m.openQuarantine()
+	if err != nil {
+		return err
+	}
+
+	single, err := m.singleObjectDownload(ctx, sourcePath, destPath)
+	if err != nil {
+		return err
+	}
+	if single == nil && m.option.VersionID != "" {
+		return errVersionIDNotSingle
+	}
+	// listDest lists the local destination to compare the files.
+	listDest := func() chan *fileInfo { return m.walkLocalFiles(ctx, destPath) }
+	destDir := destPath
+	var files chan *fileInfo
+	switch {
+	case single != nil:
+		// The object is downloaded to the file named by the destination.
+		name := filepath.Base(destPath)
+		destDir = filepath.Dir(destPath)
+		listDest = func() chan *fileInfo { return renameSingleFile(ctx, m.walkLocalFiles(ctx, destPath), name, nil) }
+		var objects chan *fileInfo
+		if m.option.VersionID != "" {
+			// The listing has only the latest version.
+			objects = renameSingleFile(ctx, replayFiles([]*fileInfo{single}), name, nil)
+		} else {
+			objects = renameSingleFile(ctx, m.listS3Files(ctx, sourcePath), name, func(file *fileInfo) bool {
+				return file.path == sourcePath.bucketPrefix
+			})
+		}
+		files = m.filterFilesForSync(ctx, m.filterSourceFiles(ctx, objects, ""), listDest(), recorder)
+	case m.option.BatchByTopLevelDir && sourcePath.pattern == "":
+		files = m.filterBatchedFilesForSync(ctx, sourcePath, destPath, recorder)
+	default:
+		files = m.filterFilesForSync(ctx, m.filterSourceFiles(ctx, m.listS3Files(ctx, sourcePath), ""), listDest(), recorder)
+	}
+	if m.option.ExecutionStrategy == TwoPhase || m.option.CheckDiskSpace {
+		planned, err := collectFiles(files)
+		if err != nil {
+			return err
+		}
+		if m.option.CheckDiskSpace {
+			if err := checkDiskSpace(destDir, planned); err != nil {
+				return err
+			}
+		}
+		files = replayFiles(planned)
+	}
+
+	errs := m.transferFiles(ctx, cancel, files, func(source *fileInfo) error {
+		key := "s3://" + sourcePath.bucket + "/" + source.path
+		if q.isQuarantined(key) {
+			m.println("Skipping the quarantined", key)
+			return nil
+		}
+		if err := m.download(ctx, source, sourcePath, destDir); err != nil {
+			if ctx.Err() == nil {
+				q.recordFailure(key)
+			}
+			return err
+		}
+		if !m.option.DryRun {
+			q.recordSuccess(key)
+		}
+		counter.add(source.size)
+		recorder.addTransferred(source)
+		return nil
+	})
+
+	if err := q.save(); err != nil {
+		errs = append(errs, err)
+	}
+	if err := parent.Err(); err != nil {
+		return err
+	}
+	if len(errs) > 0 {
+		return &SyncError{Errors: errs}
+	}
+	if m.option.Delete {
+		if err := m.deleteExtraLocalFiles(ctx, destPath, recorder); err != nil {
+			return err
+		}
+	}
+	if m.option.CreateFolderMarkers && single == nil {
+		// The directories are created after the deletion not to be pruned.
+		if err := m.downloadFolderMarkers(ctx, sourcePath, destPath); err != nil {
+			return err
+		}
+	}
+	if m.option.PostVerify && !m.option.DryRun {
+		return verifyFiles(recorder.transferred, listDest())
+	}
+	return nil
+}
+
+// transferFiles calls transfer for each of the files by Option.Parallelism workers,
+// and returns the errors. The errors of the transfers are FileError. A listing error,
+// or a transfer error with Option.FailFast, cancels the context to abort the sync,
+// and the errors caused by the abort are not reported.
+func (m *Manager) transferFiles(ctx context.Context, cancel context.CancelFunc, files chan *fileInfo, transfer func(*fileInfo) error) []error {
 	mutex := sync.Mutex{}
-	errMsgs := []string{}
-	for source := range filterFilesForSync(m.listS3Files(sourcePath), listLocalFiles(destPath)) {
-		wg.Add(1)
-		go func(source *fileInfo) {
-			defer wg.Done()
-			if source.err != nil {
-				mutex.Lock()
-				errMsgs = append(errMsgs, source.err.Error())
-				mutex.Unlock()
-				return
+	var errs []error
+	addErr := func(err error) {
+		mutex.Lock()
+		defer mutex.Unlock()
+		errs = append(errs, err)
+	}
+
+	// The files are read ahead of the workers to notice the listing error
+	// while all the workers are busy.
+	work := make(chan *fileInfo)
+	go func() {
+		defer close(work)
+		var pending []*fileInfo
+		for files != nil || len(pending) > 0 {
+			var send chan *fileInfo
+			var next *fileInfo
+			if len(pending) > 0 {
+				send, next = work, pending[0]
 			}
-			err := m.download(source, sourcePath, destPath)
+			select {
+			case file, ok := <-files:
+				if !ok {
+					files = nil
+					continue
+				}
+				if file.err != nil {
+					// Don't process the partial listing result.
+					addErr(file.err)
+					cancel()
+					pending = nil
+					continue
+				}
+				if ctx.Err() == nil {
+					pending = append(pending, file)
+				}
+			case send <- next:
+				pending = pending[1:]
+			}
+		}
+	}()
 
-			if err != nil {
-				mutex.Lock()
-				errMsgs = append(errMsgs, err.Error())
-				mutex.Unlock()
+	wg := &sync.WaitGroup{}
+	for i := 0; i < m.parallelism(); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for file := range work {
+				if ctx.Err() != nil {
+					continue
+				}
+				m.notifyFileStart(&mutex, file)
+				err := transfer(file)
+				m.notifyFileDone(&mutex, file, err)
+				if err != nil && ctx.Err() == nil {
+					addErr(&FileError{Name: file.name, Err: err})
+					if m.option.FailFast {
+						// The other transfers are aborted.
+						cancel()
+					}
+				}
 			}
-		}(source)
+		}()
 	}
 	wg.Wait()
+	return errs
+}
 
-	if len(errMsgs) > 0 {
-		return errors.New(strings.Join(errMsgs, "\n"))
+// notifyFileStart calls Option.OnFileStart under the lock.
+func (m *Manager) notifyFileStart(mutex *sync.Mutex, file *fileInfo) {
+	if m.option.OnFileStart == nil {
+		return
 	}
-	return nil
+	mutex.Lock()
+	defer mutex.Unlock()
+	m.option.OnFileStart(file.toFileInfo())
 }
 
-func (m *Manager) download(file *fileInfo, sourcePath *s3Path, destPath string) error {
+// notifyFileDone calls Option.OnFileDone under the lock.
+func (m *Manager) notifyFileDone(mutex *sync.Mutex, file *fileInfo, err error) {
+	if m.option.OnFileDone == nil {
+		return
+	}
+	var n int64
+	if err == nil && !m.option.DryRun {
+		n = file.size
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	m.option.OnFileDone(file.toFileInfo(), n, err)
+}
+
+// defaultDirMode is the default of Option.DirMode.
+const defaultDirMode os.FileMode = 0755
+
+func (m *Manager) dirMode() os.FileMode {
+	if m.option.DirMode != 0 {
+		return m.option.DirMode
+	}
+	return defaultDirMode
+}
+
+// defaultListBufferSize is the default of Option.ListBufferSize.
+const defaultListBufferSize = 1000
+
+func (m *Manager) listBufferSize() int {
+	if m.option.ListBufferSize > 0 {
+		return m.option.ListBufferSize
+	}
+	return defaultListBufferSize
+}
+
+func (m *Manager) parallelism() int {
+	if m.option.Parallelism > 0 {
+		return m.option.Parallelism
+	}
+	return runtime.NumCPU() * 2
+}
+
+func (m *Manager) download(ctx context.Context, file *fileInfo, sourcePath *s3Path, destPath string) error {
 	targetFilename := filepath.Join(destPath, file.name)
 	targetDir := filepath.Dir(targetFilename)
 
-	println("Downloading", file.name, "to", targetFilename)
+	// The listing drops the keys which escape the destination, but the names
+	// can also be rewritten by Option.ObjectFilter.
+	rel, err := filepath.Rel(destPath, targetFilename)
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("refused to download %s outside of %s", file.path, destPath)
+	}
+
+	if m.option.DryRun {
+		m.println("Would download", file.name, "to", targetFilename)
+		return nil
+	}
+	m.println("Downloading", file.name, "to", targetFilename)
 
-	if err := os.MkdirAll(targetDir, 0755); err != nil {
+	if err := m.fs().MkdirAll(targetDir, m.dirMode()); err != nil {
 		return err
 	}
 
-	writer, err := os.Create(targetFilename)
+	if stat, err := m.fs().Stat(targetFilename); err == nil && stat.IsDir() {
+		if !m.option.RemoveConflictingDirs {
+			return &DirectoryConflictError{Path: targetFilename}
+		}
+		if err := m.fs().RemoveAll(targetFilename); err != nil {
+			return err
+		}
+	}
 
-	if err != nil {
+	for retry := 0; ; retry++ {
+		err := m.retry(ctx, func() error {
+			return m.downloadToFile(ctx, file, sourcePath, targetFilename)
+		})
+		if err == ErrTransferStalled && retry < maxStallRetries {
+			continue
+		}
 		return err
 	}
+}
 
-	defer writer.Close()
-
-	_, err = s3manager.NewDownloaderWithClient(m.s3).Download(writer, &s3.GetObjectInput{
-		Bucket: aws.String(sourcePath.bucket),
-		Key:    aws.String(filepath.Join(sourcePath.bucketPrefix, file.name)),
-	})
+// tempFileSuffix is the suffix of the temporary file of a download.
+const tempFileSuffix = ".s3sync-tmp"
 
+// downloadToFile downloads the object to a temporary file next to the target file,
+// and renames it to the target only after the download completes, so that the
+// partially downloaded file is never seen at the target.
+// The temporary file is removed on failure, or kept with Option.Resume to continue
+// the download on the next attempt.
+func (m *Manager) downloadToFile(ctx context.Context, file *fileInfo, sourcePath *s3Path, targetFilename string) error {
+	filename := targetFilename + tempFileSuffix
+	flag := os.O_RDWR | os.O_CREATE | os.O_TRUNC
+	if m.option.ExclusiveCreate {
+		// The temporary file exists while another process is downloading the same file.
+		flag = os.O_RDWR | os.O_CREATE | os.O_EXCL
+	} else if m.option.Resume {
+		// The temporary file left by the interrupted download is continued.
+		flag = os.O_RDWR | os.O_CREATE
+	}
+	writer, err := m.fs().OpenFile(filename, flag, 0666)
+	if os.IsExist(err) {
+		return &ConcurrentWriteError{Path: filename}
+	}
 	if err != nil {
 		return err
 	}
 
+	var partial os.FileInfo
+	if m.option.Resume {
+		partial, err = m.resumablePartial(writer, filename, file)
+	}
+	if err == nil && m.option.FileMode != 0 {
+		// Unlike OpenFile, Chmod is not masked by the umask.
+		err = writer.Chmod(m.option.FileMode)
+	}
+	var output *s3.GetObjectOutput
+	if err == nil {
+		output, err = m.downloadToWriter(ctx, file, sourcePath, writer, partial)
+		if partial != nil && isPreconditionFailed(err) {
+			// The object is modified after the partial file is written.
+			if err = writer.Truncate(0); err == nil {
+				output, err = m.downloadToWriter(ctx, file, sourcePath, writer, nil)
+			}
+		}
+	}
+	if closeErr := writer.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && m.option.PreserveMetadata {
+		err = m.writeMetadata(targetFilename, output)
+	}
+	if err == nil {
+		// The modification time of the object is kept to compare it on the next sync.
+		err = m.fs().Chtimes(filename, file.lastModified, file.lastModified)
+	}
+	if err == nil {
+		err = m.fs().Rename(filename, targetFilename)
+	}
+	if err != nil {
+		if !m.option.Resume {
+			m.fs().Remove(filename)
+		}
+		return err
+	}
+	if m.option.Resume {
+		m.fs().Remove(filename + resumeETagSuffix)
+	}
 	return nil
 }
 
+// downloadToWriter downloads the object to the writer. If partial is not nil, only
+// the rest of the object after the partial file is downloaded by the ranged GET.
+// The returned GetObject response has the headers of the object.
+func (m *Manager) downloadToWriter(ctx context.Context, file *fileInfo, sourcePath *s3Path, writer File, partial os.FileInfo) (*s3.GetObjectOutput, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	w := m.throttleWriterAt(ctx, writer)
+	stopWatching := func() bool { return false }
+	if m.option.StallTimeout > 0 {
+		pw := &progressWriterAt{w: w}
+		w = pw
+		stopWatching = watchStall(cancel, &pw.n, m.option.StallTimeout)
+	}
+
+	sse := m.sseCustomer()
+	input := &s3.GetObjectInput{
+		Bucket:               aws.String(sourcePath.bucket),
+		Key:                  aws.String(file.path),
+		RequestPayer:         m.requestPayer(),
+		SSECustomerAlgorithm: sse.algorithm,
+		SSECustomerKey:       sse.key,
+		SSECustomerKeyMD5:    sse.keyMD5,
+	}
+	if file.versionID != "" {
+		input.VersionId = aws.String(file.versionID)
+	}
+	recorder := &getObjectRecorder{S3API: m.s3}
+	var n int64
+	var err error
+	if partial != nil {
+		n, err = m.downloadRange(ctx, recorder, w, input, partial, file.etag)
+	} else {
+		n, err = m.newDownloader(recorder).DownloadWithContext(ctx, w, input)
+	}
+
+	if stopWatching() {
+		return nil, ErrTransferStalled
+	}
+	if err != nil {
+		return nil, classifyKMSError(err)
+	}
+	if n != file.size {
+		return nil, fmt.Errorf("downloaded %d bytes of %s, expected %d bytes", n, file.path, file.size)
+	}
+
+	return recorder.output, nil
+}
+
+// newDownloader returns the downloader of the client configured by
+// Option.DownloadPartSize and Option.DownloadConcurrency.
+func (m *Manager) newDownloader(client s3iface.S3API) *s3manager.Downloader {
+	return s3manager.NewDownloaderWithClient(client, func(d *s3manager.Downloader) {
+		if m.option.DownloadPartSize > 0 {
+			d.PartSize = m.option.DownloadPartSize
+		}
+		if m.option.DownloadConcurrency > 0 {
+			d.Concurrency = m.option.DownloadConcurrency
+		}
+		if m.option.Resume {
+			// The parts are written in order, so that the partial file left by
+			// the failure is always the prefix of the object.
+			d.Concurrency = 1
+		}
+	})
+}
+
 // listS3Files return a channel which receives the file infos under the given s3Path.
-func (m *Manager) listS3Files(path *s3Path) chan *fileInfo {
-	c := make(chan *fileInfo, 50000) // TODO: revisit this buffer size later
+// The listing stops when the context is done.
+func (m *Manager) listS3Files(ctx context.Context, path *s3Path) chan *fileInfo {
+	c := make(chan *fileInfo, m.listBufferSize())
 
 	go func() {
 		defer close(c)
-		var token *string
-		for {
-			if token = m.listS3FileWithToken(c, path, token); token == nil {
-				break
-			}
+		if m.option.ParallelListing && !path.shallow {
+			m.listS3FilesParallel(ctx, c, path)
+			return
 		}
+		m.listS3Prefix(ctx, c, path, path.listPrefix(), path.delimiter())
 	}()
 
 	return c
 }
 
-// listS3FileWithToken lists (send to the result channel) the s3 files from the given continuation token.
-func (m *Manager) listS3FileWithToken(c chan *fileInfo, path *s3Path, token *string) *string {
-	list, err := m.s3.ListObjectsV2(&s3.ListObjectsV2Input{
-		Bucket:            &path.bucket,
-		Prefix:            &path.bucketPrefix,
-		ContinuationToken: token,
+// listS3Prefix lists the s3 files under the prefix of the path, and returns the
+// common prefixes of the delimiter. It returns false if the listing should stop.
+func (m *Manager) listS3Prefix(ctx context.Context, c chan *fileInfo, path *s3Path, prefix string, delimiter *string) ([]string, bool) {
+	var commonPrefixes []string
+	var token *string
+	for {
+		list := m.listS3FileWithToken(ctx, c, path, prefix, delimiter, token)
+		if list == nil {
+			return nil, false
+		}
+		for _, commonPrefix := range list.CommonPrefixes {
+			commonPrefixes = append(commonPrefixes, aws.StringValue(commonPrefix.Prefix))
+		}
+		if token = nextContinuationToken(list); token == nil {
+			return commonPrefixes, true
+		}
+	}
+}
+
+// maxKeys returns Option.MaxKeys of the listing pages, or nil to use the s3 default.
+func (m *Manager) maxKeys() *int64 {
+	if m.option.MaxKeys <= 0 {
+		return nil
+	}
+	return aws.Int64(m.option.MaxKeys)
+}
+
+// requestPayer returns Option.RequestPayer of the requests to the requester pays
+// buckets, or nil if it is not set.
+func (m *Manager) requestPayer() *string {
+	if m.option.RequestPayer == "" {
+		return nil
+	}
+	return aws.String(m.option.RequestPayer)
+}
+
+// nextContinuationToken returns the token of the next page of the listing, or nil
+// if the listing is complete. Some s3 compatible stores return the empty token
+// or the token of the last page with IsTruncated false.
+func nextContinuationToken(list *s3.ListObjectsV2Output) *string {
+	if aws.StringValue(list.NextContinuationToken) == "" {
+		return nil
+	}
+	if list.IsTruncated != nil && !*list.IsTruncated {
+		return nil
+	}
+	return list.NextContinuationToken
+}
+
+// listS3FilesParallel discovers the top-level common prefixes by the delimited listing,
+// then lists each of them concurrently up to Option.ListConcurrency.
+func (m *Manager) listS3FilesParallel(ctx context.Context, c chan *fileInfo, path *s3Path) {
+	commonPrefixes, ok := m.listS3Prefix(ctx, c, path, path.listPrefix(), aws.String("/"))
+	if !ok {
+		return
+	}
+
+	sem := make(chan struct{}, m.listConcurrency())
+	wg := &sync.WaitGroup{}
+	for _, prefix := range commonPrefixes {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(prefix string) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			m.listS3Prefix(ctx, c, path, prefix, nil)
+		}(prefix)
+	}
+	wg.Wait()
+}
+
+// listS3FileWithToken lists (send to the result channel) the s3 files under the prefix from
+// the given continuation token. It returns nil if the listing should stop.
+func (m *Manager) listS3FileWithToken(ctx context.Context, c chan *fileInfo, path *s3Path, prefix string, delimiter, token *string) *s3.ListObjectsV2Output {
+	var list *s3.ListObjectsV2Output
+	err := m.retry(ctx, func() error {
+		var err error
+		list, err = m.s3.ListObjectsV2WithContext(ctx, &s3.ListObjectsV2Input{
+			Bucket:            &path.bucket,
+			Prefix:            aws.String(prefix),
+			Delimiter:         delimiter,
+			ContinuationToken: token,
+			MaxKeys:           m.maxKeys(),
+			RequestPayer:      m.requestPayer(),
+		})
+		return err
 	})
 	if err != nil {
-		sendErrorInfoToChannel(c, err)
+		sendErrorInfoToChannel(ctx, c, err)
 		return nil
 	}
 
+	var infos []*fileInfo
 	for _, object := range list.Contents {
-		name, err := filepath.Rel(path.bucketPrefix, *object.Key)
-		if err != nil {
-			sendErrorInfoToChannel(c, err)
+		if !path.match(*object.Key) {
+			continue
+		}
+		name, ok := relativeKey(path.bucketPrefix, *object.Key)
+		if !ok {
 			continue
 		}
-		c <- &fileInfo{
-			name:         name,
+		infos = append(infos, &fileInfo{
+			name:         filepath.FromSlash(m.toLocalName(name)),
 			path:         *object.Key,
-			size:         *object.Size,
-			lastModified: *object.LastModified,
+			size:         aws.Int64Value(object.Size),
+			lastModified: aws.TimeValue(object.LastModified),
+			etag:         normalizeETag(aws.StringValue(object.ETag)),
+		})
+	}
+	if m.option.MetadataCompareKey != "" || m.option.HeadCompare {
+		// The listing doesn't contain the user metadata.
+		infos = m.headFiles(ctx, path.bucket, infos)
+	}
+	for _, info := range infos {
+		if !sendInfoToChannel(ctx, c, info) {
+			return nil
 		}
 	}
 
-	return list.NextContinuationToken
+	return list
+}
+
+// headFiles updates the infos of the listed objects by HeadObject concurrently
+// up to Option.ListConcurrency. The size, the modification time and the ETag are
+// also updated with Option.HeadCompare.
+// The objects failed to HEAD are replaced by the error infos.
+func (m *Manager) headFiles(ctx context.Context, bucket string, infos []*fileInfo) []*fileInfo {
+	results := make([]*fileInfo, len(infos))
+	sse := m.sseCustomer()
+	sem := make(chan struct{}, m.listConcurrency())
+	wg := &sync.WaitGroup{}
+	for i, info := range infos {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, info *fileInfo) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			head, err := m.s3.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+				Bucket:               aws.String(bucket),
+				Key:                  aws.String(info.path),
+				RequestPayer:         m.requestPayer(),
+				SSECustomerAlgorithm: sse.algorithm,
+				SSECustomerKey:       sse.key,
+				SSECustomerKeyMD5:    sse.keyMD5,
+			})
+			if err != nil {
+				results[i] = &fileInfo{err: err}
+				return
+			}
+			info.metadata = head.Metadata
+			if m.option.HeadCompare {
+				info.size = aws.Int64Value(head.ContentLength)
+				info.lastModified = aws.TimeValue(head.LastModified)
+				info.etag = normalizeETag(aws.StringValue(head.ETag))
+			}
+			results[i] = info
+		}(i, info)
+	}
+	wg.Wait()
+	return results
+}
+
+// defaultListConcurrency is the default of Option.ListConcurrency.
+const defaultListConcurrency = 16
+
+// defaultModTimeTolerance is the default of Option.ModTimeTolerance.
+const defaultModTimeTolerance = time.Second
+
+func (m *Manager) listConcurrency() int {
+	if m.option.ListConcurrency > 0 {
+		return m.option.ListConcurrency
+	}
+	return defaultListConcurrency
 }
 
 // listLocalFiles returns a channel which receives the infos of the files under the given basePath.
 // basePath have to be absolute path.
-func listLocalFiles(basePath string) chan *fileInfo {
+// The listing stops when the context is done.
+func listLocalFiles(ctx context.Context, basePath string) chan *fileInfo {
 	c := make(chan *fileInfo)
 
 	basePath = filepath.ToSlash(basePath)
@@ -247,53 +1214,77 @@ func listLocalFiles(basePath string) chan *fileInfo {
 			// Returns and closes the channel without sending any.
 			return
 		} else if err != nil {
-			sendErrorInfoToChannel(c, err)
+			sendErrorInfoToChannel(ctx, c, err)
 			return
 		}
-		sendFileInfoToChannel(c, basePath, basePath, stat)
-
 		if !stat.IsDir() {
+			// A single file source yields only the file itself, named by its base name
+			// rather than "." relative to itself.
+			sendFileInfoToChannel(ctx, c, filepath.Dir(basePath), basePath, stat)
 			return
 		}
 
-		err = filepath.Walk(basePath, func(path string, stat os.FileInfo, err error) error {
+		// Walk visits basePath itself too, but the directories are not sent.
+		// The trailing slash lets Walk follow basePath if it is a symbolic link to
+		// the directory, while the symbolic links under it are not followed.
+		err = filepath.Walk(basePath+"/", func(path string, stat os.FileInfo, err error) error {
 			if err != nil {
 				return err
 			}
-			sendFileInfoToChannel(c, basePath, path, stat)
+			if !sendFileInfoToChannel(ctx, c, basePath, path, stat) {
+				return ctx.Err()
+			}
 			return nil
 		})
 
 		if err != nil {
-			sendErrorInfoToChannel(c, err)
+			sendErrorInfoToChannel(ctx, c, err)
 		}
 
 	}()
 	return c
 }
 
-func sendFileInfoToChannel(c chan *fileInfo, basePath, path string, stat os.FileInfo) {
-	if stat == nil || stat.IsDir() {
-		return
+// sendFileInfoToChannel sends the info of the local file, and returns false if the context is done.
+// The directories, the symbolic links which are not followed and the other
+// irregular files are not sent.
+func sendFileInfoToChannel(ctx context.Context, c chan *fileInfo, basePath, path string, stat os.FileInfo) bool {
+	if stat == nil || !stat.Mode().IsRegular() {
+		return true
 	}
 	relPath, _ := filepath.Rel(basePath, path)
-	c <- &fileInfo{
+	return sendInfoToChannel(ctx, c, &fileInfo{
 		name:         relPath,
 		path:         path,
 		size:         stat.Size(),
 		lastModified: stat.ModTime(),
-	}
+	})
 }
 
-func sendErrorInfoToChannel(c chan *fileInfo, err error) {
-	c <- &fileInfo{
+func sendErrorInfoToChannel(ctx context.Context, c chan *fileInfo, err error) {
+	sendInfoToChannel(ctx, c, &fileInfo{
 		err: err,
+	})
+}
+
+// sendInfoToChannel sends the info unless the context is done.
+// It returns false if the context is done.
+func sendInfoToChannel(ctx context.Context, c chan *fileInfo, info *fileInfo) bool {
+	select {
+	case c <- info:
+		return true
+	case <-ctx.Done():
+		return false
 	}
 }
 
 // filterFilesForSync filters the source files from the given destination files, and returns
 // another channel which includes the files necessary to be synced.
-func filterFilesForSync(sourceFileChan, destFileChan chan *fileInfo) chan *fileInfo {
+// The listing errors of both sides are sent to the returned channel.
+// The up-to-date files are recorded as skipped, and all the source files are
+// recorded as listed for Option.Delete. The files larger than Option.MaxFileSize
+// are dropped.
+func (m *Manager) filterFilesForSync(ctx context.Context, sourceFileChan, destFileChan chan *fileInfo, recorder *syncRecorder) chan *fileInfo {
 	c := make(chan *fileInfo)
 
 	destFiles, err := fileInfoChanToMap(destFileChan)
@@ -301,17 +1292,76 @@ func filterFilesForSync(sourceFileChan, destFileChan chan *fileInfo) chan *fileI
 	go func() {
 		defer close(c)
 		if err != nil {
-			sendErrorInfoToChannel(c, err)
+			drainFiles(sourceFileChan)
+			sendErrorInfoToChannel(ctx, c, err)
 			return
 		}
 		for sourceInfo := range sourceFileChan {
+			if sourceInfo.err != nil {
+				if !sendInfoToChannel(ctx, c, sourceInfo) {
+					return
+				}
+				continue
+			}
+			if m.option.Delete {
+				recorder.addListed(sourceInfo.name)
+			}
+			if sourceInfo.kept {
+				continue
+			}
+			if m.isTooLarge(sourceInfo) {
+				// The dest is kept as is, not to be deleted by Option.Delete.
+				m.println("Skipping", sourceInfo.name, "larger than", m.option.MaxFileSize, "bytes")
+				continue
+			}
 			destInfo, ok := destFiles[sourceInfo.name]
-			// source is necessary to sync if
-			// 1. The dest doesn't exist
-			// 2. The dest doesn't have the same size as the source
-			// 3. The dest is older than the source
-			if !ok || sourceInfo.size != destInfo.size || sourceInfo.lastModified.After(destInfo.lastModified) {
-				c <- sourceInfo
+			if ok && !m.option.Force && (m.option.SkipExisting || !m.isChanged(sourceInfo, destInfo)) {
+				recorder.addSkipped(sourceInfo)
+				continue
+			}
+			if !sendInfoToChannel(ctx, c, sourceInfo) {
+				return
+			}
+		}
+	}()
+
+	return c
+}
+
+// isTooLarge returns true if the file is larger than Option.MaxFileSize.
+func (m *Manager) isTooLarge(file *fileInfo) bool {
+	return m.option.MaxFileSize > 0 && file.size > m.option.MaxFileSize
+}
+
+// filterSourceFiles applies Option.Include, Option.Exclude, Option.Filter and
+// Option.ObjectFilter to the listed source files.
+// The files dropped by other than Option.Include and Option.Exclude are sent as kept,
+// not to delete their dests.
+// dir is the directory of the batch which the names are relative to.
+func (m *Manager) filterSourceFiles(ctx context.Context, files chan *fileInfo, dir string) chan *fileInfo {
+	if m.option.Filter == nil && m.option.ObjectFilter == nil && len(m.option.Include) == 0 && len(m.option.Exclude) == 0 &&
+		!m.option.PreserveMetadata && m.option.ModifiedAfter.IsZero() && m.option.ModifiedBefore.IsZero() {
+		return files
+	}
+	c := make(chan *fileInfo)
+
+	go func() {
+		defer close(c)
+		for file := range files {
+			if file.err == nil {
+				filtered, ok := m.applyObjectFilter(file, dir)
+				if !ok {
+					if m.isFiltered(filepath.ToSlash(filepath.Join(dir, file.name))) {
+						continue
+					}
+					kept := *file
+					kept.kept = true
+					filtered = &kept
+				}
+				file = filtered
+			}
+			if !sendInfoToChannel(ctx, c, file) {
+				return
 			}
 		}
 	}()
@@ -319,6 +1369,127 @@ func filterFilesForSync(sourceFileChan, destFileChan chan *fileInfo) chan *fileI
 	return c
 }
 
+// applyObjectFilter returns the file renamed and retimed by Option.ObjectFilter,
+// and false if the file is dropped. The files filtered by Option.Include,
+// Option.Exclude and Option.Filter are dropped before Option.ObjectFilter.
+func (m *Manager) applyObjectFilter(file *fileInfo, dir string) (*fileInfo, bool) {
+	if m.isFiltered(filepath.ToSlash(filepath.Join(dir, file.name))) || !m.inModifiedWindow(file.lastModified) {
+		return nil, false
+	}
+	info := file.toFileInfo()
+	info.Name = filepath.Join(dir, info.Name)
+	if m.option.Filter != nil && !m.option.Filter(info) {
+		return nil, false
+	}
+	if m.option.ObjectFilter == nil {
+		return file, true
+	}
+	info, ok := m.option.ObjectFilter(info)
+	if !ok {
+		return nil, false
+	}
+	name := info.Name
+	if dir != "" {
+		var err error
+		if name, err = filepath.Rel(dir, info.Name); err != nil {
+			return nil, false
+		}
+	}
+	filtered := *file
+	filtered.name = name
+	filtered.lastModified = info.ModTime
+	return &filtered, true
+}
+
+// isChanged returns true if the source is necessary to sync to the existing dest.
+func (m *Manager) isChanged(sourceInfo, destInfo *fileInfo) bool {
+	if key := m.option.MetadataCompareKey; key != "" {
+		sourceValue, sourceOK := metadataValue(sourceInfo.metadata, key)
+		destValue, destOK := metadataValue(destInfo.metadata, key)
+		if sourceOK && destOK {
+			return sourceValue != destValue
+		}
+		// Fall back to the size and time comparison if either of them doesn't have the value.
+	}
+	if sourceInfo.etag != "" && destInfo.etag != "" && sourceInfo.etag == destInfo.etag {
+		// Both are s3 objects of the same content.
+		return false
+	}
+	if m.option.ContentComparison == ChecksumMD5 {
+		return m.isChangedByChecksum(sourceInfo, destInfo)
+	}
+	if m.option.CompareETag && sourceInfo.etag == "" && destInfo.etag != "" {
+		return m.isChangedByETag(sourceInfo, destInfo)
+	}
+	// source is necessary to sync if
+	// 1. The dest doesn't have the same size as the source
+	// 2. The dest is older than the source by more than the tolerance
+	return sourceInfo.size != destInfo.size || sourceInfo.lastModified.Sub(destInfo.lastModified) > m.modTimeTolerance()
+}
+
+func (m *Manager) modTimeTolerance() time.Duration {
+	if m.option.ModTimeTolerance < 0 {
+		return 0
+	}
+	if m.option.ModTimeTolerance > 0 {
+		return m.option.ModTimeTolerance
+	}
+	return defaultModTimeTolerance
+}
+
+// isChangedByETag compares the local source with the md5 ETag of the dest object.
+// The local md5 is computed only if the sizes are the same. The multipart uploaded
+// object whose ETag isn't the md5 is always uploaded again.
+func (m *Manager) isChangedByETag(sourceInfo, destInfo *fileInfo) bool {
+	if sourceInfo.size != destInfo.size || !isSinglePartETag(destInfo.etag) {
+		return true
+	}
+	sum, err := m.fileChecksum(sourceInfo, "md5")
+	if err != nil {
+		// The upload reports the error of the file.
+		return true
+	}
+	return sum != destInfo.etag
+}
+
+// isChangedByChecksum compares the md5 of the local side with the ETag of the s3 side,
+// or the ETags of the both s3 objects. The files are compared by the size only if
+// either ETag is of the multipart upload. The local md5 is computed only if the
+// sizes are the same.
+func (m *Manager) isChangedByChecksum(sourceInfo, destInfo *fileInfo) bool {
+	if sourceInfo.size != destInfo.size {
+		return true
+	}
+	local, object := sourceInfo, destInfo
+	if local.etag != "" {
+		local, object = destInfo, sourceInfo
+	}
+	if object.etag == "" || !isSinglePartETag(object.etag) {
+		// Both are local files, or the multipart ETag isn't the md5.
+		return false
+	}
+	if local.etag != "" {
+		return isSinglePartETag(local.etag) && local.etag != object.etag
+	}
+	sum, err := m.fileChecksum(local, "md5")
+	if err != nil {
+		// The transfer reports the error of the file.
+		return true
+	}
+	return sum != object.etag
+}
+
+// metadataValue returns the value of the user metadata.
+// The key is case insensitive as the sdk canonicalizes the metadata keys.
+func metadataValue(metadata map[string]*string, key string) (string, bool) {
+	for k, v := range metadata {
+		if strings.EqualFold(k, key) && v != nil {
+			return *v, true
+		}
+	}
+	return "", false
+}
+
 // fileInfoChanToMap accumulates the fileInfos from the given channel and returns a map.
 // It retruns an error if the channel contains an error.
 func fileInfoChanToMap(files chan *fileInfo) (map[string]*fileInfo, error) {
@@ -326,9 +1497,42 @@ func fileInfoChanToMap(files chan *fileInfo) (map[string]*fileInfo, error) {
 
 	for file := range files {
 		if file.err != nil {
+			drainFiles(files)
 			return nil, file.err
 		}
 		result[file.name] = file
 	}
 	return result, nil
 }
+
+// collectFiles receives all the files from the channel, and returns the first error if any.
+func collectFiles(files chan *fileInfo) ([]*fileInfo, error) {
+	var collected []*fileInfo
+	for file := range files {
+		if file.err != nil {
+			drainFiles(files)
+			return nil, file.err
+		}
+		collected = append(collected, file)
+	}
+	return collected, nil
+}
+
+// replayFiles returns a closed channel which has the files.
+func replayFiles(files []*fileInfo) chan *fileInfo {
+	c := make(chan *fileInfo, len(files))
+	for _, file := range files {
+		c <- file
+	}
+	close(c)
+	return c
+}
+
+// drainFiles receives the rest of the files in background, so that the producer
+// of the channel isn't blocked forever after the consumer stopped by an error.
+func drainFiles(files chan *fileInfo) {
+	go func() {
+		for range files {
+		}
+	}()
+}
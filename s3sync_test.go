@@ -13,13 +13,32 @@
 package s3sync
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
 	"io/ioutil"
+	"net/http"
+	"net/url"
 	"os"
+	"path"
 	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 )
 
 const dummyFilename = "README.md"
@@ -30,14 +49,6 @@ func TestS3syncNotImplemented(t *testing.T) {
 	if err := m.Sync("foo", "bar"); err == nil {
 		t.Fatal("local to local sync is not supported")
 	}
-
-	if err := m.Sync("foo", "s3://bar"); err == nil {
-		t.Fatal("local to s3 sync is not implemented yet")
-	}
-
-	if err := m.Sync("s3://foo", "s3://bar"); err == nil {
-		t.Fatal("s3 to s3 sync is not implemented yet")
-	}
 }
 
 func TestS3sync(t *testing.T) {
@@ -92,6 +103,7 @@ func TestPartialS3sync(t *testing.T) {
 	SetLogger(createLoggerWithLogFunc(func(v ...interface{}) {
 		syncCount++ // This function is called once per one download
 	}))
+	defer SetLogger(nil)
 
 	if New(getSession()).Sync("s3://example-bucket", temp) != nil {
 		t.Fatal("Sync should be successful")
@@ -119,35 +131,1984 @@ func TestPartialS3sync(t *testing.T) {
 	// TODO: Assert only one file was downloaded at the second sync.
 }
 
-func getSession() *session.Session {
-	sess, _ := session.NewSession(&aws.Config{
-		Region:           aws.String("ap-northeast-1"),
-		S3ForcePathStyle: aws.Bool(true),
-		Endpoint:         aws.String("http://localhost:4572"),
+func TestParseS3URL(t *testing.T) {
+	testCases := map[string]struct {
+		url            string
+		bucket, prefix string
+	}{
+		"Bucket":         {"s3://bucket", "bucket", ""},
+		"BucketSlash":    {"s3://bucket/", "bucket", ""},
+		"Prefix":         {"s3://bucket/path/to/dir", "bucket", "path/to/dir"},
+		"TrailingSlash":  {"s3://bucket/path/to/dir/", "bucket", "path/to/dir/"},
+		"Glob":           {"s3://bucket/logs/2024-*/", "bucket", "logs/2024-*/"},
+		"EscapedSpace":   {"s3://bucket/a%20b", "bucket", "a b"},
+		"DottedBucket":   {"s3://my.bucket/key", "my.bucket", "key"},
+		"NestedFileName": {"s3://bucket/a/b.txt", "bucket", "a/b.txt"},
+	}
+	for name, testCase := range testCases {
+		t.Run(name, func(t *testing.T) {
+			bucket, prefix, err := ParseS3URL(testCase.url)
+			if err != nil {
+				t.Fatal("ParseS3URL should be successful", err)
+			}
+			if bucket != testCase.bucket || prefix != testCase.prefix {
+				t.Errorf("Expected (%q, %q), got (%q, %q)", testCase.bucket, testCase.prefix, bucket, prefix)
+			}
+		})
+	}
+
+	for _, invalid := range []string{
+		"s3:///path",
+		"s3://",
+		"local/path",
+		"/abs/path",
+		"https://bucket/key",
+		"s3://bucket/[a-",
+		"s3://bucket/%zz",
+	} {
+		if _, _, err := ParseS3URL(invalid); err == nil {
+			t.Errorf("%q should be invalid", invalid)
+		}
+	}
+}
+
+func TestURLToS3PathGlob(t *testing.T) {
+	testCases := map[string]struct {
+		url          string
+		bucketPrefix string
+		pattern      string
+		listPrefix   string
+	}{
+		"NoGlob":       {"s3://bucket/logs/2024", "logs/2024", "", "logs/2024"},
+		"Directory":    {"s3://bucket/logs/2024-*/", "logs", "logs/2024-*", "logs/2024-"},
+		"File":         {"s3://bucket/logs/2024-0*/app.log", "logs", "logs/2024-0*/app.log", "logs/2024-0"},
+		"BucketRoot":   {"s3://bucket/*.log", "", "*.log", ""},
+		"NestedPrefix": {"s3://bucket/a/b/c[0-9]/d", "a/b", "a/b/c[0-9]/d", "a/b/c"},
+		"EscapedQuery": {"s3://bucket/a/b%3F", "a", "a/b?", "a/b"},
+	}
+	for name, testCase := range testCases {
+		t.Run(name, func(t *testing.T) {
+			u, _ := url.Parse(testCase.url)
+			p, err := urlToS3Path(u)
+			if err != nil {
+				t.Fatal("urlToS3Path should be successful", err)
+			}
+			if p.bucketPrefix != testCase.bucketPrefix {
+				t.Errorf("Expected bucketPrefix %q, got %q", testCase.bucketPrefix, p.bucketPrefix)
+			}
+			if p.pattern != testCase.pattern {
+				t.Errorf("Expected pattern %q, got %q", testCase.pattern, p.pattern)
+			}
+			if p.listPrefix() != testCase.listPrefix {
+				t.Errorf("Expected listPrefix %q, got %q", testCase.listPrefix, p.listPrefix())
+			}
+		})
+	}
+
+	u, _ := url.Parse("s3://bucket/logs/[a-/")
+	if _, err := urlToS3Path(u); err == nil {
+		t.Fatal("Bad glob pattern should be an error")
+	}
+}
+
+func TestRelativeKey(t *testing.T) {
+	testCases := []struct {
+		prefix, key string
+		expected    string
+		ok          bool
+	}{
+		{"", "a", "a", true},
+		{"", "a/b/c", "a/b/c", true},
+		{"a", "a/b", "b", true},
+		{"a/", "a/b", "b", true},
+		{"a/b", "a/b/c/d", "c/d", true},
+		{"a/b/", "a/b/c/d", "c/d", true},
+		// The key equal to the prefix is a single object.
+		{"a/b", "a/b", "b", true},
+		{"a", "a", "a", true},
+		{"a/b/", "a/b", "", false},
+		// Not under the directory.
+		{"a/b", "a/bc", "", false},
+		{"a/b", "a/bc/d", "", false},
+		{"a/b/", "a/bc", "", false},
+		{"a/b", "x/a/b/c", "", false},
+		// Directories and markers.
+		{"a", "a/", "", false},
+		{"a", "a/b/", "", false},
+		{"", "a/", "", false},
+		// Escapes and empty segments.
+		{"a", "a/../b", "", false},
+		{"a", "a/b/../../c", "", false},
+		{"", "../etc/passwd", "", false},
+		{"a", "a/./b", "", false},
+		{"a", "a//b", "", false},
+		{"", "/a", "", false},
+		// Dots in the names are not special.
+		{"a", "a/..b", "..b", true},
+		{"a", "a/b.", "b.", true},
+	}
+	for _, testCase := range testCases {
+		name, ok := relativeKey(testCase.prefix, testCase.key)
+		if name != testCase.expected || ok != testCase.ok {
+			t.Errorf("relativeKey(%q, %q) expected (%q, %v), got (%q, %v)",
+				testCase.prefix, testCase.key, testCase.expected, testCase.ok, name, ok)
+		}
+	}
+}
+
+func TestSyncBucketRoot(t *testing.T) {
+	temp, err := ioutil.TempDir("", "s3synctest")
+	if err != nil {
+		t.Fatal("Failed to create temp dir")
+	}
+	defer os.RemoveAll(temp)
+
+	files := map[string]string{
+		"a.txt":         "a",
+		"dir/b.txt":     "bb",
+		"dir/sub/c.txt": "ccc",
+	}
+	for name, data := range files {
+		writeFile(t, filepath.Join(temp, "src", name), data)
+	}
+
+	for _, root := range []string{"s3://example-bucket", "s3://example-bucket/"} {
+		t.Run(root, func(t *testing.T) {
+			client := newFakeS3()
+			client.createBucket("example-bucket")
+			client.createBucket("copy-bucket")
+			client.putObject("copy-bucket", "orphan.txt", []byte("orphan"), time.Now())
+			m := &Manager{s3: client, option: Option{Delete: true}}
+
+			if err := m.Sync(filepath.Join(temp, "src"), root); err != nil {
+				t.Fatal("Sync to the bucket root should be successful", err)
+			}
+			for name, data := range files {
+				if object, ok := client.getObject("example-bucket", name); !ok || string(object.data) != data {
+					t.Errorf("%s should be uploaded to the bucket root", name)
+				}
+			}
+
+			if err := m.Sync(root, "s3://copy-bucket"); err != nil {
+				t.Fatal("Sync between the bucket roots should be successful", err)
+			}
+			for name, data := range files {
+				if object, ok := client.getObject("copy-bucket", name); !ok || string(object.data) != data {
+					t.Errorf("%s should be copied to the bucket root", name)
+				}
+			}
+			if _, ok := client.getObject("copy-bucket", "orphan.txt"); ok {
+				t.Error("The orphan at the bucket root should be deleted")
+			}
+
+			dest := filepath.Join(temp, "dest")
+			defer os.RemoveAll(dest)
+			result, err := m.SyncWithResult(root, dest)
+			if err != nil {
+				t.Fatal("Sync from the bucket root should be successful", err)
+			}
+			for name, data := range files {
+				fileHasContent(t, filepath.Join(dest, name), data)
+			}
+			names := fileInfoNames(result.Transferred)
+			sort.Strings(names)
+			if expected := []string{"a.txt", filepath.Join("dir", "b.txt"), filepath.Join("dir", "sub", "c.txt")}; !reflect.DeepEqual(expected, names) {
+				t.Errorf("Expected names %v, got %v", expected, names)
+			}
+		})
+	}
+}
+
+func TestS3syncDirectoryMarker(t *testing.T) {
+	temp, err := ioutil.TempDir("", "s3synctest")
+	if err != nil {
+		t.Fatal("Failed to create temp dir")
+	}
+	defer os.RemoveAll(temp)
+
+	client := newFakeS3()
+	client.putObject("example-bucket", "dir/", nil, time.Now())
+	client.putObject("example-bucket", "dir/a.txt", []byte("data"), time.Now())
+	client.putObject("example-bucket", "empty/", nil, time.Now())
+
+	m := &Manager{s3: client}
+	result, err := m.SyncWithResult("s3://example-bucket", temp)
+	if err != nil {
+		t.Fatal("Sync should be successful", err)
+	}
+	if names := fileInfoNames(result.Transferred); !reflect.DeepEqual([]string{"dir/a.txt"}, names) {
+		t.Errorf("The folder markers should not be downloaded, got %v", names)
+	}
+	fileHasSize(t, filepath.Join(temp, "dir/a.txt"), 4)
+	fileNotExists(t, filepath.Join(temp, "empty"))
+}
+
+func TestS3syncGlob(t *testing.T) {
+	client := newFakeS3()
+	for _, key := range []string{
+		"logs/2023-12/app.log",
+		"logs/2024-01/app.log",
+		"logs/2024-01/other.log",
+		"logs/2024-02/app.log",
+		"logs/2024-10/app.log",
+		"logs/2024-10/nested/app.log",
+	} {
+		client.putObject("example-bucket", key, []byte(key), time.Now())
+	}
+
+	testCases := map[string]struct {
+		source   string
+		expected []string
+	}{
+		"File": {
+			"s3://example-bucket/logs/2024-0*/app.log",
+			[]string{"2024-01/app.log", "2024-02/app.log"},
+		},
+		"Directory": {
+			"s3://example-bucket/logs/2024-*/",
+			[]string{"2024-01/app.log", "2024-01/other.log", "2024-02/app.log", "2024-10/app.log", "2024-10/nested/app.log"},
+		},
+		"FileInAnyDirectory": {
+			"s3://example-bucket/logs/*/app.log",
+			[]string{"2023-12/app.log", "2024-01/app.log", "2024-02/app.log", "2024-10/app.log"},
+		},
+	}
+	for name, testCase := range testCases {
+		t.Run(name, func(t *testing.T) {
+			temp, err := ioutil.TempDir("", "s3synctest")
+			if err != nil {
+				t.Fatal("Failed to create temp dir")
+			}
+			defer os.RemoveAll(temp)
+
+			m := &Manager{s3: client}
+			if err := m.Sync(testCase.source, temp); err != nil {
+				t.Fatal("Sync should be successful", err)
+			}
+
+			files, err := fileInfoChanToMap(listLocalFiles(context.Background(), temp))
+			if err != nil {
+				t.Fatal("Failed to list local files", err)
+			}
+			if len(files) != len(testCase.expected) {
+				t.Fatalf("Expected %d files, got %d", len(testCase.expected), len(files))
+			}
+			for _, name := range testCase.expected {
+				fileHasSize(t, filepath.Join(temp, name), len("logs/"+name))
+			}
+		})
+	}
+}
+
+func TestS3syncGlobDestination(t *testing.T) {
+	if err := New(getSession()).Sync("s3://foo/bar", "s3://foo/ba*"); err == nil {
+		t.Fatal("Glob pattern in the destination should be an error")
+	}
+}
+
+func TestMetadataCompareKey(t *testing.T) {
+	now := time.Now()
+	hash := func(v string) map[string]*string {
+		return map[string]*string{"Content-Hash": aws.String(v)}
+	}
+	testCases := map[string]struct {
+		source, dest *fileInfo
+		expected     bool
+	}{
+		"SameHashDifferentSize": {
+			&fileInfo{name: "a", size: 1, lastModified: now, metadata: hash("x")},
+			&fileInfo{name: "a", size: 2, lastModified: now, metadata: hash("x")},
+			false,
+		},
+		"DifferentHashSameSize": {
+			&fileInfo{name: "a", size: 1, lastModified: now, metadata: hash("x")},
+			&fileInfo{name: "a", size: 1, lastModified: now, metadata: hash("y")},
+			true,
+		},
+		"MissingHashFallback": {
+			&fileInfo{name: "a", size: 1, lastModified: now, metadata: hash("x")},
+			&fileInfo{name: "a", size: 2, lastModified: now},
+			true,
+		},
+		"MissingHashFallbackSame": {
+			&fileInfo{name: "a", size: 1, lastModified: now},
+			&fileInfo{name: "a", size: 1, lastModified: now, metadata: hash("y")},
+			false,
+		},
+	}
+	m := &Manager{option: Option{MetadataCompareKey: "content-hash"}}
+	for name, testCase := range testCases {
+		t.Run(name, func(t *testing.T) {
+			if changed := m.isChanged(testCase.source, testCase.dest); changed != testCase.expected {
+				t.Errorf("Expected %v, got %v", testCase.expected, changed)
+			}
+		})
+	}
+}
+
+func TestModTimeTolerance(t *testing.T) {
+	now := time.Now()
+	testCases := map[string]struct {
+		tolerance time.Duration
+		diff      time.Duration
+		expected  bool
+	}{
+		"DefaultSubSecond": {0, 500 * time.Millisecond, false},
+		"DefaultOneSecond": {0, time.Second, false},
+		"DefaultNewer":     {0, 1001 * time.Millisecond, true},
+		"DefaultOlder":     {0, -time.Hour, false},
+		"Custom":           {time.Minute, 30 * time.Second, false},
+		"CustomNewer":      {time.Minute, 2 * time.Minute, true},
+		"ExactNanosecond":  {-1, time.Nanosecond, true},
+		"ExactSameModTime": {-1, 0, false},
+	}
+	for name, testCase := range testCases {
+		t.Run(name, func(t *testing.T) {
+			m := &Manager{option: Option{ModTimeTolerance: testCase.tolerance}}
+			source := &fileInfo{name: "a", size: 1, lastModified: now.Add(testCase.diff)}
+			dest := &fileInfo{name: "a", size: 1, lastModified: now}
+			if changed := m.isChanged(source, dest); changed != testCase.expected {
+				t.Errorf("Expected %v, got %v", testCase.expected, changed)
+			}
+		})
+	}
+}
+
+func TestSkipExisting(t *testing.T) {
+	temp, err := ioutil.TempDir("", "s3synctest")
+	if err != nil {
+		t.Fatal("Failed to create temp dir")
+	}
+	defer os.RemoveAll(temp)
+
+	// The local file is older and smaller than the object.
+	writeFile(t, filepath.Join(temp, "existing.txt"), "old")
+	past := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(filepath.Join(temp, "existing.txt"), past, past); err != nil {
+		t.Fatal(err)
+	}
+
+	client := newFakeS3()
+	client.putObject("example-bucket", "existing.txt", []byte("updated"), time.Now())
+	client.putObject("example-bucket", "new.txt", []byte("new"), time.Now())
+
+	m := &Manager{s3: client, option: Option{SkipExisting: true}}
+	result, err := m.syncWithResult(context.Background(), "s3://example-bucket", temp)
+	if err != nil {
+		t.Fatal("Sync should be successful", err)
+	}
+	if names := fileInfoNames(result.Transferred); !reflect.DeepEqual(names, []string{"new.txt"}) {
+		t.Errorf("Only the new file should be transferred, got %v", names)
+	}
+	if names := fileInfoNames(result.Skipped); !reflect.DeepEqual(names, []string{"existing.txt"}) {
+		t.Errorf("The existing file should be skipped, got %v", names)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(temp, "existing.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "old" {
+		t.Errorf("The existing file should be left untouched, got %q", data)
+	}
+	fileHasSize(t, filepath.Join(temp, "new.txt"), 3)
+}
+
+func TestMaxFileSize(t *testing.T) {
+	temp, err := ioutil.TempDir("", "s3synctest")
+	if err != nil {
+		t.Fatal("Failed to create temp dir")
+	}
+	defer os.RemoveAll(temp)
+
+	sizes := map[string]int{"small.txt": 4, "limit.txt": 5, "large.txt": 6}
+
+	t.Run("Upload", func(t *testing.T) {
+		source := filepath.Join(temp, "upload")
+		for name, size := range sizes {
+			writeFile(t, filepath.Join(source, name), strings.Repeat("a", size))
+		}
+		client := newFakeS3()
+		client.putObject("example-bucket", "large.txt", []byte("old"), time.Now())
+
+		m := &Manager{s3: client, option: Option{MaxFileSize: 5, Delete: true}}
+		result, err := m.syncWithResult(context.Background(), source, "s3://example-bucket")
+		if err != nil {
+			t.Fatal("Sync should be successful", err)
+		}
+		if names := fileInfoNames(result.Transferred); !reflect.DeepEqual(names, []string{"limit.txt", "small.txt"}) {
+			t.Errorf("The files up to the limit should be transferred, got %v", names)
+		}
+		if object, ok := client.getObject("example-bucket", "large.txt"); !ok || string(object.data) != "old" {
+			t.Error("The object of the large file should be neither updated nor deleted")
+		}
+	})
+
+	t.Run("Download", func(t *testing.T) {
+		client := newFakeS3()
+		for name, size := range sizes {
+			client.putObject("example-bucket", name, []byte(strings.Repeat("a", size)), time.Now())
+		}
+		dest := filepath.Join(temp, "download")
+
+		m := &Manager{s3: client, option: Option{MaxFileSize: 5}}
+		if err := m.Sync("s3://example-bucket", dest); err != nil {
+			t.Fatal("Sync should be successful", err)
+		}
+		fileHasSize(t, filepath.Join(dest, "small.txt"), 4)
+		fileHasSize(t, filepath.Join(dest, "limit.txt"), 5)
+		if _, err := os.Stat(filepath.Join(dest, "large.txt")); !os.IsNotExist(err) {
+			t.Error("The large object should not be downloaded")
+		}
 	})
-	return sess
 }
 
-type dummyLogger struct {
-	log func(...interface{})
+func TestForce(t *testing.T) {
+	temp, err := ioutil.TempDir("", "s3synctest")
+	if err != nil {
+		t.Fatal("Failed to create temp dir")
+	}
+	defer os.RemoveAll(temp)
+	for _, name := range []string{"a.txt", "dir/b.txt"} {
+		writeFile(t, filepath.Join(temp, name), "data")
+	}
+
+	client := newFakeS3()
+	client.createBucket("example-bucket")
+	if err := (&Manager{s3: client}).Sync(temp, "s3://example-bucket"); err != nil {
+		t.Fatal("Sync should be successful", err)
+	}
+
+	expected := []string{"a.txt", filepath.Join("dir", "b.txt")}
+	for name, testCase := range map[string]struct {
+		source, dest string
+	}{
+		"Upload":   {temp, "s3://example-bucket"},
+		"Download": {"s3://example-bucket", temp},
+	} {
+		t.Run(name, func(t *testing.T) {
+			// The destination is identical to the source.
+			result, err := (&Manager{s3: client}).SyncWithResult(testCase.source, testCase.dest)
+			if err != nil {
+				t.Fatal("Sync should be successful", err)
+			}
+			if len(result.Transferred) != 0 {
+				t.Fatalf("The identical files should be skipped without Force, got %v", fileInfoNames(result.Transferred))
+			}
+
+			result, err = (&Manager{s3: client, option: Option{Force: true}}).SyncWithResult(testCase.source, testCase.dest)
+			if err != nil {
+				t.Fatal("Sync should be successful", err)
+			}
+			if names := fileInfoNames(result.Transferred); !reflect.DeepEqual(expected, names) {
+				t.Errorf("All the files should be transferred with Force, got %v", names)
+			}
+		})
+	}
+
+	err = (&Manager{s3: client, option: Option{Force: true, SkipExisting: true}}).Sync(temp, "s3://example-bucket")
+	if err == nil {
+		t.Error("Force should not be used with SkipExisting")
+	}
 }
 
-func (d *dummyLogger) Log(v ...interface{}) {
-	d.log(v...)
+func TestContentComparisonChecksumMD5(t *testing.T) {
+	temp, err := ioutil.TempDir("", "s3synctest")
+	if err != nil {
+		t.Fatal("Failed to create temp dir")
+	}
+	defer os.RemoveAll(temp)
+
+	for _, name := range []string{"same.txt", "changed.txt", "multipart.txt", "resized.txt"} {
+		writeFile(t, filepath.Join(temp, name), "local")
+	}
+	// All the objects are newer than the local files.
+	newer := time.Now().Add(time.Hour)
+	setup := func() *fakeS3 {
+		client := newFakeS3()
+		client.putObject("example-bucket", "same.txt", []byte("local"), newer)
+		client.putObject("example-bucket", "changed.txt", []byte("LOCAL"), newer)
+		client.putObject("example-bucket", "multipart.txt", []byte("LOCAL"), newer).etag = "\"0123-2\""
+		client.putObject("example-bucket", "resized.txt", []byte("local!"), newer)
+		return client
+	}
+
+	t.Run("SizeTime", func(t *testing.T) {
+		m := &Manager{s3: setup(), option: Option{DryRun: true}}
+		result, err := m.SyncWithResult("s3://example-bucket", temp)
+		if err != nil {
+			t.Fatal("Sync should be successful", err)
+		}
+		if len(result.Transferred) != 4 {
+			t.Errorf("The newer objects should be downloaded, got %v", fileInfoNames(result.Transferred))
+		}
+	})
+	t.Run("ChecksumMD5", func(t *testing.T) {
+		m := &Manager{s3: setup(), option: Option{DryRun: true, ContentComparison: ChecksumMD5}}
+		result, err := m.SyncWithResult("s3://example-bucket", temp)
+		if err != nil {
+			t.Fatal("Sync should be successful", err)
+		}
+		if expected := []string{"changed.txt", "resized.txt"}; !reflect.DeepEqual(expected, fileInfoNames(result.Transferred)) {
+			t.Errorf("Expected downloads %v, got %v", expected, fileInfoNames(result.Transferred))
+		}
+		if expected := []string{"multipart.txt", "same.txt"}; !reflect.DeepEqual(expected, fileInfoNames(result.Skipped)) {
+			t.Errorf("Expected skipped %v, got %v", expected, fileInfoNames(result.Skipped))
+		}
+	})
 }
-func (d *dummyLogger) Logf(format string, v ...interface{}) {
+
+func TestListS3FilesMetadata(t *testing.T) {
+	client := newFakeS3()
+	client.putObject("example-bucket", "a.txt", []byte("a"), time.Now()).metadata = map[string]*string{
+		"Content-Hash": aws.String("x"),
+	}
+	client.putObject("example-bucket", "b.txt", []byte("b"), time.Now())
+
+	m := &Manager{s3: client, option: Option{MetadataCompareKey: "Content-Hash"}}
+	files, err := fileInfoChanToMap(m.listS3Files(context.Background(), &s3Path{bucket: "example-bucket"}))
+	if err != nil {
+		t.Fatal("listS3Files should be successful", err)
+	}
+	if v, ok := metadataValue(files["a.txt"].metadata, "content-hash"); !ok || v != "x" {
+		t.Error("The metadata should be fetched by HEAD")
+	}
+	if _, ok := metadataValue(files["b.txt"].metadata, "content-hash"); ok {
+		t.Error("The object without the metadata should not have the value")
+	}
 }
 
-func createLoggerWithLogFunc(log func(v ...interface{})) LoggerIF {
-	return &dummyLogger{log: log}
+// concurrentListS3 records the maximum number of the concurrent listings.
+type concurrentListS3 struct {
+	*fakeS3
+	running, max int32
 }
 
-func fileHasSize(t *testing.T, filename string, expectedSize int) {
-	data, err := ioutil.ReadFile(filename)
+func (f *concurrentListS3) ListObjectsV2WithContext(ctx aws.Context, input *s3.ListObjectsV2Input, opts ...request.Option) (*s3.ListObjectsV2Output, error) {
+	n := atomic.AddInt32(&f.running, 1)
+	defer atomic.AddInt32(&f.running, -1)
+	for {
+		max := atomic.LoadInt32(&f.max)
+		if n <= max || atomic.CompareAndSwapInt32(&f.max, max, n) {
+			break
+		}
+	}
+	time.Sleep(10 * time.Millisecond)
+	return f.fakeS3.ListObjectsV2WithContext(ctx, input, opts...)
+}
+
+func TestListS3FilesParallel(t *testing.T) {
+	fake := newFakeS3()
+	fake.pageSize = 2
+	keys := []string{"prefix/a.txt", "prefix/b.txt", "prefix/c.txt"}
+	for _, dir := range []string{"d1", "d2", "d3", "d4", "d5"} {
+		keys = append(keys, "prefix/"+dir+"/x.txt", "prefix/"+dir+"/sub/y.txt", "prefix/"+dir+"/sub/z.txt")
+	}
+	for _, key := range keys {
+		fake.putObject("example-bucket", key, []byte(key), time.Now())
+	}
+	client := &concurrentListS3{fakeS3: fake}
+	path := &s3Path{bucket: "example-bucket", bucketPrefix: "prefix/"}
+
+	m := &Manager{s3: client, option: Option{ParallelListing: true, ListConcurrency: 2}}
+	files, err := fileInfoChanToMap(m.listS3Files(context.Background(), path))
 	if err != nil {
-		t.Fatal(filename, "is not synced")
+		t.Fatal("listS3Files should be successful", err)
 	}
-	if len(data) != expectedSize {
-		t.Fatal(filename, "is not synced")
+	expected, err := fileInfoChanToMap((&Manager{s3: fake}).listS3Files(context.Background(), path))
+	if err != nil {
+		t.Fatal("listS3Files should be successful", err)
+	}
+	if len(files) != len(keys) || !reflect.DeepEqual(files, expected) {
+		t.Errorf("The parallel listing should have all the files, expected: %v, actual: %v", expected, files)
+	}
+	if n := atomic.LoadInt32(&client.max); n != 2 {
+		t.Errorf("The listing should be concurrent up to 2, got %d", n)
+	}
+}
+
+// listErrorS3 fails the listing at the given page.
+type listErrorS3 struct {
+	*stallingS3
+	failPage int32
+	pages    int32
+}
+
+func (l *listErrorS3) ListObjectsV2WithContext(ctx aws.Context, input *s3.ListObjectsV2Input, opts ...request.Option) (*s3.ListObjectsV2Output, error) {
+	if atomic.AddInt32(&l.pages, 1) == l.failPage {
+		return nil, errors.New("listing failed")
+	}
+	return l.stallingS3.ListObjectsV2WithContext(ctx, input, opts...)
+}
+
+func TestS3syncListingError(t *testing.T) {
+	fake := newFakeS3()
+	fake.pageSize = 2
+	for _, key := range []string{"1", "2", "3", "4", "5", "6"} {
+		fake.putObject("example-bucket", key, []byte(key), time.Now())
+	}
+	// The downloads of the first page block until the sync is aborted.
+	client := &listErrorS3{stallingS3: &stallingS3{fakeS3: fake, stalls: 2}, failPage: 2}
+
+	temp, err := ioutil.TempDir("", "s3synctest")
+	if err != nil {
+		t.Fatal("Failed to create temp dir")
+	}
+	defer os.RemoveAll(temp)
+
+	done := make(chan error)
+	go func() {
+		done <- (&Manager{s3: client}).Sync("s3://example-bucket", temp)
+	}()
+
+	select {
+	case err := <-done:
+		if err == nil || err.Error() != "listing failed" {
+			t.Fatal("Sync should fail with the listing error", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Sync should be aborted by the listing error")
+	}
+
+	if pages := atomic.LoadInt32(&client.pages); pages != 2 {
+		t.Errorf("Listing should stop at the failed page, listed %d pages", pages)
+	}
+	for _, name := range []string{"5", "6"} {
+		fileNotExists(t, filepath.Join(temp, name))
+	}
+}
+
+func TestFailFast(t *testing.T) {
+	for _, failFast := range []bool{false, true} {
+		t.Run(fmt.Sprintf("FailFast=%v", failFast), func(t *testing.T) {
+			temp, err := ioutil.TempDir("", "s3synctest")
+			if err != nil {
+				t.Fatal("Failed to create temp dir")
+			}
+			defer os.RemoveAll(temp)
+
+			fake := newFakeS3()
+			for _, key := range []string{"1", "2", "3", "4"} {
+				fake.putObject("example-bucket", key, []byte(key), time.Now())
+			}
+			client := &failingKeyS3{fakeS3: fake, key: "1", failing: 1}
+
+			m := &Manager{s3: client, option: Option{Parallelism: 1, FailFast: failFast}}
+			result, err := m.syncWithResult(context.Background(), "s3://example-bucket", temp)
+			var syncErr *SyncError
+			if !errors.As(err, &syncErr) || len(syncErr.Errors) != 1 {
+				t.Fatalf("Sync should fail with the error of the file, got %v", err)
+			}
+			if failFast {
+				if len(result.Transferred) != 0 {
+					t.Errorf("The sync should be aborted at the failed file, transferred %v", fileInfoNames(result.Transferred))
+				}
+				return
+			}
+			if names := fileInfoNames(result.Transferred); !reflect.DeepEqual(names, []string{"2", "3", "4"}) {
+				t.Errorf("The other files should be transferred, got %v", names)
+			}
+		})
+	}
+}
+
+func TestDownloadDirectoryConflict(t *testing.T) {
+	client := newFakeS3()
+	client.putObject("example-bucket", "conflict", []byte("data"), time.Now())
+	file := &fileInfo{name: "conflict", path: "conflict", size: 4}
+	sourcePath := &s3Path{bucket: "example-bucket"}
+
+	temp, err := ioutil.TempDir("", "s3synctest")
+	if err != nil {
+		t.Fatal("Failed to create temp dir")
+	}
+	defer os.RemoveAll(temp)
+	writeFile(t, filepath.Join(temp, "conflict/nested"), "data")
+
+	m := &Manager{s3: client}
+	err = m.download(context.Background(), file, sourcePath, temp)
+	var conflict *DirectoryConflictError
+	if !errors.As(err, &conflict) {
+		t.Fatal("DirectoryConflictError should be returned", err)
+	}
+	if conflict.Path != filepath.Join(temp, "conflict") {
+		t.Errorf("The error should name the conflicting path, got %s", conflict.Path)
+	}
+	fileExists(t, filepath.Join(temp, "conflict/nested"))
+
+	m.option.RemoveConflictingDirs = true
+	if err := m.download(context.Background(), file, sourcePath, temp); err != nil {
+		t.Fatal("The conflicting directory should be removed", err)
+	}
+	fileHasSize(t, filepath.Join(temp, "conflict"), 4)
+}
+
+func TestDownloadModTime(t *testing.T) {
+	temp, err := ioutil.TempDir("", "s3synctest")
+	if err != nil {
+		t.Fatal("Failed to create temp dir")
+	}
+	defer os.RemoveAll(temp)
+
+	// The objects newer than the local clock are downloaded again unless the time is kept.
+	lastModified := time.Now().Add(time.Hour).Truncate(time.Second)
+	client := newFakeS3()
+	client.putObject("example-bucket", "a.txt", []byte("a"), lastModified)
+	client.putObject("example-bucket", "dir/b.txt", []byte("b"), lastModified)
+
+	m := &Manager{s3: client}
+	for i := 0; i < 2; i++ {
+		if err := m.Sync("s3://example-bucket", temp); err != nil {
+			t.Fatal("Sync should be successful", err)
+		}
+		if i == 0 {
+			for _, name := range []string{"a.txt", "dir/b.txt"} {
+				stat, err := os.Stat(filepath.Join(temp, name))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !stat.ModTime().Equal(lastModified) {
+					t.Errorf("The modification time of %s should be %v, got %v", name, lastModified, stat.ModTime())
+				}
+			}
+		}
+	}
+	if n := client.count("GetObject"); n != 2 {
+		t.Errorf("The second sync should download nothing, got %d downloads", n)
+	}
+}
+
+// concurrentGetS3 records the maximum number of the concurrent downloads.
+type concurrentGetS3 struct {
+	*fakeS3
+	running, max int32
+}
+
+func (f *concurrentGetS3) GetObjectWithContext(ctx aws.Context, input *s3.GetObjectInput, opts ...request.Option) (*s3.GetObjectOutput, error) {
+	n := atomic.AddInt32(&f.running, 1)
+	defer atomic.AddInt32(&f.running, -1)
+	for {
+		max := atomic.LoadInt32(&f.max)
+		if n <= max || atomic.CompareAndSwapInt32(&f.max, max, n) {
+			break
+		}
+	}
+	time.Sleep(10 * time.Millisecond)
+	return f.fakeS3.GetObjectWithContext(ctx, input, opts...)
+}
+
+func TestS3syncParallelism(t *testing.T) {
+	temp, err := ioutil.TempDir("", "s3synctest")
+	if err != nil {
+		t.Fatal("Failed to create temp dir")
+	}
+	defer os.RemoveAll(temp)
+
+	fake := newFakeS3()
+	for i := 0; i < 20; i++ {
+		fake.putObject("example-bucket", fmt.Sprintf("%02d.txt", i), []byte("data"), time.Now())
+	}
+	client := &concurrentGetS3{fakeS3: fake}
+
+	m := &Manager{s3: client, option: Option{Parallelism: 3}}
+	if err := m.Sync("s3://example-bucket", temp); err != nil {
+		t.Fatal("Sync should be successful", err)
+	}
+	for i := 0; i < 20; i++ {
+		fileHasSize(t, filepath.Join(temp, fmt.Sprintf("%02d.txt", i)), 4)
+	}
+	if n := atomic.LoadInt32(&client.max); n != 3 {
+		t.Errorf("The downloads should be concurrent up to 3, got %d", n)
+	}
+}
+
+func TestSyncWithContext(t *testing.T) {
+	temp, err := ioutil.TempDir("", "s3synctest")
+	if err != nil {
+		t.Fatal("Failed to create temp dir")
+	}
+	defer os.RemoveAll(temp)
+
+	client := newFakeS3()
+	client.putObject("example-bucket", "a.txt", []byte("data"), time.Now())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	m := &Manager{s3: client}
+	if err := m.SyncWithContext(ctx, "s3://example-bucket", temp); err != context.Canceled {
+		t.Fatalf("Expected context.Canceled, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(temp, "a.txt")); !os.IsNotExist(err) {
+		t.Error("The file should not be downloaded after the cancellation")
+	}
+
+	if err := m.SyncWithContext(context.Background(), "s3://example-bucket", temp); err != nil {
+		t.Fatal("Sync should be successful", err)
+	}
+	fileHasSize(t, filepath.Join(temp, "a.txt"), 4)
+}
+
+func TestSyncDryRun(t *testing.T) {
+	temp, err := ioutil.TempDir("", "s3synctest")
+	if err != nil {
+		t.Fatal("Failed to create temp dir")
+	}
+	defer os.RemoveAll(temp)
+	writeFile(t, filepath.Join(temp, "local/new.txt"), "new")
+	writeFile(t, filepath.Join(temp, "download/stale.txt"), "stale")
+
+	client := newFakeS3()
+	client.putObject("example-bucket", "data/a.txt", []byte("a"), time.Now())
+	client.putObject("example-bucket", "upload/stale.txt", []byte("stale"), time.Now())
+
+	var logs []string
+	SetLogger(createLoggerWithLogFunc(func(v ...interface{}) {
+		logs = append(logs, fmt.Sprint(v...))
+	}))
+	defer SetLogger(nil)
+
+	m := &Manager{s3: client, option: Option{DryRun: true, Delete: true, Move: true, Parallelism: 1}}
+	testCases := map[string]struct {
+		source, dest        string
+		transferred, delete []string
+	}{
+		"Download": {"s3://example-bucket/data", filepath.Join(temp, "download"), []string{"a.txt"}, []string{"stale.txt"}},
+		"Upload":   {filepath.Join(temp, "local"), "s3://example-bucket/upload", []string{"new.txt"}, []string{"stale.txt"}},
+		"Copy":     {"s3://example-bucket/data", "s3://example-bucket/copy", []string{"a.txt"}, nil},
+	}
+	for name, tt := range testCases {
+		t.Run(name, func(t *testing.T) {
+			logs = nil
+			result, err := m.SyncWithResult(tt.source, tt.dest)
+			if err != nil {
+				t.Fatal("Sync should be successful", err)
+			}
+			if names := fileInfoNames(result.Transferred); !reflect.DeepEqual(tt.transferred, names) {
+				t.Errorf("Expected planned transfers %v, got %v", tt.transferred, names)
+			}
+			if names := fileInfoNames(result.Deleted); !reflect.DeepEqual(tt.delete, names) {
+				t.Errorf("Expected planned deletions %v, got %v", tt.delete, names)
+			}
+			for _, log := range logs {
+				if !strings.HasPrefix(log, "Would ") {
+					t.Errorf("Unexpected log in the dry run: %s", log)
+				}
+			}
+		})
+	}
+
+	fileNotExists(t, filepath.Join(temp, "download/a.txt"))
+	fileExists(t, filepath.Join(temp, "download/stale.txt"))
+	for _, key := range []string{"data/a.txt", "upload/stale.txt"} {
+		if _, ok := client.getObject("example-bucket", key); !ok {
+			t.Errorf("%s should not be deleted", key)
+		}
+	}
+	for _, key := range []string{"upload/new.txt", "copy/a.txt"} {
+		if _, ok := client.getObject("example-bucket", key); ok {
+			t.Errorf("%s should not be created", key)
+		}
+	}
+}
+
+func fileInfoNames(files []FileInfo) []string {
+	var names []string
+	for _, file := range files {
+		names = append(names, filepath.ToSlash(file.Name))
+	}
+	return names
+}
+
+func TestOptionLogger(t *testing.T) {
+	temp, err := ioutil.TempDir("", "s3synctest")
+	if err != nil {
+		t.Fatal("Failed to create temp dir")
+	}
+	defer os.RemoveAll(temp)
+
+	client := newFakeS3()
+	client.putObject("example-bucket", "a.txt", []byte("data"), time.Now())
+
+	l := &captureLogger{}
+	m := &Manager{s3: client, option: Option{Logger: l}}
+	if err := m.Sync("s3://example-bucket", temp); err != nil {
+		t.Fatal("Sync should be successful", err)
+	}
+	if lines := l.linesWithPrefix("Downloading"); len(lines) != 1 {
+		t.Errorf("The download should be logged to Option.Logger, got %v", lines)
+	}
+}
+
+func TestDefaultLogger(t *testing.T) {
+	if _, ok := logger.(NopLogger); !ok {
+		t.Errorf("The logs should be discarded by default, got %T", logger)
+	}
+}
+
+// observingGetS3 calls observe on each GetObject before returning the object.
+type observingGetS3 struct {
+	*fakeS3
+	observe func()
+}
+
+func (f *observingGetS3) GetObjectWithContext(ctx aws.Context, input *s3.GetObjectInput, opts ...request.Option) (*s3.GetObjectOutput, error) {
+	f.observe()
+	return f.fakeS3.GetObjectWithContext(ctx, input, opts...)
+}
+
+func TestDownloadAtomic(t *testing.T) {
+	temp, err := ioutil.TempDir("", "s3synctest")
+	if err != nil {
+		t.Fatal("Failed to create temp dir")
+	}
+	defer os.RemoveAll(temp)
+	target := filepath.Join(temp, "a.txt")
+	writeFile(t, target, "old")
+
+	fake := newFakeS3()
+	fake.putObject("example-bucket", "a.txt", []byte("new data"), time.Now())
+	var during []byte
+	var tempErr error
+	client := &observingGetS3{fakeS3: fake, observe: func() {
+		during, _ = ioutil.ReadFile(target)
+		_, tempErr = os.Stat(target + tempFileSuffix)
+	}}
+	file := &fileInfo{name: "a.txt", path: "a.txt", size: 8}
+
+	m := &Manager{s3: client}
+	if err := m.download(context.Background(), file, &s3Path{bucket: "example-bucket"}, temp); err != nil {
+		t.Fatal("The download should be successful", err)
+	}
+	if string(during) != "old" {
+		t.Errorf("The target should be kept until the download completes, got %q", during)
+	}
+	if tempErr != nil {
+		t.Error("The temporary file should be written during the download", tempErr)
+	}
+	fileHasSize(t, target, len("new data"))
+	fileNotExists(t, target+tempFileSuffix)
+}
+
+// truncatingGetS3 returns the body which fails after the first half of the object.
+type truncatingGetS3 struct {
+	*fakeS3
+}
+
+func (f *truncatingGetS3) GetObjectWithContext(ctx aws.Context, input *s3.GetObjectInput, opts ...request.Option) (*s3.GetObjectOutput, error) {
+	output, err := f.fakeS3.GetObjectWithContext(ctx, input, opts...)
+	if err != nil {
+		return nil, err
+	}
+	half := io.LimitReader(output.Body, aws.Int64Value(output.ContentLength)/2)
+	output.Body = ioutil.NopCloser(io.MultiReader(half, &errorReader{errors.New("connection reset")}))
+	return output, nil
+}
+
+type errorReader struct {
+	err error
+}
+
+func (r *errorReader) Read([]byte) (int, error) {
+	return 0, r.err
+}
+
+func TestDownloadFailureCleanup(t *testing.T) {
+	temp, err := ioutil.TempDir("", "s3synctest")
+	if err != nil {
+		t.Fatal("Failed to create temp dir")
+	}
+	defer os.RemoveAll(temp)
+
+	fake := newFakeS3()
+	fake.putObject("example-bucket", "a.txt", []byte("new data"), time.Now())
+	fake.putObject("example-bucket", "b.txt", []byte("new data"), time.Now())
+	writeFile(t, filepath.Join(temp, "b.txt"), "old")
+
+	m := &Manager{s3: &truncatingGetS3{fakeS3: fake}}
+	if err := m.Sync("s3://example-bucket", temp); err == nil {
+		t.Fatal("Sync should fail")
+	}
+	// Neither the partial file nor the temporary file is left.
+	fileNotExists(t, filepath.Join(temp, "a.txt"))
+	fileNotExists(t, filepath.Join(temp, "a.txt"+tempFileSuffix))
+	fileNotExists(t, filepath.Join(temp, "b.txt"+tempFileSuffix))
+	// The existing file is kept as is.
+	fileHasSize(t, filepath.Join(temp, "b.txt"), len("old"))
+
+	// The retry starts clean.
+	m = &Manager{s3: fake}
+	if err := m.Sync("s3://example-bucket", temp); err != nil {
+		t.Fatal("Sync should be successful", err)
+	}
+	fileHasSize(t, filepath.Join(temp, "a.txt"), len("new data"))
+	fileHasSize(t, filepath.Join(temp, "b.txt"), len("new data"))
+}
+
+// shortGetS3 returns the body which ends without an error after the first half of the object.
+type shortGetS3 struct {
+	*fakeS3
+}
+
+func (f *shortGetS3) GetObjectWithContext(ctx aws.Context, input *s3.GetObjectInput, opts ...request.Option) (*s3.GetObjectOutput, error) {
+	output, err := f.fakeS3.GetObjectWithContext(ctx, input, opts...)
+	if err != nil {
+		return nil, err
+	}
+	output.Body = ioutil.NopCloser(io.LimitReader(output.Body, aws.Int64Value(output.ContentLength)/2))
+	return output, nil
+}
+
+func TestDownloadSizeMismatch(t *testing.T) {
+	temp, err := ioutil.TempDir("", "s3synctest")
+	if err != nil {
+		t.Fatal("Failed to create temp dir")
+	}
+	defer os.RemoveAll(temp)
+
+	fake := newFakeS3()
+	fake.putObject("example-bucket", "a.txt", []byte("new data"), time.Now())
+
+	m := &Manager{s3: &shortGetS3{fakeS3: fake}}
+	err = m.Sync("s3://example-bucket", temp)
+	if err == nil || !strings.Contains(err.Error(), "downloaded 4 bytes of a.txt, expected 8 bytes") {
+		t.Fatalf("The short download should fail, got %v", err)
+	}
+	fileNotExists(t, filepath.Join(temp, "a.txt"))
+	fileNotExists(t, filepath.Join(temp, "a.txt"+tempFileSuffix))
+}
+
+func TestDownloadPartSizeAndConcurrency(t *testing.T) {
+	m := &Manager{s3: newFakeS3()}
+	d := m.newDownloader(m.s3)
+	if d.PartSize != s3manager.DefaultDownloadPartSize || d.Concurrency != s3manager.DefaultDownloadConcurrency {
+		t.Errorf("The downloader should have the defaults, got %d bytes and %d concurrency", d.PartSize, d.Concurrency)
+	}
+
+	temp, err := ioutil.TempDir("", "s3synctest")
+	if err != nil {
+		t.Fatal("Failed to create temp dir")
+	}
+	defer os.RemoveAll(temp)
+
+	fake := newFakeS3()
+	fake.putObject("example-bucket", "a.txt", []byte("0123456789"), time.Now())
+
+	m = &Manager{s3: fake, option: Option{DownloadPartSize: 4, DownloadConcurrency: 2}}
+	d = m.newDownloader(m.s3)
+	if d.PartSize != 4 || d.Concurrency != 2 {
+		t.Errorf("The downloader should be configured by the option, got %d bytes and %d concurrency", d.PartSize, d.Concurrency)
+	}
+	if err := m.Sync("s3://example-bucket", temp); err != nil {
+		t.Fatal("Sync should be successful", err)
+	}
+	fileHasContent(t, filepath.Join(temp, "a.txt"), "0123456789")
+	if n := fake.count("GetObject"); n != 3 {
+		t.Errorf("The object should be downloaded by 3 parts, got %d GetObject", n)
+	}
+}
+
+func TestDownloadPathTraversal(t *testing.T) {
+	temp, err := ioutil.TempDir("", "s3synctest")
+	if err != nil {
+		t.Fatal("Failed to create temp dir")
+	}
+	defer os.RemoveAll(temp)
+	dest := filepath.Join(temp, "dest")
+
+	client := newFakeS3()
+	for _, key := range []string{"../escaped.txt", "a/../../escaped.txt", "/absolute.txt", "ok.txt"} {
+		client.putObject("example-bucket", key, []byte("data"), time.Now())
+	}
+
+	// The escaping keys are dropped on listing.
+	m := &Manager{s3: client}
+	result, err := m.SyncWithResult("s3://example-bucket", dest)
+	if err != nil {
+		t.Fatal("Sync should be successful", err)
+	}
+	if names := fileInfoNames(result.Transferred); !reflect.DeepEqual([]string{"ok.txt"}, names) {
+		t.Errorf("Only ok.txt should be downloaded, got %v", names)
+	}
+	fileNotExists(t, filepath.Join(temp, "escaped.txt"))
+
+	// The names rewritten by ObjectFilter are also checked.
+	m = &Manager{s3: client, option: Option{ObjectFilter: func(info FileInfo) (FileInfo, bool) {
+		info.Name = filepath.Join("..", info.Name)
+		return info, true
+	}}}
+	if err := m.Sync("s3://example-bucket", dest); err == nil {
+		t.Fatal("The download outside of the destination should fail")
+	}
+	fileNotExists(t, filepath.Join(temp, "ok.txt"))
+
+	for _, destPath := range []string{dest, "."} {
+		for _, name := range []string{"..", filepath.Join("a", "..", "..", "b")} {
+			file := &fileInfo{name: name, path: "ok.txt", size: 4}
+			if err := m.download(context.Background(), file, &s3Path{bucket: "example-bucket"}, destPath); err == nil {
+				t.Errorf("The download to %s under %s should fail", name, destPath)
+			}
+		}
+	}
+}
+
+func TestDownloadExclusiveCreate(t *testing.T) {
+	client := newFakeS3()
+	client.putObject("example-bucket", "a.txt", []byte("new data"), time.Now())
+	file := &fileInfo{name: "a.txt", path: "a.txt", size: 8}
+	sourcePath := &s3Path{bucket: "example-bucket"}
+
+	temp, err := ioutil.TempDir("", "s3synctest")
+	if err != nil {
+		t.Fatal("Failed to create temp dir")
+	}
+	defer os.RemoveAll(temp)
+	target := filepath.Join(temp, "a.txt")
+	writeFile(t, target, "old")
+	// Another process is writing the same file.
+	writeFile(t, target+tempFileSuffix, "writing")
+
+	m := &Manager{s3: client, option: Option{ExclusiveCreate: true}}
+	err = m.download(context.Background(), file, sourcePath, temp)
+	var conflict *ConcurrentWriteError
+	if !errors.As(err, &conflict) {
+		t.Fatal("ConcurrentWriteError should be returned", err)
+	}
+	if conflict.Path != target+tempFileSuffix {
+		t.Errorf("The error should name the temporary file, got %s", conflict.Path)
+	}
+	fileHasSize(t, target+tempFileSuffix, len("writing"))
+	fileHasSize(t, target, len("old"))
+
+	if err := os.Remove(target + tempFileSuffix); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.download(context.Background(), file, sourcePath, temp); err != nil {
+		t.Fatal("The download should be successful", err)
+	}
+	fileHasSize(t, target, len("new data"))
+	fileNotExists(t, target+tempFileSuffix)
+}
+
+func TestNewWithClient(t *testing.T) {
+	temp, err := ioutil.TempDir("", "s3synctest")
+	if err != nil {
+		t.Fatal("Failed to create temp dir")
+	}
+	defer os.RemoveAll(temp)
+
+	client := newFakeS3()
+	client.putObject("example-bucket", "a.txt", []byte("data"), time.Now())
+
+	m := NewWithClient(client, WithProgressInterval(time.Minute))
+	if m.option.ChecksumStore == nil {
+		t.Error("The defaults should be set")
+	}
+	if err := m.Sync("s3://example-bucket", temp); err != nil {
+		t.Fatal("Sync should be successful", err)
+	}
+	fileHasSize(t, filepath.Join(temp, "a.txt"), 4)
+
+	if m := NewWithClient(client); m.option.ProgressInterval != 0 || m.option.ChecksumStore == nil {
+		t.Error("NewWithClient without options should use the zero Option with the defaults")
+	}
+}
+
+func TestMaxConnsPerHost(t *testing.T) {
+	m := NewWithOption(getSession(), &Option{MaxConnsPerHost: 4})
+	transport, ok := m.s3.(*s3.S3).Client.Config.HTTPClient.Transport.(*http.Transport)
+	if !ok {
+		t.Fatal("The client should have the http transport")
+	}
+	if transport.MaxConnsPerHost != 4 {
+		t.Errorf("Expected MaxConnsPerHost 4, got %d", transport.MaxConnsPerHost)
+	}
+	if transport == http.DefaultTransport {
+		t.Error("The default transport should not be modified")
+	}
+	if http.DefaultTransport.(*http.Transport).MaxConnsPerHost != 0 {
+		t.Error("The default transport should not be modified")
+	}
+
+	// The session's client settings are kept.
+	sess := getSession()
+	sess.Config.HTTPClient = &http.Client{Timeout: time.Minute}
+	m = NewWithOption(sess, &Option{MaxConnsPerHost: 2})
+	client := m.s3.(*s3.S3).Client.Config.HTTPClient
+	if client.Timeout != time.Minute || client.Transport.(*http.Transport).MaxConnsPerHost != 2 {
+		t.Error("The session's http client should be copied with the limit")
+	}
+	if sess.Config.HTTPClient.Transport != nil {
+		t.Error("The session's http client should not be modified")
+	}
+}
+
+// compatibleS3 emulates the listings of the s3 compatible stores, which return
+// the stale continuation token on the last page and the ETag which isn't the md5.
+type compatibleS3 struct {
+	*fakeS3
+}
+
+func (c *compatibleS3) ListObjectsV2WithContext(ctx aws.Context, input *s3.ListObjectsV2Input, opts ...request.Option) (*s3.ListObjectsV2Output, error) {
+	output, err := c.fakeS3.ListObjectsV2WithContext(ctx, input, opts...)
+	if err != nil {
+		return nil, err
+	}
+	output.IsTruncated = aws.Bool(output.NextContinuationToken != nil)
+	if output.NextContinuationToken == nil {
+		output.NextContinuationToken = input.ContinuationToken
+	}
+	for _, object := range output.Contents {
+		object.ETag = aws.String("\"compatible-etag\"")
+	}
+	return output, nil
+}
+
+func TestS3CompatibleStore(t *testing.T) {
+	fake := newFakeS3()
+	fake.pageSize = 2
+	fake.createBucket("example-bucket")
+	for _, key := range []string{"a.txt", "b.txt", "c.txt"} {
+		fake.putObject("example-bucket", key, []byte("data"), time.Now())
+	}
+
+	temp, err := ioutil.TempDir("", "s3synctest")
+	if err != nil {
+		t.Fatal("Failed to create temp dir")
+	}
+	defer os.RemoveAll(temp)
+
+	m := NewWithClient(&compatibleS3{fake}, WithContentComparison(ChecksumMD5))
+	if err := m.Sync("s3://example-bucket", temp); err != nil {
+		t.Fatal("Sync should be successful", err)
+	}
+	for _, name := range []string{"a.txt", "b.txt", "c.txt"} {
+		fileHasSize(t, filepath.Join(temp, name), 4)
+	}
+	if n := fake.count("ListObjectsV2"); n != 2 {
+		t.Errorf("The listing should stop at the last page, listed %d pages", n)
+	}
+}
+
+func TestNextContinuationToken(t *testing.T) {
+	testCases := map[string]struct {
+		list     *s3.ListObjectsV2Output
+		expected *string
+	}{
+		"NoToken":   {&s3.ListObjectsV2Output{}, nil},
+		"Token":     {&s3.ListObjectsV2Output{NextContinuationToken: aws.String("a")}, aws.String("a")},
+		"Truncated": {&s3.ListObjectsV2Output{NextContinuationToken: aws.String("a"), IsTruncated: aws.Bool(true)}, aws.String("a")},
+		"EmptyToken": {
+			&s3.ListObjectsV2Output{NextContinuationToken: aws.String(""), IsTruncated: aws.Bool(true)}, nil,
+		},
+		"NotTruncated": {
+			&s3.ListObjectsV2Output{NextContinuationToken: aws.String("a"), IsTruncated: aws.Bool(false)}, nil,
+		},
+	}
+	for name, tc := range testCases {
+		t.Run(name, func(t *testing.T) {
+			if token := nextContinuationToken(tc.list); !reflect.DeepEqual(tc.expected, token) {
+				t.Errorf("Expected token %v, got %v", aws.StringValue(tc.expected), aws.StringValue(token))
+			}
+		})
+	}
+}
+
+func TestForcePathStyle(t *testing.T) {
+	sess := session.Must(session.NewSession(&aws.Config{
+		Region:   aws.String("us-east-1"),
+		Endpoint: aws.String("http://localhost:9000"),
+	}))
+	m := NewWithOption(sess, &Option{ForcePathStyle: true})
+	if !aws.BoolValue(m.s3.(*s3.S3).Client.Config.S3ForcePathStyle) {
+		t.Error("The client should use the path-style url")
+	}
+	if aws.BoolValue(sess.Config.S3ForcePathStyle) {
+		t.Error("The session should not be modified")
+	}
+	m = NewWithOption(sess, &Option{})
+	if aws.BoolValue(m.s3.(*s3.S3).Client.Config.S3ForcePathStyle) {
+		t.Error("The client should not use the path-style url by default")
+	}
+}
+
+// requesterPaysS3 denies the requests without the RequestPayer like the requester pays bucket.
+type requesterPaysS3 struct {
+	*fakeS3
+}
+
+func checkRequestPayer(payer *string) error {
+	if aws.StringValue(payer) != s3.RequestPayerRequester {
+		return awserr.New("AccessDenied", "Access Denied", nil)
+	}
+	return nil
+}
+
+func (r *requesterPaysS3) ListObjectsV2WithContext(ctx aws.Context, input *s3.ListObjectsV2Input, opts ...request.Option) (*s3.ListObjectsV2Output, error) {
+	if err := checkRequestPayer(input.RequestPayer); err != nil {
+		return nil, err
+	}
+	return r.fakeS3.ListObjectsV2WithContext(ctx, input, opts...)
+}
+
+func (r *requesterPaysS3) GetObjectWithContext(ctx aws.Context, input *s3.GetObjectInput, opts ...request.Option) (*s3.GetObjectOutput, error) {
+	if err := checkRequestPayer(input.RequestPayer); err != nil {
+		return nil, err
+	}
+	return r.fakeS3.GetObjectWithContext(ctx, input, opts...)
+}
+
+func (r *requesterPaysS3) HeadObjectWithContext(ctx aws.Context, input *s3.HeadObjectInput, opts ...request.Option) (*s3.HeadObjectOutput, error) {
+	if err := checkRequestPayer(input.RequestPayer); err != nil {
+		return nil, err
+	}
+	return r.fakeS3.HeadObjectWithContext(ctx, input, opts...)
+}
+
+func TestRequestPayer(t *testing.T) {
+	temp, err := ioutil.TempDir("", "s3synctest")
+	if err != nil {
+		t.Fatal("Failed to create temp dir")
+	}
+	defer os.RemoveAll(temp)
+
+	fake := newFakeS3()
+	fake.putObject("example-bucket", "data/a.txt", []byte("data"), time.Now())
+	client := &requesterPaysS3{fake}
+
+	m := &Manager{s3: client}
+	if err := m.Sync("s3://example-bucket/data", temp); err == nil {
+		t.Fatal("Sync should fail without RequestPayer")
+	}
+	if m.requestPayer() != nil {
+		t.Error("RequestPayer should be nil without the option")
+	}
+
+	m = &Manager{s3: client, option: Option{RequestPayer: s3.RequestPayerRequester}}
+	if err := m.Sync("s3://example-bucket/data", temp); err != nil {
+		t.Fatal("Sync should be successful", err)
+	}
+	fileHasSize(t, filepath.Join(temp, "a.txt"), 4)
+
+	// The single object download checks the object by HEAD.
+	if err := m.Sync("s3://example-bucket/data/a.txt", filepath.Join(temp, "b.txt")); err != nil {
+		t.Fatal("Sync should be successful", err)
+	}
+	fileHasSize(t, filepath.Join(temp, "b.txt"), 4)
+}
+
+func TestListLocalFilesNoDuplicates(t *testing.T) {
+	temp, err := ioutil.TempDir("", "s3synctest")
+	if err != nil {
+		t.Fatal("Failed to create temp dir")
+	}
+	defer os.RemoveAll(temp)
+
+	for _, name := range []string{"a", "dir/b", "dir/sub/c"} {
+		writeFile(t, filepath.Join(temp, name), "data")
+	}
+
+	testCases := map[string]struct {
+		path     string
+		expected []string
+	}{
+		"Directory":  {temp, []string{"a", filepath.Join("dir", "b"), filepath.Join("dir", "sub", "c")}},
+		"SubDir":     {filepath.Join(temp, "dir"), []string{"b", filepath.Join("sub", "c")}},
+		"SingleFile": {filepath.Join(temp, "a"), []string{"a"}},
+		"NestedFile": {filepath.Join(temp, "dir", "sub", "c"), []string{"c"}},
+		"NotExist":   {filepath.Join(temp, "not-exist"), nil},
+	}
+	for name, testCase := range testCases {
+		t.Run(name, func(t *testing.T) {
+			seen := make(map[string]bool)
+			var names []string
+			for file := range listLocalFiles(context.Background(), testCase.path) {
+				if file.err != nil {
+					t.Fatal("listLocalFiles should be successful", file.err)
+				}
+				if seen[file.path] {
+					t.Errorf("%s is listed twice", file.path)
+				}
+				seen[file.path] = true
+				names = append(names, file.name)
+			}
+			sort.Strings(names)
+			if !reflect.DeepEqual(testCase.expected, names) {
+				t.Errorf("Expected %v, got %v", testCase.expected, names)
+			}
+		})
+	}
+}
+
+func getSession() *session.Session {
+	sess, _ := session.NewSession(&aws.Config{
+		Region:           aws.String("ap-northeast-1"),
+		S3ForcePathStyle: aws.Bool(true),
+		Endpoint:         aws.String("http://localhost:4572"),
+	})
+	return sess
+}
+
+type dummyLogger struct {
+	log func(...interface{})
+}
+
+func (d *dummyLogger) Log(v ...interface{}) {
+	d.log(v...)
+}
+func (d *dummyLogger) Logf(format string, v ...interface{}) {
+}
+
+func createLoggerWithLogFunc(log func(v ...interface{})) LoggerIF {
+	return &dummyLogger{log: log}
+}
+
+func fileHasSize(t *testing.T, filename string, expectedSize int) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(filename, "is not synced")
+	}
+	if len(data) != expectedSize {
+		t.Fatal(filename, "is not synced")
+	}
+}
+
+func fileHasContent(t *testing.T, filename string, expected string) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(filename, "is not synced")
+	}
+	if string(data) != expected {
+		t.Fatalf("%s: expected %q, got %q", filename, expected, data)
+	}
+}
+
+// staleListingS3 returns the stale size and modification time in the listing,
+// and counts the concurrent HeadObject calls.
+type staleListingS3 struct {
+	*fakeS3
+	size         int64
+	lastModified time.Time
+
+	heads, maxHeads int32
+}
+
+func (s *staleListingS3) ListObjectsV2WithContext(ctx aws.Context, input *s3.ListObjectsV2Input, opts ...request.Option) (*s3.ListObjectsV2Output, error) {
+	output, err := s.fakeS3.ListObjectsV2WithContext(ctx, input, opts...)
+	if err != nil {
+		return nil, err
+	}
+	for _, object := range output.Contents {
+		object.Size = aws.Int64(s.size)
+		object.LastModified = aws.Time(s.lastModified)
+	}
+	return output, nil
+}
+
+func (s *staleListingS3) HeadObjectWithContext(ctx aws.Context, input *s3.HeadObjectInput, opts ...request.Option) (*s3.HeadObjectOutput, error) {
+	n := atomic.AddInt32(&s.heads, 1)
+	defer atomic.AddInt32(&s.heads, -1)
+	for {
+		max := atomic.LoadInt32(&s.maxHeads)
+		if n <= max || atomic.CompareAndSwapInt32(&s.maxHeads, max, n) {
+			break
+		}
+	}
+	time.Sleep(10 * time.Millisecond)
+	return s.fakeS3.HeadObjectWithContext(ctx, input, opts...)
+}
+
+func TestS3syncHeadCompare(t *testing.T) {
+	local := time.Now().Add(-time.Hour)
+	setup := func(t *testing.T) (*staleListingS3, string) {
+		temp, err := ioutil.TempDir("", "s3synctest")
+		if err != nil {
+			t.Fatal("Failed to create temp dir")
+		}
+		fake := newFakeS3()
+		for _, name := range []string{"1", "2", "3", "4", "5", "6", "7", "8"} {
+			writeFile(t, filepath.Join(temp, name), "old")
+			if err := os.Chtimes(filepath.Join(temp, name), local, local); err != nil {
+				t.Fatal("Failed to change the modification time", err)
+			}
+			fake.putObject("example-bucket", name, []byte("updated"), time.Now())
+		}
+		// The listing claims that the objects are the same as the local files.
+		return &staleListingS3{fakeS3: fake, size: 3, lastModified: local}, temp
+	}
+
+	t.Run("Listing", func(t *testing.T) {
+		client, temp := setup(t)
+		defer os.RemoveAll(temp)
+
+		m := &Manager{s3: client}
+		if err := m.Sync("s3://example-bucket", temp); err != nil {
+			t.Fatal("Sync should be successful", err)
+		}
+		if n := client.count("GetObject"); n != 0 {
+			t.Errorf("The stale listing should skip the downloads, got %d", n)
+		}
+	})
+	t.Run("Head", func(t *testing.T) {
+		client, temp := setup(t)
+		defer os.RemoveAll(temp)
+
+		m := &Manager{s3: client, option: Option{HeadCompare: true, ListConcurrency: 3}}
+		if err := m.Sync("s3://example-bucket", temp); err != nil {
+			t.Fatal("Sync should be successful", err)
+		}
+		if n := client.count("GetObject"); n != 8 {
+			t.Errorf("The updated objects should be downloaded, got %d", n)
+		}
+		fileHasSize(t, filepath.Join(temp, "1"), len("updated"))
+		if max := atomic.LoadInt32(&client.maxHeads); max > 3 || max < 2 {
+			t.Errorf("HeadObject should be called concurrently up to 3, max: %d", max)
+		}
+	})
+}
+
+func TestS3syncExecutionStrategy(t *testing.T) {
+	client := newFakeS3()
+	client.pageSize = 2
+	for _, key := range []string{"a.txt", "dir/b.txt", "dir/c.txt", "uptodate.txt"} {
+		client.putObject("example-bucket", key, []byte(key), time.Now().Add(-time.Hour))
+	}
+
+	results := make(map[ExecutionStrategy]*SyncResult)
+	for _, strategy := range []ExecutionStrategy{Stream, TwoPhase} {
+		temp, err := ioutil.TempDir("", "s3synctest")
+		if err != nil {
+			t.Fatal("Failed to create temp dir")
+		}
+		defer os.RemoveAll(temp)
+		writeFile(t, filepath.Join(temp, "uptodate.txt"), "uptodate.txt")
+
+		m := &Manager{s3: client, option: Option{ExecutionStrategy: strategy}}
+		result, err := m.SyncWithResult("s3://example-bucket", temp)
+		if err != nil {
+			t.Fatal("Sync should be successful", err)
+		}
+		for _, name := range []string{"a.txt", "dir/b.txt", "dir/c.txt"} {
+			fileHasSize(t, filepath.Join(temp, name), len(name))
+		}
+		// The modification time of the local files differs between the runs.
+		for i := range result.Skipped {
+			result.Skipped[i].ModTime = time.Time{}
+		}
+		results[strategy] = result
+	}
+
+	if !reflect.DeepEqual(results[Stream], results[TwoPhase]) {
+		t.Errorf("Both strategies should have the same result, stream: %+v, two phase: %+v", results[Stream], results[TwoPhase])
+	}
+}
+
+func TestS3syncTwoPhaseListingError(t *testing.T) {
+	fake := newFakeS3()
+	fake.pageSize = 2
+	for _, key := range []string{"1", "2", "3", "4"} {
+		fake.putObject("example-bucket", key, []byte(key), time.Now())
+	}
+	client := &listErrorS3{stallingS3: &stallingS3{fakeS3: fake}, failPage: 2}
+
+	temp, err := ioutil.TempDir("", "s3synctest")
+	if err != nil {
+		t.Fatal("Failed to create temp dir")
+	}
+	defer os.RemoveAll(temp)
+
+	m := &Manager{s3: client, option: Option{ExecutionStrategy: TwoPhase}}
+	if err := m.Sync("s3://example-bucket", temp); err == nil {
+		t.Fatal("Sync should fail with the listing error")
+	}
+	if n := fake.count("GetObject"); n != 0 {
+		t.Errorf("Nothing should be downloaded before the listing completes, got %d", n)
+	}
+}
+
+func TestS3syncObjectFilter(t *testing.T) {
+	for _, batch := range []bool{false, true} {
+		batch := batch
+		t.Run(fmt.Sprintf("BatchByTopLevelDir=%v", batch), func(t *testing.T) {
+			client := newFakeS3()
+			for _, key := range []string{"a.txt", "debug.log", "dir/old.txt", "dir/trace.log"} {
+				client.putObject("example-bucket", key, []byte(key), time.Now())
+			}
+			temp, err := ioutil.TempDir("", "s3synctest")
+			if err != nil {
+				t.Fatal("Failed to create temp dir")
+			}
+			defer os.RemoveAll(temp)
+
+			m := &Manager{s3: client, option: Option{
+				BatchByTopLevelDir: batch,
+				ObjectFilter: func(info FileInfo) (FileInfo, bool) {
+					if filepath.Ext(info.Name) == ".log" {
+						return info, false
+					}
+					if info.Name == filepath.Join("dir", "old.txt") {
+						info.Name = filepath.Join("dir", "new.txt")
+					}
+					return info, true
+				},
+			}}
+			for i := 0; i < 2; i++ {
+				if err := m.Sync("s3://example-bucket", temp); err != nil {
+					t.Fatal("Sync should be successful", err)
+				}
+			}
+
+			fileHasSize(t, filepath.Join(temp, "a.txt"), len("a.txt"))
+			fileHasSize(t, filepath.Join(temp, "dir", "new.txt"), len("dir/old.txt"))
+			for _, name := range []string{"debug.log", "dir/old.txt", "dir/trace.log"} {
+				fileNotExists(t, filepath.Join(temp, name))
+			}
+			if n := client.count("GetObject"); n != 2 {
+				t.Errorf("The rewritten files should be compared with the rewritten names, got %d downloads", n)
+			}
+		})
+	}
+}
+
+func TestListBufferSize(t *testing.T) {
+	client := newFakeS3()
+	for i := 0; i < 20; i++ {
+		client.putObject("example-bucket", fmt.Sprintf("%02d.txt", i), []byte("data"), time.Now())
+	}
+
+	testCases := map[string]struct {
+		bufferSize int
+		expected   int
+	}{
+		"Default": {0, defaultListBufferSize},
+		"Small":   {1, 1},
+		"Large":   {50000, 50000},
+	}
+	for name, testCase := range testCases {
+		t.Run(name, func(t *testing.T) {
+			m := &Manager{s3: client, option: Option{ListBufferSize: testCase.bufferSize}}
+			c := m.listS3Files(context.Background(), &s3Path{bucket: "example-bucket"})
+			if cap(c) != testCase.expected {
+				t.Errorf("Expected buffer size %d, got %d", testCase.expected, cap(c))
+			}
+			files, err := collectFiles(c)
+			if err != nil {
+				t.Fatal("Listing should be successful", err)
+			}
+			if len(files) != 20 {
+				t.Errorf("All the objects should be listed regardless of the buffer size, got %d", len(files))
+			}
+		})
+	}
+}
+
+func TestMaxKeys(t *testing.T) {
+	temp, err := ioutil.TempDir("", "s3synctest")
+	if err != nil {
+		t.Fatal("Failed to create temp dir")
+	}
+	defer os.RemoveAll(temp)
+
+	testCases := map[string]struct {
+		maxKeys int64
+		pages   int
+	}{
+		"Default": {0, 1},
+		"Small":   {3, 7},
+		"Exact":   {10, 2},
+	}
+	for name, testCase := range testCases {
+		t.Run(name, func(t *testing.T) {
+			client := newFakeS3()
+			for i := 0; i < 20; i++ {
+				client.putObject("example-bucket", fmt.Sprintf("%02d.txt", i), []byte("data"), time.Now())
+			}
+			m := &Manager{s3: client, option: Option{MaxKeys: testCase.maxKeys}}
+			result, err := m.syncWithResult(context.Background(), "s3://example-bucket", filepath.Join(temp, name))
+			if err != nil {
+				t.Fatal("Sync should be successful", err)
+			}
+			if len(result.Transferred) != 20 {
+				t.Errorf("All the objects should be synced regardless of the page size, got %d", len(result.Transferred))
+			}
+			if n := client.count("ListObjectsV2"); n != testCase.pages {
+				t.Errorf("Expected %d pages, got %d", testCase.pages, n)
+			}
+		})
+	}
+}
+
+func TestSyncSingleFile(t *testing.T) {
+	temp, err := ioutil.TempDir("", "s3synctest")
+	if err != nil {
+		t.Fatal("Failed to create temp dir")
+	}
+	defer os.RemoveAll(temp)
+
+	source := filepath.Join(temp, "report.pdf")
+	writeFile(t, source, "report")
+
+	t.Run("Upload", func(t *testing.T) {
+		testCases := map[string]struct {
+			dest     string
+			expected string
+		}{
+			"Key":       {"s3://example-bucket/reports/2024.pdf", "reports/2024.pdf"},
+			"TopKey":    {"s3://example-bucket/2024.pdf", "2024.pdf"},
+			"Directory": {"s3://example-bucket/reports/", "reports/report.pdf"},
+			"Bucket":    {"s3://example-bucket", "report.pdf"},
+		}
+		for name, testCase := range testCases {
+			t.Run(name, func(t *testing.T) {
+				client := newFakeS3()
+				client.createBucket("example-bucket")
+				client.putObject("example-bucket", "reports/other.pdf", []byte("other"), time.Now())
+				m := &Manager{s3: client, option: Option{Delete: true}}
+
+				result, err := m.syncWithResult(context.Background(), source, testCase.dest)
+				if err != nil {
+					t.Fatal("Sync should be successful", err)
+				}
+				if len(result.Transferred) != 1 || result.Transferred[0].Name != path.Base(testCase.expected) {
+					t.Fatalf("The file should be transferred as %s, got %v", path.Base(testCase.expected), result.Transferred)
+				}
+				object, ok := client.getObject("example-bucket", testCase.expected)
+				if !ok || string(object.data) != "report" {
+					t.Fatalf("The file should be uploaded to %s", testCase.expected)
+				}
+				if _, ok := client.getObject("example-bucket", "reports/other.pdf"); !ok {
+					t.Error("The other object should not be deleted")
+				}
+
+				// The uploaded object is compared on the next sync.
+				result, err = m.syncWithResult(context.Background(), source, testCase.dest)
+				if err != nil {
+					t.Fatal("Sync should be successful", err)
+				}
+				if len(result.Transferred) != 0 || len(result.Skipped) != 1 {
+					t.Errorf("The unchanged file should be skipped, got %+v", result)
+				}
+			})
+		}
+	})
+
+	t.Run("Download", func(t *testing.T) {
+		client := newFakeS3()
+		client.putObject("example-bucket", "reports/2024.pdf", []byte("report"), time.Now())
+		client.putObject("example-bucket", "reports/2024.pdf.bak", []byte("backup"), time.Now())
+		m := &Manager{s3: client}
+
+		if err := os.MkdirAll(filepath.Join(temp, "existing"), 0755); err != nil {
+			t.Fatal(err)
+		}
+		testCases := map[string]struct {
+			dest     string
+			expected string
+		}{
+			"File":              {filepath.Join(temp, "download", "report.pdf"), filepath.Join(temp, "download", "report.pdf")},
+			"Directory":         {filepath.Join(temp, "dir") + string(filepath.Separator), filepath.Join(temp, "dir", "2024.pdf")},
+			"ExistingDirectory": {filepath.Join(temp, "existing"), filepath.Join(temp, "existing", "2024.pdf")},
+		}
+		for name, testCase := range testCases {
+			t.Run(name, func(t *testing.T) {
+				result, err := m.syncWithResult(context.Background(), "s3://example-bucket/reports/2024.pdf", testCase.dest)
+				if err != nil {
+					t.Fatal("Sync should be successful", err)
+				}
+				if len(result.Transferred) != 1 {
+					t.Fatalf("Only the object should be transferred, got %v", result.Transferred)
+				}
+				fileHasSize(t, testCase.expected, len("report"))
+
+				// The downloaded file is compared on the next sync.
+				result, err = m.syncWithResult(context.Background(), "s3://example-bucket/reports/2024.pdf", testCase.dest)
+				if err != nil {
+					t.Fatal("Sync should be successful", err)
+				}
+				if len(result.Transferred) != 0 || len(result.Skipped) != 1 {
+					t.Errorf("The unchanged file should be skipped, got %+v", result)
+				}
+			})
+		}
+	})
+}
+
+// versionedS3 serves the older versions of the objects from the fake client of each version.
+type versionedS3 struct {
+	*fakeS3
+	versions map[string]*fakeS3
+
+	mu         sync.Mutex
+	versionIDs []string
+}
+
+func (v *versionedS3) version(versionID *string) s3iface.S3API {
+	if versionID == nil {
+		return v.fakeS3
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.versionIDs = append(v.versionIDs, *versionID)
+	if version, ok := v.versions[*versionID]; ok {
+		return version
+	}
+	return newFakeS3()
+}
+
+func (v *versionedS3) HeadObjectWithContext(ctx aws.Context, input *s3.HeadObjectInput, opts ...request.Option) (*s3.HeadObjectOutput, error) {
+	return v.version(input.VersionId).HeadObjectWithContext(ctx, input, opts...)
+}
+
+func (v *versionedS3) GetObjectWithContext(ctx aws.Context, input *s3.GetObjectInput, opts ...request.Option) (*s3.GetObjectOutput, error) {
+	return v.version(input.VersionId).GetObjectWithContext(ctx, input, opts...)
+}
+
+func TestVersionID(t *testing.T) {
+	temp, err := ioutil.TempDir("", "s3synctest")
+	if err != nil {
+		t.Fatal("Failed to create temp dir")
+	}
+	defer os.RemoveAll(temp)
+
+	old := newFakeS3()
+	old.putObject("example-bucket", "reports/report.pdf", []byte("old"), time.Now().Add(-time.Hour))
+	latest := newFakeS3()
+	latest.putObject("example-bucket", "reports/report.pdf", []byte("latest"), time.Now())
+	client := &versionedS3{fakeS3: latest, versions: map[string]*fakeS3{"v1": old}}
+
+	dest := filepath.Join(temp, "report.pdf")
+	m := &Manager{s3: client, option: Option{VersionID: "v1"}}
+	if err := m.Sync("s3://example-bucket/reports/report.pdf", dest); err != nil {
+		t.Fatal("Sync should be successful", err)
+	}
+	data, err := ioutil.ReadFile(dest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "old" {
+		t.Errorf("The version should be downloaded, got %q", data)
+	}
+	for _, versionID := range client.versionIDs {
+		if versionID != "v1" {
+			t.Errorf("Expected VersionId v1, got %q", versionID)
+		}
+	}
+	if old.count("GetObject") != 1 || latest.count("GetObject") != 0 {
+		t.Error("Only the version should be got")
+	}
+
+	t.Run("NotSingle", func(t *testing.T) {
+		for _, dests := range [][2]string{
+			{"s3://example-bucket/reports/", temp},
+			{"s3://example-bucket/reports/report.pdf", "s3://example-bucket/copy.pdf"},
+			{dest, "s3://example-bucket/reports/"},
+		} {
+			if err := m.Sync(dests[0], dests[1]); err != errVersionIDNotSingle {
+				t.Errorf("%s to %s: expected %v, got %v", dests[0], dests[1], errVersionIDNotSingle, err)
+			}
+		}
+	})
+}
+
+func TestDownloadFileMode(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("The permission bits are not supported on windows")
+	}
+	temp, err := ioutil.TempDir("", "s3synctest")
+	if err != nil {
+		t.Fatal("Failed to create temp dir")
+	}
+	defer os.RemoveAll(temp)
+
+	client := newFakeS3()
+	client.putObject("example-bucket", "dir/a.txt", []byte("data"), time.Now())
+
+	m := &Manager{s3: client, option: Option{FileMode: 0600, DirMode: 0700}}
+	if err := m.Sync("s3://example-bucket", temp); err != nil {
+		t.Fatal("Sync should be successful", err)
+	}
+	for name, expected := range map[string]os.FileMode{"dir": 0700, "dir/a.txt": 0600} {
+		stat, err := os.Stat(filepath.Join(temp, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if mode := stat.Mode().Perm(); mode != expected {
+			t.Errorf("Expected mode of %s %v, got %v", name, expected, mode)
+		}
+	}
+}
+
+// erroringFiles returns a channel which fails in the middle of the files,
+// and a channel closed when all the files are sent.
+func erroringFiles(n int) (chan *fileInfo, chan struct{}) {
+	c := make(chan *fileInfo)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		defer close(c)
+		for i := 0; i < n; i++ {
+			if i == n/2 {
+				c <- &fileInfo{err: errors.New("listing failed")}
+				continue
+			}
+			c <- &fileInfo{name: fmt.Sprintf("%d", i)}
+		}
+	}()
+	return c, done
+}
+
+func TestFileChannelDrainedOnError(t *testing.T) {
+	waitDone := func(t *testing.T, done chan struct{}) {
+		t.Helper()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Error("The channel should be drained")
+		}
+	}
+
+	t.Run("fileInfoChanToMap", func(t *testing.T) {
+		files, done := erroringFiles(10)
+		if _, err := fileInfoChanToMap(files); err == nil {
+			t.Error("The error should be returned")
+		}
+		waitDone(t, done)
+	})
+	t.Run("collectFiles", func(t *testing.T) {
+		files, done := erroringFiles(10)
+		if _, err := collectFiles(files); err == nil {
+			t.Error("The error should be returned")
+		}
+		waitDone(t, done)
+	})
+	t.Run("filterFilesForSync", func(t *testing.T) {
+		sourceFiles, sourceDone := erroringFiles(10)
+		destFiles, destDone := erroringFiles(10)
+		m := &Manager{}
+		var errs int
+		for file := range m.filterFilesForSync(context.Background(), sourceFiles, destFiles, &syncRecorder{}) {
+			if file.err != nil {
+				errs++
+			}
+		}
+		if errs != 1 {
+			t.Errorf("The error of the destination should be sent once, got %d", errs)
+		}
+		waitDone(t, sourceDone)
+		waitDone(t, destDone)
+	})
+}
+
+func TestIsSinglePartETag(t *testing.T) {
+	testCases := map[string]bool{
+		"d41d8cd98f00b204e9800998ecf8427e":   true,
+		"d41d8cd98f00b204e9800998ecf8427e-2": false,
+		"compatible-etag":                    false,
+		"x41d8cd98f00b204e9800998ecf8427e":   false,
+		"":                                   false,
+	}
+	for etag, expected := range testCases {
+		if isSinglePartETag(etag) != expected {
+			t.Errorf("isSinglePartETag(%q) should be %v", etag, expected)
+		}
 	}
 }
@@ -0,0 +1,119 @@
+// Copyright 2019 SEQSENSE, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package s3sync
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// errVersionIDNotSingle is returned if Option.VersionID is set for the sync
+// other than the download of a single object.
+var errVersionIDNotSingle = errors.New("the VersionID option is only supported for the single object download")
+
+// isSingleFile returns true if the local path is a regular file.
+func (m *Manager) isSingleFile(localPath string) bool {
+	stat, err := m.fs().Stat(localPath)
+	return err == nil && stat.Mode().IsRegular()
+}
+
+// singleFileUploadPath returns the s3 path to which the single local file is uploaded,
+// and the name of the file under it.
+// The destination without the trailing slash is the key of the object, otherwise
+// the file is uploaded under the destination by its base name.
+// The returned path lists only the siblings of the object to compare the file.
+func (m *Manager) singleFileUploadPath(source string, destPath *s3Path) (*s3Path, string) {
+	key := destPath.bucketPrefix
+	if key == "" || strings.HasSuffix(key, "/") {
+		key += m.toS3Name(filepath.Base(source))
+	}
+	dir := key[:strings.LastIndex(key, "/")+1]
+	return &s3Path{bucket: destPath.bucket, bucketPrefix: dir, shallow: true}, m.toLocalName(key[len(dir):])
+}
+
+// singleObjectDownload returns the object if the s3 source is a single object and
+// the local destination is the path of the file rather than a directory, or nil otherwise.
+// The destination with the trailing separator or an existing directory is a directory.
+// The object is the version of Option.VersionID if it is set.
+func (m *Manager) singleObjectDownload(ctx context.Context, sourcePath *s3Path, destPath string) (*fileInfo, error) {
+	key := sourcePath.bucketPrefix
+	if sourcePath.pattern != "" || key == "" || strings.HasSuffix(key, "/") ||
+		strings.HasSuffix(destPath, "/") || strings.HasSuffix(destPath, string(filepath.Separator)) {
+		return nil, nil
+	}
+	if stat, err := m.fs().Stat(destPath); err == nil && stat.IsDir() {
+		return nil, nil
+	} else if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	sse := m.sseCustomer()
+	input := &s3.HeadObjectInput{
+		Bucket:               aws.String(sourcePath.bucket),
+		Key:                  aws.String(key),
+		RequestPayer:         m.requestPayer(),
+		SSECustomerAlgorithm: sse.algorithm,
+		SSECustomerKey:       sse.key,
+		SSECustomerKeyMD5:    sse.keyMD5,
+	}
+	if m.option.VersionID != "" {
+		input.VersionId = aws.String(m.option.VersionID)
+	}
+	head, err := m.s3.HeadObjectWithContext(ctx, input)
+	if isNotFound(err) {
+		// The source is a directory.
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return &fileInfo{
+		name:         filepath.Base(key),
+		path:         key,
+		size:         aws.Int64Value(head.ContentLength),
+		lastModified: aws.TimeValue(head.LastModified),
+		metadata:     head.Metadata,
+		etag:         normalizeETag(aws.StringValue(head.ETag)),
+		versionID:    m.option.VersionID,
+	}, nil
+}
+
+// renameSingleFile passes the files which keep returns true for, renamed to name.
+// All the files are passed if keep is nil.
+func renameSingleFile(ctx context.Context, files chan *fileInfo, name string, keep func(*fileInfo) bool) chan *fileInfo {
+	c := make(chan *fileInfo)
+
+	go func() {
+		defer close(c)
+		for file := range files {
+			if file.err == nil {
+				if keep != nil && !keep(file) {
+					continue
+				}
+				renamed := *file
+				renamed.name = name
+				file = &renamed
+			}
+			if !sendInfoToChannel(ctx, c, file) {
+				return
+			}
+		}
+	}()
+
+	return c
+}
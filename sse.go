@@ -0,0 +1,55 @@
+// Copyright 2019 SEQSENSE, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package s3sync
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+// sseCustomerKeySize is the size of the AES256 key of SSE-C.
+const sseCustomerKeySize = 32
+
+// sseCustomer is the headers of the server side encryption by the customer
+// provided key (SSE-C).
+type sseCustomer struct {
+	algorithm *string
+	// key is the raw key, which the sdk encodes by base64 in the request header.
+	key    *string
+	keyMD5 *string
+}
+
+// sseCustomer returns the SSE-C headers of Option.SSECustomerKey, or the nil headers
+// if it is not set.
+func (m *Manager) sseCustomer() sseCustomer {
+	if m.option.SSECustomerKey == "" {
+		return sseCustomer{}
+	}
+	sum := md5.Sum([]byte(m.option.SSECustomerKey))
+	return sseCustomer{
+		algorithm: aws.String("AES256"),
+		key:       aws.String(m.option.SSECustomerKey),
+		keyMD5:    aws.String(base64.StdEncoding.EncodeToString(sum[:])),
+	}
+}
+
+// validateSSECustomerKey validates the size of Option.SSECustomerKey.
+func validateSSECustomerKey(option *Option) error {
+	if n := len(option.SSECustomerKey); n != 0 && n != sseCustomerKeySize {
+		return fmt.Errorf("SSECustomerKey must be %d bytes, got %d bytes", sseCustomerKeySize, n)
+	}
+	return nil
+}
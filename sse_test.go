@@ -0,0 +1,129 @@
+// Copyright 2019 SEQSENSE, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package s3sync
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const testSSECustomerKey = "0123456789abcdef0123456789abcdef"
+
+// sseCustomerS3 rejects the requests without the SSE-C headers of testSSECustomerKey
+// like the objects encrypted by the key.
+type sseCustomerS3 struct {
+	*fakeS3
+}
+
+func checkSSECustomer(api string, algorithm, key, keyMD5 *string) error {
+	sum := md5.Sum([]byte(testSSECustomerKey))
+	if aws.StringValue(algorithm) != "AES256" || aws.StringValue(key) != testSSECustomerKey ||
+		aws.StringValue(keyMD5) != base64.StdEncoding.EncodeToString(sum[:]) {
+		return awserr.New("InvalidRequest", api+" requires the SSE-C headers", nil)
+	}
+	return nil
+}
+
+func (c *sseCustomerS3) PutObjectWithContext(ctx aws.Context, input *s3.PutObjectInput, opts ...request.Option) (*s3.PutObjectOutput, error) {
+	if err := checkSSECustomer("PutObject", input.SSECustomerAlgorithm, input.SSECustomerKey, input.SSECustomerKeyMD5); err != nil {
+		return nil, err
+	}
+	return c.fakeS3.PutObjectWithContext(ctx, input, opts...)
+}
+
+func (c *sseCustomerS3) PutObjectRequest(input *s3.PutObjectInput) (*request.Request, *s3.PutObjectOutput) {
+	output := &s3.PutObjectOutput{}
+	return fakeRequest("PutObject", input, output, func() error {
+		_, err := c.PutObjectWithContext(aws.BackgroundContext(), input)
+		return err
+	}), output
+}
+
+func (c *sseCustomerS3) GetObjectWithContext(ctx aws.Context, input *s3.GetObjectInput, opts ...request.Option) (*s3.GetObjectOutput, error) {
+	if err := checkSSECustomer("GetObject", input.SSECustomerAlgorithm, input.SSECustomerKey, input.SSECustomerKeyMD5); err != nil {
+		return nil, err
+	}
+	return c.fakeS3.GetObjectWithContext(ctx, input, opts...)
+}
+
+func (c *sseCustomerS3) HeadObjectWithContext(ctx aws.Context, input *s3.HeadObjectInput, opts ...request.Option) (*s3.HeadObjectOutput, error) {
+	if err := checkSSECustomer("HeadObject", input.SSECustomerAlgorithm, input.SSECustomerKey, input.SSECustomerKeyMD5); err != nil {
+		return nil, err
+	}
+	return c.fakeS3.HeadObjectWithContext(ctx, input, opts...)
+}
+
+func (c *sseCustomerS3) CopyObjectWithContext(ctx aws.Context, input *s3.CopyObjectInput, opts ...request.Option) (*s3.CopyObjectOutput, error) {
+	if err := checkSSECustomer("CopyObject", input.SSECustomerAlgorithm, input.SSECustomerKey, input.SSECustomerKeyMD5); err != nil {
+		return nil, err
+	}
+	if err := checkSSECustomer("CopyObject source", input.CopySourceSSECustomerAlgorithm, input.CopySourceSSECustomerKey, input.CopySourceSSECustomerKeyMD5); err != nil {
+		return nil, err
+	}
+	return c.fakeS3.CopyObjectWithContext(ctx, input, opts...)
+}
+
+func TestSSECustomerKey(t *testing.T) {
+	temp, err := ioutil.TempDir("", "s3synctest")
+	if err != nil {
+		t.Fatal("Failed to create temp dir")
+	}
+	defer os.RemoveAll(temp)
+	writeFile(t, filepath.Join(temp, "upload/a.txt"), "data")
+
+	fake := newFakeS3()
+	fake.createBucket("example-bucket")
+	client := &sseCustomerS3{fake}
+
+	m := &Manager{s3: client}
+	if err := m.Sync(filepath.Join(temp, "upload"), "s3://example-bucket/upload"); err == nil {
+		t.Fatal("Upload should fail without the key")
+	}
+
+	m = &Manager{s3: client, option: Option{SSECustomerKey: testSSECustomerKey}}
+	if err := m.Sync(filepath.Join(temp, "upload"), "s3://example-bucket/upload"); err != nil {
+		t.Fatal("Upload should be successful", err)
+	}
+	if err := m.Sync("s3://example-bucket/upload", "s3://example-bucket/copy"); err != nil {
+		t.Fatal("Copy should be successful", err)
+	}
+	if err := m.Sync("s3://example-bucket/copy", filepath.Join(temp, "download")); err != nil {
+		t.Fatal("Download should be successful", err)
+	}
+	fileHasContent(t, filepath.Join(temp, "download/a.txt"), "data")
+
+	// The single object download checks the object by HEAD.
+	if err := m.Sync("s3://example-bucket/copy/a.txt", filepath.Join(temp, "b.txt")); err != nil {
+		t.Fatal("Download should be successful", err)
+	}
+	fileHasContent(t, filepath.Join(temp, "b.txt"), "data")
+
+	m = &Manager{s3: client, option: Option{SSECustomerKey: "short"}}
+	err = m.Sync("s3://example-bucket/copy", filepath.Join(temp, "download"))
+	if err == nil || !strings.Contains(err.Error(), "SSECustomerKey must be 32 bytes") {
+		t.Errorf("The invalid key should be rejected, got %v", err)
+	}
+	if sse := (&Manager{}).sseCustomer(); sse.algorithm != nil || sse.key != nil || sse.keyMD5 != nil {
+		t.Error("The SSE-C headers should be nil without the key")
+	}
+}
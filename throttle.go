@@ -0,0 +1,191 @@
+// Copyright 2019 SEQSENSE, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package s3sync
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// rateLimiter limits the throughput of the bytes shared by the concurrent transfers.
+type rateLimiter struct {
+	bytesPerSecond int64
+
+	mutex sync.Mutex
+	// next is the time when the bytes reserved so far are transferred at the rate.
+	next time.Time
+}
+
+func newRateLimiter(bytesPerSecond int64) *rateLimiter {
+	return &rateLimiter{bytesPerSecond: bytesPerSecond}
+}
+
+// chunkSize returns the maximum number of the bytes transferred at once,
+// which keeps the throughput smooth.
+func (l *rateLimiter) chunkSize() int {
+	if n := l.bytesPerSecond / 10; n > 1 {
+		return int(n)
+	}
+	return 1
+}
+
+// wait reserves n bytes and blocks until they are allowed to be transferred
+// at the rate, or the context is done.
+func (l *rateLimiter) wait(ctx context.Context, n int) error {
+	if n <= 0 {
+		return nil
+	}
+	l.mutex.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	l.next = l.next.Add(time.Duration(int64(n) * int64(time.Second) / l.bytesPerSecond))
+	delay := l.next.Sub(now)
+	l.mutex.Unlock()
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// throttledReader limits the throughput of the reads by the rateLimiter.
+type throttledReader struct {
+	ctx     context.Context
+	r       io.Reader
+	limiter *rateLimiter
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > t.limiter.chunkSize() {
+		p = p[:t.limiter.chunkSize()]
+	}
+	n, err := t.r.Read(p)
+	if waitErr := t.limiter.wait(t.ctx, n); err == nil {
+		err = waitErr
+	}
+	return n, err
+}
+
+// throttledReadSeeker is the throttledReader which can be rewound for the retries.
+type throttledReadSeeker struct {
+	throttledReader
+	s io.Seeker
+}
+
+func (t *throttledReadSeeker) Seek(offset int64, whence int) (int64, error) {
+	return t.s.Seek(offset, whence)
+}
+
+// throttledReadSeekerAt is the throttledReadSeeker which keeps io.ReaderAt of the
+// body, so that the uploader reads the parts by the section readers instead of
+// copying them to the buffers.
+type throttledReadSeekerAt struct {
+	throttledReadSeeker
+	ra io.ReaderAt
+}
+
+func (t *throttledReadSeekerAt) ReadAt(p []byte, off int64) (int, error) {
+	var read int
+	for read < len(p) {
+		chunk := p[read:]
+		if len(chunk) > t.limiter.chunkSize() {
+			chunk = chunk[:t.limiter.chunkSize()]
+		}
+		n, err := t.ra.ReadAt(chunk, off+int64(read))
+		read += n
+		if waitErr := t.limiter.wait(t.ctx, n); err == nil {
+			err = waitErr
+		}
+		if err != nil {
+			return read, err
+		}
+	}
+	return read, nil
+}
+
+// throttledWriterAt limits the throughput of the writes by the rateLimiter.
+type throttledWriterAt struct {
+	ctx     context.Context
+	w       io.WriterAt
+	limiter *rateLimiter
+}
+
+func (t *throttledWriterAt) WriteAt(b []byte, off int64) (int, error) {
+	var written int
+	for written < len(b) {
+		chunk := b[written:]
+		if len(chunk) > t.limiter.chunkSize() {
+			chunk = chunk[:t.limiter.chunkSize()]
+		}
+		if err := t.limiter.wait(t.ctx, len(chunk)); err != nil {
+			return written, err
+		}
+		n, err := t.w.WriteAt(chunk, off+int64(written))
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// rateLimiter returns the limiter of Option.MaxBytesPerSecond shared by all the
+// transfers of the Manager, or nil if the throughput is not limited.
+func (m *Manager) rateLimiter() *rateLimiter {
+	if m.option.MaxBytesPerSecond <= 0 {
+		return nil
+	}
+	m.limiterOnce.Do(func() {
+		if m.limiter == nil {
+			m.limiter = newRateLimiter(m.option.MaxBytesPerSecond)
+		}
+	})
+	return m.limiter
+}
+
+// throttleReader wraps the reader to limit its throughput by Option.MaxBytesPerSecond.
+func (m *Manager) throttleReader(ctx context.Context, r io.Reader) io.Reader {
+	if l := m.rateLimiter(); l != nil {
+		return &throttledReader{ctx: ctx, r: r, limiter: l}
+	}
+	return r
+}
+
+// throttleReadSeeker wraps the reader to limit its throughput by Option.MaxBytesPerSecond.
+// The wrapped reader implements io.ReaderAt if the reader does.
+func (m *Manager) throttleReadSeeker(ctx context.Context, r io.ReadSeeker) io.ReadSeeker {
+	if l := m.rateLimiter(); l != nil {
+		t := throttledReadSeeker{throttledReader: throttledReader{ctx: ctx, r: r, limiter: l}, s: r}
+		if ra, ok := r.(io.ReaderAt); ok {
+			return &throttledReadSeekerAt{throttledReadSeeker: t, ra: ra}
+		}
+		return &t
+	}
+	return r
+}
+
+// throttleWriterAt wraps the writer to limit its throughput by Option.MaxBytesPerSecond.
+func (m *Manager) throttleWriterAt(ctx context.Context, w io.WriterAt) io.WriterAt {
+	if l := m.rateLimiter(); l != nil {
+		return &throttledWriterAt{ctx: ctx, w: w, limiter: l}
+	}
+	return w
+}
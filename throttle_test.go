@@ -0,0 +1,112 @@
+// Copyright 2019 SEQSENSE, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package s3sync
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMaxBytesPerSecond(t *testing.T) {
+	const (
+		numFiles       = 3
+		fileSize       = 1000
+		bytesPerSecond = 10000
+	)
+	// The limit is shared by the parallel workers.
+	minDuration := time.Duration(numFiles*fileSize) * time.Second / bytesPerSecond
+
+	temp, err := ioutil.TempDir("", "s3synctest")
+	if err != nil {
+		t.Fatal("Failed to create temp dir")
+	}
+	defer os.RemoveAll(temp)
+
+	client := newFakeS3()
+	client.createBucket("example-bucket")
+	for i := 0; i < numFiles; i++ {
+		name := fmt.Sprintf("%d.txt", i)
+		client.putObject("example-bucket", "download/"+name, bytes.Repeat([]byte("a"), fileSize), time.Now())
+		writeFile(t, filepath.Join(temp, "upload", name), strings.Repeat("a", fileSize))
+	}
+	m := &Manager{s3: client, option: Option{MaxBytesPerSecond: bytesPerSecond, Parallelism: numFiles}}
+
+	t.Run("Download", func(t *testing.T) {
+		start := time.Now()
+		if err := m.Sync("s3://example-bucket/download", filepath.Join(temp, "download")); err != nil {
+			t.Fatal("Sync should be successful", err)
+		}
+		if d := time.Since(start); d < minDuration {
+			t.Errorf("The download should take at least %v, took %v", minDuration, d)
+		}
+		for i := 0; i < numFiles; i++ {
+			fileHasSize(t, filepath.Join(temp, "download", fmt.Sprintf("%d.txt", i)), fileSize)
+		}
+	})
+	t.Run("Upload", func(t *testing.T) {
+		start := time.Now()
+		if err := m.Sync(filepath.Join(temp, "upload"), "s3://example-bucket/upload"); err != nil {
+			t.Fatal("Sync should be successful", err)
+		}
+		if d := time.Since(start); d < minDuration {
+			t.Errorf("The upload should take at least %v, took %v", minDuration, d)
+		}
+		for i := 0; i < numFiles; i++ {
+			if _, ok := client.getObject("example-bucket", fmt.Sprintf("upload/%d.txt", i)); !ok {
+				t.Errorf("%d.txt should be uploaded", i)
+			}
+		}
+	})
+}
+
+func TestRateLimiterContextDone(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	l := newRateLimiter(1)
+	if err := l.wait(ctx, 1000); err != context.Canceled {
+		t.Errorf("The wait should be stopped by the context, got %v", err)
+	}
+}
+
+func TestThrottleReadSeekerAt(t *testing.T) {
+	m := &Manager{option: Option{MaxBytesPerSecond: 1 << 20}}
+	data := []byte(strings.Repeat("0123456789", 100))
+
+	body := m.throttleReadSeeker(context.Background(), bytes.NewReader(data))
+	ra, ok := body.(io.ReaderAt)
+	if !ok {
+		t.Fatal("The throttled body should implement io.ReaderAt to upload the parts without copying")
+	}
+	p := make([]byte, 20)
+	if n, err := ra.ReadAt(p, 995); n != 5 || err != io.EOF || string(p[:n]) != "56789" {
+		t.Errorf("Expected the last 5 bytes with EOF, got %q, %v", p[:n], err)
+	}
+	if n, err := ra.ReadAt(p, 10); n != 20 || err != nil || string(p) != "01234567890123456789" {
+		t.Errorf("Expected 20 bytes from the offset, got %q, %v", p[:n], err)
+	}
+
+	// The reader without ReadAt is not wrapped as io.ReaderAt.
+	body = m.throttleReadSeeker(context.Background(), struct{ io.ReadSeeker }{bytes.NewReader(data)})
+	if _, ok := body.(io.ReaderAt); ok {
+		t.Error("The throttled body should not implement io.ReaderAt if the reader doesn't")
+	}
+}
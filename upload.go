@@ -0,0 +1,388 @@
+// Copyright 2019 SEQSENSE, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package s3sync
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/url"
+	"path"
+	"path/filepath"
+	"reflect"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// maxSinglePartSize is the maximum object size of a single PutObject request.
+const maxSinglePartSize int64 = 5 * 1024 * 1024 * 1024
+
+// upload uploads the local file read from body to the dest s3 path.
+func (m *Manager) upload(ctx context.Context, file *fileInfo, body io.ReadSeeker, destPath *s3Path) error {
+	key := m.uploadKey(file, destPath)
+
+	if m.option.DryRun {
+		m.println("Would upload", file.name, "to", "s3://"+destPath.bucket+"/"+key)
+		return nil
+	}
+	m.println("Uploading", file.name, "to", "s3://"+destPath.bucket+"/"+key)
+	if m.option.DisableMultipart && file.size > maxSinglePartSize {
+		return fmt.Errorf("can't upload %s without multipart: the file is larger than %d bytes", file.name, maxSinglePartSize)
+	}
+
+	input, err := m.localUploadInput(file, destPath.bucket, key)
+	if err != nil {
+		return err
+	}
+	body = m.throttleReadSeeker(ctx, body)
+	if m.isResumable(file) {
+		return m.uploadResumable(ctx, file, body, input)
+	}
+	input.Body = body
+	if m.option.VerifyUpload && file.size <= maxSinglePartSize {
+		contentMD5, err := m.contentMD5(file)
+		if err != nil {
+			return err
+		}
+		input.ContentMD5 = aws.String(contentMD5)
+	}
+	return m.retry(ctx, func() error {
+		// The body is read again from the start on retry.
+		if _, err := body.Seek(0, io.SeekStart); err != nil {
+			return err
+		}
+		_, err := m.newUploader(file.size).UploadWithContext(ctx, input)
+		return err
+	})
+}
+
+// uploadFile uploads the local file to the dest s3 path.
+// With Option.UpdateHeadersInPlace, only the headers are updated if the body is unchanged.
+// With Option.Dedup, the file whose content is already uploaded in the sync is copied
+// from the uploaded object.
+func (m *Manager) uploadFile(ctx context.Context, file *fileInfo, destPath *s3Path, dedup *dedupTracker) error {
+	if m.option.DryRun {
+		// Neither the headers nor the duplicates are checked in the dry run.
+		return m.upload(ctx, file, nil, destPath)
+	}
+	key := m.uploadKey(file, destPath)
+	if m.option.UpdateHeadersInPlace {
+		input, err := m.localUploadInput(file, destPath.bucket, key)
+		if err != nil {
+			return err
+		}
+		updated, err := m.updateHeadersInPlace(ctx, file, input)
+		if err != nil || updated {
+			return err
+		}
+	}
+
+	upload := func() error {
+		f, err := m.fs().Open(file.path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		return m.upload(ctx, file, f, destPath)
+	}
+	if dedup == nil {
+		return upload()
+	}
+
+	hash, err := m.fileChecksum(file, "sha256")
+	if err != nil {
+		return err
+	}
+	return dedup.transfer(hash, key, upload, func(sourceKey string) error {
+		m.println("Copying", "s3://"+destPath.bucket+"/"+sourceKey, "to", "s3://"+destPath.bucket+"/"+key)
+
+		// The headers are replaced since they depend on the name of the file.
+		input, err := m.localUploadInput(file, destPath.bucket, key)
+		if err != nil {
+			return err
+		}
+		if file.size > maxCopyObjectSize {
+			return m.multipartCopy(ctx, input, destPath.bucket, sourceKey, file.size, m.sseCustomer())
+		}
+		_, err = m.s3.CopyObjectWithContext(ctx, &s3.CopyObjectInput{
+			Bucket:                         input.Bucket,
+			Key:                            input.Key,
+			CopySource:                     aws.String(copySource(destPath.bucket, sourceKey)),
+			MetadataDirective:              aws.String(s3.MetadataDirectiveReplace),
+			ACL:                            input.ACL,
+			CacheControl:                   input.CacheControl,
+			ContentType:                    input.ContentType,
+			Metadata:                       input.Metadata,
+			StorageClass:                   input.StorageClass,
+			TaggingDirective:               taggingDirective(input.Tagging),
+			Tagging:                        input.Tagging,
+			SSECustomerAlgorithm:           input.SSECustomerAlgorithm,
+			SSECustomerKey:                 input.SSECustomerKey,
+			SSECustomerKeyMD5:              input.SSECustomerKeyMD5,
+			CopySourceSSECustomerAlgorithm: input.SSECustomerAlgorithm,
+			CopySourceSSECustomerKey:       input.SSECustomerKey,
+			CopySourceSSECustomerKeyMD5:    input.SSECustomerKeyMD5,
+		})
+		return err
+	})
+}
+
+// uploadKey returns the key of the object which the file is uploaded to.
+func (m *Manager) uploadKey(file *fileInfo, destPath *s3Path) string {
+	return path.Join(destPath.bucketPrefix, m.toS3Name(filepath.ToSlash(file.name)))
+}
+
+// mapUploadName applies Option.ExplicitKeyMap to the name of the local source file,
+// so that both the comparison and the upload use the mapped key.
+func (m *Manager) mapUploadName(file *fileInfo) *fileInfo {
+	if file.err != nil {
+		return file
+	}
+	if key, ok := m.option.ExplicitKeyMap[filepath.ToSlash(file.name)]; ok {
+		mapped := *file
+		mapped.name = filepath.FromSlash(m.toLocalName(key))
+		return &mapped
+	}
+	return file
+}
+
+// mapUploadNames applies mapUploadName to the listed local source files.
+func (m *Manager) mapUploadNames(ctx context.Context, files chan *fileInfo) chan *fileInfo {
+	if len(m.option.ExplicitKeyMap) == 0 {
+		return files
+	}
+	c := make(chan *fileInfo)
+
+	go func() {
+		defer close(c)
+		for file := range files {
+			if !sendInfoToChannel(ctx, c, m.mapUploadName(file)) {
+				return
+			}
+		}
+	}()
+
+	return c
+}
+
+// newUploader returns the uploader configured for the file of the given size.
+func (m *Manager) newUploader(size int64) *s3manager.Uploader {
+	return s3manager.NewUploaderWithClient(m.s3, func(u *s3manager.Uploader) {
+		if m.option.PartSize > 0 {
+			u.PartSize = m.option.PartSize
+		}
+		if m.option.MaxUploadParts > 0 {
+			u.MaxUploadParts = m.option.MaxUploadParts
+		}
+		if m.option.UploadConcurrency > 0 {
+			u.Concurrency = m.option.UploadConcurrency
+		}
+		// The uploader sends a single PutObject if the whole content fits in a part.
+		// The Content-MD5 of Option.VerifyUpload is of the whole content.
+		singlePart := size < m.option.SinglePartThreshold ||
+			((m.option.VerifyUpload || m.option.DisableMultipart) && size <= maxSinglePartSize)
+		if singlePart && u.PartSize <= size {
+			u.PartSize = size + 1
+		}
+	})
+}
+
+// contentMD5 returns the base64 encoded md5 of the file for the Content-MD5 header.
+func (m *Manager) contentMD5(file *fileInfo) (string, error) {
+	sum, err := m.fileChecksum(file, "md5")
+	if err != nil {
+		return "", err
+	}
+	b, err := hex.DecodeString(sum)
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(b), nil
+}
+
+// uploadInput returns the upload input of the file without the body.
+// The Content-Type is Option.ContentType, or guessed from the extension of the file.
+// It is left to the s3 default if the extension is unknown.
+func (m *Manager) uploadInput(file *fileInfo, bucket, key string) *s3manager.UploadInput {
+	input := &s3manager.UploadInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	}
+	if m.option.ContentType != "" {
+		input.ContentType = aws.String(m.option.ContentType)
+	} else if !m.option.NoMimeTypeGuess {
+		if contentType := mime.TypeByExtension(filepath.Ext(file.name)); contentType != "" {
+			input.ContentType = aws.String(contentType)
+		}
+	}
+	if m.option.StorageClass != "" {
+		input.StorageClass = aws.String(m.option.StorageClass)
+	}
+	if m.option.StorageClassFunc != nil {
+		if class := m.option.StorageClassFunc(file.toFileInfo()); class != "" {
+			input.StorageClass = aws.String(class)
+		}
+	}
+	if m.option.ACL != "" {
+		input.ACL = aws.String(m.option.ACL)
+	}
+	if m.option.CacheControl != "" {
+		input.CacheControl = aws.String(m.option.CacheControl)
+	}
+	if len(m.option.Metadata) > 0 {
+		input.Metadata = aws.StringMap(m.option.Metadata)
+	}
+	if tagging := m.tagging(); tagging != "" {
+		input.Tagging = aws.String(tagging)
+	}
+	sse := m.sseCustomer()
+	input.SSECustomerAlgorithm, input.SSECustomerKey, input.SSECustomerKeyMD5 = sse.algorithm, sse.key, sse.keyMD5
+	return input
+}
+
+// localUploadInput returns the upload input of the local file, with the headers
+// restored from the sidecar file by Option.PreserveMetadata.
+func (m *Manager) localUploadInput(file *fileInfo, bucket, key string) (*s3manager.UploadInput, error) {
+	input := m.uploadInput(file, bucket, key)
+	if err := m.restoreMetadata(file, input); err != nil {
+		return nil, err
+	}
+	return input, nil
+}
+
+// taggingDirective returns REPLACE if the tagging is set, or nil to copy the tags
+// of the source object.
+func taggingDirective(tagging *string) *string {
+	if tagging == nil {
+		return nil
+	}
+	return aws.String(s3.TaggingDirectiveReplace)
+}
+
+// tagging returns Option.Tags encoded as the query string, "k1=v1&k2=v2".
+func (m *Manager) tagging() string {
+	tags := make(url.Values, len(m.option.Tags))
+	for k, v := range m.option.Tags {
+		tags.Set(k, v)
+	}
+	return tags.Encode()
+}
+
+// updateHeadersInPlace updates the headers of the existing object to the ones of the
+// upload input by copying the object onto itself, if the body of the object is the same
+// as the local file. It returns false if the file has to be uploaded.
+func (m *Manager) updateHeadersInPlace(ctx context.Context, file *fileInfo, input *s3manager.UploadInput) (bool, error) {
+	head, err := m.s3.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket:               input.Bucket,
+		Key:                  input.Key,
+		SSECustomerAlgorithm: input.SSECustomerAlgorithm,
+		SSECustomerKey:       input.SSECustomerKey,
+		SSECustomerKeyMD5:    input.SSECustomerKeyMD5,
+	})
+	if err != nil {
+		if isNotFound(err) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	etag := normalizeETag(aws.StringValue(head.ETag))
+	if aws.Int64Value(head.ContentLength) != file.size || !isSinglePartETag(etag) {
+		return false, nil
+	}
+	sum, err := m.fileChecksum(file, "md5")
+	if err != nil {
+		return false, err
+	}
+	if sum != etag {
+		return false, nil
+	}
+
+	if !headersDiffer(input, head) {
+		// Nothing to update.
+		return true, nil
+	}
+
+	_, err = m.s3.CopyObjectWithContext(ctx, &s3.CopyObjectInput{
+		Bucket:                         input.Bucket,
+		Key:                            input.Key,
+		CopySource:                     aws.String(copySource(*input.Bucket, *input.Key)),
+		MetadataDirective:              aws.String(s3.MetadataDirectiveReplace),
+		ACL:                            input.ACL,
+		CacheControl:                   input.CacheControl,
+		ContentType:                    input.ContentType,
+		Metadata:                       input.Metadata,
+		StorageClass:                   input.StorageClass,
+		SSECustomerAlgorithm:           input.SSECustomerAlgorithm,
+		SSECustomerKey:                 input.SSECustomerKey,
+		SSECustomerKeyMD5:              input.SSECustomerKeyMD5,
+		CopySourceSSECustomerAlgorithm: input.SSECustomerAlgorithm,
+		CopySourceSSECustomerKey:       input.SSECustomerKey,
+		CopySourceSSECustomerKeyMD5:    input.SSECustomerKeyMD5,
+	})
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// headersDiffer returns true if the headers of the upload input differ from the object.
+// ACL is not compared since HEAD doesn't return it.
+func headersDiffer(input *s3manager.UploadInput, head *s3.HeadObjectOutput) bool {
+	if aws.StringValue(input.ContentType) != aws.StringValue(head.ContentType) ||
+		aws.StringValue(input.CacheControl) != aws.StringValue(head.CacheControl) {
+		return true
+	}
+	return !reflect.DeepEqual(normalizeMetadata(input.Metadata), normalizeMetadata(head.Metadata))
+}
+
+func normalizeMetadata(metadata map[string]*string) map[string]string {
+	normalized := make(map[string]string)
+	for k, v := range metadata {
+		normalized[strings.ToLower(k)] = aws.StringValue(v)
+	}
+	return normalized
+}
+
+// copySource returns the url encoded CopySource of the object.
+func copySource(bucket, key string) string {
+	segments := strings.Split(bucket+"/"+key, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+// validateUploadOption validates the upload options against the s3 limits.
+func validateUploadOption(option *Option) error {
+	if option.PartSize != 0 && (option.PartSize < s3manager.MinUploadPartSize || option.PartSize > maxSinglePartSize) {
+		return fmt.Errorf("PartSize must be between %d and %d", s3manager.MinUploadPartSize, maxSinglePartSize)
+	}
+	if option.MaxUploadParts < 0 || option.MaxUploadParts > s3manager.MaxUploadParts {
+		return fmt.Errorf("MaxUploadParts must be between 1 and %d", s3manager.MaxUploadParts)
+	}
+	if option.SinglePartThreshold < 0 || option.SinglePartThreshold > maxSinglePartSize {
+		return fmt.Errorf("SinglePartThreshold must be between 0 and %d", maxSinglePartSize)
+	}
+	if option.UploadConcurrency < 0 {
+		return errors.New("UploadConcurrency must not be negative")
+	}
+	return nil
+}
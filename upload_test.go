@@ -0,0 +1,730 @@
+// Copyright 2019 SEQSENSE, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package s3sync
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+func TestUploaderSinglePartThreshold(t *testing.T) {
+	const mib = 1024 * 1024
+	testCases := map[string]struct {
+		size      int
+		option    Option
+		multipart bool
+	}{
+		"SmallDefault":      {1 * mib, Option{}, false},
+		"LargeDefault":      {6 * mib, Option{}, true},
+		"BelowThreshold":    {6 * mib, Option{SinglePartThreshold: 8 * mib}, false},
+		"AboveThreshold":    {9 * mib, Option{SinglePartThreshold: 8 * mib}, true},
+		"BelowPartSize":     {6 * mib, Option{PartSize: 7 * mib}, false},
+		"AbovePartSize":     {8 * mib, Option{PartSize: 7 * mib}, true},
+		"ThresholdPartSize": {7 * mib, Option{PartSize: 6 * mib, SinglePartThreshold: 7*mib + 1}, false},
+		"VerifyUpload":      {6 * mib, Option{VerifyUpload: true}, false},
+		"DisableMultipart":  {12 * mib, Option{DisableMultipart: true, PartSize: 5 * mib}, false},
+		"Concurrency":       {12 * mib, Option{PartSize: 5 * mib, UploadConcurrency: 1}, true},
+	}
+	for name, testCase := range testCases {
+		t.Run(name, func(t *testing.T) {
+			client := newFakeS3()
+			m := &Manager{s3: client, option: testCase.option}
+			_, err := m.newUploader(int64(testCase.size)).Upload(&s3manager.UploadInput{
+				Bucket: aws.String("example-bucket"),
+				Key:    aws.String("file"),
+				Body:   bytes.NewReader(make([]byte, testCase.size)),
+			})
+			if err != nil {
+				t.Fatal("Upload should be successful", err)
+			}
+
+			if testCase.multipart {
+				if client.count("PutObject") != 0 || client.count("CompleteMultipartUpload") != 1 {
+					t.Error("The file should be uploaded by multipart")
+				}
+			} else {
+				if client.count("PutObject") != 1 || client.count("CreateMultipartUpload") != 0 {
+					t.Error("The file should be uploaded by a single PutObject")
+				}
+			}
+			if object, ok := client.getObject("example-bucket", "file"); !ok || len(object.data) != testCase.size {
+				t.Error("The file should be uploaded")
+			}
+		})
+	}
+}
+
+func TestSyncDisableMultipart(t *testing.T) {
+	temp, err := ioutil.TempDir("", "s3synctest")
+	if err != nil {
+		t.Fatal("Failed to create temp dir")
+	}
+	defer os.RemoveAll(temp)
+
+	const size = 12 * 1024 * 1024
+	writeFile(t, filepath.Join(temp, "src", "large"), string(make([]byte, size)))
+
+	client := newFakeS3()
+	client.createBucket("example-bucket")
+	// The resumable upload is also replaced by the single PutObject.
+	m := &Manager{s3: client, option: Option{
+		DisableMultipart: true,
+		ResumeStateDir:   filepath.Join(temp, "state"),
+	}}
+	if err := m.Sync(filepath.Join(temp, "src"), "s3://example-bucket"); err != nil {
+		t.Fatal("Sync should be successful", err)
+	}
+	if client.count("PutObject") != 1 || client.count("CreateMultipartUpload") != 0 {
+		t.Error("The file should be uploaded by a single PutObject")
+	}
+	if object, ok := client.getObject("example-bucket", "large"); !ok || len(object.data) != size {
+		t.Error("The file should be uploaded")
+	}
+}
+
+func TestStorageClassFunc(t *testing.T) {
+	m := &Manager{option: Option{
+		StorageClassFunc: func(file FileInfo) string {
+			switch {
+			case file.Size > 1024:
+				return s3.StorageClassGlacier
+			case file.Name == "default":
+				return ""
+			default:
+				return s3.StorageClassStandard
+			}
+		},
+	}}
+
+	testCases := map[string]struct {
+		file     *fileInfo
+		expected string
+	}{
+		"Large":   {&fileInfo{name: "large", size: 2048}, s3.StorageClassGlacier},
+		"Small":   {&fileInfo{name: "small", size: 10}, s3.StorageClassStandard},
+		"Default": {&fileInfo{name: "default", size: 10}, ""},
+	}
+	for name, testCase := range testCases {
+		t.Run(name, func(t *testing.T) {
+			input := m.uploadInput(testCase.file, "example-bucket", testCase.file.name)
+			if class := aws.StringValue(input.StorageClass); class != testCase.expected {
+				t.Errorf("Expected storage class %q, got %q", testCase.expected, class)
+			}
+			if testCase.expected == "" && input.StorageClass != nil {
+				t.Error("Empty storage class should leave the field nil")
+			}
+		})
+	}
+
+	if input := (&Manager{}).uploadInput(&fileInfo{}, "example-bucket", "key"); input.StorageClass != nil {
+		t.Error("Storage class should be nil without the option")
+	}
+}
+
+func TestStorageClassAndACL(t *testing.T) {
+	temp, err := ioutil.TempDir("", "s3synctest")
+	if err != nil {
+		t.Fatal("Failed to create temp dir")
+	}
+	defer os.RemoveAll(temp)
+	writeFile(t, filepath.Join(temp, "a.txt"), "a")
+
+	testCases := map[string]struct {
+		option            Option
+		storageClass, acl string
+	}{
+		"Default": {Option{}, "", ""},
+		"Set":     {Option{StorageClass: s3.StorageClassStandardIa, ACL: s3.ObjectCannedACLPublicRead}, s3.StorageClassStandardIa, s3.ObjectCannedACLPublicRead},
+		"Func": {
+			Option{StorageClass: s3.StorageClassStandardIa, StorageClassFunc: func(FileInfo) string { return s3.StorageClassGlacier }},
+			s3.StorageClassGlacier, "",
+		},
+	}
+	for name, testCase := range testCases {
+		t.Run(name, func(t *testing.T) {
+			client := newFakeS3()
+			client.createBucket("example-bucket")
+			m := &Manager{s3: client, option: testCase.option}
+			if err := m.Sync(temp, "s3://example-bucket/upload"); err != nil {
+				t.Fatal("Upload should be successful", err)
+			}
+			if err := m.Sync("s3://example-bucket/upload", "s3://example-bucket/copy"); err != nil {
+				t.Fatal("Copy should be successful", err)
+			}
+			for _, key := range []string{"upload/a.txt", "copy/a.txt"} {
+				object, ok := client.getObject("example-bucket", key)
+				if !ok {
+					t.Fatalf("%s should exist", key)
+				}
+				if object.storageClass != testCase.storageClass || object.acl != testCase.acl {
+					t.Errorf("%s: expected storage class %q and ACL %q, got %q and %q",
+						key, testCase.storageClass, testCase.acl, object.storageClass, object.acl)
+				}
+			}
+		})
+	}
+
+	if input := (&Manager{}).uploadInput(&fileInfo{}, "example-bucket", "key"); input.ACL != nil {
+		t.Error("ACL should be nil without the option")
+	}
+}
+
+func TestTags(t *testing.T) {
+	temp, err := ioutil.TempDir("", "s3synctest")
+	if err != nil {
+		t.Fatal("Failed to create temp dir")
+	}
+	defer os.RemoveAll(temp)
+	writeFile(t, filepath.Join(temp, "a.txt"), "a")
+
+	tags := map[string]string{"team": "robot", "cost center": "a&b"}
+	const encoded = "cost+center=a%26b&team=robot"
+
+	testCases := map[string]struct {
+		directive        string
+		uploaded, copied string
+	}{
+		"Default": {"", encoded, encoded},
+		"Copy":    {s3.TaggingDirectiveCopy, encoded, encoded},
+		"Replace": {s3.TaggingDirectiveReplace, encoded, "env=prod"},
+	}
+	for name, testCase := range testCases {
+		t.Run(name, func(t *testing.T) {
+			client := newFakeS3()
+			client.createBucket("example-bucket")
+			m := &Manager{s3: client, option: Option{Tags: tags}}
+			if err := m.Sync(temp, "s3://example-bucket/upload"); err != nil {
+				t.Fatal("Upload should be successful", err)
+			}
+			m = &Manager{s3: client, option: Option{
+				Tags:             map[string]string{"env": "prod"},
+				TaggingDirective: testCase.directive,
+			}}
+			if err := m.Sync("s3://example-bucket/upload", "s3://example-bucket/copy"); err != nil {
+				t.Fatal("Copy should be successful", err)
+			}
+			for key, expected := range map[string]string{
+				"upload/a.txt": testCase.uploaded,
+				"copy/a.txt":   testCase.copied,
+			} {
+				object, ok := client.getObject("example-bucket", key)
+				if !ok {
+					t.Fatalf("%s should exist", key)
+				}
+				if object.tagging != expected {
+					t.Errorf("%s: expected tagging %q, got %q", key, expected, object.tagging)
+				}
+			}
+		})
+	}
+
+	if input := (&Manager{}).uploadInput(&fileInfo{}, "example-bucket", "key"); input.Tagging != nil {
+		t.Error("Tagging should be nil without the tags")
+	}
+	m := &Manager{option: Option{Tags: map[string]string{}}}
+	if input := m.uploadInput(&fileInfo{}, "example-bucket", "key"); input.Tagging != nil {
+		t.Error("Tagging should be nil with the empty tags")
+	}
+}
+
+func TestCacheControlAndMetadata(t *testing.T) {
+	temp, err := ioutil.TempDir("", "s3synctest")
+	if err != nil {
+		t.Fatal("Failed to create temp dir")
+	}
+	defer os.RemoveAll(temp)
+	writeFile(t, filepath.Join(temp, "a.txt"), "a")
+	writeFile(t, filepath.Join(temp, "dir/b.txt"), "b")
+
+	client := newFakeS3()
+	client.createBucket("example-bucket")
+	m := &Manager{s3: client, option: Option{
+		CacheControl: "max-age=31536000",
+		Metadata:     map[string]string{"Owner": "me"},
+	}}
+	if err := m.Sync(temp, "s3://example-bucket/site"); err != nil {
+		t.Fatal("Upload should be successful", err)
+	}
+	for _, key := range []string{"site/a.txt", "site/dir/b.txt"} {
+		object, ok := client.getObject("example-bucket", key)
+		if !ok {
+			t.Fatalf("%s should exist", key)
+		}
+		if object.cacheControl != "max-age=31536000" || aws.StringValue(object.metadata["Owner"]) != "me" {
+			t.Errorf("%s: the headers should be set, got %q and %v", key, object.cacheControl, object.metadata)
+		}
+	}
+
+	// The headers of the touched but unchanged file are updated in place.
+	future := time.Now().Add(time.Hour)
+	if err := os.Chtimes(filepath.Join(temp, "a.txt"), future, future); err != nil {
+		t.Fatal(err)
+	}
+	m = &Manager{s3: client, option: Option{
+		CacheControl:         "no-cache",
+		UpdateHeadersInPlace: true,
+	}}
+	if err := m.Sync(temp, "s3://example-bucket/site"); err != nil {
+		t.Fatal("Sync should be successful", err)
+	}
+	object, _ := client.getObject("example-bucket", "site/a.txt")
+	if object.cacheControl != "no-cache" || len(object.metadata) != 0 {
+		t.Errorf("The headers should be replaced, got %q and %v", object.cacheControl, object.metadata)
+	}
+
+	if input := (&Manager{}).uploadInput(&fileInfo{}, "example-bucket", "key"); input.CacheControl != nil || input.Metadata != nil {
+		t.Error("CacheControl and Metadata should be nil without the options")
+	}
+}
+
+// corruptingS3 flips the first byte of the uploaded body in transit.
+type corruptingS3 struct {
+	*fakeS3
+}
+
+func corrupt(body io.Reader) (io.ReadSeeker, error) {
+	data, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > 0 {
+		data[0] ^= 0xff
+	}
+	return bytes.NewReader(data), nil
+}
+
+func (c *corruptingS3) PutObjectWithContext(ctx aws.Context, input *s3.PutObjectInput, opts ...request.Option) (*s3.PutObjectOutput, error) {
+	body, err := corrupt(input.Body)
+	if err != nil {
+		return nil, err
+	}
+	corrupted := *input
+	corrupted.Body = body
+	return c.fakeS3.PutObjectWithContext(ctx, &corrupted, opts...)
+}
+
+func (c *corruptingS3) PutObjectRequest(input *s3.PutObjectInput) (*request.Request, *s3.PutObjectOutput) {
+	output := &s3.PutObjectOutput{}
+	return fakeRequest("PutObject", input, output, func() error {
+		_, err := c.PutObjectWithContext(aws.BackgroundContext(), input)
+		return err
+	}), output
+}
+
+func (c *corruptingS3) UploadPartWithContext(ctx aws.Context, input *s3.UploadPartInput, opts ...request.Option) (*s3.UploadPartOutput, error) {
+	body, err := corrupt(input.Body)
+	if err != nil {
+		return nil, err
+	}
+	corrupted := *input
+	corrupted.Body = body
+	return c.fakeS3.UploadPartWithContext(ctx, &corrupted, opts...)
+}
+
+func TestVerifyUpload(t *testing.T) {
+	temp, err := ioutil.TempDir("", "s3synctest")
+	if err != nil {
+		t.Fatal("Failed to create temp dir")
+	}
+	defer os.RemoveAll(temp)
+	writeFile(t, filepath.Join(temp, "small/a.txt"), "data")
+	writeFile(t, filepath.Join(temp, "large/b.bin"), strings.Repeat("b", int(s3manager.MinUploadPartSize)+1))
+
+	testCases := map[string]struct {
+		dir    string
+		option Option
+	}{
+		"SinglePart": {"small", Option{VerifyUpload: true}},
+		"Resumable": {"large", Option{
+			VerifyUpload:   true,
+			ResumeStateDir: filepath.Join(temp, "state"),
+			PartSize:       s3manager.MinUploadPartSize,
+		}},
+	}
+	for name, testCase := range testCases {
+		t.Run(name, func(t *testing.T) {
+			client := newFakeS3()
+			client.createBucket("example-bucket")
+			m := &Manager{s3: client, option: testCase.option}
+			if err := m.Sync(filepath.Join(temp, testCase.dir), "s3://example-bucket/"+name); err != nil {
+				t.Fatal("Upload should be successful", err)
+			}
+
+			m.s3 = &corruptingS3{fakeS3: newFakeS3()}
+			m.s3.(*corruptingS3).createBucket("example-bucket")
+			err := m.Sync(filepath.Join(temp, testCase.dir), "s3://example-bucket/"+name)
+			if err == nil || !strings.Contains(err.Error(), "BadDigest") {
+				t.Errorf("The corrupted upload should fail by BadDigest, got %v", err)
+			}
+		})
+	}
+
+	t.Run("Header", func(t *testing.T) {
+		client := newFakeS3()
+		client.createBucket("example-bucket")
+		m := &Manager{s3: client, option: Option{VerifyUpload: true}}
+		if err := m.Sync(filepath.Join(temp, "small"), "s3://example-bucket/header"); err != nil {
+			t.Fatal("Upload should be successful", err)
+		}
+		sum := md5.Sum([]byte("data"))
+		object, ok := client.getObject("example-bucket", "header/a.txt")
+		if !ok || object.contentMD5 != base64.StdEncoding.EncodeToString(sum[:]) {
+			t.Errorf("Content-MD5 should be set, got %+v", object)
+		}
+
+		m.option.VerifyUpload = false
+		writeFile(t, filepath.Join(temp, "small/a.txt"), "changed")
+		if err := m.Sync(filepath.Join(temp, "small"), "s3://example-bucket/header"); err != nil {
+			t.Fatal("Upload should be successful", err)
+		}
+		if object, _ := client.getObject("example-bucket", "header/a.txt"); object.contentMD5 != "" {
+			t.Errorf("Content-MD5 should not be set without the option, got %q", object.contentMD5)
+		}
+	})
+}
+
+func TestValidateUploadOption(t *testing.T) {
+	valid := []Option{
+		{},
+		{PartSize: s3manager.MinUploadPartSize, MaxUploadParts: 100, SinglePartThreshold: maxSinglePartSize},
+	}
+	for _, option := range valid {
+		if err := validateUploadOption(&option); err != nil {
+			t.Errorf("%+v should be valid: %v", option, err)
+		}
+	}
+
+	invalid := []Option{
+		{PartSize: 1024},
+		{PartSize: maxSinglePartSize + 1},
+		{MaxUploadParts: s3manager.MaxUploadParts + 1},
+		{MaxUploadParts: -1},
+		{SinglePartThreshold: maxSinglePartSize + 1},
+		{UploadConcurrency: -1},
+	}
+	for _, option := range invalid {
+		if err := validateUploadOption(&option); err == nil {
+			t.Errorf("%+v should be invalid", option)
+		}
+	}
+
+	m := &Manager{s3: newFakeS3(), option: Option{PartSize: 1}}
+	if err := m.Sync("s3://example-bucket", "foo"); err == nil {
+		t.Error("Sync should validate the option")
+	}
+}
+
+func TestUploadContentType(t *testing.T) {
+	testCases := map[string]struct {
+		option   Option
+		name     string
+		expected string
+	}{
+		"Guess":     {Option{}, "index.html", "text/html; charset=utf-8"},
+		"Unknown":   {Option{}, "data.unknownext", ""},
+		"NoGuess":   {Option{NoMimeTypeGuess: true}, "index.html", ""},
+		"Override":  {Option{ContentType: "text/plain"}, "index.html", "text/plain"},
+		"Overrides": {Option{ContentType: "text/plain", NoMimeTypeGuess: true}, "data.unknownext", "text/plain"},
+	}
+	for name, tt := range testCases {
+		t.Run(name, func(t *testing.T) {
+			m := &Manager{option: tt.option}
+			input := m.uploadInput(&fileInfo{name: tt.name}, "example-bucket", tt.name)
+			if contentType := aws.StringValue(input.ContentType); contentType != tt.expected {
+				t.Errorf("Expected Content-Type %q, got %q", tt.expected, contentType)
+			}
+		})
+	}
+}
+
+func TestUpdateHeadersInPlace(t *testing.T) {
+	temp, err := ioutil.TempDir("", "s3synctest")
+	if err != nil {
+		t.Fatal("Failed to create temp dir")
+	}
+	defer os.RemoveAll(temp)
+	writeFile(t, filepath.Join(temp, "index.html"), "<html></html>")
+	file := &fileInfo{name: "index.html", path: filepath.Join(temp, "index.html"), size: 13}
+
+	newInput := func() *s3manager.UploadInput {
+		input := (&Manager{}).uploadInput(file, "example-bucket", "index.html")
+		input.ContentType = aws.String("text/html")
+		input.Metadata = map[string]*string{"Owner": aws.String("me")}
+		return input
+	}
+
+	t.Run("HeaderOnly", func(t *testing.T) {
+		client := newFakeS3()
+		client.putObject("example-bucket", "index.html", []byte("<html></html>"), time.Now()).contentType = "text/plain"
+		m := &Manager{s3: client}
+
+		updated, err := m.updateHeadersInPlace(context.Background(), file, newInput())
+		if err != nil || !updated {
+			t.Fatal("The headers should be updated in place", err)
+		}
+		if client.count("CopyObject") != 1 {
+			t.Error("The object should be copied onto itself")
+		}
+		object, _ := client.getObject("example-bucket", "index.html")
+		if object.contentType != "text/html" || aws.StringValue(object.metadata["Owner"]) != "me" {
+			t.Error("The headers should be replaced", object.contentType, object.metadata)
+		}
+		if string(object.data) != "<html></html>" {
+			t.Error("The body should be kept")
+		}
+
+		// The second call doesn't copy since the headers are the same.
+		if updated, err := m.updateHeadersInPlace(context.Background(), file, newInput()); err != nil || !updated {
+			t.Fatal("The object should be up to date", err)
+		}
+		if client.count("CopyObject") != 1 {
+			t.Error("The object should not be copied if the headers are the same")
+		}
+	})
+
+	t.Run("BodyChanged", func(t *testing.T) {
+		client := newFakeS3()
+		client.putObject("example-bucket", "index.html", []byte("<html>!</html>"), time.Now())
+		m := &Manager{s3: client}
+
+		updated, err := m.updateHeadersInPlace(context.Background(), file, newInput())
+		if err != nil || updated {
+			t.Fatal("The changed file should be uploaded", err)
+		}
+		if client.count("CopyObject") != 0 {
+			t.Error("The object should not be copied")
+		}
+	})
+
+	t.Run("Multipart", func(t *testing.T) {
+		client := newFakeS3()
+		client.putObject("example-bucket", "index.html", []byte("<html></html>"), time.Now()).etag = "\"0123-2\""
+		m := &Manager{s3: client}
+
+		if updated, _ := m.updateHeadersInPlace(context.Background(), file, newInput()); updated {
+			t.Fatal("The multipart uploaded object can't be compared by the checksum")
+		}
+	})
+
+	t.Run("NotFound", func(t *testing.T) {
+		m := &Manager{s3: newFakeS3()}
+		if updated, err := m.updateHeadersInPlace(context.Background(), file, newInput()); err != nil || updated {
+			t.Fatal("The new file should be uploaded", err)
+		}
+	})
+}
+
+func TestCopySource(t *testing.T) {
+	if s := copySource("bucket", "dir/a b+c.txt"); s != "bucket/dir/a%20b+c.txt" {
+		t.Errorf("Unexpected copy source %s", s)
+	}
+}
+
+func TestUploadKey(t *testing.T) {
+	client := newFakeS3()
+	client.putObject("example-bucket", "prefix/dir/sub/a.txt", []byte("a"), time.Now())
+
+	m := &Manager{s3: client}
+	destPath := &s3Path{bucket: "example-bucket", bucketPrefix: "prefix"}
+
+	// The local names use the os separator, but the keys are always slash separated.
+	file := &fileInfo{name: filepath.Join("dir", "sub", "a.txt")}
+	if key := m.uploadKey(file, destPath); key != "prefix/dir/sub/a.txt" {
+		t.Errorf("Unexpected key %s", key)
+	}
+
+	// The listed names are converted back to the same keys.
+	files, err := collectFiles(m.listS3Files(context.Background(), destPath))
+	if err != nil {
+		t.Fatal("Listing should be successful", err)
+	}
+	if len(files) != 1 {
+		t.Fatal("1 file should be listed", files)
+	}
+	if files[0].name != file.name {
+		t.Errorf("Expected name %s, got %s", file.name, files[0].name)
+	}
+	if key := m.uploadKey(files[0], destPath); key != files[0].path {
+		t.Errorf("Expected key %s, got %s", files[0].path, key)
+	}
+}
+
+func TestCompareETag(t *testing.T) {
+	temp, err := ioutil.TempDir("", "s3synctest")
+	if err != nil {
+		t.Fatal("Failed to create temp dir")
+	}
+	defer os.RemoveAll(temp)
+
+	for _, name := range []string{"same.txt", "changed.txt", "multipart.txt", "resized.txt"} {
+		writeFile(t, filepath.Join(temp, name), "local")
+	}
+	// All the objects are older than the local files.
+	old := time.Now().Add(-time.Hour)
+	setup := func() *fakeS3 {
+		client := newFakeS3()
+		client.putObject("example-bucket", "same.txt", []byte("local"), old)
+		client.putObject("example-bucket", "changed.txt", []byte("LOCAL"), old)
+		client.putObject("example-bucket", "multipart.txt", []byte("local"), old).etag = "\"0123-2\""
+		client.putObject("example-bucket", "resized.txt", []byte("local!"), old)
+		return client
+	}
+
+	t.Run("Disabled", func(t *testing.T) {
+		client := setup()
+		m := &Manager{s3: client}
+		if results, err := m.SyncFanOut(temp, []string{"s3://example-bucket"}); err != nil || results["s3://example-bucket"] != nil {
+			t.Fatal("SyncFanOut should be successful", err, results)
+		}
+		if n := client.count("PutObject"); n != 4 {
+			t.Errorf("The older objects should be uploaded, got %d uploads", n)
+		}
+	})
+	t.Run("Enabled", func(t *testing.T) {
+		client := setup()
+		store := &countingChecksumStore{MemoryChecksumStore: NewMemoryChecksumStore()}
+		m := &Manager{s3: client, option: Option{CompareETag: true, ChecksumStore: store}}
+		if results, err := m.SyncFanOut(temp, []string{"s3://example-bucket"}); err != nil || results["s3://example-bucket"] != nil {
+			t.Fatal("SyncFanOut should be successful", err, results)
+		}
+		if n := client.count("PutObject"); n != 3 {
+			t.Errorf("Only same.txt should be skipped, got %d uploads", n)
+		}
+		if object, _ := client.getObject("example-bucket", "same.txt"); !object.lastModified.Equal(old) {
+			t.Error("same.txt should not be uploaded")
+		}
+		if store.puts != 2 {
+			t.Errorf("The md5 should be computed only for the single part objects of the same size, got %d", store.puts)
+		}
+	})
+}
+
+func TestSyncLocalToS3(t *testing.T) {
+	temp, err := ioutil.TempDir("", "s3synctest")
+	if err != nil {
+		t.Fatal("Failed to create temp dir")
+	}
+	defer os.RemoveAll(temp)
+
+	files := map[string]string{
+		"a.txt":         "a",
+		"dir/b.txt":     "bb",
+		"dir/sub/c.txt": "ccc",
+		"uptodate.txt":  "uptodate",
+	}
+	for name, data := range files {
+		writeFile(t, filepath.Join(temp, name), data)
+	}
+
+	client := newFakeS3()
+	client.putObject("example-bucket", "prefix/uptodate.txt", []byte("uptodate"), time.Now().Add(time.Hour))
+
+	m := &Manager{s3: client}
+	for i := 0; i < 2; i++ {
+		if err := m.Sync(temp, "s3://example-bucket/prefix"); err != nil {
+			t.Fatal("Sync should be successful", err)
+		}
+	}
+
+	for name, data := range files {
+		if object, ok := client.getObject("example-bucket", "prefix/"+name); !ok || string(object.data) != data {
+			t.Errorf("prefix/%s should be uploaded", name)
+		}
+	}
+	if n := client.count("PutObject"); n != 3 {
+		t.Errorf("Only the changed files should be uploaded once, got %d uploads", n)
+	}
+
+	if err := m.Sync(temp, "s3://missing-bucket"); err == nil {
+		t.Error("Sync to the missing bucket should fail")
+	}
+}
+
+func TestSyncLocalToS3Dedup(t *testing.T) {
+	temp, err := ioutil.TempDir("", "s3synctest")
+	if err != nil {
+		t.Fatal("Failed to create temp dir")
+	}
+	defer os.RemoveAll(temp)
+
+	writeFile(t, filepath.Join(temp, "a.txt"), "same")
+	writeFile(t, filepath.Join(temp, "dir/b.html"), "same")
+	writeFile(t, filepath.Join(temp, "c.txt"), "other")
+
+	client := newFakeS3()
+	client.createBucket("example-bucket")
+	m := &Manager{s3: client, option: Option{Dedup: true}}
+	if err := m.Sync(temp, "s3://example-bucket"); err != nil {
+		t.Fatal("Sync should be successful", err)
+	}
+
+	for name, data := range map[string]string{"a.txt": "same", "dir/b.html": "same", "c.txt": "other"} {
+		if object, ok := client.getObject("example-bucket", name); !ok || string(object.data) != data {
+			t.Errorf("%s should be synced", name)
+		}
+	}
+	if n := client.count("PutObject"); n != 2 {
+		t.Errorf("The same content should be uploaded once, got %d uploads", n)
+	}
+	if n := client.count("CopyObject"); n != 1 {
+		t.Errorf("The same content should be copied, got %d copies", n)
+	}
+}
+
+func TestSyncLocalToS3DedupMultipartCopy(t *testing.T) {
+	defer func(size int64) { maxCopyObjectSize = size }(maxCopyObjectSize)
+	maxCopyObjectSize = 10
+
+	temp, err := ioutil.TempDir("", "s3synctest")
+	if err != nil {
+		t.Fatal("Failed to create temp dir")
+	}
+	defer os.RemoveAll(temp)
+
+	writeFile(t, filepath.Join(temp, "a.txt"), "large content over the limit")
+	writeFile(t, filepath.Join(temp, "dir/b.html"), "large content over the limit")
+
+	client := newFakeS3()
+	client.createBucket("example-bucket")
+	m := &Manager{s3: client, option: Option{Dedup: true}}
+	if err := m.Sync(temp, "s3://example-bucket"); err != nil {
+		t.Fatal("Sync should be successful", err)
+	}
+
+	for _, name := range []string{"a.txt", "dir/b.html"} {
+		if object, ok := client.getObject("example-bucket", name); !ok || string(object.data) != "large content over the limit" {
+			t.Errorf("%s should be synced", name)
+		}
+	}
+	if client.count("PutObject") != 1 || client.count("CopyObject") != 0 || client.count("UploadPartCopy") == 0 {
+		t.Error("The large duplicate should be copied by parts")
+	}
+	// The headers of the copy are of its own name.
+	if object, _ := client.getObject("example-bucket", "dir/b.html"); !strings.HasPrefix(object.contentType, "text/html") {
+		t.Errorf("The content type of the copy should be of its name, got %q", object.contentType)
+	}
+}
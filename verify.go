@@ -0,0 +1,92 @@
+// Copyright 2019 SEQSENSE, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package s3sync
+
+import (
+	"context"
+	"sort"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// verifyFiles compares the transferred files with the re-listed destination,
+// and returns VerifyError if some of them are missing or have the wrong size.
+func verifyFiles(transferred []*fileInfo, dest chan *fileInfo) error {
+	verifyErr, err := compareTransferred(transferred, dest)
+	if err != nil {
+		return err
+	}
+	return verifyErr.orNil()
+}
+
+// verifyS3Files verifies the s3 destination like verifyFiles. With Option.VerifyContentType,
+// the Content-Type of the objects of both the transferred and the skipped files are
+// also compared with the one which the upload would set.
+func (m *Manager) verifyS3Files(ctx context.Context, recorder *syncRecorder, destPath *s3Path) error {
+	verifyErr, err := compareTransferred(recorder.transferred, m.listS3Files(ctx, destPath))
+	if err != nil {
+		return err
+	}
+
+	if m.option.VerifyContentType {
+		sse := m.sseCustomer()
+		files := append(append([]*fileInfo{}, recorder.transferred...), recorder.skipped...)
+		for _, file := range files {
+			key := m.uploadKey(file, destPath)
+			expected := aws.StringValue(m.uploadInput(file, destPath.bucket, key).ContentType)
+			if expected == "" {
+				// s3 sets the default type.
+				continue
+			}
+			head, err := m.s3.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+				Bucket:               aws.String(destPath.bucket),
+				Key:                  aws.String(key),
+				SSECustomerAlgorithm: sse.algorithm,
+				SSECustomerKey:       sse.key,
+				SSECustomerKeyMD5:    sse.keyMD5,
+			})
+			if isNotFound(err) {
+				// Already reported as missing.
+				continue
+			} else if err != nil {
+				return err
+			}
+			if aws.StringValue(head.ContentType) != expected {
+				verifyErr.ContentTypeDrift = append(verifyErr.ContentTypeDrift, file.name)
+			}
+		}
+		sort.Strings(verifyErr.ContentTypeDrift)
+	}
+	return verifyErr.orNil()
+}
+
+func compareTransferred(transferred []*fileInfo, dest chan *fileInfo) (*VerifyError, error) {
+	destFiles, err := fileInfoChanToMap(dest)
+	if err != nil {
+		return nil, err
+	}
+
+	verifyErr := &VerifyError{}
+	for _, file := range transferred {
+		destFile, ok := destFiles[file.name]
+		if !ok {
+			verifyErr.Missing = append(verifyErr.Missing, file.name)
+		} else if destFile.size != file.size {
+			verifyErr.SizeMismatch = append(verifyErr.SizeMismatch, file.name)
+		}
+	}
+	sort.Strings(verifyErr.Missing)
+	sort.Strings(verifyErr.SizeMismatch)
+	return verifyErr, nil
+}
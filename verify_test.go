@@ -0,0 +1,187 @@
+// Copyright 2019 SEQSENSE, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package s3sync
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// droppingS3 reports the success of PutObject for the given keys without storing them.
+type droppingS3 struct {
+	*fakeS3
+	drop map[string]bool
+}
+
+func (d *droppingS3) PutObjectRequest(input *s3.PutObjectInput) (*request.Request, *s3.PutObjectOutput) {
+	output := &s3.PutObjectOutput{}
+	return fakeRequest("PutObject", input, output, func() error {
+		_, err := d.PutObjectWithContext(aws.BackgroundContext(), input)
+		return err
+	}), output
+}
+
+func (d *droppingS3) PutObjectWithContext(ctx aws.Context, input *s3.PutObjectInput, opts ...request.Option) (*s3.PutObjectOutput, error) {
+	if d.drop[aws.StringValue(input.Key)] {
+		d.called("PutObject")
+		return &s3.PutObjectOutput{}, nil
+	}
+	return d.fakeS3.PutObjectWithContext(ctx, input, opts...)
+}
+
+func TestSyncFanOutPostVerify(t *testing.T) {
+	temp, err := ioutil.TempDir("", "s3synctest")
+	if err != nil {
+		t.Fatal("Failed to create temp dir")
+	}
+	defer os.RemoveAll(temp)
+
+	writeFile(t, filepath.Join(temp, "a.txt"), "a")
+	writeFile(t, filepath.Join(temp, "dir/b.txt"), "bb")
+
+	client := &droppingS3{fakeS3: newFakeS3(), drop: map[string]bool{"dir/b.txt": true}}
+	client.createBucket("bucket1")
+	client.createBucket("bucket2")
+
+	t.Run("WithoutVerify", func(t *testing.T) {
+		m := &Manager{s3: client}
+		results, err := m.SyncFanOut(temp, []string{"s3://bucket1"})
+		if err != nil {
+			t.Fatal("SyncFanOut should be successful", err)
+		}
+		if results["s3://bucket1"] != nil {
+			t.Error("The dropped upload should not be detected without PostVerify", results)
+		}
+	})
+	t.Run("WithVerify", func(t *testing.T) {
+		m := &Manager{s3: client, option: Option{PostVerify: true}}
+		results, err := m.SyncFanOut(temp, []string{"s3://bucket2"})
+		if err != nil {
+			t.Fatal("SyncFanOut should be successful", err)
+		}
+		var verifyErr *VerifyError
+		if !errors.As(results["s3://bucket2"], &verifyErr) {
+			t.Fatal("VerifyError should be returned", results)
+		}
+		if !reflect.DeepEqual([]string{filepath.FromSlash("dir/b.txt")}, verifyErr.Missing) {
+			t.Errorf("dir/b.txt should be missing, actual: %v", verifyErr.Missing)
+		}
+		if len(verifyErr.SizeMismatch) != 0 {
+			t.Errorf("No size mismatch is expected, actual: %v", verifyErr.SizeMismatch)
+		}
+	})
+}
+
+func TestS3ToLocalPostVerify(t *testing.T) {
+	temp, err := ioutil.TempDir("", "s3synctest")
+	if err != nil {
+		t.Fatal("Failed to create temp dir")
+	}
+	defer os.RemoveAll(temp)
+
+	client := newFakeS3()
+	client.putObject("example-bucket", "a.txt", []byte("a"), time.Now())
+	client.putObject("example-bucket", "dir/b.txt", []byte("bb"), time.Now())
+
+	m := &Manager{s3: client, option: Option{PostVerify: true}}
+	if err := m.Sync("s3://example-bucket", temp); err != nil {
+		t.Fatal("Sync should be successful", err)
+	}
+}
+
+func TestVerifyFiles(t *testing.T) {
+	temp, err := ioutil.TempDir("", "s3synctest")
+	if err != nil {
+		t.Fatal("Failed to create temp dir")
+	}
+	defer os.RemoveAll(temp)
+
+	writeFile(t, filepath.Join(temp, "ok.txt"), "ok")
+	writeFile(t, filepath.Join(temp, "short.txt"), "s")
+
+	transferred := []*fileInfo{
+		{name: "ok.txt", size: 2},
+		{name: "short.txt", size: 5},
+		{name: "missing.txt", size: 1},
+	}
+	err = verifyFiles(transferred, listLocalFiles(context.Background(), temp))
+	var verifyErr *VerifyError
+	if !errors.As(err, &verifyErr) {
+		t.Fatal("VerifyError should be returned", err)
+	}
+	if !reflect.DeepEqual([]string{"missing.txt"}, verifyErr.Missing) {
+		t.Errorf("Unexpected missing files: %v", verifyErr.Missing)
+	}
+	if !reflect.DeepEqual([]string{"short.txt"}, verifyErr.SizeMismatch) {
+		t.Errorf("Unexpected size mismatch files: %v", verifyErr.SizeMismatch)
+	}
+
+	if err := verifyFiles(transferred[:1], listLocalFiles(context.Background(), temp)); err != nil {
+		t.Error("Verification of the matching files should be successful", err)
+	}
+}
+
+func TestSyncFanOutVerifyContentType(t *testing.T) {
+	temp, err := ioutil.TempDir("", "s3synctest")
+	if err != nil {
+		t.Fatal("Failed to create temp dir")
+	}
+	defer os.RemoveAll(temp)
+
+	writeFile(t, filepath.Join(temp, "index.html"), "<html></html>")
+	writeFile(t, filepath.Join(temp, "style.css"), "body {}")
+	writeFile(t, filepath.Join(temp, "data.unknownext"), "data")
+
+	client := newFakeS3()
+	// The up-to-date objects which were uploaded with the old types.
+	client.putObject("example-bucket", "index.html", []byte("<html></html>"), time.Now().Add(time.Hour)).contentType = "text/plain"
+	client.putObject("example-bucket", "data.unknownext", []byte("data"), time.Now().Add(time.Hour)).contentType = "binary/octet-stream"
+
+	t.Run("Disabled", func(t *testing.T) {
+		m := &Manager{s3: client, option: Option{PostVerify: true}}
+		results, err := m.SyncFanOut(temp, []string{"s3://example-bucket"})
+		if err != nil {
+			t.Fatal("SyncFanOut should be started", err)
+		}
+		if results["s3://example-bucket"] != nil {
+			t.Error("The content type should not be verified by default", results)
+		}
+	})
+	t.Run("Enabled", func(t *testing.T) {
+		m := &Manager{s3: client, option: Option{PostVerify: true, VerifyContentType: true}}
+		results, err := m.SyncFanOut(temp, []string{"s3://example-bucket"})
+		if err != nil {
+			t.Fatal("SyncFanOut should be started", err)
+		}
+		var verifyErr *VerifyError
+		if !errors.As(results["s3://example-bucket"], &verifyErr) {
+			t.Fatal("VerifyError should be returned", results)
+		}
+		if !reflect.DeepEqual([]string{"index.html"}, verifyErr.ContentTypeDrift) {
+			t.Errorf("Only index.html should drift, actual: %v", verifyErr.ContentTypeDrift)
+		}
+		if len(verifyErr.Missing) != 0 || len(verifyErr.SizeMismatch) != 0 {
+			t.Errorf("Only the content type should differ, actual: %v", verifyErr)
+		}
+	})
+}
@@ -0,0 +1,160 @@
+// Copyright 2019 SEQSENSE, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package s3sync
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// readDir is replaced in the tests to fail the walk.
+var readDir = ioutil.ReadDir
+
+// walkLocalFiles lists the local files under the path by listLocalFiles, or by
+// listLocalFilesConcurrently with Option.WalkConcurrency, Option.FollowSymlinks
+// or Option.FileSystem.
+func (m *Manager) walkLocalFiles(ctx context.Context, basePath string) chan *fileInfo {
+	if m.option.WalkConcurrency <= 1 && !m.option.FollowSymlinks && m.option.FileSystem == nil {
+		return listLocalFiles(ctx, basePath)
+	}
+	return listLocalFilesConcurrently(ctx, m.fs(), basePath, m.option.WalkConcurrency, m.option.FollowSymlinks)
+}
+
+// listLocalFilesConcurrently lists the local files like listLocalFiles, but walks
+// the subdirectories concurrently by up to the given number of goroutines.
+// The files are sent in no particular order. The walk stops at the first error,
+// which is sent to the channel.
+// If followSymlinks is true, the symbolic links are listed as the files or the
+// directories which they point to. The links to their own ancestors and the broken
+// links are skipped.
+func listLocalFilesConcurrently(ctx context.Context, fs FileSystem, basePath string, concurrency int, followSymlinks bool) chan *fileInfo {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	c := make(chan *fileInfo)
+
+	go func() {
+		defer close(c)
+
+		// The single file, the missing path and the error are same as the sequential listing.
+		stat, err := fs.Stat(basePath)
+		if os.IsNotExist(err) {
+			return
+		} else if err != nil {
+			sendErrorInfoToChannel(ctx, c, err)
+			return
+		}
+		if !stat.IsDir() {
+			sendFileInfoToChannel(ctx, c, filepath.Dir(filepath.ToSlash(basePath)), filepath.ToSlash(basePath), stat)
+			return
+		}
+
+		walkCtx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		w := &localWalker{
+			ctx:      walkCtx,
+			cancel:   cancel,
+			c:        c,
+			fs:       fs,
+			basePath: filepath.ToSlash(basePath),
+			sem:      make(chan struct{}, concurrency-1),
+			follow:   followSymlinks,
+		}
+		w.walk(w.basePath, []os.FileInfo{stat})
+		w.wg.Wait()
+
+		if w.err != nil {
+			sendErrorInfoToChannel(ctx, c, w.err)
+		}
+	}()
+	return c
+}
+
+// localWalker walks the directory tree, walking the subdirectories by the new
+// goroutines while the semaphore allows, and by the current goroutine otherwise.
+type localWalker struct {
+	ctx      context.Context
+	cancel   func()
+	c        chan *fileInfo
+	fs       FileSystem
+	basePath string
+	sem      chan struct{}
+	wg       sync.WaitGroup
+	follow   bool
+
+	once sync.Once
+	err  error
+}
+
+// walk walks the directory. ancestors are the infos of the directory and its
+// ancestors to detect the loops of the symbolic links.
+func (w *localWalker) walk(dir string, ancestors []os.FileInfo) {
+	infos, err := w.fs.ReadDir(dir)
+	if err != nil {
+		w.fail(err)
+		return
+	}
+	for _, info := range infos {
+		path := filepath.Join(dir, info.Name())
+		if w.follow && info.Mode()&os.ModeSymlink != 0 {
+			if info, err = w.fs.Stat(path); err != nil || isAncestor(info, ancestors) {
+				// The broken link or the loop.
+				continue
+			}
+		}
+		if !info.IsDir() {
+			if !sendFileInfoToChannel(w.ctx, w.c, w.basePath, path, info) {
+				return
+			}
+			continue
+		}
+		subAncestors := append(ancestors[:len(ancestors):len(ancestors)], info)
+		select {
+		case w.sem <- struct{}{}:
+			w.wg.Add(1)
+			go func() {
+				defer func() {
+					<-w.sem
+					w.wg.Done()
+				}()
+				w.walk(path, subAncestors)
+			}()
+		default:
+			w.walk(path, subAncestors)
+		}
+		if w.ctx.Err() != nil {
+			return
+		}
+	}
+}
+
+// isAncestor returns true if the directory is one of the ancestors.
+func isAncestor(dir os.FileInfo, ancestors []os.FileInfo) bool {
+	for _, ancestor := range ancestors {
+		if os.SameFile(dir, ancestor) {
+			return true
+		}
+	}
+	return false
+}
+
+// fail records the first error and stops the other walkers.
+func (w *localWalker) fail(err error) {
+	w.once.Do(func() {
+		w.err = err
+		w.cancel()
+	})
+}
@@ -0,0 +1,203 @@
+// Copyright 2019 SEQSENSE, Inc.
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package s3sync
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"runtime"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestListLocalFilesConcurrently(t *testing.T) {
+	temp, err := ioutil.TempDir("", "s3synctest")
+	if err != nil {
+		t.Fatal("Failed to create temp dir")
+	}
+	defer os.RemoveAll(temp)
+
+	// 3^4 directories of 4 levels, each of which has a file.
+	var writeTree func(dir string, depth int)
+	writeTree = func(dir string, depth int) {
+		writeFile(t, filepath.Join(dir, "file.txt"), "data")
+		if depth == 4 {
+			return
+		}
+		for i := 0; i < 3; i++ {
+			writeTree(filepath.Join(dir, fmt.Sprintf("dir%d", i)), depth+1)
+		}
+	}
+	writeTree(temp, 0)
+
+	listNames := func(files chan *fileInfo) []string {
+		var names []string
+		for file := range files {
+			if file.err != nil {
+				t.Fatal("Listing should be successful", file.err)
+			}
+			names = append(names, file.name)
+		}
+		sort.Strings(names)
+		return names
+	}
+	expected := listNames(listLocalFiles(context.Background(), temp))
+	if len(expected) != 1+3+9+27+81 {
+		t.Fatalf("Unexpected number of files %d", len(expected))
+	}
+
+	for _, concurrency := range []int{2, 4, 100} {
+		t.Run(fmt.Sprint(concurrency), func(t *testing.T) {
+			names := listNames(listLocalFilesConcurrently(context.Background(), osFileSystem{}, temp, concurrency, false))
+			if !reflect.DeepEqual(expected, names) {
+				t.Errorf("All the files should be listed exactly once, got %d files", len(names))
+			}
+		})
+	}
+
+	t.Run("SingleFile", func(t *testing.T) {
+		names := listNames(listLocalFilesConcurrently(context.Background(), osFileSystem{}, filepath.Join(temp, "file.txt"), 4, false))
+		if !reflect.DeepEqual([]string{"file.txt"}, names) {
+			t.Errorf("Expected the single file, got %v", names)
+		}
+	})
+
+	t.Run("Error", func(t *testing.T) {
+		errRead := errors.New("read error")
+		defer func(f func(string) ([]os.FileInfo, error)) {
+			readDir = f
+		}(readDir)
+		readDir = func(dir string) ([]os.FileInfo, error) {
+			if strings.HasSuffix(dir, filepath.Join("dir1", "dir2")) {
+				return nil, errRead
+			}
+			return ioutil.ReadDir(dir)
+		}
+
+		var err error
+		for file := range listLocalFilesConcurrently(context.Background(), osFileSystem{}, temp, 4, false) {
+			if file.err != nil {
+				err = file.err
+			}
+		}
+		if err != errRead {
+			t.Errorf("The error of the subtree should be sent, got %v", err)
+		}
+	})
+
+	t.Run("Sync", func(t *testing.T) {
+		client := newFakeS3()
+		client.createBucket("example-bucket")
+		m := &Manager{s3: client, option: Option{WalkConcurrency: 4}}
+		result, err := m.SyncWithResult(temp, "s3://example-bucket")
+		if err != nil {
+			t.Fatal("Sync should be successful", err)
+		}
+		if len(result.Transferred) != len(expected) {
+			t.Errorf("Expected %d files uploaded, got %d", len(expected), len(result.Transferred))
+		}
+	})
+}
+
+func TestFollowSymlinks(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("Creating the symbolic links requires the privilege on Windows")
+	}
+	temp, err := ioutil.TempDir("", "s3synctest")
+	if err != nil {
+		t.Fatal("Failed to create temp dir")
+	}
+	defer os.RemoveAll(temp)
+
+	root := filepath.Join(temp, "root")
+	writeFile(t, filepath.Join(root, "a.txt"), "a")
+	writeFile(t, filepath.Join(root, "dir/b.txt"), "bb")
+	writeFile(t, filepath.Join(temp, "outside/c.txt"), "ccc")
+	for link, target := range map[string]string{
+		"link.txt":    filepath.Join(root, "a.txt"),
+		"linkdir":     filepath.Join(temp, "outside"),
+		"dir/loop":    root,
+		"dir/self":    filepath.Join(root, "dir"),
+		"broken.txt":  filepath.Join(temp, "not-exist"),
+		"dir/up.txt":  filepath.Join(root, "dir/b.txt"),
+		"dir/nested2": filepath.Join(root, "linkdir"),
+	} {
+		if err := os.Symlink(target, filepath.Join(root, link)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	rootLink := filepath.Join(temp, "rootlink")
+	if err := os.Symlink(root, rootLink); err != nil {
+		t.Fatal(err)
+	}
+
+	listFiles := func(files chan *fileInfo) map[string]int64 {
+		listed := make(map[string]int64)
+		for file := range files {
+			if file.err != nil {
+				t.Fatal("Listing should be successful", file.err)
+			}
+			if _, ok := listed[file.name]; ok {
+				t.Errorf("%s is listed twice", file.name)
+			}
+			listed[file.name] = file.size
+		}
+		return listed
+	}
+
+	regular := map[string]int64{"a.txt": 1, filepath.Join("dir", "b.txt"): 2}
+	followed := map[string]int64{
+		"a.txt":                                  1,
+		filepath.Join("dir", "b.txt"):            2,
+		"link.txt":                               1,
+		filepath.Join("linkdir", "c.txt"):        3,
+		filepath.Join("dir", "up.txt"):           2,
+		filepath.Join("dir", "nested2", "c.txt"): 3,
+	}
+	testCases := map[string]struct {
+		files    chan *fileInfo
+		expected map[string]int64
+	}{
+		"Skip":               {listLocalFiles(context.Background(), root), regular},
+		"SkipRootLink":       {listLocalFiles(context.Background(), rootLink), regular},
+		"SkipConcurrently":   {listLocalFilesConcurrently(context.Background(), osFileSystem{}, root, 4, false), regular},
+		"Follow":             {listLocalFilesConcurrently(context.Background(), osFileSystem{}, root, 1, true), followed},
+		"FollowRootLink":     {listLocalFilesConcurrently(context.Background(), osFileSystem{}, rootLink, 1, true), followed},
+		"FollowConcurrently": {listLocalFilesConcurrently(context.Background(), osFileSystem{}, root, 4, true), followed},
+	}
+	for name, testCase := range testCases {
+		t.Run(name, func(t *testing.T) {
+			if listed := listFiles(testCase.files); !reflect.DeepEqual(testCase.expected, listed) {
+				t.Errorf("Expected %v, got %v", testCase.expected, listed)
+			}
+		})
+	}
+
+	t.Run("Sync", func(t *testing.T) {
+		client := newFakeS3()
+		client.createBucket("example-bucket")
+		m := &Manager{s3: client, option: Option{FollowSymlinks: true}}
+		if err := m.Sync(root, "s3://example-bucket"); err != nil {
+			t.Fatal("Sync should be successful", err)
+		}
+		if object, ok := client.getObject("example-bucket", "linkdir/c.txt"); !ok || string(object.data) != "ccc" {
+			t.Error("The file under the linked directory should be uploaded")
+		}
+	})
+}